@@ -0,0 +1,56 @@
+package main
+
+import (
+	"fmt"
+	"runtime"
+	"runtime/debug"
+
+	"github.com/slimsag/http-server-stabilizer/pkg/stabilizer"
+)
+
+// The version, VCS commit and date of the build, which may be set when
+// building with e.g.:
+//
+//	go build -ldflags "-X main.version=v1.2.3 -X main.commit=$(git rev-parse HEAD) -X main.date=$(date -u +%FT%TZ)"
+var (
+	version string
+	commit  string
+	date    string
+)
+
+// buildInfo returns the build info given with -ldflags. Anything not given is
+// taken from what the Go toolchain embedded in the binary instead: the module
+// version if it was built with go install, and the commit and its date if it
+// was built in a checkout.
+func buildInfo() stabilizer.BuildInfo {
+	info := stabilizer.BuildInfo{Version: version, Commit: commit, Date: date}
+	if bi, ok := debug.ReadBuildInfo(); ok {
+		if info.Version == "" && bi.Main.Version != "(devel)" {
+			info.Version = bi.Main.Version
+		}
+		for _, setting := range bi.Settings {
+			switch {
+			case setting.Key == "vcs.revision" && info.Commit == "":
+				info.Commit = setting.Value
+			case setting.Key == "vcs.time" && info.Date == "":
+				info.Date = setting.Value
+			}
+		}
+	}
+	if info.Version == "" {
+		info.Version = "dev"
+	}
+	return info
+}
+
+// printVersion prints the build info for -version.
+func printVersion(info stabilizer.BuildInfo) {
+	fmt.Printf("http-server-stabilizer %s\n", info.Version)
+	if info.Commit != "" {
+		fmt.Printf("commit: %s\n", info.Commit)
+	}
+	if info.Date != "" {
+		fmt.Printf("date: %s\n", info.Date)
+	}
+	fmt.Printf("go: %s\n", runtime.Version())
+}
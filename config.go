@@ -0,0 +1,278 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/signal"
+	"strconv"
+	"syscall"
+	"time"
+
+	"github.com/slimsag/http-server-stabilizer/pkg/stabilizer"
+	"github.com/sourcegraph/log"
+	"gopkg.in/yaml.v2"
+)
+
+// dynamicFlags are the flags which are applied when -config is reloaded.
+// Changes to any other flag need a restart.
+var dynamicFlags = map[string]bool{
+	"timeout":       true,
+	"timeout-min":   true,
+	"timeout-max":   true,
+	"queue-timeout": true,
+	"concurrency":   true,
+	"workers":       true,
+	"route":         true,
+}
+
+// config is a -config file. It holds the value of any flag by name, e.g.
+// "timeout: 10s"; repeatable flags such as route take a list. The worker
+// command is given by "command" and "args", unless given on the command line.
+type config struct {
+	flags   map[string][]string
+	command []string
+}
+
+// loadConfig reads and validates the config file at the given path.
+func loadConfig(path string) (*config, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var raw map[string]interface{}
+	if err := yaml.Unmarshal(data, &raw); err != nil {
+		return nil, err
+	}
+
+	c := &config{flags: make(map[string][]string)}
+	var command, args []string
+	for name, value := range raw {
+		values, err := configValues(value)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %v", name, err)
+		}
+		switch name {
+		case "command":
+			if len(values) != 1 {
+				return nil, fmt.Errorf("command: expected a single command")
+			}
+			command = values
+		case "args":
+			args = values
+		case "config":
+			return nil, fmt.Errorf("config: cannot be set in a config file")
+		default:
+			if flag.Lookup(name) == nil {
+				return nil, fmt.Errorf("%s: unknown flag", name)
+			}
+			c.flags[name] = values
+		}
+	}
+	if len(args) > 0 && len(command) == 0 {
+		return nil, fmt.Errorf("args: given without command")
+	}
+	c.command = append(command, args...)
+
+	// Check the values are valid by setting them on a copy of the flags.
+	if _, err := c.flagSet(); err != nil {
+		return nil, err
+	}
+	return c, nil
+}
+
+// configValues returns the string values of a YAML scalar or list.
+func configValues(value interface{}) ([]string, error) {
+	switch v := value.(type) {
+	case []interface{}:
+		var values []string
+		for _, item := range v {
+			values = append(values, fmt.Sprint(item))
+		}
+		return values, nil
+	case map[interface{}]interface{}, nil:
+		return nil, fmt.Errorf("expected a value or a list of values")
+	}
+	return []string{fmt.Sprint(value)}, nil
+}
+
+// flagSet returns a copy of the command line flags, with their default values
+// except where set by the config.
+func (c *config) flagSet() (*flag.FlagSet, error) {
+	fs := flag.NewFlagSet("config", flag.ContinueOnError)
+	var err error
+	flag.VisitAll(func(f *flag.Flag) {
+		switch f.Value.(type) {
+		case *byteSize:
+			value := new(byteSize)
+			_ = value.Set(f.DefValue)
+			fs.Var(value, f.Name, f.Usage)
+		case *routes:
+			fs.Var(new(routes), f.Name, f.Usage)
+		case *pools:
+			fs.Var(new(pools), f.Name, f.Usage)
+		case *envVars:
+			fs.Var(new(envVars), f.Name, f.Usage)
+		case *cgroupLimits:
+			fs.Var(new(cgroupLimits), f.Name, f.Usage)
+		case *warmupRequests:
+			fs.Var(new(warmupRequests), f.Name, f.Usage)
+		default:
+			getter, ok := f.Value.(flag.Getter)
+			if !ok {
+				err = fmt.Errorf("%s: flag of type %T not supported", f.Name, f.Value)
+				return
+			}
+			switch v := getter.Get().(type) {
+			case bool:
+				fs.Bool(f.Name, v, f.Usage)
+			case int:
+				fs.Int(f.Name, v, f.Usage)
+			case float64:
+				fs.Float64(f.Name, v, f.Usage)
+			case string:
+				fs.String(f.Name, v, f.Usage)
+			case time.Duration:
+				fs.Duration(f.Name, v, f.Usage)
+			default:
+				err = fmt.Errorf("%s: flag of type %T not supported", f.Name, v)
+				return
+			}
+			// The defaults, rather than the current values.
+			if setErr := fs.Set(f.Name, f.DefValue); setErr != nil && err == nil {
+				err = setErr
+			}
+		}
+	})
+	if err != nil {
+		return nil, err
+	}
+	for name, values := range c.flags {
+		if len(values) > 1 {
+			switch fs.Lookup(name).Value.(type) {
+			case *routes, *pools, *envVars, *cgroupLimits, *warmupRequests:
+			default:
+				return nil, fmt.Errorf("%s: only one value may be given", name)
+			}
+		}
+		for _, value := range values {
+			if err := fs.Set(name, value); err != nil {
+				return nil, fmt.Errorf("%s: %v", name, err)
+			}
+		}
+	}
+	return fs, nil
+}
+
+// applyConfig sets the flags which were not set on the command line from the
+// config, and returns the names of the flags that were set on the command
+// line.
+func applyConfig(c *config) (explicit map[string]bool) {
+	explicit = make(map[string]bool)
+	flag.Visit(func(f *flag.Flag) { explicit[f.Name] = true })
+	for name, values := range c.flags {
+		if explicit[name] {
+			continue
+		}
+		for _, value := range values {
+			// The values were validated by loadConfig.
+			_ = flag.Set(name, value)
+		}
+	}
+	return explicit
+}
+
+// watchConfig reloads the -config file on SIGHUP, applying changes to
+// dynamicFlags. Flags set on the command line are left alone. If the file is
+// invalid, the current config is kept.
+func watchConfig(s *stabilizer.Stabilizer, logger log.Logger, path string, explicit map[string]bool) {
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
+	for range hup {
+		if err := reloadConfig(s, logger, path, explicit); err != nil {
+			logger.Error("failed to reload config, keeping the current one", log.String("config", path), log.Error(err))
+		}
+	}
+}
+
+func reloadConfig(s *stabilizer.Stabilizer, logger log.Logger, path string, explicit map[string]bool) error {
+	c, err := loadConfig(path)
+	if err != nil {
+		return err
+	}
+	fs, err := c.flagSet()
+	if err != nil {
+		return err
+	}
+
+	// Work out the new settings, and only update the flags once the
+	// stabilizer has accepted them.
+	next := s.Config()
+	var changed []*flag.Flag
+	fs.VisitAll(func(f *flag.Flag) {
+		current := flag.Lookup(f.Name).Value
+		if explicit[f.Name] || f.Value.String() == current.String() {
+			return
+		}
+		if !dynamicFlags[f.Name] {
+			logger.Warn("config change requires a restart",
+				log.String("flag", f.Name),
+				log.String("current", current.String()),
+				log.String("new", f.Value.String()))
+			return
+		}
+		changed = append(changed, f)
+		switch f.Name {
+		case "route":
+			next.Routes = []stabilizer.Route(*f.Value.(*routes))
+		case "workers":
+			next.Workers, _ = strconv.Atoi(f.Value.String())
+		case "concurrency":
+			next.Concurrency, _ = strconv.Atoi(f.Value.String())
+		case "timeout":
+			next.Timeout, _ = time.ParseDuration(f.Value.String())
+		case "timeout-min":
+			next.TimeoutMin, _ = time.ParseDuration(f.Value.String())
+		case "timeout-max":
+			next.TimeoutMax, _ = time.ParseDuration(f.Value.String())
+		case "queue-timeout":
+			next.QueueTimeout, _ = time.ParseDuration(f.Value.String())
+		}
+	})
+	if err := s.Update(stabilizer.WithConfig(next)); err != nil {
+		return err
+	}
+
+	var names []string
+	for _, f := range changed {
+		current := flag.Lookup(f.Name).Value
+		logger.Info("config changed",
+			log.String("flag", f.Name),
+			log.String("old", current.String()),
+			log.String("new", f.Value.String()))
+		names = append(names, f.Name)
+		if f.Name == "route" {
+			*flagRoutes = *f.Value.(*routes)
+		} else {
+			_ = current.Set(f.Value.String())
+		}
+	}
+	if len(c.command) > 0 && !equalStrings(c.command, append([]string{next.Command}, next.Args...)) {
+		logger.Warn("config change requires a restart", log.String("flag", "command"))
+	}
+	logger.Info("reloaded config", log.String("config", path), log.Strings("changed", names))
+	return nil
+}
+
+func equalStrings(a, b []string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,98 @@
+package main
+
+import (
+	"flag"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+// TestMain leaves the flags the testing package defines out of the command
+// line flags, which are otherwise the stabilizer's.
+func TestMain(m *testing.M) {
+	flag.Parse()
+	stabilizerFlags := flag.NewFlagSet(os.Args[0], flag.ExitOnError)
+	flag.VisitAll(func(f *flag.Flag) {
+		if !strings.HasPrefix(f.Name, "test.") {
+			stabilizerFlags.Var(f.Value, f.Name, f.Usage)
+			stabilizerFlags.Lookup(f.Name).DefValue = f.DefValue
+		}
+	})
+	// m.Run would parse the command line again otherwise.
+	_ = stabilizerFlags.Parse(nil)
+	flag.CommandLine = stabilizerFlags
+	os.Exit(m.Run())
+}
+
+// writeConfig writes a -config file with the given contents in dir, returning
+// its path.
+func writeConfig(t *testing.T, dir, contents string) string {
+	t.Helper()
+	path := filepath.Join(dir, "config.yaml")
+	if err := ioutil.WriteFile(path, []byte(contents), 0600); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+// TestConfigFlagTypes loads a config once all flags are defined, so that a
+// flag of a type the config does not know about fails here rather than every
+// -config at startup.
+func TestConfigFlagTypes(t *testing.T) {
+	dir := tempDir(t)
+	defer os.RemoveAll(dir)
+	if _, err := loadConfig(writeConfig(t, dir, "timeout: 5s\n")); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := (&config{}).flagSet(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestConfigLists(t *testing.T) {
+	dir := tempDir(t)
+	defer os.RemoveAll(dir)
+	c, err := loadConfig(writeConfig(t, dir, `
+warmup:
+  - GET /health/full
+  - /ready
+route:
+  - /render,timeout=30s
+  - /search,concurrency=2
+`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	fs, err := c.flagSet()
+	if err != nil {
+		t.Fatal(err)
+	}
+	got := *fs.Lookup("warmup").Value.(*warmupRequests)
+	if want := (warmupRequests{"GET /health/full", "/ready"}); !reflect.DeepEqual(got, want) {
+		t.Errorf("got warmup %q, want %q", got, want)
+	}
+	if got, want := fs.Lookup("route").Value.String(), flag.Lookup("route").Value.String(); got == want {
+		t.Errorf("got routes %q, which were not set by the config", got)
+	}
+}
+
+func TestConfigSingleValue(t *testing.T) {
+	dir := tempDir(t)
+	defer os.RemoveAll(dir)
+	if _, err := loadConfig(writeConfig(t, dir, "timeout:\n  - 5s\n  - 10s\n")); err == nil {
+		t.Error("expected an error for a list of timeouts")
+	}
+}
+
+// tempDir returns a new temporary directory, which the caller must remove.
+func tempDir(t *testing.T) string {
+	t.Helper()
+	dir, err := ioutil.TempDir("", "hss-config")
+	if err != nil {
+		t.Fatal(err)
+	}
+	return dir
+}
@@ -0,0 +1,280 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/slimsag/http-server-stabilizer/pkg/stabilizer"
+)
+
+// byteSize is a flag.Value for a number of bytes, which may have a K, M or G
+// suffix (powers of 1024), e.g. 512M.
+type byteSize int64
+
+// byteSizeFlag defines a byteSize flag with the given name, default value and
+// usage string, like flag.Int.
+func byteSizeFlag(name string, value byteSize, usage string) *byteSize {
+	flag.Var(&value, name, usage)
+	return &value
+}
+
+func (b *byteSize) String() string {
+	return strconv.FormatInt(int64(*b), 10)
+}
+
+func (b *byteSize) Set(s string) error {
+	multiplier := int64(1)
+	trimmed := strings.TrimSuffix(strings.ToUpper(strings.TrimSpace(s)), "B")
+	switch {
+	case strings.HasSuffix(trimmed, "K"):
+		multiplier = 1 << 10
+	case strings.HasSuffix(trimmed, "M"):
+		multiplier = 1 << 20
+	case strings.HasSuffix(trimmed, "G"):
+		multiplier = 1 << 30
+	}
+	if multiplier != 1 {
+		trimmed = trimmed[:len(trimmed)-1]
+	}
+	n, err := strconv.ParseInt(trimmed, 10, 64)
+	if err != nil || n < 0 {
+		return fmt.Errorf("invalid byte size %q", s)
+	}
+	*b = byteSize(n * multiplier)
+	return nil
+}
+
+// routes is a flag.Value for -route, which may be given multiple times.
+type routes []stabilizer.Route
+
+// routesFlag defines a routes flag with the given name and usage string.
+func routesFlag(name, usage string) *routes {
+	var value routes
+	flag.Var(&value, name, usage)
+	return &value
+}
+
+func (r *routes) String() string {
+	var specs []string
+	for _, rt := range *r {
+		specs = append(specs, rt.String())
+	}
+	return strings.Join(specs, " ")
+}
+
+// Set parses a route such as "/render,timeout=30s,concurrency=2".
+func (r *routes) Set(s string) error {
+	rt, err := stabilizer.ParseRoute(s)
+	if err != nil {
+		return err
+	}
+	*r = append(*r, rt)
+	return nil
+}
+
+// pools is a flag.Value for -pool, which may be given multiple times.
+type pools []stabilizer.Pool
+
+// poolsFlag defines a pools flag with the given name and usage string.
+func poolsFlag(name, usage string) *pools {
+	var value pools
+	flag.Var(&value, name, usage)
+	return &value
+}
+
+func (p *pools) String() string {
+	var specs []string
+	for _, pool := range *p {
+		specs = append(specs, pool.String())
+	}
+	return strings.Join(specs, " ")
+}
+
+// Set parses a pool such as "name=highlight,prefix=/highlight,cmd=./highlighter {{.Port}}".
+func (p *pools) Set(s string) error {
+	pool, err := stabilizer.ParsePool(s)
+	if err != nil {
+		return err
+	}
+	*p = append(*p, pool)
+	return nil
+}
+
+// envVars is a flag.Value for -worker-env, which may be given multiple times.
+type envVars []string
+
+// envVarsFlag defines an envVars flag with the given name and usage string.
+func envVarsFlag(name, usage string) *envVars {
+	var value envVars
+	flag.Var(&value, name, usage)
+	return &value
+}
+
+func (e *envVars) String() string {
+	return strings.Join(*e, " ")
+}
+
+// Set parses an environment variable such as "CACHE_DIR=/cache/{{.WorkerIndex}}".
+func (e *envVars) Set(s string) error {
+	if i := strings.Index(s, "="); i <= 0 {
+		return fmt.Errorf("invalid environment variable %q, expected KEY=VALUE", s)
+	}
+	*e = append(*e, s)
+	return nil
+}
+
+// cgroupLimits is a flag.Value for -worker-cgroup, which may be given multiple
+// times.
+type cgroupLimits []string
+
+// cgroupLimitsFlag defines a cgroupLimits flag with the given name and usage
+// string.
+func cgroupLimitsFlag(name, usage string) *cgroupLimits {
+	var value cgroupLimits
+	flag.Var(&value, name, usage)
+	return &value
+}
+
+func (c *cgroupLimits) String() string {
+	return strings.Join(*c, " ")
+}
+
+// Set parses a cgroup limit such as "memory.max=512M".
+func (c *cgroupLimits) Set(s string) error {
+	if i := strings.Index(s, "="); i <= 0 {
+		return fmt.Errorf("invalid cgroup limit %q, expected FILE=VALUE", s)
+	}
+	*c = append(*c, s)
+	return nil
+}
+
+// warmupRequests is a flag.Value for -warmup, which may be given multiple
+// times.
+type warmupRequests []string
+
+// warmupFlag defines a warmupRequests flag with the given name and usage
+// string.
+func warmupFlag(name, usage string) *warmupRequests {
+	var value warmupRequests
+	flag.Var(&value, name, usage)
+	return &value
+}
+
+func (w *warmupRequests) String() string {
+	return strings.Join(*w, ", ")
+}
+
+// Set adds a request such as "GET /health/full", which the stabilizer
+// validates.
+func (w *warmupRequests) Set(s string) error {
+	*w = append(*w, s)
+	return nil
+}
+
+// readWarmupFile reads the -warmup requests in a -warmup-requests file, one
+// per line, leaving out blank lines and comments starting with #.
+func readWarmupFile(path string) ([]string, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var requests []string
+	for _, line := range strings.Split(string(data), "\n") {
+		line = strings.TrimSpace(line)
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		requests = append(requests, line)
+	}
+	return requests, nil
+}
+
+// parseRate parses a rate such as 100/s, 600/m or 1000/h into a number per
+// second. An empty rate gives 0.
+func parseRate(v string) (float64, error) {
+	v = strings.TrimSpace(v)
+	if v == "" {
+		return 0, nil
+	}
+	per := time.Second
+	if i := strings.Index(v, "/"); i >= 0 {
+		switch v[i+1:] {
+		case "s":
+		case "m":
+			per = time.Minute
+		case "h":
+			per = time.Hour
+		default:
+			return 0, fmt.Errorf("invalid unit %q, expected s, m or h", v[i+1:])
+		}
+		v = v[:i]
+	}
+	n, err := strconv.ParseFloat(v, 64)
+	if err != nil || n < 0 {
+		return 0, fmt.Errorf("invalid rate %q", v)
+	}
+	return n / per.Seconds(), nil
+}
+
+// parseList parses a comma-separated list, leaving out empty items.
+func parseList(v string) []string {
+	var items []string
+	for _, field := range strings.Split(v, ",") {
+		if field = strings.TrimSpace(field); field != "" {
+			items = append(items, field)
+		}
+	}
+	return items
+}
+
+// parseStatusCodes parses a comma-separated list of HTTP status codes. An
+// empty list gives none.
+func parseStatusCodes(v string) ([]int, error) {
+	var codes []int
+	for _, field := range strings.Split(v, ",") {
+		field = strings.TrimSpace(field)
+		if field == "" {
+			continue
+		}
+		code, err := strconv.Atoi(field)
+		if err != nil {
+			return nil, err
+		}
+		codes = append(codes, code)
+	}
+	return codes, nil
+}
+
+// parseBuckets parses a comma-separated list of histogram buckets.
+func parseBuckets(v string) ([]float64, error) {
+	var buckets []float64
+	for _, field := range strings.Split(v, ",") {
+		b, err := strconv.ParseFloat(strings.TrimSpace(field), 64)
+		if err != nil {
+			return nil, err
+		}
+		buckets = append(buckets, b)
+	}
+	sort.Float64s(buckets)
+	return buckets, nil
+}
+
+// workerRange returns -min-workers and -max-workers, each of which is
+// -workers unless it was set, on the command line or by -config.
+func workerRange() (min, max int) {
+	min, max = *flagWorkers, *flagWorkers
+	flag.Visit(func(f *flag.Flag) {
+		switch f.Name {
+		case "min-workers":
+			min = *flagMinWorkers
+		case "max-workers":
+			max = *flagMaxWorkers
+		}
+	})
+	return min, max
+}
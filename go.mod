@@ -7,4 +7,11 @@ require (
 	github.com/prometheus/client_golang v1.13.0
 	github.com/slimsag/freeport v0.0.0-20200820000215-330cfe47953a
 	github.com/sourcegraph/log v0.0.0-20221206163500-7d93c6ad7037
+	go.opentelemetry.io/otel v1.11.1
+	go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracehttp v1.11.1
+	go.opentelemetry.io/otel/sdk v1.11.1
+	go.opentelemetry.io/otel/trace v1.11.1
+	golang.org/x/net v0.0.0-20220722155237-a158d28d115b
+	golang.org/x/sys v0.0.0-20220919091848-fb04ddd9f9c8
+	gopkg.in/yaml.v2 v2.4.0
 )
@@ -0,0 +1,39 @@
+package main
+
+import (
+	"net"
+	"syscall"
+
+	"golang.org/x/sys/unix"
+)
+
+// handOff makes the kernel send new connections to the address of a
+// -reuseport listener to the stabilizer which started listening on it after
+// this one, if any, rather than spreading them across both. The old one then
+// only accepts the connections that were already queued for it, so that none
+// are left to be reset once it closes its listener.
+//
+// The program attached to the listener's SO_REUSEPORT group picks the second
+// socket in it. That is the new stabilizer's while both are listening, and
+// there is no such socket otherwise, in which case the kernel picks one as
+// usual.
+func handOff(ln net.Listener) error {
+	sc, ok := ln.(syscall.Conn)
+	if !ok {
+		return nil
+	}
+	c, err := sc.SyscallConn()
+	if err != nil {
+		return err
+	}
+	prog := []unix.SockFilter{{Code: unix.BPF_RET | unix.BPF_K, K: 1}}
+	if controlErr := c.Control(func(fd uintptr) {
+		err = unix.SetsockoptSockFprog(int(fd), unix.SOL_SOCKET, unix.SO_ATTACH_REUSEPORT_CBPF, &unix.SockFprog{
+			Len:    uint16(len(prog)),
+			Filter: &prog[0],
+		})
+	}); controlErr != nil {
+		return controlErr
+	}
+	return err
+}
@@ -0,0 +1,104 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// TestReuseportUpgrade starts a new server listening with -reuseport on the
+// address of an old one which is under load, then shuts down the old one as
+// on SIGTERM, and checks that no request fails.
+func TestReuseportUpgrade(t *testing.T) {
+	defer func(reuseport bool) { *flagReuseport = reuseport }(*flagReuseport)
+	*flagReuseport = true
+
+	// start serves on addr, counting the requests served on new
+	// connections.
+	start := func(addr string, served *int64) (*http.Server, string) {
+		ln, err := listen(addr)
+		if err != nil {
+			t.Fatal(err)
+		}
+		srv := newServer(ln.Addr().String(), http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+			if req.Close {
+				atomic.AddInt64(served, 1)
+			}
+			_, _ = rw.Write([]byte("ok"))
+		}))
+		go srv.Serve(ln)
+		return srv, ln.Addr().String()
+	}
+	var oldServed, newServed int64
+	old, addr := start("127.0.0.1:0", &oldServed)
+	defer old.Close()
+
+	// Steady load, on new connections so that they are spread across
+	// listeners, and on a kept alive connection.
+	var (
+		stop     = make(chan struct{})
+		wg       sync.WaitGroup
+		requests int64
+		failed   int64
+	)
+	load := func(client *http.Client) {
+		defer wg.Done()
+		for {
+			select {
+			case <-stop:
+				return
+			default:
+			}
+			atomic.AddInt64(&requests, 1)
+			resp, err := client.Get("http://" + addr)
+			if err == nil {
+				_, err = ioutil.ReadAll(resp.Body)
+				resp.Body.Close()
+			}
+			if err == nil && resp.StatusCode != http.StatusOK {
+				err = fmt.Errorf("got status %v", resp.Status)
+			}
+			if err != nil {
+				atomic.AddInt64(&failed, 1)
+				t.Logf("request failed: %v", err)
+			}
+		}
+	}
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go load(&http.Client{Transport: &http.Transport{DisableKeepAlives: true}})
+	}
+	wg.Add(1)
+	go load(&http.Client{Transport: &http.Transport{}})
+
+	time.Sleep(200 * time.Millisecond)
+	upgraded, _ := start(addr, &newServed)
+	defer upgraded.Close()
+	time.Sleep(200 * time.Millisecond)
+	// New connections are no longer handed to the old server.
+	beforeShutdown := atomic.LoadInt64(&oldServed)
+	time.Sleep(200 * time.Millisecond)
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if err := old.Shutdown(ctx); err != nil {
+		t.Fatal(err)
+	}
+	time.Sleep(200 * time.Millisecond)
+	close(stop)
+	wg.Wait()
+
+	if failed > 0 {
+		t.Errorf("%v of %v requests failed during the upgrade", failed, requests)
+	}
+	if newServed == 0 {
+		t.Error("the new server served no requests")
+	}
+	if n := oldServed - beforeShutdown; n > 0 {
+		t.Errorf("the old server served %v requests on new connections after the new one started listening", n)
+	}
+}
@@ -0,0 +1,13 @@
+//go:build !linux
+// +build !linux
+
+package main
+
+import "net"
+
+// handOff does nothing, as connections can't be steered to a new -reuseport
+// listener on this platform. They are spread across both stabilizers, and
+// those still queued for the old one when it closes its listener are reset.
+func handOff(ln net.Listener) error {
+	return nil
+}
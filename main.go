@@ -1,288 +1,418 @@
 package main
 
 import (
-	"bufio"
 	"context"
-	"encoding/json"
+	"errors"
+	"expvar"
 	"flag"
 	"fmt"
-	"io"
 	"math/rand"
-	"net"
 	"net/http"
-	"net/http/httputil"
-	"net/url"
+	"net/http/pprof"
 	"os"
-	"os/exec"
-	"path"
-	"strconv"
+	"os/signal"
 	"strings"
-	"sync"
 	"syscall"
 	"time"
 
-	"github.com/sourcegraph/log"
-
-	oldfreeport "github.com/phayes/freeport"
-	"github.com/prometheus/client_golang/prometheus"
-	"github.com/prometheus/client_golang/prometheus/promauto"
 	"github.com/prometheus/client_golang/prometheus/promhttp"
-	freeport "github.com/slimsag/freeport"
+	"github.com/slimsag/http-server-stabilizer/pkg/stabilizer"
+	"github.com/sourcegraph/log"
 )
 
 var (
+	flagConfig            = flag.String("config", "", "YAML file of flag values by name (e.g. 'timeout: 10s'), plus the worker 'command' and 'args'; flags on the command line take precedence, and timeouts, concurrency, workers and routes are reloaded on SIGHUP")
 	flagListen            = flag.String("listen", ":8080", "HTTP address to listen on")
+	flagTLSCert           = flag.String("tls-cert", "", "if set with -tls-key, serve HTTPS (and HTTP/2) using this certificate file, which is reloaded when it changes or on SIGHUP")
+	flagTLSKey            = flag.String("tls-key", "", "the private key file for -tls-cert")
 	flagWorkers           = flag.Int("workers", 8, "number of worker subprocesses to spawn")
+	flagMinWorkers        = flag.Int("min-workers", 0, "if set, with -max-workers, the fewest workers to scale down to when they are idle; defaults to -workers, and may be 0 to start the first worker when a request arrives")
+	flagMaxWorkers        = flag.Int("max-workers", 0, "if set, with -min-workers, the most workers to scale up to when requests wait or the workers are busy; defaults to -workers")
+	flagScaleUpQueueWait  = flag.Duration("scale-up-queue-wait", 100*time.Millisecond, "when autoscaling, add a worker if some request has been waiting this long for one throughout -scale-up-after")
+	flagScaleUpSat        = flag.Float64("scale-up-saturation", 0.8, "when autoscaling, add a worker if this fraction of the workers' capacity (workers times -concurrency) has been in use throughout -scale-up-after")
+	flagScaleUpAfter      = flag.Duration("scale-up-after", 15*time.Second, "when autoscaling, how long requests must wait or the workers be busy before a worker is added")
+	flagScaleDownIdle     = flag.Duration("scale-down-idle", 10*time.Minute, "when autoscaling, drain the least recently used worker once it has not served a request for this long")
+	flagWorkerEnv         = envVarsFlag("worker-env", "sets an environment variable for workers, e.g. 'CACHE_DIR=/cache/{{.WorkerIndex}}' or 'WORKER_PORT={{.Port}}', which may use the same template variables as the worker's arguments; may be repeated")
+	flagWorkerEnvClear    = flag.Bool("worker-env-clear", false, "if true, workers only get the -worker-env environment variables, rather than also inheriting the stabilizer's")
+	flagWorkerEnvRedact   = flag.String("worker-env-redact", stabilizer.DefaultWorkerEnvRedact, "regexp matching the names of environment variables whose values are redacted when workers' environments are logged at debug level")
+	flagWorkerDir         = flag.String("worker-dir", "", "working directory of workers, e.g. '/tmp/worker-{{.WorkerIndex}}'; if it uses template variables, each worker's directory is created for it and removed once it exits")
+	flagWorkerStdinFile   = flag.String("worker-stdin-file", "", "file workers read their standard input from (default /dev/null)")
+	flagWorkerUser        = flag.String("worker-user", "", "user, a name or numeric id, workers run as; requires running as root")
+	flagWorkerGroup       = flag.String("worker-group", "", "group, a name or numeric id, workers run as; requires running as root (default the -worker-user's primary group)")
+	flagWorkerCgroup      = cgroupLimitsFlag("worker-cgroup", "cgroup v2 limit set for each worker in a cgroup of its own, e.g. 'memory.max=512M' or 'cpu.max=50000 100000'; may be repeated")
+	flagWorkerCgroupDir   = flag.String("worker-cgroup-parent", stabilizer.DefaultWorkerCgroupParent, "cgroup v2 directory under which each worker gets a cgroup of its own with -worker-cgroup")
+	flagWorkerNice        = flag.Int("worker-nice", 0, "niceness, from -20 to 19, workers are run at, e.g. 10 to yield to other services on the host; 0 leaves it unchanged (Linux only)")
+	flagWorkerCPUs        = flag.Int("worker-cpus", 0, "if non-zero, the number of CPUs each worker is pinned to, spread across those available, and what the -worker-cpus-env variables are set to (pinning is Linux only)")
+	flagWorkerCPUsEnv     = flag.String("worker-cpus-env", strings.Join(stabilizer.DefaultWorkerCPUsEnv, ","), "comma-separated environment variables set to -worker-cpus for workers")
+	flagWorkerUmask       = flag.String("worker-umask", "", "file mode creation mask, in octal, workers are started with, e.g. 027 (default the stabilizer's)")
+	flagCanaryCommand     = flag.String("canary-command", "", "if set, a worker command (e.g. a new version of the worker) run by -canary-workers extra workers, which are sent -canary-weight of requests; metrics are then labelled with the variant, stable or canary, that served them")
+	flagCanaryArgs        = flag.String("canary-args", "", "space-separated arguments of -canary-command, in which template variables such as {{.Port}} are replaced as in the worker's arguments")
+	flagCanaryWeight      = flag.Float64("canary-weight", 0, "the fraction of requests, from 0 to 1, sent to the canary workers while any is ready (e.g. 0.05); 0 keeps them running but unused")
+	flagCanaryWorkers     = flag.Int("canary-workers", 1, "number of canary worker subprocesses to spawn for -canary-command")
+	flagMirrorCommand     = flag.String("mirror-command", "", "if set, a worker command run by -mirror-workers shadow workers, which are sent a copy of -mirror-sample of requests in the background; their responses are discarded, and their metrics are labelled with variant=\"shadow\"")
+	flagMirrorArgs        = flag.String("mirror-args", "", "space-separated arguments of -mirror-command, in which template variables such as {{.Port}} are replaced as in the worker's arguments")
+	flagMirrorSample      = flag.Float64("mirror-sample", 0.01, "the fraction of requests, from 0 to 1, copied to the shadow workers; copies are dropped rather than queued while the shadow workers are busy")
+	flagMirrorWorkers     = flag.Int("mirror-workers", 1, "number of shadow worker subprocesses to spawn for -mirror-command")
+	flagMirrorTimeout     = flag.Duration("mirror-timeout", 2*time.Second, "if a copy of a request sent to a shadow worker takes longer than this, the shadow worker is killed")
+	flagMirrorMaxBody     = byteSizeFlag("mirror-max-body-bytes", 64<<10, "requests with a larger body, or one of unknown length, are not mirrored; smaller bodies are read into memory before the request is sent to a worker")
+	flagUpstreams         = flag.String("upstreams", "", "comma-separated URLs of servers run elsewhere, e.g. 'http://10.0.0.1:4443,http://10.0.0.2:4443', to send requests to instead of running a worker command; an upstream a request times out on is ejected for -eject-duration rather than killed")
+	flagEjectDuration     = flag.Duration("eject-duration", 30*time.Second, "how long an upstream (see -upstreams) is not sent requests after being ejected, before it is health checked to be sent them again")
+	flagPools             = poolsFlag("pool", "runs another set of workers for requests whose path starts with a prefix, e.g. 'name=highlight,prefix=/highlight,workers=6,concurrency=1,timeout=30s,cmd=./highlighter -port {{.Port}}' where cmd must come last; may be repeated, and the longest matching prefix is used. Requests matching no pool go to the worker command, or get a 404 if none is given; metrics are then labelled with the pool")
 	flagTimeout           = flag.Duration("timeout", 10*time.Second, "if request to worker takes longer than this, it will be killed")
 	flagTimeoutHeader     = flag.String("header", "X-Stabilize-Timeout", "request header used to override default timeout value, if not an empty string")
+	flagRoutes            = routesFlag("route", "overrides settings for requests whose path starts with a prefix, e.g. '/render,timeout=30s,timeout-max=1m,concurrency=2'; may be repeated, and the longest matching prefix is used")
+	flagTimeoutMin        = flag.Duration("timeout-min", 0, "if non-zero, timeouts requested with -header that are shorter than this are raised to it")
+	flagTimeoutMax        = flag.Duration("timeout-max", 0, "if non-zero, timeouts requested with -header that are longer than this are lowered to it")
+	flagForwardTimeout    = flag.Bool("forward-timeout-header", false, "if true, the -header request header is passed on to workers; otherwise it is removed")
+	flagDeadlineHeader    = flag.String("deadline-header", "", "if set, requests are sent to workers with this header (e.g. X-Stabilize-Deadline-Ms) set to the number of milliseconds left before they time out")
+	flagTimeoutActivity   = flag.Bool("timeout-resets-on-activity", false, "if true, the timeout of a request starts over whenever its worker sends part of the response, so that streaming responses can run for longer than -timeout")
+	flagFlushInterval     = flag.Duration("flush-interval", 0, "how often to flush responses to clients while they are being copied from workers; a negative value such as -1ns flushes after every write, and 0 only flushes once the buffer fills (responses with Content-Type text/event-stream are always flushed immediately)")
+	flagWSIdleTimeout     = flag.Duration("ws-idle-timeout", 0, "if non-zero, a WebSocket connection is closed once no data has been sent either way for this long (0 leaves them open until either side closes them)")
+	flagKillGrace         = flag.Duration("kill-grace", 0, "when killing a worker, send SIGTERM and wait this long for it to exit before sending SIGKILL (0 kills immediately)")
+	flagDrainTimeout      = flag.Duration("drain-timeout", 0, "how long a worker being replaced (e.g. due to -worker-max-age) is given to finish the requests it is serving before it is killed anyway (0 waits for them, up to their timeout)")
+	flagStuckDumpSignal   = flag.String("stuck-dump-signal", "", "if set, a signal (e.g. SIGQUIT for Go workers or SIGABRT) sent to a worker that timed out before it is killed, so that it prints its stacks, which are logged together")
+	flagStuckDumpGrace    = flag.Duration("stuck-dump-grace", 2*time.Second, "how long a worker sent -stuck-dump-signal is given to print its stacks before it is killed")
+	flagPoisonDir         = flag.String("poison-request-dir", "", "if set, each request that times out and gets its worker killed is written to a JSON file in this directory (with credentials redacted), so that it can be replayed")
+	flagPoisonBody        = byteSizeFlag("poison-request-body-bytes", 64<<10, "the maximum size of request body written to -poison-request-dir (0 leaves bodies out)")
+	flagPoisonKeep        = flag.Int("poison-request-keep", 50, "the number of files kept in -poison-request-dir, oldest first being removed (0 keeps all of them)")
 	flagConcurrency       = flag.Int("concurrency", 10, "number of concurrent requests to allow per worker")
+	flagMaxRequestBytes   = byteSizeFlag("max-request-bytes", 0, "if non-zero, requests with a body larger than this (e.g. 10M) are rejected with status 413")
+	flagMaxRetries        = flag.Int("max-retries", 0, "how many times a request may be retried on another worker if the connection to its worker was refused or reset, e.g. because the worker was killed; only GET and HEAD requests, and requests whose body was buffered (see -retry-buffer-max-bytes), are retried")
+	flagRetryBufferMax    = byteSizeFlag("retry-buffer-max-bytes", 1<<20, "request bodies up to this size are buffered so that requests with a body can be retried or hedged (see -max-retries and -hedge-after); larger bodies are streamed and not retried or hedged")
+	flagHedgeAfter        = flag.Duration("hedge-after", 0, "if non-zero, a request that could be retried (see -max-retries) that has not received response headers within this time is also sent to another worker, and whichever responds first is used")
+	flagHedgeMax          = flag.Int("hedge-max", 1, "the maximum number of additional workers a request is sent to by -hedge-after, each after a further -hedge-after")
+	flagAccessLog         = flag.Bool("access-log", false, "if true, log each request with its status, duration, size, worker and request ID")
+	flagAccessLogSample   = flag.Float64("access-log-sample", 1, "the fraction of successful requests to include in -access-log, e.g. 0.1; failed requests are always logged")
+	flagTrustForwarded    = flag.Bool("trust-forwarded-headers", false, "if true, X-Forwarded-For/Proto/Host headers sent by clients are passed on to workers (use when behind another proxy); otherwise they are replaced")
+	flagPreserveHost      = flag.Bool("preserve-host", true, "if true, requests are sent to workers with the Host header sent by the client; otherwise with the worker's address")
+	flagBalance           = flag.String("balance", stabilizer.BalancePool, "how requests are spread across workers: pool, which hands each request to the next worker with spare -concurrency, or least-loaded, which picks the worker serving the fewest requests")
+	flagSlowStart         = flag.Duration("slow-start", 0, "if set, a worker which replaces one that died or was recycled is sent one request at a time at first, and is allowed more over this long until it is allowed -concurrency")
+	flagSlowStartCurve    = flag.String("slow-start-curve", stabilizer.SlowStartLinear, "how a worker's concurrency is raised during -slow-start: linear, or exponential, which raises it slowly at first and more quickly towards the end")
+	flagAffinityKey       = flag.String("affinity-key", "", "if set, a header (or query parameter, given as query:name) whose value is used to send requests with the same value to the same worker by consistent hashing, while that worker has spare -concurrency")
+	flagPriorityHeader    = flag.String("priority-header", "", "if set, a header (e.g. X-Stabilize-Priority) whose value, high or low, gives the priority of a request; when all workers are busy, waiting requests of higher priority are handed workers first")
+	flagPriorityReserved  = flag.Float64("priority-reserved", 0, "fraction of the pool's capacity (workers times -concurrency), from 0 to 1, which only high priority requests may use")
+	flagPriorityPromote   = flag.Duration("priority-promote-after", 5*time.Second, "requests which have waited this long for a worker are handed the next one whatever their priority, so that low priority requests are not starved (0 disables)")
+	flagSingleFlight      = flag.Bool("single-flight", false, "if set, GET and HEAD requests identical to one being served (by URL and -single-flight-headers) wait for its response and are sent a copy of it, with an X-Coalesced header giving the number of requests that shared it")
+	flagSingleFlightHdrs  = flag.String("single-flight-headers", "Authorization,Cookie,Accept,Accept-Encoding", "comma-separated request headers which must also match for -single-flight requests to share a response")
+	flagSingleFlightMax   = byteSizeFlag("single-flight-max-bytes", 1<<20, "responses larger than this are not shared by -single-flight, and the waiting requests are served as usual")
+	flagCacheTTL          = flag.Duration("cache-ttl", 0, "if non-zero, successful (200) responses to GET requests are cached for this long, and served with an X-Cache: HIT header; responses with Cache-Control: no-store are not cached")
+	flagCacheVary         = flag.String("cache-vary", "Authorization,Cookie,Accept,Accept-Encoding", "comma-separated request headers which must also match for -cache-ttl to serve a cached response")
+	flagCacheMaxBytes     = byteSizeFlag("cache-max-bytes", 64<<20, "maximum size of the -cache-ttl cache, beyond which the least recently used responses are forgotten")
+	flagMaxInflight       = flag.Int("max-inflight", 0, "if non-zero, requests beyond this many in flight (including those waiting for a worker) are rejected right away with status 429 and the reason hss_overloaded")
+	flagRateLimit         = flag.String("rate-limit", "", "if set, the rate of requests each client may make, e.g. 100/s, 600/m or 1000/h; further requests are rejected right away with status 429 and the reason hss_rate_limited")
+	flagRateLimitBurst    = flag.Int("rate-limit-burst", 0, "number of requests a client may make at once, on top of -rate-limit (default -rate-limit per second, rounded up)")
+	flagRateLimitKey      = flag.String("rate-limit-key", "", "header identifying the client for -rate-limit, e.g. X-Actor-ID (default the client's IP, taken from X-Forwarded-For with -trust-forwarded-headers)")
+	flagQueueTimeout      = flag.Duration("queue-timeout", 0, "if no worker becomes available to serve a request within this time, it is rejected (0 waits up to -timeout)")
+	flagQueueStatus       = flag.Int("queue-timeout-status", http.StatusServiceUnavailable, "HTTP status code returned when a request is rejected because no worker became available (e.g. 503 or 429)")
+	flagTimeoutStatus     = flag.Int("timeout-status", http.StatusGatewayTimeout, "HTTP status code returned when a request times out, which should not be retried as it is")
+	flagErrorStatus       = flag.Int("error-status", http.StatusServiceUnavailable, "HTTP status code returned when a request fails on its worker for another reason, e.g. because the worker was killed due to another request; such requests may be retried")
+	flagUpstreamErrors    = flag.String("upstream-5xx-as-error", "", "comma-separated statuses (e.g. 502,503) of worker responses which are replaced with a JSON error with the reason hss_upstream_error, holding the worker's response body in its detail, rather than passed on as they are")
+	flagErrorTemplate     = flag.String("error-template", "", "if set, an html/template file used to render error responses to clients that prefer HTML (e.g. browsers), executed with .Code, .Status, .Reason, .Description, .RequestID and .Retriable")
+	flagWorkerLogFormat   = flag.String("worker-log-format", stabilizer.LogFormatText, "the format of worker output: text, which is logged line by line (see -worker-stderr-level), or json, in which case each line's level (or severity) and message (or msg) are kept and its other fields are logged as fields")
+	flagWorkerLogMaxLine  = byteSizeFlag("worker-log-max-line-bytes", 0, "if non-zero, lines of worker output longer than this (e.g. 16K) are truncated when logged")
+	flagWorkerLogRate     = flag.Float64("worker-log-rate", 0, "if non-zero, at most this many lines of output per second are logged for each worker, and the number of lines left out is logged periodically instead")
+	flagWorkerLogTail     = flag.Int("worker-log-tail", 100, "the number of lines of each worker's most recent output (up to 64K) which are logged together when it crashes or is killed (0 disables this)")
+	flagDebugHeaders      = flag.Bool("debug-headers", true, "if true, responses from workers have an X-Worker header identifying the worker by pid and port, and X-Worker-Duration and X-Queue-Duration headers telling how long the worker took to respond and how long the request waited for a worker")
+	flagDebugErrors       = flag.Bool("debug-error-responses", false, "if true, error responses for failed requests include the worker's recent output; not for production, as the output may contain sensitive data")
+	flagWorkerStderrLevel = flag.String("worker-stderr-level", stabilizer.LevelWarn, "the level at which lines workers write to stderr are logged: debug, info, warn or error (stdout is logged at info)")
+	flagWorkerHost        = flag.String("worker-host", "127.0.0.1", "the address workers listen on and are sent requests at, e.g. ::1 on IPv6-only hosts, passed to them as {{.Host}}")
+	flagWorkerSocketDir   = flag.String("worker-socket-dir", "", "if set, workers listen on a Unix socket in this directory, passed to them as {{.Socket}}, instead of a TCP port")
+	flagWorkerPortOutput  = flag.String("worker-port-from-output", "", "if set, workers pick their own port (e.g. by passing them --port=0) and this regexp is used to find it in their output, e.g. 'listening on port (\\d+)'")
+	flagWorkerPortRange   = flag.String("worker-port-range", "", "if set, worker ports are allocated from this inclusive range, e.g. 20000-20100, instead of being any free port")
+	flagWorkerProtocol    = flag.String("worker-protocol", stabilizer.ProtocolHTTP1, "the protocol spoken by workers: http1, or h2c for HTTP/2 without TLS (e.g. gRPC servers), in which case clients may also use h2c")
+	flagWorkerDial        = flag.Duration("worker-dial-timeout", 2*time.Second, "how long to wait to connect to a worker before failing the request")
+	flagWorkerMaxIdle     = flag.Int("worker-max-idle-conns-per-host", 0, "the number of idle keep-alive connections kept open to each worker (0 for -concurrency)")
+	flagWorkerIdleConn    = flag.Duration("worker-idle-conn-timeout", 90*time.Second, "how long an idle keep-alive connection to a worker is kept open (0 to keep it open until the worker closes it)")
+	flagWorkerNoKeepAlive = flag.Bool("worker-disable-keepalives", false, "if true, open a new connection to a worker for every request")
+	flagWorkerHeaders     = flag.Duration("worker-response-header-timeout", 0, "if non-zero, a worker that does not send response headers within this time (after the request has been sent to it) is killed as stuck, even if -timeout has not passed yet; responses that have started are not affected (http1 workers only)")
+	flagWorkerReadyPath   = flag.String("worker-ready-path", "", "if set, a worker is ready once a GET request to this path returns 2xx; otherwise once it accepts TCP connections")
+	flagWorkerMaxRequests = flag.Int("worker-max-requests", 0, "if non-zero, a worker is replaced after serving this many requests (its replacement is started before it is drained)")
+	flagWorkerMaxAge      = flag.Duration("worker-max-age", 0, "if non-zero, a worker is replaced after running for about this long, give or take 10% (its replacement is started before it is drained)")
+	flagWorkerMaxRSS      = byteSizeFlag("worker-max-rss", 0, "if non-zero, a worker is drained and replaced once its resident memory exceeds this many bytes; accepts K, M and G suffixes, e.g. 512M (Linux only)")
+	flagUnhealthy5xx      = flag.Int("unhealthy-after-5xx", 0, "if non-zero, a worker is drained and restarted after returning this many 5xx responses in a row")
+	flagHealthCheckPath   = flag.String("healthcheck-path", "", "if set, idle workers are checked every -healthcheck-interval with a GET request to this path, which must return 2xx")
+	flagHealthCheckEvery  = flag.Duration("healthcheck-interval", 30*time.Second, "how often to health check idle workers (see -healthcheck-path)")
+	flagHealthCheckWait   = flag.Duration("healthcheck-timeout", 2*time.Second, "how long a health check may take before it fails")
+	flagHealthCheckFails  = flag.Int("healthcheck-failures", 3, "the number of health checks in a row a worker must fail to be restarted")
+	flagWorkerStartup     = flag.Duration("worker-startup-timeout", 30*time.Second, "if a worker does not become ready within this time, it will be restarted")
+	flagWarmup            = warmupFlag("warmup", "a request, e.g. 'GET /health/full', sent to each worker once it is ready and before it is sent other requests, so that it can e.g. load what it loads lazily; may be repeated, and the requests are sent one at a time")
+	flagWarmupFile        = flag.String("warmup-requests", "", "a file of -warmup requests, one per line; blank lines and lines starting with # are ignored")
+	flagWarmupTimeout     = flag.Duration("warmup-timeout", 30*time.Second, "how long each -warmup request may take")
+	flagWarmupRequired    = flag.Bool("warmup-required", false, "if true, a worker whose -warmup requests fail or get a 5xx response is restarted, as if it had failed to start; otherwise the failure is logged and the worker is sent requests all the same")
 	flagPrometheus        = flag.String("prometheus", ":6060", "publish Prometheus metrics on specified address")
-	flagPrometheusAppName = flag.String("prometheus-app-name", "", "App name to specify in Prometheus")
+	flagAdminTLSCert      = flag.String("prometheus-tls-cert", "", "if set with -prometheus-tls-key, serve HTTPS on the -prometheus address using this certificate file")
+	flagAdminTLSKey       = flag.String("prometheus-tls-key", "", "the private key file for -prometheus-tls-cert")
+	flagPrometheusAppName = flag.String("prometheus-app-name", "", "App name to specify in Prometheus, used as the namespace of metrics (characters not valid in metric names, such as dashes, are replaced with underscores)")
+	flagDebugEndpoints    = flag.Bool("debug-endpoints", false, "if true, -prometheus also serves the stabilizer's own pprof profiles under /debug/pprof/ and expvar variables at /debug/vars")
+	flagDisableMetrics    = flag.Bool("disable-metrics", false, "if true, no metrics are registered, and -prometheus only serves the admin endpoints")
+	flagProcMetrics       = flag.Duration("proc-metrics-interval", 2*time.Second, "how often each worker's CPU time, resident memory, open file descriptors and threads are recorded in the hss_worker_cpu_seconds_total, hss_worker_rss_bytes, hss_worker_open_fds and hss_worker_threads metrics (0 disables them; Linux only)")
+	flagMetricsRoute      = flag.String("metrics-route-label", "", "if set, a regular expression matching path segments such as IDs (e.g. '^[0-9]+$'), and hss_requests_total gets a route label holding the request's path with matching segments replaced by :id; beware that every distinct route is a new metric")
+	flagOTelEndpoint      = flag.String("otel-endpoint", "", "if set, the URL of an OTLP/HTTP collector (e.g. http://localhost:4318) to which a span is exported for each request; the trace is continued from the request's traceparent header and passed on to the worker in the same way")
+	flagOTelSampleRatio   = flag.Float64("otel-sample-ratio", 1, "the ratio (0 to 1) of requests which are traced with -otel-endpoint; requests continuing a caller's trace are traced if the caller's was")
+	flagPrometheusBuckets = flag.String("prometheus-buckets", "0.005,0.01,0.025,0.05,0.1,0.25,0.5,1,2.5,5,10,30,60", "comma-separated request duration histogram buckets, in seconds")
+	flagHealthyMinWorkers = flag.Int("healthy-min-workers", 1, "minimum number of live workers for /healthz to report healthy")
+	flagMaxRestarts       = flag.Int("max-restarts", 0, "if non-zero, exit with status 3 once workers have failed (timed out, crashed or failed to start) more than this many times within -max-restarts-window")
+	flagMaxRestartsWindow = flag.Duration("max-restarts-window", 5*time.Minute, "the window over which -max-restarts is counted")
+	flagStartupReady      = flag.Bool("startup-require-ready", true, "at startup, wait for a worker to become ready before listening, and exit if it does not; if false, only check that the worker command runs for a moment")
+	flagReuseport         = flag.Bool("reuseport", false, "bind -listen and -prometheus with SO_REUSEPORT, so that a new stabilizer (e.g. an upgraded binary) can start listening on the same addresses before this one is sent SIGTERM to drain and exit (on Linux new connections then go to the new stabilizer; elsewhere they are spread across both, and those still queued for this one when it exits are reset)")
+	flagReap              = flag.Bool("reap", false, "reap orphaned processes left behind by workers, so that they do not linger as zombies (Linux only; always on when running as PID 1, e.g. as a container's entrypoint)")
+	flagForwardSignals    = flag.String("forward-signals", "", "comma-separated signals (SIGHUP, SIGUSR1, SIGUSR2 or SIGWINCH) which are relayed to the process group of every ready worker when the stabilizer receives them, e.g. to make workers reopen their log files")
+	flagRolloutSignal     = flag.String("rollout-signal", "SIGHUP", "a signal (SIGHUP, SIGUSR1 or SIGUSR2) which replaces the workers one at a time, waiting for each replacement to be ready before draining the old worker, or 'none'; SIGHUP is ignored here if -config, -tls-cert, -prometheus-tls-cert or -forward-signals uses it")
+	flagWatchBinary       = flag.Bool("watch-worker-binary", false, "replace the workers one at a time, as -rollout-signal does, whenever the worker command's binary is replaced or modified on disk")
+	flagWorkerVersionArg  = flag.String("worker-version-arg", "", "if set, an argument (e.g. --version) with which the worker command prints its version; it is run with it at startup and whenever -watch-worker-binary sees a new binary, and the first line it prints is logged, served at /buildinfo and /workers, and exported as hss_worker_build_info")
+	flagShutdownGrace     = flag.Duration("shutdown-grace", 30*time.Second, "on SIGTERM/SIGINT, how long to wait for in-flight requests to finish before killing workers")
+	flagReadHeaderTimeout = flag.Duration("read-header-timeout", 10*time.Second, "how long clients of -listen and -prometheus are given to send request headers, so that slow clients cannot tie up connections (0 to wait forever)")
+	flagIdleTimeout       = flag.Duration("idle-timeout", 120*time.Second, "how long an idle keep-alive connection to -listen or -prometheus is kept open (0 to use -read-header-timeout)")
+	flagWriteTimeout      = flag.Duration("write-timeout", 0, "if non-zero, how long -listen and -prometheus are given to read a request and write its response; leave it off unless responses are never streamed, as it also cuts off long responses and WebSockets")
+	flagMaxHeaderBytes    = byteSizeFlag("max-header-bytes", http.DefaultMaxHeaderBytes, "the maximum size of the request headers accepted by -listen and -prometheus")
+	flagDrainOnSignal     = flag.String("drain-on-signal", "", "if set, a signal (SIGUSR1 or SIGUSR2) which puts the stabilizer into drain mode, in which /readyz reports it is not ready; POST /undrain on the admin server takes it out again")
+	flagDrainReject       = flag.Bool("drain-reject", false, "in drain mode, reject new requests with status 503 and the reason hss_draining, rather than serving them")
+
+	flagVersion = flag.Bool("version", false, "print the version of the stabilizer and exit")
 
 	flagDemo       = flag.Bool("demo", false, "start an HTTP demo server that does nothing")
 	flagDemoListen = flag.String("demo-listen", ":9700", "specify HTTP address for demo server to listen on")
+	flagDemoLeak   = byteSizeFlag("demo-leak", 0, "if non-zero, the demo server leaks this many bytes per request instead of randomly getting stuck")
 )
 
-type worker struct {
-	// log is a logger that carries the worker's pid and port as a fields
-	log log.Logger
-
-	ctx    context.Context
-	port   int
-	cancel func()
-	pid    int
-	cmd    *exec.Cmd
-	output *io.PipeReader
-	done   chan struct{}
-}
-
-// watch monitors the worker until it dies.
-func (w *worker) watch() {
-	go func() {
-		<-w.ctx.Done()
+// exitCodeTooManyRestarts is the exit status used when workers are restarted
+// more than -max-restarts times within -max-restarts-window.
+const exitCodeTooManyRestarts = 3
 
-		// Kill the process.
-		if err := w.cmd.Process.Kill(); err != nil {
-			if err != nil {
-				w.log.Error("killing process", log.Error(err))
-			}
-		}
-
-		// Also kill subprocesses (OS X, Linux) -- not supported on Windows.
-		pgid, err := syscall.Getpgid(w.pid)
-		if err == nil {
-			syscall.Kill(-pgid, 15)
-		}
-
-		w.cmd.ProcessState, _ = w.cmd.Process.Wait()
-		close(w.done)
-		w.output.Close()
-	}()
-
-	output := bufio.NewReader(w.output)
-	for {
-		line, err := output.ReadString('\n')
-		w.log.Info(line)
-		if err != nil {
-			w.log.Error("read error",
-				log.Error(err),
-				log.String("process.state", w.cmd.ProcessState.String()))
-			return
-		}
+// stabilizerConfig returns the stabilizer configuration given by flags, for
+// the given worker command.
+func stabilizerConfig(command []string) (stabilizer.Config, error) {
+	buckets, err := parseBuckets(*flagPrometheusBuckets)
+	if err != nil {
+		return stabilizer.Config{}, fmt.Errorf("invalid -prometheus-buckets: %v", err)
 	}
-}
-
-// spawnWorker spawns a new worker process. stderr and stdout will be logged,
-// the done channel signals when the worker has died, and w.cancel() can be
-// used to kill the worker.
-func spawnWorker(ctx context.Context, logger log.Logger, port int, command string, args ...string) *worker {
-	ctx, cancel := context.WithCancel(ctx)
-	cmd := exec.CommandContext(ctx, command, args...)
-	cmd.SysProcAttr = &syscall.SysProcAttr{
-		// Create a new process group so any subprocesses the worker spawns can
-		// be killed.
-		Setpgid: true,
-	}
-	pr, pw := io.Pipe()
-	cmd.Stderr = pw
-	cmd.Stdout = pw
-	w := &worker{
-		log: logger.With(log.Int("port", port)),
-
-		ctx:    ctx,
-		port:   port,
-		cancel: cancel,
-		cmd:    cmd,
-		output: pr,
-		done:   make(chan struct{}),
+	minWorkers, maxWorkers := workerRange()
+	if minWorkers == maxWorkers {
+		// -workers is the same as -min-workers and -max-workers both set
+		// to it.
+		minWorkers, maxWorkers = 0, 0
 	}
-
-	if err := cmd.Start(); err != nil {
-		logger.Error("spawn error", log.Error(err))
-		close(w.done)
-		return w
+	rateLimit, err := parseRate(*flagRateLimit)
+	if err != nil {
+		return stabilizer.Config{}, fmt.Errorf("invalid -rate-limit: %v", err)
 	}
-
-	// Track the process ID associated with this worker
-	w.pid = w.cmd.Process.Pid
-	w.log = w.log.With(log.Int("pid", w.pid))
-
-	go w.watch()
-
-	w.log.Info("started")
-	return w
-}
-
-type stabilizer struct {
-	log     log.Logger
-	command string
-	args    []string
-
-	workerPool     chan *worker
-	workerByPortMu sync.RWMutex
-	workerByPort   map[int]*worker
-}
-
-func templateArgs(args []string, port string) []string {
-	var v []string
-	for _, arg := range args {
-		v = append(v, strings.Replace(arg, "{{.Port}}", port, -1))
+	upstreamErrors, err := parseStatusCodes(*flagUpstreamErrors)
+	if err != nil {
+		return stabilizer.Config{}, fmt.Errorf("invalid -upstream-5xx-as-error: %v", err)
 	}
-	return v
-}
-
-func (s *stabilizer) acquire() *worker {
-	for {
-		w := <-s.workerPool
-		if w.ctx.Err() == nil {
-			return w
+	warmup := []string(*flagWarmup)
+	if *flagWarmupFile != "" {
+		requests, err := readWarmupFile(*flagWarmupFile)
+		if err != nil {
+			return stabilizer.Config{}, fmt.Errorf("invalid -warmup-requests: %v", err)
 		}
-		time.Sleep(50 * time.Millisecond)
+		warmup = append(requests, warmup...)
 	}
-}
-
-func (s *stabilizer) release(w *worker) {
-	go func() {
-		s.workerPool <- w
-	}()
-}
-
-func getFreePort() (port int, err error) {
-	if v, _ := strconv.ParseBool(os.Getenv("USE_OLD_FREEPORT")); v == true {
-		return oldfreeport.GetFreePort()
+	if len(command) == 0 && len(*flagPools) == 0 && *flagUpstreams == "" {
+		return stabilizer.Config{}, errors.New("no worker command given")
+	}
+	if len(command) == 0 {
+		// Only the -pool pools run workers, or -upstreams are used instead.
+		command = []string{""}
 	}
-	return freeport.GetFreePort()
+	return stabilizer.Config{
+		Command:                     command[0],
+		Args:                        command[1:],
+		Workers:                     *flagWorkers,
+		MinWorkers:                  minWorkers,
+		MaxWorkers:                  maxWorkers,
+		ScaleUpQueueWait:            *flagScaleUpQueueWait,
+		ScaleUpSaturation:           *flagScaleUpSat,
+		ScaleUpAfter:                *flagScaleUpAfter,
+		ScaleDownIdle:               *flagScaleDownIdle,
+		WorkerEnv:                   []string(*flagWorkerEnv),
+		WorkerEnvClear:              *flagWorkerEnvClear,
+		WorkerEnvRedact:             *flagWorkerEnvRedact,
+		WorkerDir:                   *flagWorkerDir,
+		WorkerStdinFile:             *flagWorkerStdinFile,
+		WorkerUmask:                 *flagWorkerUmask,
+		WorkerUser:                  *flagWorkerUser,
+		WorkerGroup:                 *flagWorkerGroup,
+		WorkerCgroup:                []string(*flagWorkerCgroup),
+		WorkerCgroupParent:          *flagWorkerCgroupDir,
+		WorkerNice:                  *flagWorkerNice,
+		WorkerCPUs:                  *flagWorkerCPUs,
+		WorkerCPUsEnv:               parseList(*flagWorkerCPUsEnv),
+		CanaryCommand:               *flagCanaryCommand,
+		CanaryArgs:                  strings.Fields(*flagCanaryArgs),
+		CanaryWeight:                *flagCanaryWeight,
+		CanaryWorkers:               *flagCanaryWorkers,
+		MirrorCommand:               *flagMirrorCommand,
+		MirrorArgs:                  strings.Fields(*flagMirrorArgs),
+		MirrorSample:                *flagMirrorSample,
+		MirrorWorkers:               *flagMirrorWorkers,
+		MirrorTimeout:               *flagMirrorTimeout,
+		MirrorMaxBodyBytes:          int64(*flagMirrorMaxBody),
+		Upstreams:                   parseList(*flagUpstreams),
+		EjectDuration:               *flagEjectDuration,
+		Pools:                       []stabilizer.Pool(*flagPools),
+		Concurrency:                 *flagConcurrency,
+		SlowStart:                   *flagSlowStart,
+		SlowStartCurve:              *flagSlowStartCurve,
+		Balance:                     *flagBalance,
+		AffinityKey:                 *flagAffinityKey,
+		PriorityHeader:              *flagPriorityHeader,
+		PriorityReserved:            *flagPriorityReserved,
+		PriorityPromoteAfter:        *flagPriorityPromote,
+		Timeout:                     *flagTimeout,
+		TimeoutHeader:               *flagTimeoutHeader,
+		TimeoutMin:                  *flagTimeoutMin,
+		TimeoutMax:                  *flagTimeoutMax,
+		ForwardTimeoutHeader:        *flagForwardTimeout,
+		DeadlineHeader:              *flagDeadlineHeader,
+		TimeoutResetsOnActivity:     *flagTimeoutActivity,
+		FlushInterval:               *flagFlushInterval,
+		WSIdleTimeout:               *flagWSIdleTimeout,
+		AccessLog:                   *flagAccessLog,
+		AccessLogSample:             *flagAccessLogSample,
+		Routes:                      []stabilizer.Route(*flagRoutes),
+		QueueTimeout:                *flagQueueTimeout,
+		QueueTimeoutStatus:          *flagQueueStatus,
+		MaxInflight:                 *flagMaxInflight,
+		DrainReject:                 *flagDrainReject,
+		Reap:                        *flagReap || os.Getpid() == 1,
+		WatchWorkerBinary:           *flagWatchBinary,
+		WorkerVersionArg:            *flagWorkerVersionArg,
+		SingleFlight:                *flagSingleFlight,
+		SingleFlightHeaders:         parseList(*flagSingleFlightHdrs),
+		SingleFlightMaxBytes:        int64(*flagSingleFlightMax),
+		CacheTTL:                    *flagCacheTTL,
+		CacheVary:                   parseList(*flagCacheVary),
+		CacheMaxBytes:               int64(*flagCacheMaxBytes),
+		RateLimit:                   rateLimit,
+		RateLimitBurst:              *flagRateLimitBurst,
+		RateLimitKey:                *flagRateLimitKey,
+		TimeoutStatus:               *flagTimeoutStatus,
+		ErrorStatus:                 *flagErrorStatus,
+		ErrorTemplate:               *flagErrorTemplate,
+		Upstream5xxAsError:          upstreamErrors,
+		MaxRequestBytes:             int64(*flagMaxRequestBytes),
+		MaxRetries:                  *flagMaxRetries,
+		RetryBufferMaxBytes:         int64(*flagRetryBufferMax),
+		HedgeAfter:                  *flagHedgeAfter,
+		HedgeMax:                    *flagHedgeMax,
+		TrustForwardedHeaders:       *flagTrustForwarded,
+		PreserveHost:                *flagPreserveHost,
+		KillGrace:                   *flagKillGrace,
+		DrainTimeout:                *flagDrainTimeout,
+		StuckDumpSignal:             *flagStuckDumpSignal,
+		StuckDumpGrace:              *flagStuckDumpGrace,
+		PoisonRequestDir:            *flagPoisonDir,
+		PoisonRequestBodyBytes:      int64(*flagPoisonBody),
+		PoisonRequestKeep:           *flagPoisonKeep,
+		WorkerLogFormat:             *flagWorkerLogFormat,
+		WorkerStderrLevel:           *flagWorkerStderrLevel,
+		WorkerLogTail:               *flagWorkerLogTail,
+		DebugErrorResponses:         *flagDebugErrors,
+		DebugHeaders:                *flagDebugHeaders,
+		WorkerLogMaxLineBytes:       int64(*flagWorkerLogMaxLine),
+		WorkerLogRate:               *flagWorkerLogRate,
+		WorkerHost:                  *flagWorkerHost,
+		WorkerSocketDir:             *flagWorkerSocketDir,
+		WorkerPortFromOutput:        *flagWorkerPortOutput,
+		WorkerPortRange:             *flagWorkerPortRange,
+		WorkerProtocol:              *flagWorkerProtocol,
+		WorkerDialTimeout:           *flagWorkerDial,
+		WorkerResponseHeaderTimeout: *flagWorkerHeaders,
+		WorkerMaxIdleConnsPerHost:   *flagWorkerMaxIdle,
+		WorkerIdleConnTimeout:       *flagWorkerIdleConn,
+		WorkerDisableKeepAlives:     *flagWorkerNoKeepAlive,
+		WorkerReadyPath:             *flagWorkerReadyPath,
+		WorkerStartupTimeout:        *flagWorkerStartup,
+		Warmup:                      warmup,
+		WarmupTimeout:               *flagWarmupTimeout,
+		WarmupRequired:              *flagWarmupRequired,
+		WorkerMaxRequests:           *flagWorkerMaxRequests,
+		WorkerMaxAge:                *flagWorkerMaxAge,
+		WorkerMaxRSS:                int64(*flagWorkerMaxRSS),
+		UnhealthyAfter5xx:           *flagUnhealthy5xx,
+		HealthCheckPath:             *flagHealthCheckPath,
+		HealthCheckInterval:         *flagHealthCheckEvery,
+		HealthCheckTimeout:          *flagHealthCheckWait,
+		HealthCheckFailures:         *flagHealthCheckFails,
+		HealthyMinWorkers:           *flagHealthyMinWorkers,
+		MaxRestarts:                 *flagMaxRestarts,
+		MaxRestartsWindow:           *flagMaxRestartsWindow,
+		StartupRequireReady:         *flagStartupReady,
+		PrometheusAppName:           *flagPrometheusAppName,
+		PrometheusBuckets:           buckets,
+		MetricsRouteLabel:           *flagMetricsRoute,
+		ProcMetricsInterval:         *flagProcMetrics,
+		OTelEndpoint:                *flagOTelEndpoint,
+		OTelSampleRatio:             *flagOTelSampleRatio,
+	}, nil
 }
 
-// ensureWorkers ensures that n workers are always alive. If they die, they
-// will be started again.
-func (s *stabilizer) ensureWorkers(n int) {
-	s.log.Info("ensuring workers",
-		log.String("command", strings.Join(append([]string{s.command}, s.args...), " ")),
-		log.Int("count", n))
-
-	for i := 0; i < n; i++ {
-		go func(i int) {
-			for {
-				workerPort, err := getFreePort()
-				if err != nil {
-					s.log.Warn("failed to find free port")
-					time.Sleep(1 * time.Second)
-					continue
-				}
+func main() {
+	flag.Parse()
 
-				args := templateArgs(s.args, fmt.Sprint(workerPort))
-				w := spawnWorker(context.Background(),
-					log.Scoped("worker", "worker instance"),
-					workerPort, s.command, args...)
-				s.workerByPortMu.Lock()
-				s.workerByPort[workerPort] = w
-				s.workerByPortMu.Unlock()
-				var (
-					done        bool
-					poolEntries int
-				)
-				for {
-					if done {
-						break
-					}
-					if poolEntries < *flagConcurrency {
-						select {
-						case s.workerPool <- w:
-							poolEntries++
-						case <-w.done:
-							done = true
-						}
-						continue
-					}
-					<-w.done
-					break
-				}
-			}
-		}(i)
+	build := buildInfo()
+	if *flagVersion {
+		printVersion(build)
+		return
 	}
-}
 
-func (s *stabilizer) director(req *http.Request) {
-	timeout := *flagTimeout
-	if *flagTimeoutHeader != "" {
+	// Flags given on the command line take precedence over -config.
+	var (
+		cfg      *config
+		explicit map[string]bool
+	)
+	if *flagConfig != "" {
 		var err error
-		timeout, err = time.ParseDuration(req.Header.Get(*flagTimeoutHeader))
+		cfg, err = loadConfig(*flagConfig)
 		if err != nil {
-			timeout = *flagTimeout
+			fmt.Fprintf(os.Stderr, "invalid -config: %v\n", err)
+			os.Exit(2)
 		}
+		explicit = applyConfig(cfg)
 	}
-
-	// We cannot cancel this timeout effectively within http.ReverseProxy director
-	ctx, _ := context.WithTimeout(req.Context(), timeout)
-	*req = *req.WithContext(ctx)
-
-	// Pull a worker from the pool and set it as our target.
-	worker := s.acquire()
-	target, _ := url.Parse(fmt.Sprintf("http://127.0.0.1:%v", worker.port))
-	s.log.Debug("handling request",
-		log.String("url", req.URL.String()),
-		log.String("target", target.String()))
-
-	// Copy what httputil.NewSingleHostReverseProxy would do.
-	req.URL.Scheme = target.Scheme
-	req.URL.Host = target.Host
-	req.URL.Path = path.Join(target.Path, req.URL.Path)
-	if target.RawQuery == "" || req.URL.RawQuery == "" {
-		req.URL.RawQuery = target.RawQuery + req.URL.RawQuery
-	} else {
-		req.URL.RawQuery = target.RawQuery + "&" + req.URL.RawQuery
-	}
-	if _, ok := req.Header["User-Agent"]; !ok {
-		// explicitly disable User-Agent so it's not set to default value
-		req.Header.Set("User-Agent", "")
+	command := flag.Args()
+	if len(command) == 0 && cfg != nil {
+		command = cfg.command
 	}
-}
-
-var workerRestartsCounter prometheus.Counter
-
-func main() {
-	flag.Parse()
 
 	liblog := log.Init(log.Resource{
 		Name:       *flagPrometheusAppName,
 		InstanceID: hostname(),
-		Version:    "",
+		Version:    build.Version,
 	})
 	defer liblog.Sync()
 
-	workerRestartsCounter = promauto.NewCounter(prometheus.CounterOpts{
-		Name: *flagPrometheusAppName + "_hss_worker_restarts",
-		Help: "The total number of worker process restarts",
-	})
-
 	if *flagDemo {
 		demoLog := log.Scoped("demo", "demo endpoint")
 
 		demoLog.Info("listening", log.String("addr", *flagDemoListen))
 		rand.Seed(time.Now().UnixNano())
-		http.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
-			if rand.Int()%2 == 0 {
+		var leaked [][]byte
+		mux := http.NewServeMux()
+		mux.HandleFunc("/events", func(w http.ResponseWriter, r *http.Request) {
+			// Stream server-sent events for longer than the default timeout.
+			w.Header().Set("Content-Type", "text/event-stream")
+			for i := 0; i < 15; i++ {
+				fmt.Fprintf(w, "data: event %d from worker %s\n\n", i, *flagDemoListen)
+				w.(http.Flusher).Flush()
+				select {
+				case <-r.Context().Done():
+					return
+				case <-time.After(time.Second):
+				}
+			}
+		})
+		mux.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
+			if *flagDemoLeak > 0 {
+				// Pretend the server slowly leaks memory. The leaked memory
+				// is written to so that it counts towards the RSS.
+				leak := make([]byte, *flagDemoLeak)
+				for i := range leak {
+					leak[i] = 1
+				}
+				leaked = append(leaked, leak)
+			} else if rand.Int()%2 == 0 {
 				demoLog.Warn("stuck")
 				i := 0
 				for {
@@ -296,109 +426,219 @@ func main() {
 			fmt.Fprintf(w, "Hello from worker %s\n", *flagDemoListen)
 		})
 
-		if err := http.ListenAndServe(*flagDemoListen, nil); err != nil {
+		if err := http.ListenAndServe(*flagDemoListen, mux); err != nil {
 			demoLog.Fatal("server exited", log.Error(err))
 		}
 	}
 
-	if flag.NArg() < 2 {
+	if len(command) < 2 && (len(command) > 0 || (len(*flagPools) == 0 && *flagUpstreams == "")) {
 		flag.Usage()
 		os.Exit(2)
 	}
 
+	serverLog := log.Scoped("server", "")
+	settings, err := stabilizerConfig(command)
+	if err != nil {
+		serverLog.Fatal("invalid flags", log.Error(err))
+	}
+	var certs, adminCerts *certReloader
+	if *flagTLSCert != "" || *flagTLSKey != "" {
+		var err error
+		certs, err = newCertReloader(serverLog, *flagTLSCert, *flagTLSKey)
+		if err != nil {
+			serverLog.Fatal("invalid -tls-cert or -tls-key", log.Error(err))
+		}
+	}
+	if *flagAdminTLSCert != "" || *flagAdminTLSKey != "" {
+		var err error
+		adminCerts, err = newCertReloader(serverLog, *flagAdminTLSCert, *flagAdminTLSKey)
+		if err != nil {
+			serverLog.Fatal("invalid -prometheus-tls-cert or -prometheus-tls-key", log.Error(err))
+		}
+	}
+	drainSignal, err := parseDrainSignal(*flagDrainOnSignal)
+	if err != nil {
+		serverLog.Fatal("invalid -drain-on-signal", log.Error(err))
+	}
+	forwardSignals, err := parseForwardSignals(*flagForwardSignals)
+	if err != nil {
+		serverLog.Fatal("invalid -forward-signals", log.Error(err))
+	}
+	for _, sig := range forwardSignals {
+		if sig == drainSignal || (sig == syscall.SIGHUP && *flagConfig != "") {
+			serverLog.Fatal("invalid -forward-signals: signal is already used by -drain-on-signal or -config", log.String("signal", sig.String()))
+		}
+	}
+	rolloutSignal, err := parseRolloutSignal(*flagRolloutSignal)
+	if err != nil {
+		serverLog.Fatal("invalid -rollout-signal", log.Error(err))
+	}
+	for _, sig := range forwardSignals {
+		if sig == rolloutSignal && sig == syscall.SIGHUP {
+			rolloutSignal = nil
+		} else if sig == rolloutSignal {
+			serverLog.Fatal("invalid -rollout-signal: signal is already used by -forward-signals", log.String("signal", sig.String()))
+		}
+	}
+	if rolloutSignal == syscall.SIGHUP && (*flagConfig != "" || *flagTLSCert != "" || *flagAdminTLSCert != "") {
+		// SIGHUP reloads the config or certificates instead, which should
+		// not also replace every worker.
+		rolloutSignal = nil
+	}
+	if rolloutSignal != nil && rolloutSignal == drainSignal {
+		serverLog.Fatal("invalid -rollout-signal: signal is already used by -drain-on-signal", log.String("signal", rolloutSignal.String()))
+	}
+
+	// Take the socket passed by systemd, if any, before starting workers so
+	// that they do not inherit it.
+	ln, err := systemdListener()
+	if err != nil {
+		serverLog.Fatal("invalid systemd socket activation", log.Error(err))
+	}
+	if ln != nil {
+		serverLog.Info("using socket passed by systemd instead of -listen", log.String("addr", ln.Addr().String()))
+	}
+
+	opts := []stabilizer.Option{stabilizer.WithConfig(settings), stabilizer.WithBuildInfo(build)}
+	if *flagDisableMetrics {
+		opts = append(opts, stabilizer.WithRegisterer(nil))
+	}
+	s := stabilizer.New(opts...)
+	if *flagConfig != "" {
+		go watchConfig(s, serverLog, *flagConfig, explicit)
+	}
+	if drainSignal != nil {
+		go drainOnSignal(s, serverLog, drainSignal)
+	}
+	if len(forwardSignals) > 0 {
+		go forwardToWorkers(s, serverLog, forwardSignals)
+	}
+	if rolloutSignal != nil {
+		go rolloutOnSignal(s, serverLog, rolloutSignal)
+	}
+
 	if *flagPrometheus != "" {
 		go func() {
 			mux := http.NewServeMux()
-			mux.Handle("/metrics", promhttp.Handler())
-			http.ListenAndServe(*flagPrometheus, mux)
+			if !*flagDisableMetrics {
+				mux.Handle("/metrics", promhttp.Handler())
+			}
+			if *flagDebugEndpoints {
+				// Only ever on -prometheus: importing net/http/pprof and
+				// expvar registers them with http.DefaultServeMux, which is
+				// not served at all.
+				mux.HandleFunc("/debug/pprof/", pprof.Index)
+				mux.HandleFunc("/debug/pprof/cmdline", pprof.Cmdline)
+				mux.HandleFunc("/debug/pprof/profile", pprof.Profile)
+				mux.HandleFunc("/debug/pprof/symbol", pprof.Symbol)
+				mux.HandleFunc("/debug/pprof/trace", pprof.Trace)
+				mux.Handle("/debug/vars", expvar.Handler())
+				expvar.Publish("stabilizer", expvar.Func(func() interface{} { return s.Stats() }))
+			}
+			mux.Handle("/", s.AdminHandler())
+			if err := listenAndServe(newServer(*flagPrometheus, mux), adminCerts); err != nil {
+				serverLog.Error("admin server exited", log.Error(err))
+			}
 		}()
 	}
 
-	s := &stabilizer{
-		log:          log.Scoped("stabilizer", "worker stabilizer"),
-		command:      flag.Arg(0),
-		args:         flag.Args()[1:],
-		workerPool:   make(chan *worker, *flagWorkers**flagConcurrency),
-		workerByPort: make(map[int]*worker),
-	}
-	go s.ensureWorkers(*flagWorkers)
+	if err := s.Start(context.Background()); err != nil {
+		serverLog.Fatal("failed to start", log.String("command", settings.Command), log.Error(err))
+	}
 
-	handler := &httputil.ReverseProxy{
-		Director: s.director,
-		Transport: &http.Transport{
-			DialContext: (&net.Dialer{
-				Timeout:   2000 * time.Millisecond,
-				KeepAlive: 30 * time.Second,
-			}).DialContext,
-			TLSHandshakeTimeout: 10 * time.Second,
-		},
-		ModifyResponse: func(r *http.Response) error {
-			// Set the X-Worker response header for debugging purposes.
-			workerPort, _ := strconv.ParseInt(r.Request.URL.Port(), 10, 64)
-			s.workerByPortMu.RLock()
-			w := s.workerByPort[int(workerPort)]
-			s.workerByPortMu.RUnlock()
-			s.release(w)
-			r.Header.Set("X-Worker", fmt.Sprint(w.pid))
-			return nil
-		},
-		ErrorHandler: func(rw http.ResponseWriter, r *http.Request, err error) {
-			// Set the X-Worker response header for debugging purposes.
-			workerPort, _ := strconv.ParseInt(r.URL.Port(), 10, 64)
-			s.workerByPortMu.RLock()
-			w := s.workerByPort[int(workerPort)]
-			s.workerByPortMu.RUnlock()
-			s.release(w)
-			rw.Header().Set("X-Worker", fmt.Sprint(w.pid))
+	server := newServer(*flagListen, s.Handler())
+	if ln == nil {
+		ln, err = listen(*flagListen)
+		if err != nil {
+			serverLog.Fatal("failed to listen", log.String("listen", *flagListen), log.Error(err))
+		}
+	}
+	go func() {
+		if err := serve(server, ln, certs); err != http.ErrServerClosed {
+			serverLog.Fatal("server exited", log.Error(err))
+		}
+	}()
+	go notifyReady(s, serverLog)
+	go watchdog(serverLog)
+
+	// Upon SIGTERM/SIGINT stop accepting new connections and let in-flight
+	// requests finish before killing the workers.
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGTERM, syscall.SIGINT)
+	var sig os.Signal
+	select {
+	case sig = <-signals:
+	case <-s.Exceeded():
+		// Exit so that whatever supervises the stabilizer notices, rather
+		// than restarting workers forever.
+		server.Close()
+		_ = s.Shutdown(context.Background())
+		serverLog.Error("exiting due to too many worker restarts",
+			log.Int("max", *flagMaxRestarts),
+			log.Duration("window", *flagMaxRestartsWindow),
+			log.Strings("recent", s.RecentFailures(10)))
+		liblog.Sync()
+		os.Exit(exitCodeTooManyRestarts)
+	}
+	// Report not ready while in-flight requests finish.
+	s.Drain()
+	_ = sdNotify("STOPPING=1")
+	serverLog.Info("shutting down",
+		log.String("signal", sig.String()),
+		log.Duration("grace", *flagShutdownGrace))
+	shutdownCtx, shutdownCancel := context.WithTimeout(context.Background(), *flagShutdownGrace)
+	defer shutdownCancel()
+	if err := server.Shutdown(shutdownCtx); err != nil {
+		serverLog.Warn("in-flight requests did not finish within grace period", log.Error(err))
+	}
+	_ = s.Shutdown(context.Background())
+	serverLog.Info("shutdown complete")
+}
 
-			rw.WriteHeader(http.StatusServiceUnavailable)
+// newServer returns a server for the given address and handler, with the
+// timeouts and limits given by flags.
+func newServer(addr string, handler http.Handler) *http.Server {
+	return &http.Server{
+		Addr:              addr,
+		Handler:           handler,
+		ReadHeaderTimeout: *flagReadHeaderTimeout,
+		IdleTimeout:       *flagIdleTimeout,
+		WriteTimeout:      *flagWriteTimeout,
+		MaxHeaderBytes:    int(*flagMaxHeaderBytes),
+	}
+}
 
-			// This error type matches what Rocket uses (the Rust server
-			// we use in syntect server)
-			type Err struct {
-				// HTTP error code
-				Code int `json:"code"`
-				// Error string that can be matched on
-				Reason string `json:"reason"`
-				// PII-safe human-readable description, which can be used for logging
-				Description string `json:"description"`
-			}
+// drainOnSignal puts the stabilizer into drain mode whenever sig is received.
+func drainOnSignal(s *stabilizer.Stabilizer, logger log.Logger, sig os.Signal) {
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, sig)
+	for range signals {
+		if s.Drain() {
+			logger.Info("draining due to signal", log.String("signal", sig.String()))
+		}
+	}
+}
 
-			// If the request timed out, kill the worker since it may be stuck.
-			// It will automatically restart.
-			if ctxErr := r.Context().Err(); ctxErr != nil {
-				w.log.Warn("restarting due to timeout", log.String("ctxErr", ctxErr.Error()))
-				workerRestartsCounter.Inc()
-				w.cancel()
-				_ = json.NewEncoder(rw).Encode(&map[string]interface{}{
-					"error": Err{
-						Code:        http.StatusServiceUnavailable,
-						Reason:      "hss_worker_timeout",
-						Description: fmt.Sprintf("Worker (pid: %v) failed to highlight file; restarting it", w.pid),
-					},
-				})
-				return
-			}
+// rolloutOnSignal replaces the workers one at a time whenever sig is
+// received. Signals received during a rollout are coalesced into one more
+// rollout after it.
+func rolloutOnSignal(s *stabilizer.Stabilizer, logger log.Logger, sig os.Signal) {
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, sig)
+	for range signals {
+		_, _ = s.Rollout("signal " + sig.String())
+	}
+}
 
-			// Technically we could hit other errors here if e.g. communication
-			// between our reverse proxy and the worker was failing for some
-			// other reason like the network being flooded, but in practice
-			// this is unlikely to happen and instead the most likely case is
-			// that the worker was killed due to another request on the same
-			// worker timing out. In this case, having a different error code
-			// to handle is not that useful so we also return
-			// hss_worker_timeout.
-			w.log.Error("error encountered", log.Error(err))
-			_ = json.NewEncoder(rw).Encode(&map[string]interface{}{
-				"error": Err{
-					Code:        http.StatusServiceUnavailable,
-					Reason:      "hss_worker_unknown_error",
-					Description: fmt.Sprintf("Worker (pid: %v) unknown error: %v", w.pid, err),
-				},
-			})
-		},
-	}
-	if err := http.ListenAndServe(*flagListen, handler); err != nil {
-		log.Scoped("server", "").Fatal("server exited", log.Error(err))
+// forwardToWorkers relays the given signals to the workers whenever the
+// stabilizer receives them, for -forward-signals.
+func forwardToWorkers(s *stabilizer.Stabilizer, logger log.Logger, signals []syscall.Signal) {
+	received := make(chan os.Signal, 1)
+	for _, sig := range signals {
+		signal.Notify(received, sig)
+	}
+	for sig := range received {
+		pids := s.SignalWorkers(sig.(syscall.Signal))
+		logger.Info("forwarded signal to workers", log.String("signal", sig.String()), log.Ints("pids", pids))
 	}
 }
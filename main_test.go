@@ -0,0 +1,46 @@
+package main
+
+import (
+	"io/ioutil"
+	"net"
+	"net/http"
+	"testing"
+	"time"
+)
+
+// TestReadHeaderTimeout checks that a client which does not finish sending
+// its request headers within -read-header-timeout is disconnected.
+func TestReadHeaderTimeout(t *testing.T) {
+	defer func(timeout time.Duration) { *flagReadHeaderTimeout = timeout }(*flagReadHeaderTimeout)
+	*flagReadHeaderTimeout = 200 * time.Millisecond
+
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	srv := newServer(l.Addr().String(), http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		t.Error("handler called for a partial request")
+	}))
+	go srv.Serve(l)
+	defer srv.Close()
+
+	conn, err := net.Dial("tcp", l.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	start := time.Now()
+	if _, err := conn.Write([]byte("GET / HT")); err != nil {
+		t.Fatal(err)
+	}
+	// The server closes the connection, or we give up waiting for it to.
+	if err := conn.SetReadDeadline(time.Now().Add(5 * time.Second)); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := ioutil.ReadAll(conn); err != nil {
+		t.Fatalf("connection not closed by the server: %v", err)
+	}
+	if elapsed := time.Since(start); elapsed < *flagReadHeaderTimeout {
+		t.Errorf("connection closed after %v, before the %v header timeout", elapsed, *flagReadHeaderTimeout)
+	}
+}
@@ -0,0 +1,114 @@
+// Package hsserr describes the errors http-server-stabilizer responds with
+// when it cannot get a response from a worker, so that Go clients calling
+// through it can recognize them without matching strings of their own.
+package hsserr
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"mime"
+	"net/http"
+	"strings"
+)
+
+// Header is set to "1" on every error response the stabilizer writes itself,
+// as opposed to passing on from a worker, including worker responses it
+// replaces with ReasonUpstreamError.
+const Header = "X-HSS-Error"
+
+// Reasons for which the stabilizer responds with an error, which are the
+// Reason of its Err.
+const (
+	// ReasonWorkerTimeout is for requests which timed out, after which
+	// their worker was killed.
+	ReasonWorkerTimeout = "hss_worker_timeout"
+	// ReasonWorkerUnknownError is for requests which failed for another
+	// reason, such as their worker being killed due to another request.
+	ReasonWorkerUnknownError = "hss_worker_unknown_error"
+	// ReasonNoWorkerAvailable is for requests which waited longer than
+	// -queue-timeout for a worker.
+	ReasonNoWorkerAvailable = "hss_no_worker_available"
+	// ReasonUpstreamError is for worker responses with a
+	// -upstream-5xx-as-error status, whose body is in the Err's Detail.
+	ReasonUpstreamError = "hss_upstream_error"
+	// ReasonRequestTooLarge is for requests with a body larger than
+	// -max-request-bytes.
+	ReasonRequestTooLarge = "hss_request_too_large"
+	// ReasonRequestBodyError is for requests whose body could not be read.
+	ReasonRequestBodyError = "hss_request_body_error"
+	// ReasonRateLimited is for requests beyond the client's -rate-limit.
+	ReasonRateLimited = "hss_rate_limited"
+	// ReasonOverloaded is for requests beyond -max-inflight.
+	ReasonOverloaded = "hss_overloaded"
+	// ReasonDraining is for requests rejected in drain mode with
+	// -drain-reject.
+	ReasonDraining = "hss_draining"
+	// ReasonNoPool is for requests matching no -pool when there is no
+	// worker command.
+	ReasonNoPool = "hss_no_pool"
+)
+
+// Err is the error returned to clients when a request could not be served by
+// a worker. This error type matches what Rocket uses (the Rust server we use
+// in syntect server)
+type Err struct {
+	// HTTP error code
+	Code int `json:"code"`
+	// Error string that can be matched on, one of the Reason constants
+	Reason string `json:"reason"`
+	// PII-safe human-readable description, which can be used for logging
+	Description string `json:"description"`
+	// ID of the request, also sent in the X-Request-ID response header
+	RequestID string `json:"request_id,omitempty"`
+	// Whether the request may succeed if retried as it is, e.g. because its
+	// worker was killed due to another request
+	Retriable bool `json:"retriable"`
+	// The body of the worker's response, for ReasonUpstreamError
+	Detail string `json:"detail,omitempty"`
+}
+
+// Error implements the error interface.
+func (e *Err) Error() string {
+	return fmt.Sprintf("%s (%d): %s", e.Reason, e.Code, e.Description)
+}
+
+// Response is the JSON body of an error response, in which the Err is
+// wrapped.
+type Response struct {
+	Error Err `json:"error"`
+}
+
+// Decode returns the error in the response if the stabilizer wrote it, and
+// reports whether it did. The body is read and replaced, so that it can
+// still be read by the caller.
+//
+// Only JSON error responses, which the stabilizer writes unless the request's
+// Accept header prefers HTML or plain text, carry the whole Err. For others,
+// the Err only has the Code, RequestID, and whether it is Retriable as told
+// by the Retry-After header.
+func Decode(resp *http.Response) (*Err, bool) {
+	if resp.Header.Get(Header) != "1" {
+		return nil, false
+	}
+	e := &Err{
+		Code:      resp.StatusCode,
+		RequestID: resp.Header.Get("X-Request-ID"),
+		Retriable: resp.Header.Get("Retry-After") != "",
+	}
+	if mediaType, _, _ := mime.ParseMediaType(resp.Header.Get("Content-Type")); !strings.EqualFold(mediaType, "application/json") || resp.Body == nil {
+		return e, true
+	}
+	body, err := ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+	resp.Body = ioutil.NopCloser(bytes.NewReader(body))
+	if err != nil {
+		return e, true
+	}
+	var r Response
+	if err := json.Unmarshal(body, &r); err != nil || r.Error.Reason == "" {
+		return e, true
+	}
+	return &r.Error, true
+}
@@ -0,0 +1,100 @@
+package stabilizer
+
+import (
+	"context"
+	"math/rand"
+	"net/http"
+	"time"
+
+	"github.com/sourcegraph/log"
+)
+
+// accessEntry collects what is logged about a request in the access log.
+type accessEntry struct {
+	// pr is the request as handled by ServeHTTP, or nil if it never got
+	// that far, and s the Stabilizer whose ServeHTTP handled it, which is
+	// that of a pool or variant if the request was sent to one.
+	pr *proxyRequest
+	s  *Stabilizer
+}
+
+type accessEntryKey struct{}
+
+// getAccessEntry returns the accessEntry stored in ctx by accessLog or
+// trackOutcome, or nil if neither was used.
+func getAccessEntry(ctx context.Context) *accessEntry {
+	entry, _ := ctx.Value(accessEntryKey{}).(*accessEntry)
+	return entry
+}
+
+// trackOutcome returns the accessEntry in which ServeHTTP will record how the
+// request went, and the request to pass on for it to do so.
+func trackOutcome(req *http.Request) (*accessEntry, *http.Request) {
+	if entry := getAccessEntry(req.Context()); entry != nil {
+		return entry, req
+	}
+	entry := &accessEntry{}
+	return entry, req.WithContext(context.WithValue(req.Context(), accessEntryKey{}, entry))
+}
+
+// succeeded reports whether the request got a response from its worker, as
+// opposed to e.g. timing out.
+func (e *accessEntry) succeeded() bool {
+	return e.pr != nil && (e.pr.outcome == outcomeOK || e.pr.outcome == outcomeUpstream)
+}
+
+// accessLog wraps next to log one entry per request once it has been served.
+// Successful requests are sampled at -access-log-sample, while failed ones
+// are always logged.
+func (s *Stabilizer) accessLog(next http.Handler) http.Handler {
+	logger := s.log.Scoped("access", "access log")
+	return http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		start := time.Now()
+		entry, tracked := trackOutcome(req)
+		recorder := &statusRecorder{ResponseWriter: rw}
+		next.ServeHTTP(recorder, tracked)
+
+		status := recorder.status
+		if status == 0 {
+			status = http.StatusOK
+		}
+		outcome := outcomeOK
+		if entry.pr != nil {
+			outcome = entry.pr.outcome
+		}
+		failed := outcome != outcomeOK || status >= 500
+		if !failed && rand.Float64() >= s.cfg.AccessLogSample {
+			return
+		}
+
+		fields := []log.Field{
+			log.String("method", req.Method),
+			log.String("path", req.URL.Path),
+			log.Int("status", status),
+			log.String("outcome", outcome),
+			log.Duration("duration", time.Since(start)),
+			log.Int64("bytes", recorder.bytes),
+		}
+		if pr := entry.pr; pr != nil {
+			fields = append(fields,
+				log.String("requestID", pr.id),
+				log.Duration("queueWait", pr.queueWait),
+				log.Bool("timeoutHeader", pr.timeoutRequested))
+			if w := pr.worker; w != nil {
+				fields = append(fields, log.Int("pid", w.pid))
+				if w.socket != "" {
+					fields = append(fields, log.String("socket", w.socket))
+				} else {
+					fields = append(fields, log.Int("port", w.port))
+				}
+			}
+		}
+		// Entries of traced requests have their trace ID.
+		entryLog := withTrace(tracked.Context(), logger)
+		if failed {
+			entryLog.Warn("request failed", fields...)
+		} else {
+			entryLog.Info("request", fields...)
+		}
+	})
+}
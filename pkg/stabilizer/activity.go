@@ -0,0 +1,137 @@
+package stabilizer
+
+import (
+	"context"
+	"io"
+	"sync"
+	"time"
+)
+
+// activityContext is a context which, like one returned by
+// context.WithTimeout, ends with context.DeadlineExceeded once its timeout
+// has passed, except that the timeout starts over whenever touch is called.
+// It is used for -timeout-resets-on-activity, so that a worker streaming a
+// response is not treated as stuck, and for -ws-idle-timeout.
+type activityContext struct {
+	context.Context
+	timeout time.Duration
+	done    chan struct{}
+
+	mu       sync.Mutex
+	timer    *time.Timer
+	deadline time.Time
+	err      error
+}
+
+// withActivityTimeout returns a context which ends once timeout has passed
+// without it being touched, or once parent ends.
+func withActivityTimeout(parent context.Context, timeout time.Duration) (*activityContext, context.CancelFunc) {
+	ctx := &activityContext{
+		Context:  parent,
+		timeout:  timeout,
+		done:     make(chan struct{}),
+		deadline: time.Now().Add(timeout),
+	}
+	ctx.timer = time.AfterFunc(timeout, func() { ctx.end(context.DeadlineExceeded) })
+	go func() {
+		select {
+		case <-parent.Done():
+			ctx.end(parent.Err())
+		case <-ctx.done:
+		}
+	}()
+	return ctx, func() { ctx.end(context.Canceled) }
+}
+
+// setTimeout changes the timeout to the given one, starting now. A zero
+// timeout means the context no longer times out.
+func (ctx *activityContext) setTimeout(timeout time.Duration) {
+	ctx.mu.Lock()
+	defer ctx.mu.Unlock()
+	if ctx.err != nil {
+		return
+	}
+	ctx.timeout = timeout
+	ctx.timer.Stop()
+	if timeout > 0 {
+		ctx.timer.Reset(timeout)
+		ctx.deadline = time.Now().Add(timeout)
+	} else {
+		ctx.deadline = time.Time{}
+	}
+}
+
+// touch restarts the timeout, unless the context has already ended.
+func (ctx *activityContext) touch() {
+	ctx.mu.Lock()
+	defer ctx.mu.Unlock()
+	if ctx.err != nil || ctx.timeout == 0 {
+		return
+	}
+	ctx.timer.Reset(ctx.timeout)
+	ctx.deadline = time.Now().Add(ctx.timeout)
+}
+
+func (ctx *activityContext) end(err error) {
+	ctx.mu.Lock()
+	defer ctx.mu.Unlock()
+	if ctx.err != nil {
+		return
+	}
+	ctx.err = err
+	ctx.timer.Stop()
+	close(ctx.done)
+}
+
+func (ctx *activityContext) Deadline() (time.Time, bool) {
+	ctx.mu.Lock()
+	defer ctx.mu.Unlock()
+	return ctx.deadline, !ctx.deadline.IsZero()
+}
+
+func (ctx *activityContext) Done() <-chan struct{} {
+	return ctx.done
+}
+
+func (ctx *activityContext) Err() error {
+	ctx.mu.Lock()
+	defer ctx.mu.Unlock()
+	return ctx.err
+}
+
+// activityReader touches its context whenever data is read from it.
+type activityReader struct {
+	io.ReadCloser
+	ctx *activityContext
+}
+
+func (r activityReader) Read(p []byte) (int, error) {
+	n, err := r.ReadCloser.Read(p)
+	if n > 0 {
+		r.ctx.touch()
+	}
+	return n, err
+}
+
+// activityConn touches its context whenever data is read from or written to
+// it.
+type activityConn struct {
+	io.ReadWriteCloser
+	ctx *activityContext
+}
+
+func (c activityConn) Read(p []byte) (int, error) {
+	n, err := c.ReadWriteCloser.Read(p)
+	if n > 0 {
+		c.ctx.touch()
+	}
+	return n, err
+}
+
+func (c activityConn) Write(p []byte) (int, error) {
+	n, err := c.ReadWriteCloser.Write(p)
+	if n > 0 {
+		c.ctx.touch()
+	}
+	return n, err
+}
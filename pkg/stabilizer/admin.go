@@ -0,0 +1,448 @@
+package stabilizer
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/sourcegraph/log"
+)
+
+// workersAlive returns the number of worker processes that are currently
+// running.
+func (s *Stabilizer) workersAlive() int {
+	s.workerByAddrMu.RLock()
+	defer s.workerByAddrMu.RUnlock()
+	alive := 0
+	for _, w := range s.workerByAddr {
+		if w.alive() {
+			alive++
+		}
+	}
+	return alive
+}
+
+// workersReady returns the number of workers that are ready to serve
+// requests.
+func (s *Stabilizer) workersReady() int {
+	s.workerByAddrMu.RLock()
+	defer s.workerByAddrMu.RUnlock()
+	ready := 0
+	for _, w := range s.workerByAddr {
+		w.mu.Lock()
+		if w.ready && w.alive() {
+			ready++
+		}
+		w.mu.Unlock()
+	}
+	return ready
+}
+
+// serveHealthz reports how many workers are alive. It responds with 503 if
+// fewer than -healthy-min-workers are alive, of any pool, so that it can be
+// used as a liveness probe.
+func (s *Stabilizer) serveHealthz(rw http.ResponseWriter, r *http.Request) {
+	alive, healthy := s.countWorkers((*Stabilizer).workersAlive)
+	expected, _ := s.countWorkers((*Stabilizer).targetWorkers)
+	status := http.StatusOK
+	if !healthy {
+		status = http.StatusServiceUnavailable
+	}
+	rw.Header().Set("Content-Type", "application/json")
+	rw.WriteHeader(status)
+	_ = json.NewEncoder(rw).Encode(&struct {
+		WorkersAlive    int `json:"workers_alive"`
+		WorkersExpected int `json:"workers_expected"`
+	}{
+		WorkersAlive:    alive,
+		WorkersExpected: expected,
+	})
+}
+
+// Stats is a snapshot of the state of a Stabilizer, for debugging.
+type Stats struct {
+	WorkersTarget int `json:"workers_target"`
+	WorkersAlive  int `json:"workers_alive"`
+	WorkersReady  int `json:"workers_ready"`
+
+	// PoolSize is the number of workers accepting requests, AvailableSlots
+	// the number of requests they could be handed right away, and Queued
+	// the number of requests waiting for a worker.
+	PoolSize       int `json:"pool_size"`
+	AvailableSlots int `json:"available_slots"`
+	Queued         int `json:"queued"`
+
+	// Restarts is the number of worker restarts by reason, as counted by
+	// hss_worker_restarts.
+	Restarts map[string]int `json:"restarts"`
+	Draining bool           `json:"draining"`
+
+	// Variants and Pools are the stats of the -canary-command and
+	// -mirror-command workers, and of each -pool, by name.
+	Variants map[string]Stats `json:"variants,omitempty"`
+	Pools    map[string]Stats `json:"pools,omitempty"`
+}
+
+// Stats returns a snapshot of the state of the stabilizer.
+func (s *Stabilizer) Stats() Stats {
+	stats := Stats{
+		WorkersTarget: s.targetWorkers(),
+		WorkersAlive:  s.workersAlive(),
+		WorkersReady:  s.workersReady(),
+		PoolSize:      s.pool.size(),
+		Restarts:      make(map[string]int),
+		Draining:      s.Draining(),
+	}
+	stats.AvailableSlots, stats.Queued = s.pool.stats()
+	s.restartCountMu.Lock()
+	for reason, n := range s.restartCount {
+		stats.Restarts[reason] = n
+	}
+	s.restartCountMu.Unlock()
+	for _, v := range s.variants() {
+		if stats.Variants == nil {
+			stats.Variants = make(map[string]Stats)
+		}
+		stats.Variants[v.variant] = v.Stats()
+	}
+	for _, p := range s.pools {
+		if stats.Pools == nil {
+			stats.Pools = make(map[string]Stats)
+		}
+		stats.Pools[p.Name] = p.s.Stats()
+	}
+	return stats
+}
+
+// Worker states reported by /workers.
+const (
+	stateStarting = "starting"
+	stateReady    = "ready"
+	stateBusy     = "busy"
+	stateDraining = "draining"
+	stateDead     = "dead"
+
+	// stateRecycling is used for a worker that is still serving requests
+	// while its replacement starts.
+	stateRecycling = "recycling"
+
+	// stateEjected is used for an -upstreams server which is not sent
+	// requests until it passes a health check again.
+	stateEjected = "ejected"
+)
+
+// workerStatus describes a worker in the /workers response.
+type workerStatus struct {
+	Variant       string     `json:"variant,omitempty"`
+	Index         int        `json:"index"`
+	PID           int        `json:"pid"`
+	Upstream      string     `json:"upstream,omitempty"`
+	Port          int        `json:"port,omitempty"`
+	Socket        string     `json:"socket,omitempty"`
+	State         string     `json:"state"`
+	Started       time.Time  `json:"started"`
+	Version       string     `json:"version,omitempty"`
+	Requests      int        `json:"requests"`
+	Responses5xx  int        `json:"responses_5xx"`
+	Inflight      int        `json:"inflight"`
+	Concurrency   int        `json:"concurrency"`
+	DrainReason   string     `json:"drain_reason,omitempty"`
+	RestartReason string     `json:"restart_reason,omitempty"`
+	RestartTime   *time.Time `json:"restart_time,omitempty"`
+}
+
+// workerStatus returns the worker's current status.
+func (s *Stabilizer) workerStatus(w *worker) workerStatus {
+	inflight, concurrency := s.pool.load(w)
+	draining := s.pool.draining(w)
+	drainReason := s.pool.drainReason(w)
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	state := stateReady
+	switch {
+	case !w.alive():
+		state = stateDead
+	case draining:
+		state = stateDraining
+	case w.recycleReason != "":
+		state = stateRecycling
+	case !w.ready && w.upstream != "" && w.restartReason != "":
+		state = stateEjected
+	case !w.ready:
+		state = stateStarting
+	case inflight > 0:
+		state = stateBusy
+	}
+	status := workerStatus{
+		Index:         w.index,
+		PID:           w.pid,
+		Upstream:      w.upstream,
+		Port:          w.port,
+		Socket:        w.socket,
+		State:         state,
+		Started:       w.started,
+		Version:       w.version,
+		Requests:      w.requests,
+		Responses5xx:  w.responses5xx,
+		Inflight:      inflight,
+		Concurrency:   concurrency,
+		DrainReason:   drainReason,
+		RestartReason: w.restartReason,
+	}
+	if !w.restartTime.IsZero() {
+		status.RestartTime = &w.restartTime
+	}
+	return status
+}
+
+// serveWorkers lists the workers and their state as JSON. If a canary or
+// mirror is configured, its workers follow the stable ones, and each
+// worker's variant is given. If pools are configured, the workers are listed
+// by pool, with those of the stabilizer's own command as the default pool.
+func (s *Stabilizer) serveWorkers(rw http.ResponseWriter, r *http.Request) {
+	var resp interface{} = s.variantStatuses()
+	if len(s.pools) > 0 {
+		byPool := make(map[string][]workerStatus)
+		if s.command != "" {
+			byPool[poolDefault] = s.variantStatuses()
+		}
+		for _, p := range s.pools {
+			byPool[p.Name] = p.s.workerStatuses()
+		}
+		resp = byPool
+	}
+
+	rw.Header().Set("Content-Type", "application/json")
+	_ = json.NewEncoder(rw).Encode(resp)
+}
+
+// variantStatuses returns the status of each worker, followed by those of the
+// other variants if any, which are labelled with their variant.
+func (s *Stabilizer) variantStatuses() []workerStatus {
+	workers := s.workerStatuses()
+	if variants := s.variants(); len(variants) > 0 {
+		for i := range workers {
+			workers[i].Variant = variantStable
+		}
+		for _, v := range variants {
+			for _, status := range v.workerStatuses() {
+				status.Variant = v.variant
+				workers = append(workers, status)
+			}
+		}
+	}
+	return workers
+}
+
+// workerStatuses returns the status of each worker, ordered by slot.
+func (s *Stabilizer) workerStatuses() []workerStatus {
+	s.workerByAddrMu.RLock()
+	workers := make([]workerStatus, 0, len(s.workerByAddr))
+	for _, w := range s.workerByAddr {
+		workers = append(workers, s.workerStatus(w))
+	}
+	s.workerByAddrMu.RUnlock()
+	sort.Slice(workers, func(i, j int) bool {
+		return workers[i].Index < workers[j].Index
+	})
+	return workers
+}
+
+// serveWorkerAction handles POST /workers/{pid}/restart, which restarts a
+// single worker, and POST /workers/restart-all, which restarts all workers one
+// at a time.
+func (s *Stabilizer) serveWorkerAction(rw http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		http.Error(rw, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	var (
+		restarted []int
+		err       error
+	)
+	path := strings.TrimPrefix(r.URL.Path, "/workers/")
+	switch {
+	case path == "restart-all":
+		restarted, err = s.restartAll(reasonAdmin)
+		for _, child := range s.childStabilizers() {
+			if err != nil {
+				break
+			}
+			var childRestarted []int
+			childRestarted, err = child.restartAll(reasonAdmin)
+			restarted = append(restarted, childRestarted...)
+		}
+
+	case strings.HasSuffix(path, "/restart"):
+		// Workers of -upstreams have no pid, so don't let a pid which
+		// is not valid pick one of them.
+		var pid int
+		pid, err = strconv.Atoi(strings.TrimSuffix(path, "/restart"))
+		if err != nil || pid <= 0 {
+			http.Error(rw, "invalid worker pid", http.StatusBadRequest)
+			return
+		}
+		w := s.workerByPID(pid)
+		if w == nil {
+			http.Error(rw, "no such worker", http.StatusNotFound)
+			return
+		}
+		if w.kill(reasonAdmin) {
+			w.log.Info("restarting due to admin request")
+			restarted = append(restarted, w.pid)
+		}
+
+	default:
+		http.NotFound(rw, r)
+		return
+	}
+
+	resp := struct {
+		Restarted []int  `json:"restarted"`
+		Error     string `json:"error,omitempty"`
+	}{Restarted: restarted}
+	rw.Header().Set("Content-Type", "application/json")
+	if err != nil {
+		resp.Error = err.Error()
+		rw.WriteHeader(http.StatusInternalServerError)
+	}
+	_ = json.NewEncoder(rw).Encode(&resp)
+}
+
+// workerByPID returns the live worker, of any variant or pool, with the given
+// pid, or nil.
+func (s *Stabilizer) workerByPID(pid int) *worker {
+	s.workerByAddrMu.RLock()
+	defer s.workerByAddrMu.RUnlock()
+	for _, w := range s.workerByAddr {
+		if w.pid == pid && w.alive() {
+			return w
+		}
+	}
+	for _, child := range s.childStabilizers() {
+		if w := child.workerByPID(pid); w != nil {
+			return w
+		}
+	}
+	return nil
+}
+
+// restartAll restarts every worker for the given reason, one at a time,
+// waiting for each worker's replacement to become ready before moving on to
+// the next so that capacity never drops by more than one worker. It returns
+// the pids of the workers that were restarted.
+func (s *Stabilizer) restartAll(reason string) ([]int, error) {
+	if len(s.upstreams) > 0 {
+		return nil, errUpstreams
+	}
+	s.restartAllMu.Lock()
+	defer s.restartAllMu.Unlock()
+
+	workers := s.workersByIndex()
+	s.log.Info("rolling restart started", log.String("reason", reason), log.Int("workers", len(workers)))
+	var restarted []int
+	for _, w := range workers {
+		if !w.kill(reason) {
+			// Already dead or restarting.
+			continue
+		}
+		restarted = append(restarted, w.pid)
+		if err := s.waitReplaced(w); err != nil {
+			s.log.Error("rolling restart aborted", log.Int("pid", w.pid), log.Error(err))
+			return restarted, err
+		}
+	}
+	s.log.Info("rolling restart complete", log.String("reason", reason), log.Ints("pids", restarted))
+	return restarted, nil
+}
+
+// workersByIndex returns the workers, ordered by slot.
+func (s *Stabilizer) workersByIndex() []*worker {
+	s.workerByAddrMu.RLock()
+	var workers []*worker
+	for _, w := range s.workerByAddr {
+		workers = append(workers, w)
+	}
+	s.workerByAddrMu.RUnlock()
+	sort.Slice(workers, func(i, j int) bool {
+		return workers[i].index < workers[j].index
+	})
+	return workers
+}
+
+// waitReplaced waits for a ready worker to replace old in its slot.
+func (s *Stabilizer) waitReplaced(old *worker) error {
+	timeout := time.After(s.cfg.KillGrace + s.cfg.WorkerStartupTimeout)
+	ticker := time.NewTicker(readyPollInterval)
+	defer ticker.Stop()
+	for {
+		if s.slotReady(old.index, old) {
+			return nil
+		}
+		select {
+		case <-s.ctx.Done():
+			return s.ctx.Err()
+		case <-timeout:
+			return fmt.Errorf("replacement for worker (pid: %v) did not become ready in time", old.pid)
+		case <-ticker.C:
+		}
+	}
+}
+
+// slotReady reports whether a ready worker other than old is running in the
+// given slot.
+func (s *Stabilizer) slotReady(index int, old *worker) bool {
+	s.workerByAddrMu.RLock()
+	defer s.workerByAddrMu.RUnlock()
+	for _, w := range s.workerByAddr {
+		if w.index != index || w == old {
+			continue
+		}
+		w.mu.Lock()
+		ready := w.ready
+		w.mu.Unlock()
+		if ready && w.alive() {
+			return true
+		}
+	}
+	return false
+}
+
+// serveConfigWorkers reports the number of workers that should be running on
+// GET, and changes it on PUT with a body like {"count": 4}.
+func (s *Stabilizer) serveConfigWorkers(rw http.ResponseWriter, r *http.Request) {
+	var config struct {
+		Count int `json:"count"`
+	}
+	switch r.Method {
+	case "GET":
+	case "PUT":
+		if s.autoscaling() {
+			http.Error(rw, "the number of workers is autoscaled between -min-workers and -max-workers", http.StatusConflict)
+			return
+		}
+		if err := json.NewDecoder(r.Body).Decode(&config); err != nil {
+			http.Error(rw, fmt.Sprintf("invalid request body: %v", err), http.StatusBadRequest)
+			return
+		}
+		// Update the configuration, so that it reports the new number
+		// of workers and a reload of -config changes it from there.
+		if err := s.Update(WithWorkers(config.Count)); err != nil {
+			http.Error(rw, err.Error(), http.StatusBadRequest)
+			return
+		}
+	default:
+		http.Error(rw, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	config.Count = s.targetWorkers()
+	rw.Header().Set("Content-Type", "application/json")
+	_ = json.NewEncoder(rw).Encode(&config)
+}
@@ -0,0 +1,82 @@
+package stabilizer
+
+import (
+	"hash/fnv"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// affinityQueryPrefix marks an -affinity-key which names a query parameter
+// rather than a header.
+const affinityQueryPrefix = "query:"
+
+// ringReplicas is the number of points each worker has on the hash ring, so
+// that keys are spread evenly between workers.
+const ringReplicas = 64
+
+// hashRing maps keys to workers by consistent hashing, so that when workers
+// come and go most keys stay with the same worker. Workers are placed on the
+// ring by their slot, so a restarted worker takes over its predecessor's keys.
+type hashRing struct {
+	hashes  []uint32
+	workers []*worker
+}
+
+// newHashRing returns a hash ring over the given workers.
+func newHashRing(workers []*worker) *hashRing {
+	r := &hashRing{}
+	points := make(map[uint32]*worker, len(workers)*ringReplicas)
+	for _, w := range workers {
+		for i := 0; i < ringReplicas; i++ {
+			h := ringHash(strconv.Itoa(w.index) + "-" + strconv.Itoa(i))
+			points[h] = w
+			r.hashes = append(r.hashes, h)
+		}
+	}
+	sort.Slice(r.hashes, func(i, j int) bool { return r.hashes[i] < r.hashes[j] })
+	for _, h := range r.hashes {
+		r.workers = append(r.workers, points[h])
+	}
+	return r
+}
+
+// lookup returns the worker the key maps to, or nil if the ring is empty.
+func (r *hashRing) lookup(key string) *worker {
+	if len(r.hashes) == 0 {
+		return nil
+	}
+	h := ringHash(key)
+	i := sort.Search(len(r.hashes), func(i int) bool { return r.hashes[i] >= h })
+	if i == len(r.hashes) {
+		i = 0
+	}
+	return r.workers[i]
+}
+
+// ringHash hashes a key or point on the ring. FNV alone leaves similar short
+// strings close together, so its result is mixed with MurmurHash3's
+// finalizer to spread them around the ring.
+func ringHash(s string) uint32 {
+	h := fnv.New32a()
+	h.Write([]byte(s))
+	x := h.Sum32()
+	x ^= x >> 16
+	x *= 0x85ebca6b
+	x ^= x >> 13
+	x *= 0xc2b2ae35
+	x ^= x >> 16
+	return x
+}
+
+// affinityKey returns the -affinity-key of a request, or "" if it has none.
+func (s *Stabilizer) affinityKey(req *http.Request) string {
+	if s.cfg.AffinityKey == "" {
+		return ""
+	}
+	if strings.HasPrefix(s.cfg.AffinityKey, affinityQueryPrefix) {
+		return req.URL.Query().Get(strings.TrimPrefix(s.cfg.AffinityKey, affinityQueryPrefix))
+	}
+	return req.Header.Get(s.cfg.AffinityKey)
+}
@@ -0,0 +1,207 @@
+package stabilizer
+
+import (
+	"fmt"
+	"os"
+	"regexp"
+	"strings"
+	"text/template"
+)
+
+// DefaultWorkerEnvRedact is the default Config.WorkerEnvRedact.
+const DefaultWorkerEnvRedact = `(?i)secret|token|passw|credential|key|auth`
+
+// argTemplates are the worker's arguments parsed as templates, by parseArgs.
+type argTemplates []*template.Template
+
+// argsData is what templates in the worker's arguments are executed with.
+type argsData struct {
+	Host        string
+	Port        int
+	Socket      string
+	WorkerIndex int
+	Hostname    string
+
+	// allocate allocates the extra ports, which are kept in ports by number
+	// so that each is the same in every argument.
+	allocate func() (int, error)
+	ports    map[int]int
+}
+
+// port returns the nth port of the worker, allocating it if needed.
+func (d *argsData) port(n int) (int, error) {
+	if port, ok := d.ports[n]; ok {
+		return port, nil
+	}
+	port, err := d.allocate()
+	if err != nil {
+		return 0, fmt.Errorf("failed to allocate port %d: %v", n, err)
+	}
+	d.ports[n] = port
+	return port, nil
+}
+
+// Port2 to Port9 are extra ports for the worker to listen on, e.g. for a
+// debug endpoint, which are allocated when used.
+func (d *argsData) Port2() (int, error) { return d.port(2) }
+func (d *argsData) Port3() (int, error) { return d.port(3) }
+func (d *argsData) Port4() (int, error) { return d.port(4) }
+func (d *argsData) Port5() (int, error) { return d.port(5) }
+func (d *argsData) Port6() (int, error) { return d.port(6) }
+func (d *argsData) Port7() (int, error) { return d.port(7) }
+func (d *argsData) Port8() (int, error) { return d.port(8) }
+func (d *argsData) Port9() (int, error) { return d.port(9) }
+
+// replaceArgs replaces {{.Host}}, {{.Port}} and {{.Socket}} in an argument.
+func replaceArgs(arg, host, port, socket string) string {
+	arg = strings.Replace(arg, "{{.Host}}", host, -1)
+	arg = strings.Replace(arg, "{{.Port}}", port, -1)
+	return strings.Replace(arg, "{{.Socket}}", socket, -1)
+}
+
+// parseArgs parses the worker's arguments, or environment variables, which
+// use more than {{.Host}}, {{.Port}} and {{.Socket}} as templates, and checks
+// that they can be executed. The others are left nil, and only have those
+// replaced, as they always were.
+func parseArgs(args []string) (argTemplates, error) {
+	templates := make(argTemplates, len(args))
+	data := &argsData{allocate: func() (int, error) { return 0, nil }, ports: make(map[int]int)}
+	for i, arg := range args {
+		if !strings.Contains(replaceArgs(arg, "", "", ""), "{{") {
+			continue
+		}
+		t, err := template.New("arg").Option("missingkey=error").Parse(arg)
+		if err == nil {
+			err = t.Execute(new(strings.Builder), data)
+		}
+		if err != nil {
+			return nil, fmt.Errorf("%q: %v", arg, err)
+		}
+		templates[i] = t
+	}
+	return templates, nil
+}
+
+// execute returns the arguments with their templates executed with data.
+func (t argTemplates) execute(args []string, data *argsData) ([]string, error) {
+	executed := make([]string, len(args))
+	for i, arg := range args {
+		if t[i] == nil {
+			executed[i] = replaceArgs(arg, data.Host, fmt.Sprint(data.Port), data.Socket)
+			continue
+		}
+		var b strings.Builder
+		if err := t[i].Execute(&b, data); err != nil {
+			return nil, err
+		}
+		executed[i] = b.String()
+	}
+	return executed, nil
+}
+
+// workerCommand is what a worker is run with.
+type workerCommand struct {
+	args []string
+	// env is the worker's environment, or nil if it inherits the
+	// stabilizer's.
+	env []string
+	// extraPorts are the ports allocated for the worker other than the one
+	// it listens on.
+	extraPorts []int
+	// dir is the worker's working directory, or empty if it is the
+	// stabilizer's. ownDir reports whether dir was created for the worker
+	// from a -worker-dir template, to be removed once it is done.
+	dir    string
+	ownDir bool
+}
+
+// workerCommand returns what a worker in the given slot, which listens on the
+// given port or socket, is run with.
+func (s *Stabilizer) workerCommand(index, port int, socket string) (workerCommand, error) {
+	data := &argsData{
+		Host:        s.cfg.WorkerHost,
+		Port:        port,
+		Socket:      socket,
+		WorkerIndex: index,
+		Hostname:    s.hostname,
+		allocate:    s.ports.allocate,
+		ports:       make(map[int]int),
+	}
+	var (
+		wc  workerCommand
+		err error
+	)
+	wc.args, err = s.argTemplates.execute(s.args, data)
+	cpusEnv := s.cpusEnv()
+	if err == nil && (len(s.cfg.WorkerEnv) > 0 || s.cfg.WorkerEnvClear || len(cpusEnv) > 0) {
+		wc.env, err = s.envTemplates.execute(s.cfg.WorkerEnv, data)
+		// -worker-env takes precedence over -worker-cpus-env.
+		wc.env = append(cpusEnv, wc.env...)
+		if !s.cfg.WorkerEnvClear {
+			wc.env = append(os.Environ(), wc.env...)
+		}
+	}
+	if err == nil && s.cfg.WorkerDir != "" {
+		var dir []string
+		dir, err = s.dirTemplate.execute([]string{s.cfg.WorkerDir}, data)
+		if err == nil && strings.Contains(s.cfg.WorkerDir, "{{") {
+			wc.dir, wc.ownDir = dir[0], true
+			s.useWorkerDir(wc.dir)
+			err = os.MkdirAll(wc.dir, 0755)
+			if err == nil {
+				err = s.chownForWorkers(wc.dir)
+			}
+			if err != nil {
+				// Don't leave the directory behind, as no worker
+				// will use it.
+				s.workerByAddrMu.Lock()
+				_ = s.releaseWorkerDir(wc.dir)
+				s.workerByAddrMu.Unlock()
+			}
+		} else if err == nil {
+			wc.dir = dir[0]
+		}
+	}
+	for _, port := range data.ports {
+		wc.extraPorts = append(wc.extraPorts, port)
+	}
+	if err != nil {
+		for _, port := range wc.extraPorts {
+			s.ports.release(port)
+		}
+		return workerCommand{}, err
+	}
+	return wc, nil
+}
+
+// checkEnv returns an error if the -worker-env variables are not of the form
+// KEY=VALUE.
+func checkEnv(env []string) error {
+	for _, kv := range env {
+		if i := strings.Index(kv, "="); i <= 0 {
+			return fmt.Errorf("%q must be of the form KEY=VALUE", kv)
+		}
+	}
+	return nil
+}
+
+// redactEnv returns the environment with the values of the variables whose
+// names match pattern, -worker-env-redact, replaced, so that it can be
+// logged.
+func redactEnv(env []string, pattern *regexp.Regexp) []string {
+	redacted := make([]string, len(env))
+	for i, kv := range env {
+		redacted[i] = kv
+		if j := strings.Index(kv, "="); j > 0 && pattern != nil && pattern.MatchString(kv[:j]) {
+			redacted[i] = kv[:j+1] + "REDACTED"
+		}
+	}
+	return redacted
+}
+
+// hostname returns the hostname of the machine, or an empty string if it is
+// not known.
+func hostname() string {
+	h, _ := os.Hostname()
+	return h
+}
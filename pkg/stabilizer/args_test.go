@@ -0,0 +1,138 @@
+package stabilizer
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/sourcegraph/log/logtest"
+)
+
+// getEnv returns the environment of the worker which served a request to
+// /env, and its pid.
+func getEnv(t *testing.T, url string) (int, map[string]string) {
+	t.Helper()
+	resp, err := http.Get(url + "/env")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	var r testWorkerResponse
+	if err := json.NewDecoder(resp.Body).Decode(&r); err != nil {
+		t.Fatal(err)
+	}
+	env := make(map[string]string)
+	for _, kv := range r.Env {
+		if i := strings.Index(kv, "="); i > 0 {
+			env[kv[:i]] = kv[i+1:]
+		}
+	}
+	return r.PID, env
+}
+
+// TestWorkerEnv checks that each worker sees the -worker-env variables, with
+// its own values substituted.
+func TestWorkerEnv(t *testing.T) {
+	os.Setenv("HSS_TEST_INHERITED", "1")
+	defer os.Unsetenv("HSS_TEST_INHERITED")
+	cfg := testConfig()
+	cfg.Workers = 2
+	cfg.WorkerEnv = append(cfg.WorkerEnv,
+		"WORKER_PORT={{.Port}}",
+		"CACHE_DIR=/tmp/cache-{{.WorkerIndex}}",
+		"WORKER_ADDR={{.Host}}:{{.Port}}")
+	s, srv, stop := startStabilizer(t, cfg)
+	defer stop()
+	waitFor(t, 10*time.Second, "both workers to be ready", func() bool {
+		return s.pool.size() == 2
+	})
+
+	type slot struct{ index, port int }
+	slots := make(map[int]slot)
+	s.pool.mu.Lock()
+	for _, w := range s.pool.workers {
+		slots[w.pid] = slot{w.index, w.port}
+	}
+	s.pool.mu.Unlock()
+
+	// Requests are handed to the workers in turn.
+	seen := make(map[int]bool)
+	for i := 0; i < 10 && len(seen) < 2; i++ {
+		pid, env := getEnv(t, srv.URL)
+		seen[pid] = true
+		want := map[string]string{
+			"WORKER_PORT":        fmt.Sprint(slots[pid].port),
+			"CACHE_DIR":          fmt.Sprintf("/tmp/cache-%d", slots[pid].index),
+			"WORKER_ADDR":        fmt.Sprintf("%s:%d", cfg.WorkerHost, slots[pid].port),
+			"HSS_TEST_INHERITED": "1",
+		}
+		for name, value := range want {
+			if env[name] != value {
+				t.Errorf("worker %v: got %s=%q, want %q", pid, name, env[name], value)
+			}
+		}
+	}
+}
+
+// TestWorkerEnvClear checks that with -worker-env-clear, workers only see the
+// -worker-env variables.
+func TestWorkerEnvClear(t *testing.T) {
+	os.Setenv("HSS_TEST_INHERITED", "1")
+	defer os.Unsetenv("HSS_TEST_INHERITED")
+	cfg := testConfig()
+	cfg.WorkerEnvClear = true
+	cfg.WorkerEnv = append(cfg.WorkerEnv, "WORKER_PORT={{.Port}}")
+	_, srv, stop := startStabilizer(t, cfg)
+	defer stop()
+
+	_, env := getEnv(t, srv.URL)
+	if _, ok := env["HSS_TEST_INHERITED"]; ok {
+		t.Error("worker inherited the environment despite -worker-env-clear")
+	}
+	if env["WORKER_PORT"] == "" {
+		t.Error("worker did not see the -worker-env variables")
+	}
+}
+
+// TestSharedWorkerDir checks that a templated -worker-dir which is the same
+// for several workers is only removed once none of them uses it, including
+// workers which are still starting.
+func TestSharedWorkerDir(t *testing.T) {
+	tmp, err := ioutil.TempDir("", "hss-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tmp)
+	cfg := testConfig()
+	cfg.WorkerDir = filepath.Join(tmp, "shared{{if .WorkerIndex}}{{end}}")
+	s := New(WithConfig(cfg), WithLogger(logtest.NoOp(t)), WithRegisterer(nil))
+
+	var workers []*worker
+	for i := 0; i < 2; i++ {
+		wc, err := s.workerCommand(i, 0, "")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !wc.ownDir {
+			t.Fatal("templated -worker-dir not owned by the worker")
+		}
+		workers = append(workers, &worker{log: logtest.NoOp(t), index: i, dir: wc.dir})
+	}
+	dir := workers[0].dir
+
+	// The second worker has not been handed out yet.
+	s.forgetWorker(workers[0])
+	if _, err := os.Stat(dir); err != nil {
+		t.Fatalf("dir removed while another worker uses it: %v", err)
+	}
+	s.forgetWorker(workers[1])
+	if _, err := os.Stat(dir); !os.IsNotExist(err) {
+		t.Fatalf("dir not removed once no worker uses it: %v", err)
+	}
+}
@@ -0,0 +1,133 @@
+package stabilizer
+
+import (
+	"errors"
+	"time"
+
+	"github.com/sourcegraph/log"
+)
+
+// autoscaleInterval is how often the autoscaler looks at how busy the workers
+// are.
+const autoscaleInterval = time.Second
+
+// Triggers of autoscaling decisions, which label metrics.
+const (
+	triggerQueueWait  = "queue_wait"
+	triggerSaturation = "saturation"
+	triggerRequest    = "request"
+	triggerIdle       = "idle"
+)
+
+// autoscaling reports whether the number of workers varies between
+// -min-workers and -max-workers.
+func (s *Stabilizer) autoscaling() bool {
+	return s.cfg.MaxWorkers > 0
+}
+
+// checkAutoscaling returns an error if -min-workers and -max-workers or the
+// thresholds for scaling between them are not valid.
+func checkAutoscaling(cfg Config) error {
+	switch {
+	case cfg.MinWorkers < 0:
+		return errors.New("the minimum number of workers must not be negative")
+	case cfg.MinWorkers > cfg.MaxWorkers:
+		return errors.New("the minimum number of workers must not be more than the maximum")
+	case cfg.ScaleUpQueueWait <= 0, cfg.ScaleUpAfter <= 0, cfg.ScaleDownIdle <= 0:
+		return errors.New("the scale up queue wait, scale up after and scale down idle durations must be positive")
+	case cfg.ScaleUpSaturation <= 0 || cfg.ScaleUpSaturation > 1:
+		return errors.New("the scale up saturation must be more than 0 and at most 1")
+	}
+	return nil
+}
+
+// autoscale adds a worker, up to -max-workers, whenever requests have been
+// waiting for -scale-up-queue-wait or the workers have been serving
+// -scale-up-saturation of their capacity for -scale-up-after, and drains one,
+// down to -min-workers, whenever the least recently used worker has been idle
+// for -scale-down-idle. A worker counts as used from when it was added, so
+// one is not scaled down right after being scaled up. With no workers at
+// all, one is added as soon as a request arrives. It returns once the
+// stabilizer is shut down.
+func (s *Stabilizer) autoscale() {
+	ticker := time.NewTicker(autoscaleInterval)
+	defer ticker.Stop()
+	var busySince time.Time
+	for {
+		select {
+		case <-s.ctx.Done():
+			return
+		case <-ticker.C:
+		}
+		queueWait, saturation, queued := s.pool.pressure()
+		s.metrics.autoscaleQueueWait.Set(queueWait.Seconds())
+		s.metrics.autoscaleSaturation.Set(saturation)
+
+		target := s.targetWorkers()
+		trigger, value := "", 0.0
+		switch {
+		case queueWait >= s.cfg.ScaleUpQueueWait:
+			trigger, value = triggerQueueWait, queueWait.Seconds()
+		case saturation >= s.cfg.ScaleUpSaturation:
+			trigger, value = triggerSaturation, saturation
+		}
+		if trigger == "" || s.pool.size() < target {
+			// Workers which are still starting will take some of the
+			// load, so don't count it against them.
+			busySince = time.Time{}
+		} else if busySince.IsZero() {
+			busySince = time.Now()
+		}
+
+		switch {
+		case target == 0 && queued > 0 && target < s.cfg.MaxWorkers:
+			s.scaleWorkers(target+1, triggerRequest, float64(queued))
+		case !busySince.IsZero() && time.Since(busySince) >= s.cfg.ScaleUpAfter && target < s.cfg.MaxWorkers:
+			s.scaleWorkers(target+1, trigger, value)
+		case trigger == "" && target > s.cfg.MinWorkers:
+			idle, ok := s.slotIdle(target - 1)
+			if !ok || idle < s.cfg.ScaleDownIdle {
+				continue
+			}
+			s.scaleWorkers(target-1, triggerIdle, idle.Seconds())
+		default:
+			continue
+		}
+		busySince = time.Time{}
+	}
+}
+
+// scaleWorkers changes the number of workers to n because of the value of
+// the given trigger.
+func (s *Stabilizer) scaleWorkers(n int, trigger string, value float64) {
+	from := s.targetWorkers()
+	direction := "up"
+	if n < from {
+		direction = "down"
+	}
+	s.log.Info("autoscaling workers",
+		log.String("direction", direction),
+		log.Int("from", from),
+		log.Int("to", n),
+		log.String("trigger", trigger),
+		log.Float64("value", value))
+	s.metrics.autoscaleCounter.WithLabelValues(direction, trigger).Inc()
+	s.ensureWorkers(n)
+}
+
+// slotIdle returns how long the worker in the slot with the given index has
+// not been serving requests. It reports false if the slot has no worker
+// accepting requests, or it is serving some.
+func (s *Stabilizer) slotIdle(index int) (time.Duration, bool) {
+	s.workerByAddrMu.RLock()
+	defer s.workerByAddrMu.RUnlock()
+	for _, w := range s.workerByAddr {
+		if w.index != index {
+			continue
+		}
+		if since, ok := s.pool.idleSince(w); ok {
+			return time.Since(since), true
+		}
+	}
+	return 0, false
+}
@@ -0,0 +1,63 @@
+package stabilizer
+
+import (
+	"encoding/json"
+	"net/http"
+	"runtime"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// BuildInfo tells which build of the program embedding a Stabilizer is
+// running.
+type BuildInfo struct {
+	// Version is the version of the program, e.g. v1.2.3, Commit the VCS
+	// revision it was built from and Date when it was built or committed.
+	Version string `json:"version"`
+	Commit  string `json:"commit"`
+	Date    string `json:"date"`
+}
+
+// buildInfoMetric returns the hss_build_info metric, which is always 1 and
+// labeled with the build info.
+func (s *Stabilizer) buildInfoMetric(namespace string) prometheus.Collector {
+	return prometheus.NewGaugeFunc(prometheus.GaugeOpts{
+		Namespace: namespace,
+		Name:      "hss_build_info",
+		Help:      "Always 1, labeled with the version, commit and build date of the stabilizer and the Go version it was built with",
+		ConstLabels: prometheus.Labels{
+			"version":   s.buildInfo.Version,
+			"commit":    s.buildInfo.Commit,
+			"date":      s.buildInfo.Date,
+			"goversion": runtime.Version(),
+		},
+	}, func() float64 { return 1 })
+}
+
+// serveBuildInfo handles GET /buildinfo, which tells which build of the
+// stabilizer is running, and the worker command it runs along with its
+// version with -worker-version-arg.
+func (s *Stabilizer) serveBuildInfo(rw http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" {
+		http.Error(rw, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	info := struct {
+		BuildInfo
+		GoVersion string   `json:"go_version"`
+		Command   string   `json:"command"`
+		Args      []string `json:"args"`
+		// WorkerVersion is only known with -worker-version-arg.
+		WorkerVersion string `json:"worker_version,omitempty"`
+	}{
+		GoVersion:     runtime.Version(),
+		Command:       s.command,
+		Args:          s.args,
+		WorkerVersion: s.currentWorkerVersion(),
+	}
+	if s.buildInfo != nil {
+		info.BuildInfo = *s.buildInfo
+	}
+	rw.Header().Set("Content-Type", "application/json")
+	_ = json.NewEncoder(rw).Encode(&info)
+}
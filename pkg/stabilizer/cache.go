@@ -0,0 +1,186 @@
+package stabilizer
+
+import (
+	"container/list"
+	"encoding/json"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/sourcegraph/log"
+)
+
+// cacheHeader is the response header which tells whether a response was
+// served from the -cache-ttl cache.
+const cacheHeader = "X-Cache"
+
+// responseCache holds successful responses to GET requests for up to ttl, and
+// up to maxBytes of them, forgetting the least recently used first.
+type responseCache struct {
+	ttl      time.Duration
+	maxBytes int64
+
+	mu sync.Mutex
+	// entries holds the element of lru for each key, and lru the entries
+	// with the most recently used first.
+	entries map[string]*list.Element
+	lru     list.List
+	bytes   int64
+}
+
+// cacheEntry is a cached response.
+type cacheEntry struct {
+	key     string
+	expires time.Time
+	status  int
+	header  http.Header
+	body    []byte
+}
+
+// size returns roughly how much memory the entry takes up.
+func (e *cacheEntry) size() int64 {
+	n := len(e.key) + len(e.body)
+	for name, values := range e.header {
+		n += len(name)
+		for _, v := range values {
+			n += len(v)
+		}
+	}
+	return int64(n)
+}
+
+func newResponseCache(ttl time.Duration, maxBytes int64) *responseCache {
+	return &responseCache{ttl: ttl, maxBytes: maxBytes, entries: make(map[string]*list.Element)}
+}
+
+// get returns the entry for key, or nil if there is none or it has expired.
+func (c *responseCache) get(key string, now time.Time) *cacheEntry {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	elem, ok := c.entries[key]
+	if !ok {
+		return nil
+	}
+	e := elem.Value.(*cacheEntry)
+	if !now.Before(e.expires) {
+		c.removeLocked(elem)
+		return nil
+	}
+	c.lru.MoveToFront(elem)
+	return e
+}
+
+// put adds an entry, replacing any for the same key, and forgets the least
+// recently used entries until the cache is within maxBytes. Entries larger
+// than maxBytes are not added.
+func (c *responseCache) put(e *cacheEntry) {
+	size := e.size()
+	if size > c.maxBytes {
+		return
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if elem, ok := c.entries[e.key]; ok {
+		c.removeLocked(elem)
+	}
+	c.entries[e.key] = c.lru.PushFront(e)
+	c.bytes += size
+	for c.bytes > c.maxBytes {
+		c.removeLocked(c.lru.Back())
+	}
+}
+
+// removeLocked removes an entry. c.mu must be held.
+func (c *responseCache) removeLocked(elem *list.Element) {
+	e := c.lru.Remove(elem).(*cacheEntry)
+	delete(c.entries, e.key)
+	c.bytes -= e.size()
+}
+
+// flush removes all entries, and returns how many there were.
+func (c *responseCache) flush() int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	n := len(c.entries)
+	c.entries = make(map[string]*list.Element)
+	c.lru.Init()
+	c.bytes = 0
+	return n
+}
+
+// cachedBytes returns roughly how much memory the cached responses take up.
+func (c *responseCache) cachedBytes() int64 {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.bytes
+}
+
+// cacheable reports whether a response may be cached: it must be a successful
+// response, which the worker did not forbid storing.
+func cacheable(status int, header http.Header) bool {
+	if status != http.StatusOK {
+		return false
+	}
+	for _, directive := range strings.Split(strings.Join(header.Values("Cache-Control"), ","), ",") {
+		if strings.EqualFold(strings.TrimSpace(directive), "no-store") {
+			return false
+		}
+	}
+	return true
+}
+
+// cacheResponses wraps next to serve GET requests from the -cache-ttl cache,
+// and to cache their responses.
+func (s *Stabilizer) cacheResponses(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		if req.Method != http.MethodGet || !coalescable(req) {
+			next.ServeHTTP(rw, req)
+			return
+		}
+		key := requestKey(req, s.cfg.CacheVary)
+		if e := s.cache.get(key, time.Now()); e != nil {
+			s.metrics.cacheCounter.WithLabelValues("hit").Inc()
+			rw.Header().Set(cacheHeader, "HIT")
+			writeCopy(rw, req, e.status, e.header, e.body)
+			return
+		}
+		s.metrics.cacheCounter.WithLabelValues("miss").Inc()
+		rw.Header().Set(cacheHeader, "MISS")
+
+		entry, tracked := trackOutcome(req)
+		recorder := &copyRecorder{ResponseWriter: rw, max: s.cfg.CacheMaxBytes}
+		start := time.Now()
+		next.ServeHTTP(recorder, tracked)
+		if entry.succeeded() && !recorder.overflow && req.Context().Err() == nil && cacheable(recorder.status, recorder.header) {
+			// The response may have been computed from the state at any time
+			// since the request started, so it expires ttl after that.
+			s.cache.put(&cacheEntry{
+				key:     key,
+				expires: start.Add(s.cache.ttl),
+				status:  recorder.status,
+				header:  recorder.header,
+				body:    recorder.body.Bytes(),
+			})
+		}
+	})
+}
+
+// serveCacheFlush handles POST /cache/flush, which empties the -cache-ttl
+// cache.
+func (s *Stabilizer) serveCacheFlush(rw http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		http.Error(rw, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	if s.cache == nil {
+		http.Error(rw, "the cache is disabled", http.StatusNotFound)
+		return
+	}
+	n := s.cache.flush()
+	s.log.Info("flushed cache due to admin request", log.Int("entries", n))
+	rw.Header().Set("Content-Type", "application/json")
+	_ = json.NewEncoder(rw).Encode(&struct {
+		Flushed int `json:"flushed"`
+	}{Flushed: n})
+}
@@ -0,0 +1,29 @@
+package stabilizer
+
+import (
+	"math/rand"
+	"net/http"
+)
+
+// canaryConfig returns the configuration of the -canary-command workers of a
+// Stabilizer with the given configuration. They are configured the same way,
+// other than their command and number.
+func canaryConfig(cfg Config) Config {
+	cfg.Command, cfg.Args = cfg.CanaryCommand, cfg.CanaryArgs
+	cfg.Workers = cfg.CanaryWorkers
+	cfg.MinWorkers, cfg.MaxWorkers = 0, 0
+	return cfg
+}
+
+// serveCanary sends CanaryWeight of requests to the canary, so long as it has
+// a worker to serve them, and reports whether it served the request.
+func (s *Stabilizer) serveCanary(rw http.ResponseWriter, req *http.Request) bool {
+	if s.canary == nil || s.cfg.CanaryWeight <= 0 || rand.Float64() >= s.cfg.CanaryWeight {
+		return false
+	}
+	if s.canary.pool.size() == 0 {
+		return false
+	}
+	s.canary.ServeHTTP(rw, req)
+	return true
+}
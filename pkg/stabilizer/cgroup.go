@@ -0,0 +1,70 @@
+package stabilizer
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+
+	"github.com/sourcegraph/log"
+)
+
+// DefaultWorkerCgroupParent is the cgroup v2 directory under which each worker
+// gets a cgroup of its own with -worker-cgroup.
+const DefaultWorkerCgroupParent = "/sys/fs/cgroup/http-server-stabilizer"
+
+// cgroupFilePattern matches the names of the cgroup interface files which
+// -worker-cgroup may write to, such as memory.max.
+var cgroupFilePattern = regexp.MustCompile(`^[a-z]+\.[a-zA-Z0-9_.]+$`)
+
+// cgroupLimit is a -worker-cgroup limit: a value written to an interface file
+// of each worker's cgroup.
+type cgroupLimit struct {
+	file, value string
+}
+
+// parseCgroupLimits parses -worker-cgroup limits, e.g. memory.max=512M.
+func parseCgroupLimits(limits []string) ([]cgroupLimit, error) {
+	var parsed []cgroupLimit
+	for _, limit := range limits {
+		i := strings.Index(limit, "=")
+		if i < 0 || limit[i+1:] == "" {
+			return nil, fmt.Errorf("%q must be FILE=VALUE, e.g. memory.max=512M", limit)
+		}
+		file := limit[:i]
+		if !cgroupFilePattern.MatchString(file) || strings.HasPrefix(file, "cgroup.") {
+			return nil, fmt.Errorf("%q is not a cgroup controller's interface file, e.g. memory.max or cpu.max", file)
+		}
+		parsed = append(parsed, cgroupLimit{file: file, value: limit[i+1:]})
+	}
+	return parsed, nil
+}
+
+// prepareCgroups prepares -worker-cgroup-parent if there are -worker-cgroup
+// limits. Should that fail, e.g. as the cgroup filesystem is read-only or this
+// is not Linux, workers are run without limits.
+func (s *Stabilizer) prepareCgroups() {
+	if len(s.cgroupLimits) == 0 {
+		return
+	}
+	c, err := newCgroups(s.cfg.WorkerCgroupParent, s.cgroupLimits)
+	if err != nil {
+		s.log.Warn("failed to prepare worker cgroups, workers will run without resource limits", log.Error(err))
+		return
+	}
+	s.cgroups = c
+}
+
+// cgroupControllers returns the controllers that limits need, e.g. memory for
+// memory.max.
+func cgroupControllers(limits []cgroupLimit) []string {
+	var controllers []string
+	seen := make(map[string]bool)
+	for _, limit := range limits {
+		controller := limit.file[:strings.Index(limit.file, ".")]
+		if !seen[controller] {
+			seen[controller] = true
+			controllers = append(controllers, controller)
+		}
+	}
+	return controllers
+}
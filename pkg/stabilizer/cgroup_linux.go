@@ -0,0 +1,120 @@
+package stabilizer
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync/atomic"
+
+	"golang.org/x/sys/unix"
+)
+
+// cgroupSeq numbers the cgroups of workers, across all Stabilizers in the
+// process, which may share a parent.
+var cgroupSeq uint32
+
+// cgroups creates a cgroup v2 leaf with the -worker-cgroup limits for each
+// worker, under -worker-cgroup-parent.
+type cgroups struct {
+	parent string
+	limits []cgroupLimit
+}
+
+// newCgroups prepares parent for worker cgroups with the given limits: it is
+// created in its existing parent if needed, cgroups left behind in it by a
+// previous run are removed, and the controllers the limits need are enabled
+// for its children.
+func newCgroups(parent string, limits []cgroupLimit) (*cgroups, error) {
+	var fs unix.Statfs_t
+	if err := unix.Statfs(filepath.Dir(parent), &fs); err != nil {
+		return nil, err
+	}
+	if fs.Type != unix.CGROUP2_SUPER_MAGIC {
+		return nil, fmt.Errorf("%s is not in a cgroup v2 filesystem", parent)
+	}
+	if err := os.Mkdir(parent, 0755); err != nil && !os.IsExist(err) {
+		return nil, err
+	}
+	stale, err := filepath.Glob(filepath.Join(parent, "worker-*"))
+	if err != nil {
+		return nil, err
+	}
+	for _, path := range stale {
+		// Cgroups which still have processes in them cannot be removed, and
+		// are left alone.
+		os.Remove(path)
+	}
+	var enable []string
+	for _, controller := range cgroupControllers(limits) {
+		enable = append(enable, "+"+controller)
+	}
+	if len(enable) > 0 {
+		// The controllers must be enabled for parent itself first. That may
+		// fail, e.g. if its parent has processes in it, in which case they
+		// must have been enabled already.
+		_ = writeCgroupFile(filepath.Dir(parent), "cgroup.subtree_control", strings.Join(enable, " "))
+		if err := writeCgroupFile(parent, "cgroup.subtree_control", strings.Join(enable, " ")); err != nil {
+			return nil, err
+		}
+	}
+	return &cgroups{parent: parent, limits: limits}, nil
+}
+
+// enter creates a cgroup with the limits for the process with the given pid,
+// and moves it there. It returns the path of the cgroup, which must be
+// removed with removeCgroup once the process is gone.
+//
+// The process runs without limits until it has been moved, which happens
+// right after it is started, before it is ready to serve requests.
+func (c *cgroups) enter(pid int) (string, error) {
+	path := filepath.Join(c.parent, fmt.Sprintf("worker-%d", atomic.AddUint32(&cgroupSeq, 1)))
+	if err := os.Mkdir(path, 0755); err != nil {
+		return "", err
+	}
+	err := func() error {
+		for _, limit := range c.limits {
+			if err := writeCgroupFile(path, limit.file, limit.value); err != nil {
+				return err
+			}
+		}
+		return writeCgroupFile(path, "cgroup.procs", strconv.Itoa(pid))
+	}()
+	if err != nil {
+		os.Remove(path)
+		return "", err
+	}
+	return path, nil
+}
+
+// writeCgroupFile writes value to an interface file of a cgroup.
+func writeCgroupFile(path, file, value string) error {
+	if err := ioutil.WriteFile(filepath.Join(path, file), []byte(value), 0644); err != nil {
+		return fmt.Errorf("writing %q to %s: %v", value, file, err)
+	}
+	return nil
+}
+
+// cgroupOOMKilled reports whether the kernel's OOM killer killed a process in
+// the cgroup at path, as reported by its memory.events.
+func cgroupOOMKilled(path string) bool {
+	data, err := ioutil.ReadFile(filepath.Join(path, "memory.events"))
+	if err != nil {
+		return false
+	}
+	for _, line := range strings.Split(string(data), "\n") {
+		fields := strings.Fields(line)
+		if len(fields) == 2 && fields[0] == "oom_kill" {
+			n, _ := strconv.Atoi(fields[1])
+			return n > 0
+		}
+	}
+	return false
+}
+
+// removeCgroup removes the cgroup of a worker which is gone.
+func removeCgroup(path string) error {
+	return os.Remove(path)
+}
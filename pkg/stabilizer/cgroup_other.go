@@ -0,0 +1,28 @@
+//go:build !linux
+// +build !linux
+
+package stabilizer
+
+import "errors"
+
+type cgroups struct{}
+
+// newCgroups is only implemented on Linux.
+func newCgroups(parent string, limits []cgroupLimit) (*cgroups, error) {
+	return nil, errors.New("cgroups are not supported on this platform")
+}
+
+// enter is only implemented on Linux.
+func (c *cgroups) enter(pid int) (string, error) {
+	return "", errors.New("cgroups are not supported on this platform")
+}
+
+// cgroupOOMKilled is only implemented on Linux.
+func cgroupOOMKilled(path string) bool {
+	return false
+}
+
+// removeCgroup is only implemented on Linux.
+func removeCgroup(path string) error {
+	return nil
+}
@@ -0,0 +1,94 @@
+package stabilizer
+
+import (
+	"fmt"
+	"os/exec"
+	"path/filepath"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/sourcegraph/log"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// metricLabels returns the constant labels of the metrics of the workers of
+// the given variant and pool, for a Stabilizer with the given configuration:
+// the variant if a canary or mirror is configured, and the pool if any pools
+// are.
+func metricLabels(cfg Config, variant, pool string) prometheus.Labels {
+	labels := prometheus.Labels{}
+	if cfg.CanaryCommand != "" || cfg.MirrorCommand != "" {
+		labels["variant"] = variant
+	}
+	if len(cfg.Pools) > 0 {
+		labels["pool"] = pool
+	}
+	return labels
+}
+
+// newChild returns a Stabilizer which runs another set of workers for a
+// Stabilizer, a variant or a pool, with the given name and configuration. It
+// is only sent requests by that Stabilizer, through its ServeHTTP rather than
+// its own Handler. Its metrics are registered with reg, if not nil, with the
+// given labels, and its requests traced with tp, if not nil.
+func newChild(name string, cfg Config, logger log.Logger, reg prometheus.Registerer, tp trace.TracerProvider, labels prometheus.Labels) *Stabilizer {
+	cfg.CanaryCommand, cfg.CanaryArgs = "", nil
+	cfg.MirrorCommand, cfg.MirrorArgs = "", nil
+	cfg.Pools = nil
+	// The stabilizer reaps orphans for all of its children.
+	cfg.Reap = false
+	if cfg.WorkerSocketDir != "" {
+		cfg.WorkerSocketDir = filepath.Join(cfg.WorkerSocketDir, name)
+	}
+	if len(cfg.WorkerCgroup) > 0 {
+		if cfg.WorkerCgroupParent == "" {
+			cfg.WorkerCgroupParent = DefaultWorkerCgroupParent
+		}
+		cfg.WorkerCgroupParent = filepath.Join(cfg.WorkerCgroupParent, name)
+	}
+	if logger == nil {
+		logger = log.Scoped(name, name+" workers")
+	} else {
+		logger = logger.Scoped(name, name+" workers")
+	}
+	if reg != nil {
+		reg = prometheus.WrapRegistererWith(labels, reg)
+	}
+	// The child's requests are traced by the provider of the Stabilizer,
+	// rather than one of its own.
+	return New(WithConfig(cfg), WithLogger(logger), WithRegisterer(reg), WithTracerProvider(tp))
+}
+
+// childStabilizers returns the Stabilizers running workers for this one: the
+// variants, and then the pools.
+func (s *Stabilizer) childStabilizers() []*Stabilizer {
+	children := s.variants()
+	for _, p := range s.pools {
+		children = append(children, p.s)
+	}
+	return children
+}
+
+// startChild starts the workers of a child. Unlike Start, it does not wait for
+// them to start up.
+func (s *Stabilizer) startChild() error {
+	if s.err != nil {
+		return s.err
+	}
+	if _, err := exec.LookPath(s.command); err != nil {
+		return fmt.Errorf("worker command %q not found: %v", s.command, err)
+	}
+	if s.cfg.WorkerSocketDir != "" {
+		if err := s.cleanSockets(); err != nil {
+			return fmt.Errorf("failed to prepare worker socket dir: %v", err)
+		}
+	}
+	s.prepareCgroups()
+	if s.cfg.WorkerVersionArg != "" {
+		s.updateWorkerVersion()
+	}
+	s.ensureWorkers(s.cfg.Workers)
+	if s.cfg.WatchWorkerBinary {
+		go s.watchWorkerBinary()
+	}
+	return nil
+}
@@ -0,0 +1,85 @@
+package stabilizer
+
+import (
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+
+	"github.com/sourcegraph/log"
+)
+
+// DefaultWorkerCPUsEnv are the environment variables set to -worker-cpus for
+// workers, which runtimes size their thread pools from.
+var DefaultWorkerCPUsEnv = []string{"GOMAXPROCS", "OMP_NUM_THREADS"}
+
+// checkCPUs returns an error if -worker-nice, -worker-cpus or
+// -worker-cpus-env is invalid.
+func checkCPUs(cfg Config) error {
+	if cfg.WorkerNice < -20 || cfg.WorkerNice > 19 {
+		return fmt.Errorf("invalid worker nice %d: must be from -20 to 19", cfg.WorkerNice)
+	}
+	if cfg.WorkerCPUs < 0 {
+		return errors.New("the number of worker CPUs must not be negative")
+	}
+	for _, name := range cfg.WorkerCPUsEnv {
+		if name == "" || strings.Contains(name, "=") {
+			return fmt.Errorf("invalid worker CPUs environment variable %q", name)
+		}
+	}
+	return nil
+}
+
+// cpusEnv returns the -worker-cpus-env environment variables for workers, if
+// -worker-cpus is set.
+func (s *Stabilizer) cpusEnv() []string {
+	if s.cfg.WorkerCPUs == 0 {
+		return nil
+	}
+	var env []string
+	for _, name := range s.cfg.WorkerCPUsEnv {
+		env = append(env, name+"="+strconv.Itoa(s.cfg.WorkerCPUs))
+	}
+	return env
+}
+
+// workerCPUs returns the CPUs the worker in slot index, of n, is pinned to:
+// perWorker consecutive ones of those available, starting at a point spread
+// evenly across them by slot. Workers share CPUs only if there are not enough
+// for each to have its own.
+func workerCPUs(available []int, perWorker, index, n int) []int {
+	if n < 1 {
+		n = 1
+	}
+	start := index * len(available) / n
+	cpus := make([]int, 0, perWorker)
+	for i := 0; i < perWorker && i < len(available); i++ {
+		cpus = append(cpus, available[(start+i)%len(available)])
+	}
+	return cpus
+}
+
+// tuneWorker sets the niceness of a worker process which was just started,
+// and pins it to its CPUs for the given number of workers.
+func (s *Stabilizer) tuneWorker(w *worker, n int) {
+	if s.cfg.WorkerNice != 0 && cpusSupported {
+		if err := setNice(w.pid, s.cfg.WorkerNice); err != nil {
+			w.log.Warn("failed to set worker niceness", log.Error(err))
+		}
+	}
+	s.pinWorker(w, n)
+}
+
+// pinWorker pins a worker to its CPUs for the given number of workers, if
+// -worker-cpus is set.
+func (s *Stabilizer) pinWorker(w *worker, n int) {
+	if s.cpus == nil || w.upstream != "" || !w.alive() {
+		return
+	}
+	cpus := workerCPUs(s.cpus, s.cfg.WorkerCPUs, w.index, n)
+	if err := setAffinity(w.pid, cpus); err != nil {
+		w.log.Warn("failed to set worker CPU affinity", log.Error(err))
+		return
+	}
+	w.log.Info("pinned to CPUs", log.Ints("cpus", cpus))
+}
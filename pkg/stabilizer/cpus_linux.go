@@ -0,0 +1,68 @@
+package stabilizer
+
+import (
+	"fmt"
+	"io/ioutil"
+	"strconv"
+
+	"golang.org/x/sys/unix"
+)
+
+// cpusSupported reports whether availableCPUs, setAffinity and setNice work
+// on this platform.
+const cpusSupported = true
+
+// availableCPUs returns the CPUs the stabilizer may run on.
+func availableCPUs() ([]int, error) {
+	var set unix.CPUSet
+	if err := unix.SchedGetaffinity(0, &set); err != nil {
+		return nil, err
+	}
+	var cpus []int
+	for cpu := 0; len(cpus) < set.Count(); cpu++ {
+		if set.IsSet(cpu) {
+			cpus = append(cpus, cpu)
+		}
+	}
+	return cpus, nil
+}
+
+// setAffinity pins every thread of the process with the given pid to cpus.
+// Threads it starts later inherit the affinity of the thread that starts them.
+func setAffinity(pid int, cpus []int) error {
+	var set unix.CPUSet
+	for _, cpu := range cpus {
+		set.Set(cpu)
+	}
+	return forEachThread(pid, func(tid int) error {
+		return unix.SchedSetaffinity(tid, &set)
+	})
+}
+
+// setNice sets the niceness of every thread of the process with the given pid,
+// as on Linux it is a property of each thread.
+func setNice(pid, nice int) error {
+	return forEachThread(pid, func(tid int) error {
+		return unix.Setpriority(unix.PRIO_PROCESS, tid, nice)
+	})
+}
+
+// forEachThread calls f with the ID of each thread of the process with the
+// given pid, as listed in /proc/<pid>/task. Threads which exit meanwhile are
+// skipped.
+func forEachThread(pid int, f func(tid int) error) error {
+	tasks, err := ioutil.ReadDir(fmt.Sprintf("/proc/%d/task", pid))
+	if err != nil {
+		return err
+	}
+	for _, task := range tasks {
+		tid, err := strconv.Atoi(task.Name())
+		if err != nil {
+			continue
+		}
+		if err := f(tid); err != nil && err != unix.ESRCH {
+			return err
+		}
+	}
+	return nil
+}
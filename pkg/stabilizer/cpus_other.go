@@ -0,0 +1,27 @@
+//go:build !linux
+// +build !linux
+
+package stabilizer
+
+import "errors"
+
+// cpusSupported reports whether availableCPUs, setAffinity and setNice work
+// on this platform.
+const cpusSupported = false
+
+var errCPUsUnsupported = errors.New("setting worker CPU affinity and niceness is not supported on this platform")
+
+// availableCPUs is only implemented on Linux.
+func availableCPUs() ([]int, error) {
+	return nil, errCPUsUnsupported
+}
+
+// setAffinity is only implemented on Linux.
+func setAffinity(pid int, cpus []int) error {
+	return errCPUsUnsupported
+}
+
+// setNice is only implemented on Linux.
+func setNice(pid, nice int) error {
+	return errCPUsUnsupported
+}
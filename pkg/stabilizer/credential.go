@@ -0,0 +1,77 @@
+package stabilizer
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"os/user"
+	"strconv"
+)
+
+// workerCredential is the user and group workers are run as, with
+// -worker-user and -worker-group.
+type workerCredential struct {
+	uid, gid uint32
+}
+
+// lookupCredential resolves a user and group, each a name or numeric id, to
+// the ids workers are run as. Either may be empty: the group defaults to the
+// user's primary group, and the user to the stabilizer's.
+func lookupCredential(username, groupname string) (*workerCredential, error) {
+	cred := &workerCredential{uid: uint32(os.Geteuid()), gid: uint32(os.Getegid())}
+	if username != "" {
+		u, err := user.Lookup(username)
+		if _, ok := err.(user.UnknownUserError); ok {
+			u, err = user.LookupId(username)
+		}
+		if err != nil {
+			return nil, fmt.Errorf("unknown user %q", username)
+		}
+		uid, err := strconv.ParseUint(u.Uid, 10, 32)
+		if err != nil {
+			return nil, fmt.Errorf("user %q has non-numeric id %q", username, u.Uid)
+		}
+		gid, err := strconv.ParseUint(u.Gid, 10, 32)
+		if err != nil {
+			return nil, fmt.Errorf("user %q has non-numeric group id %q", username, u.Gid)
+		}
+		cred.uid, cred.gid = uint32(uid), uint32(gid)
+	}
+	if groupname != "" {
+		g, err := user.LookupGroup(groupname)
+		if _, ok := err.(user.UnknownGroupError); ok {
+			g, err = user.LookupGroupId(groupname)
+		}
+		if err != nil {
+			return nil, fmt.Errorf("unknown group %q", groupname)
+		}
+		gid, err := strconv.ParseUint(g.Gid, 10, 32)
+		if err != nil {
+			return nil, fmt.Errorf("group %q has non-numeric id %q", groupname, g.Gid)
+		}
+		cred.gid = uint32(gid)
+	}
+	return cred, nil
+}
+
+// check returns an error if the stabilizer may not run workers as cred. Only
+// root may, which also ensures that it may still signal the process groups of
+// workers which run as another user.
+func (cred *workerCredential) check() error {
+	if os.Geteuid() == 0 {
+		return nil
+	}
+	if cred.uid != uint32(os.Geteuid()) || cred.gid != uint32(os.Getegid()) {
+		return errors.New("running workers as another user or group requires the stabilizer to run as root")
+	}
+	return nil
+}
+
+// chownForWorkers makes a directory the stabilizer created for workers, such
+// as -worker-socket-dir, owned by the user they run as, if not its own.
+func (s *Stabilizer) chownForWorkers(path string) error {
+	if s.credential == nil {
+		return nil
+	}
+	return os.Chown(path, int(s.credential.uid), int(s.credential.gid))
+}
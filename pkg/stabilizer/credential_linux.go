@@ -0,0 +1,12 @@
+package stabilizer
+
+import "syscall"
+
+// credentialSupported reports whether setCredential works on this platform.
+const credentialSupported = true
+
+// setCredential makes a worker run as cred. Its supplementary groups are
+// dropped, rather than inherited from the stabilizer.
+func setCredential(attr *syscall.SysProcAttr, cred *workerCredential) {
+	attr.Credential = &syscall.Credential{Uid: cred.uid, Gid: cred.gid}
+}
@@ -0,0 +1,80 @@
+package stabilizer
+
+import (
+	"encoding/json"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"os/user"
+	"path/filepath"
+	"strconv"
+	"testing"
+)
+
+// TestWorkerUser checks that a worker run with -worker-user and -worker-group
+// runs as that user and group.
+func TestWorkerUser(t *testing.T) {
+	if os.Geteuid() != 0 {
+		t.Skip("running workers as another user requires root")
+	}
+	u, err := user.Lookup("nobody")
+	if err != nil {
+		t.Skip("no nobody user")
+	}
+
+	// The test binary is copied to where the user may run it from.
+	dir, err := ioutil.TempDir("", "hss-worker")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	if err := os.Chmod(dir, 0755); err != nil {
+		t.Fatal(err)
+	}
+	command := filepath.Join(dir, "worker")
+	if err := copyFile(command, os.Args[0], 0755); err != nil {
+		t.Fatal(err)
+	}
+
+	cfg := testConfig()
+	cfg.Command = command
+	cfg.WorkerUser = "nobody"
+	cfg.WorkerGroup = u.Gid
+	_, srv, stop := startStabilizer(t, cfg)
+	defer stop()
+
+	resp, err := http.Get(srv.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	var r testWorkerResponse
+	if err := json.NewDecoder(resp.Body).Decode(&r); err != nil {
+		t.Fatal(err)
+	}
+	if got := strconv.Itoa(r.UID); got != u.Uid {
+		t.Errorf("worker runs as uid %v, want %v", got, u.Uid)
+	}
+	if got := strconv.Itoa(r.GID); got != u.Gid {
+		t.Errorf("worker runs as gid %v, want %v", got, u.Gid)
+	}
+}
+
+// copyFile copies the file at src to dst, created with the given mode.
+func copyFile(dst, src string, mode os.FileMode) error {
+	in, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+	out, err := os.OpenFile(dst, os.O_WRONLY|os.O_CREATE|os.O_EXCL, mode)
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(out, in); err != nil {
+		out.Close()
+		return err
+	}
+	return out.Close()
+}
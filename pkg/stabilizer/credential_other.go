@@ -0,0 +1,12 @@
+//go:build !linux
+// +build !linux
+
+package stabilizer
+
+import "syscall"
+
+// credentialSupported reports whether setCredential works on this platform.
+const credentialSupported = false
+
+// setCredential is only implemented on Linux.
+func setCredential(attr *syscall.SysProcAttr, cred *workerCredential) {}
@@ -0,0 +1,97 @@
+package stabilizer
+
+import (
+	"encoding/json"
+	"net/http"
+	"sync/atomic"
+
+	"github.com/slimsag/http-server-stabilizer/pkg/hsserr"
+	"github.com/sourcegraph/log"
+)
+
+// Drain puts the stabilizer into drain mode, in which /readyz reports it is
+// not ready so that load balancers stop sending it requests. Requests are
+// still served, unless -drain-reject is set. It reports whether the
+// stabilizer was not draining already.
+func (s *Stabilizer) Drain() bool {
+	return atomic.CompareAndSwapInt32(&s.draining, 0, 1)
+}
+
+// Undrain takes the stabilizer out of drain mode. It reports whether the
+// stabilizer was draining.
+func (s *Stabilizer) Undrain() bool {
+	return atomic.CompareAndSwapInt32(&s.draining, 1, 0)
+}
+
+// Draining reports whether the stabilizer is in drain mode.
+func (s *Stabilizer) Draining() bool {
+	return atomic.LoadInt32(&s.draining) == 1
+}
+
+// rejectDraining wraps next to reject requests with 503 while the stabilizer
+// is in drain mode, with -drain-reject.
+func (s *Stabilizer) rejectDraining(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		if !s.Draining() {
+			next.ServeHTTP(rw, req)
+			return
+		}
+		if id := requestID(req); id != "" {
+			rw.Header().Set(requestIDHeader, id)
+		}
+		s.writeError(rw, req, http.StatusServiceUnavailable, hsserr.ReasonDraining,
+			"The server is draining and not accepting new requests", true)
+	})
+}
+
+// Ready reports whether the stabilizer is ready to be sent requests: it is not
+// in drain mode, and at least -healthy-min-workers workers, of each pool if
+// any, are ready.
+func (s *Stabilizer) Ready() bool {
+	_, healthy := s.countWorkers((*Stabilizer).workersReady)
+	return !s.Draining() && healthy
+}
+
+// serveReadyz reports whether the stabilizer is ready to be sent requests,
+// responding with 503 if not, so that it can be used as a readiness probe.
+func (s *Stabilizer) serveReadyz(rw http.ResponseWriter, r *http.Request) {
+	ready, healthy := s.countWorkers((*Stabilizer).workersReady)
+	draining := s.Draining()
+	status := http.StatusOK
+	if draining || !healthy {
+		status = http.StatusServiceUnavailable
+	}
+	rw.Header().Set("Content-Type", "application/json")
+	rw.WriteHeader(status)
+	_ = json.NewEncoder(rw).Encode(&struct {
+		Ready        bool `json:"ready"`
+		Draining     bool `json:"draining"`
+		WorkersReady int  `json:"workers_ready"`
+	}{
+		Ready:        status == http.StatusOK,
+		Draining:     draining,
+		WorkersReady: ready,
+	})
+}
+
+// serveDrain handles POST /drain and POST /undrain, which put the stabilizer
+// into and out of drain mode.
+func (s *Stabilizer) serveDrain(rw http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		http.Error(rw, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	var changed bool
+	if r.URL.Path == "/drain" {
+		changed = s.Drain()
+	} else {
+		changed = s.Undrain()
+	}
+	if changed {
+		s.log.Info("drain mode changed due to admin request", log.Bool("draining", s.Draining()))
+	}
+	rw.Header().Set("Content-Type", "application/json")
+	_ = json.NewEncoder(rw).Encode(&struct {
+		Draining bool `json:"draining"`
+	}{Draining: s.Draining()})
+}
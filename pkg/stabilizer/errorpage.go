@@ -0,0 +1,133 @@
+package stabilizer
+
+import (
+	"bytes"
+	"fmt"
+	"html/template"
+	"mime"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/sourcegraph/log"
+)
+
+// Formats of error responses, chosen by the request's Accept header.
+const (
+	errorFormatJSON  = "json"
+	errorFormatHTML  = "html"
+	errorFormatPlain = "plain"
+)
+
+// errorFormats are the formats error responses can be written in and their
+// media types, in order of preference when the client accepts several
+// equally.
+var errorFormats = []struct {
+	format    string
+	mediaType string
+}{
+	{errorFormatJSON, "application/json"},
+	{errorFormatHTML, "text/html"},
+	{errorFormatPlain, "text/plain"},
+}
+
+// defaultErrorTemplate is the HTML error page used unless -error-template is
+// given.
+var defaultErrorTemplate = template.Must(template.New("error").Parse(`<!DOCTYPE html>
+<html>
+<head><title>{{.Code}} {{.Status}}</title></head>
+<body>
+<h1>{{.Code}} {{.Status}}</h1>
+<p>{{.Description}}</p>
+{{if .RequestID}}<p><small>Request ID: {{.RequestID}}</small></p>{{end}}
+</body>
+</html>
+`))
+
+// errorPage is the data an HTML error page template is executed with.
+type errorPage struct {
+	Err
+	// Status is the text of the status code, e.g. "Gateway Timeout".
+	Status string
+}
+
+// loadErrorTemplate returns the HTML error page template in the given file,
+// or the default template if path is empty.
+func loadErrorTemplate(path string) (*template.Template, error) {
+	if path == "" {
+		return defaultErrorTemplate, nil
+	}
+	return template.ParseFiles(path)
+}
+
+// negotiateErrorFormat returns the format in which to write an error response
+// to a request with the given Accept header. JSON is preferred unless the
+// client prefers HTML or plain text.
+func negotiateErrorFormat(accept string) string {
+	if strings.TrimSpace(accept) == "" {
+		return errorFormatJSON
+	}
+	best, bestQ := errorFormatJSON, 0.0
+	for _, f := range errorFormats {
+		if q := acceptQuality(accept, f.mediaType); q > bestQ {
+			best, bestQ = f.format, q
+		}
+	}
+	return best
+}
+
+// acceptQuality returns the quality an Accept header gives a media type, from
+// the most specific range that matches it.
+func acceptQuality(accept, mediaType string) float64 {
+	typ := mediaType[:strings.Index(mediaType, "/")]
+	q, specificity := 0.0, -1
+	for _, part := range strings.Split(accept, ",") {
+		r, params, err := mime.ParseMediaType(strings.TrimSpace(part))
+		if err != nil {
+			continue
+		}
+		var s int
+		switch {
+		case r == mediaType:
+			s = 2
+		case r == typ+"/*":
+			s = 1
+		case r == "*/*":
+			s = 0
+		default:
+			continue
+		}
+		if s <= specificity {
+			continue
+		}
+		specificity = s
+		q = 1
+		if v, ok := params["q"]; ok {
+			if parsed, err := strconv.ParseFloat(v, 64); err == nil {
+				q = parsed
+			}
+		}
+	}
+	return q
+}
+
+// writeErrorPage writes an error response as an HTML page, or as plain text
+// if the template fails.
+func (s *Stabilizer) writeErrorPage(rw http.ResponseWriter, e Err) {
+	var page bytes.Buffer
+	if err := s.errorTemplate.Execute(&page, errorPage{Err: e, Status: http.StatusText(e.Code)}); err != nil {
+		s.log.Error("failed to execute error template", log.Error(err))
+		writeErrorText(rw, e)
+		return
+	}
+	rw.Header().Set("Content-Type", "text/html; charset=utf-8")
+	rw.WriteHeader(e.Code)
+	rw.Write(page.Bytes())
+}
+
+// writeErrorText writes an error response as a line of plain text.
+func writeErrorText(rw http.ResponseWriter, e Err) {
+	rw.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	rw.WriteHeader(e.Code)
+	fmt.Fprintf(rw, "%d %s: %s\n", e.Code, http.StatusText(e.Code), e.Description)
+}
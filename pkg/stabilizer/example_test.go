@@ -0,0 +1,87 @@
+package stabilizer_test
+
+import (
+	"context"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/slimsag/http-server-stabilizer/pkg/stabilizer"
+	"github.com/sourcegraph/log/logtest"
+)
+
+func ExampleNew() {
+	s := stabilizer.New(
+		stabilizer.WithCommand("my-server", "-port={{.Port}}"),
+		stabilizer.WithWorkers(4),
+		stabilizer.WithConcurrency(10),
+		stabilizer.WithTimeout(10*time.Second),
+	)
+	if err := s.Start(context.Background()); err != nil {
+		log.Fatal(err)
+	}
+	defer s.Shutdown(context.Background())
+	log.Fatal(http.ListenAndServe(":8080", s.Handler()))
+}
+
+// TestEmbed runs a stabilizer as a program embedding the package would, with
+// the test binary as its workers.
+func TestEmbed(t *testing.T) {
+	cfg := stabilizer.DefaultConfig()
+	cfg.WorkerEnv = []string{"HSS_TEST_WORKER=worker"}
+	registry := prometheus.NewRegistry()
+	s := stabilizer.New(
+		stabilizer.WithConfig(cfg),
+		stabilizer.WithCommand(os.Args[0], "{{.Host}}", "{{.Port}}"),
+		stabilizer.WithWorkers(2),
+		stabilizer.WithConcurrency(1),
+		stabilizer.WithTimeout(5*time.Second),
+		stabilizer.WithLogger(logtest.NoOp(t)),
+		stabilizer.WithRegisterer(registry),
+	)
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+	if err := s.Start(ctx); err != nil {
+		t.Fatal(err)
+	}
+	defer func() {
+		if err := s.Shutdown(ctx); err != nil {
+			t.Error(err)
+		}
+	}()
+	srv := httptest.NewServer(s.Handler())
+	defer srv.Close()
+	admin := httptest.NewServer(s.AdminHandler())
+	defer admin.Close()
+
+	for _, url := range []string{srv.URL, admin.URL + "/healthz"} {
+		resp, err := http.Get(url)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		if resp.StatusCode != http.StatusOK {
+			t.Errorf("%s: got status %v, want %v", url, resp.StatusCode, http.StatusOK)
+		}
+	}
+	if got := s.Config().Workers; got != 2 {
+		t.Errorf("got %v workers, want 2", got)
+	}
+
+	families, err := registry.Gather()
+	if err != nil {
+		t.Fatal(err)
+	}
+	found := false
+	for _, family := range families {
+		found = found || strings.HasPrefix(family.GetName(), "hss_")
+	}
+	if !found {
+		t.Error("no metrics registered with the registerer")
+	}
+}
@@ -0,0 +1,98 @@
+package stabilizer
+
+import (
+	"context"
+	"crypto/tls"
+	"fmt"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"golang.org/x/net/http2"
+)
+
+// workerTransport returns the transport used to send requests to workers,
+// speaking -worker-protocol.
+func (s *Stabilizer) workerTransport() (http.RoundTripper, error) {
+	protocol := s.cfg.WorkerProtocol
+	switch protocol {
+	case ProtocolHTTP1:
+		maxIdle := s.cfg.WorkerMaxIdleConnsPerHost
+		if maxIdle == 0 {
+			// Keep a connection for each request a worker may be serving,
+			// rather than net/http's default of 2.
+			maxIdle = s.cfg.Concurrency
+		}
+		return &http.Transport{
+			DialContext:           s.dialWorker,
+			TLSHandshakeTimeout:   10 * time.Second,
+			ResponseHeaderTimeout: s.cfg.WorkerResponseHeaderTimeout,
+			MaxIdleConnsPerHost:   maxIdle,
+			IdleConnTimeout:       s.cfg.WorkerIdleConnTimeout,
+			DisableKeepAlives:     s.cfg.WorkerDisableKeepAlives,
+		}, nil
+	case ProtocolH2C:
+		// HTTP/2 without TLS: the transport is told to dial a TLS
+		// connection to an http:// URL, and is given a plain one.
+		return &http2.Transport{
+			AllowHTTP: true,
+			DialTLS: func(network, addr string, _ *tls.Config) (net.Conn, error) {
+				return s.dialWorker(context.Background(), network, addr)
+			},
+		}, nil
+	}
+	return nil, fmt.Errorf("unknown protocol %q, expected %q or %q", protocol, ProtocolHTTP1, ProtocolH2C)
+}
+
+// isGRPC reports whether the request is a gRPC request.
+func isGRPC(req *http.Request) bool {
+	return strings.HasPrefix(req.Header.Get("Content-Type"), "application/grpc")
+}
+
+// gRPC status codes, see
+// https://github.com/grpc/grpc/blob/master/doc/statuscodes.md
+const (
+	grpcUnknown           = 2
+	grpcInvalidArgument   = 3
+	grpcDeadlineExceeded  = 4
+	grpcResourceExhausted = 8
+	grpcUnavailable       = 14
+)
+
+// writeGRPCError writes a gRPC error response equivalent to the given HTTP
+// error. The status is sent in a response with no body, which gRPC clients
+// read as the trailers.
+func writeGRPCError(rw http.ResponseWriter, code int, reason, description string) {
+	status := grpcUnknown
+	switch code {
+	case http.StatusBadRequest:
+		status = grpcInvalidArgument
+	case http.StatusTooManyRequests:
+		status = grpcResourceExhausted
+	case http.StatusServiceUnavailable:
+		status = grpcUnavailable
+	case http.StatusGatewayTimeout:
+		status = grpcDeadlineExceeded
+	}
+	h := rw.Header()
+	h.Set("Content-Type", "application/grpc")
+	h.Set("Grpc-Status", strconv.Itoa(status))
+	h.Set("Grpc-Message", grpcEncodeMessage(reason+": "+description))
+	rw.WriteHeader(http.StatusOK)
+}
+
+// grpcEncodeMessage percent-encodes a grpc-message value.
+func grpcEncodeMessage(msg string) string {
+	var b strings.Builder
+	for i := 0; i < len(msg); i++ {
+		c := msg[i]
+		if c < ' ' || c > '~' || c == '%' {
+			fmt.Fprintf(&b, "%%%02X", c)
+		} else {
+			b.WriteByte(c)
+		}
+	}
+	return b.String()
+}
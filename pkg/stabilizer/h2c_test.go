@@ -0,0 +1,95 @@
+package stabilizer
+
+import (
+	"bytes"
+	"crypto/tls"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"testing"
+	"time"
+
+	"golang.org/x/net/http2"
+)
+
+// grpcRequest makes a gRPC request with the given message to the echo method
+// of the test worker, over h2c.
+func grpcRequest(t *testing.T, url string, message []byte) *http.Response {
+	t.Helper()
+	client := &http.Client{Transport: &http2.Transport{
+		AllowHTTP: true,
+		DialTLS: func(network, addr string, _ *tls.Config) (net.Conn, error) {
+			return net.Dial(network, addr)
+		},
+	}}
+	// Each message is prefixed by whether it is compressed, and its length.
+	frame := append([]byte{0, 0, 0, 0, byte(len(message))}, message...)
+	req, err := http.NewRequest("POST", url, bytes.NewReader(frame))
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.Header.Set("Content-Type", "application/grpc")
+	req.Header.Set("TE", "trailers")
+	resp, err := client.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return resp
+}
+
+// TestGRPC checks that a gRPC request is proxied to an h2c worker, with its
+// status in the trailers.
+func TestGRPC(t *testing.T) {
+	cfg := testConfig()
+	cfg.WorkerProtocol = ProtocolH2C
+	_, srv, stop := startStabilizer(t, cfg)
+	defer stop()
+
+	resp := grpcRequest(t, srv.URL+"/grpc.Echo/Echo", []byte("hello"))
+	defer resp.Body.Close()
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resp.ProtoMajor != 2 {
+		t.Errorf("got protocol %v, want HTTP/2", resp.Proto)
+	}
+	if want := "\x00\x00\x00\x00\x05hello"; string(body) != want {
+		t.Errorf("got body %q, want %q", body, want)
+	}
+	// The trailers are only known once the body has been read.
+	if got := resp.Trailer.Get("Grpc-Status"); got != "0" {
+		t.Errorf("got grpc-status %q, want 0", got)
+	}
+	if got := resp.Trailer.Get("Grpc-Message"); got != "OK" {
+		t.Errorf("got grpc-message %q, want OK", got)
+	}
+}
+
+// TestGRPCTimeout checks that a gRPC request which times out gets a gRPC
+// status rather than an error body.
+func TestGRPCTimeout(t *testing.T) {
+	cfg := testConfig()
+	cfg.WorkerProtocol = ProtocolH2C
+	cfg.Timeout = 200 * time.Millisecond
+	_, srv, stop := startStabilizer(t, cfg)
+	defer stop()
+
+	resp := grpcRequest(t, srv.URL+"/grpc.Echo/Echo?ms=5000", []byte("hello"))
+	defer resp.Body.Close()
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(body) > 0 {
+		t.Errorf("got body %q, want none", body)
+	}
+	// With no body, the status is in the headers rather than trailers.
+	status := resp.Header.Get("Grpc-Status")
+	if status == "" {
+		status = resp.Trailer.Get("Grpc-Status")
+	}
+	if status != "4" {
+		t.Errorf("got grpc-status %q, want 4 (deadline exceeded)", status)
+	}
+}
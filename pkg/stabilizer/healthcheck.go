@@ -0,0 +1,50 @@
+package stabilizer
+
+import (
+	"context"
+	"strconv"
+	"time"
+
+	"github.com/sourcegraph/log"
+)
+
+// healthCheck checks the worker every -healthcheck-interval while it is idle,
+// and drains it once it has failed -healthcheck-failures checks in a row. It
+// returns once the worker is done.
+//
+// Checks go straight to the worker rather than through the pool, so they
+// don't take up capacity. Workers that are serving requests are not checked,
+// as those requests show whether the worker is healthy.
+func (s *Stabilizer) healthCheck(w *worker) {
+	index := strconv.Itoa(w.index)
+	ticker := time.NewTicker(s.cfg.HealthCheckInterval)
+	defer ticker.Stop()
+	failures := 0
+	for {
+		select {
+		case <-w.ctx.Done():
+			return
+		case <-ticker.C:
+		}
+		if s.pool.inflight(w) > 0 || s.pool.draining(w) {
+			failures = 0
+			continue
+		}
+
+		ctx, cancel := context.WithTimeout(w.ctx, s.cfg.HealthCheckTimeout)
+		err := s.probeWorker(ctx, w.host(), s.cfg.HealthCheckPath)
+		cancel()
+		if err == nil || w.ctx.Err() != nil {
+			failures = 0
+			continue
+		}
+		failures++
+		s.metrics.healthCheckFailures.WithLabelValues(index).Inc()
+		w.log.Warn("health check failed", log.Int("failures", failures), log.Error(err))
+		if failures >= s.cfg.HealthCheckFailures {
+			w.log.Warn("restarting due to failed health checks")
+			s.pool.drain(w, reasonHealthCheck)
+			return
+		}
+	}
+}
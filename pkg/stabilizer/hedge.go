@@ -0,0 +1,179 @@
+package stabilizer
+
+import (
+	"context"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"sync/atomic"
+	"time"
+
+	"github.com/sourcegraph/log"
+)
+
+// hedgingTransport sends a request that is slow to get a response from its
+// worker to up to -hedge-max other workers as well, after -hedge-after, and
+// uses whichever response comes first.
+//
+// Upon returning, the proxyRequest's lease is on the worker that the response
+// (or error) came from, and any other leases have been or will be closed.
+type hedgingTransport struct {
+	s    *Stabilizer
+	next http.RoundTripper
+}
+
+// attempt is the result of sending a request to one worker.
+type attempt struct {
+	lease  *lease
+	hedge  bool
+	ctx    context.Context
+	cancel func()
+	resp   *http.Response
+	err    error
+}
+
+func (t hedgingTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	pr := getProxyRequest(req.Context())
+	deadline, hasDeadline := req.Context().Deadline()
+	if t.s.cfg.HedgeAfter <= 0 || t.s.cfg.HedgeMax <= 0 || pr == nil || pr.worker == nil || !hasDeadline || !retriable(req) || isWebSocket(req) {
+		return t.next.RoundTrip(req)
+	}
+
+	// The primary attempt is detached from the request, so that if it is
+	// hedged away it can keep running until the request deadline: if its
+	// worker is stuck, it is then killed just as if the request had not been
+	// hedged. Otherwise, it ends with the request.
+	primaryCtx, cancelPrimary := context.WithDeadline(context.Background(), deadline)
+	var hedgedAway int32
+	go func() {
+		<-req.Context().Done()
+		if atomic.LoadInt32(&hedgedAway) == 0 {
+			cancelPrimary()
+		}
+	}()
+
+	results := make(chan attempt, 1+t.s.cfg.HedgeMax)
+	send := func(a attempt, req *http.Request) {
+		a.resp, a.err = t.next.RoundTrip(req)
+		results <- a
+	}
+	primary := attempt{lease: pr.lease, ctx: primaryCtx, cancel: cancelPrimary}
+	go send(primary, req.WithContext(primaryCtx))
+	pending := 1
+
+	hedgeTimer := time.NewTimer(t.s.cfg.HedgeAfter)
+	defer hedgeTimer.Stop()
+	var (
+		hedges   []attempt
+		failed   *attempt
+		finished bool
+	)
+	for !finished {
+		select {
+		case <-hedgeTimer.C:
+			if len(hedges) >= t.s.cfg.HedgeMax {
+				continue
+			}
+			if len(hedges)+1 < t.s.cfg.HedgeMax {
+				hedgeTimer.Reset(t.s.cfg.HedgeAfter)
+			}
+			l := t.s.pool.tryAcquire(pr.worker)
+			if l == nil {
+				continue
+			}
+			hedgeReq, err := t.s.hedgeRequest(req, l.worker)
+			if err != nil {
+				l.Close()
+				continue
+			}
+			hedgeCtx, cancel := context.WithCancel(req.Context())
+			hedge := attempt{lease: l, hedge: true, ctx: hedgeCtx, cancel: cancel}
+			hedges = append(hedges, hedge)
+			t.s.metrics.hedgesCounter.Inc()
+			go send(hedge, hedgeReq.WithContext(hedgeCtx))
+			pending++
+
+		case a := <-results:
+			pending--
+			if a.err != nil && pending > 0 {
+				// Wait for another attempt to succeed.
+				if a.hedge {
+					a.cancel()
+					a.lease.Close()
+				} else {
+					failed = &a
+				}
+				continue
+			}
+			if a.err != nil && failed != nil {
+				// Every attempt failed, so report the primary's error.
+				if a.hedge {
+					a.cancel()
+					a.lease.Close()
+				}
+				a = *failed
+			}
+
+			// Use this attempt, and clean up after the others.
+			finished = true
+			pr.use(a.lease)
+			if a.hedge {
+				pr.hedged = true
+				t.s.metrics.hedgesWonCounter.Inc()
+				atomic.StoreInt32(&hedgedAway, 1)
+			}
+			for _, h := range hedges {
+				if h.lease != a.lease {
+					h.cancel()
+				}
+			}
+			if failed != nil && failed.lease != a.lease {
+				failed.lease.Close()
+			}
+			go t.finishLosers(results, pending, pr.id)
+			if a.resp != nil {
+				// The attempt was sent with its own context, but the
+				// response must refer to the original request.
+				a.resp.Request = req
+			}
+			return a.resp, a.err
+		}
+	}
+	return nil, nil
+}
+
+// finishLosers waits for the attempts that were not used to finish, and
+// closes their leases. A primary attempt that was hedged away and times
+// out gets its worker killed, as it would have been had the request not been
+// hedged.
+func (t hedgingTransport) finishLosers(results <-chan attempt, pending int, requestID string) {
+	for ; pending > 0; pending-- {
+		a := <-results
+		if a.resp != nil {
+			io.Copy(ioutil.Discard, a.resp.Body)
+			a.resp.Body.Close()
+		}
+		if !a.hedge && a.ctx.Err() == context.DeadlineExceeded {
+			if a.lease.worker.killStuck(reasonTimeout, requestID) {
+				a.lease.worker.log.Warn("restarting due to timeout of hedged request", log.String("requestID", requestID))
+			}
+		}
+		a.cancel()
+		a.lease.Close()
+	}
+}
+
+// hedgeRequest returns a copy of req to send to the given worker.
+func (s *Stabilizer) hedgeRequest(req *http.Request, w *worker) (*http.Request, error) {
+	hedge := req.Clone(req.Context())
+	hedge.URL.Host = w.host()
+	s.setDeadlineHeader(hedge)
+	if req.GetBody != nil {
+		body, err := req.GetBody()
+		if err != nil {
+			return nil, err
+		}
+		hedge.Body = body
+	}
+	return hedge, nil
+}
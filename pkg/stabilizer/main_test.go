@@ -0,0 +1,219 @@
+package stabilizer
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"os/exec"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/sourcegraph/log/logtest"
+	"golang.org/x/net/http2"
+	"golang.org/x/net/http2/h2c"
+	"golang.org/x/net/websocket"
+)
+
+// testWorkerEnv is set in the environment of the workers started by tests,
+// which run the test binary itself, to make it act as a test worker instead
+// of running the tests.
+const testWorkerEnv = "HSS_TEST_WORKER"
+
+func TestMain(m *testing.M) {
+	switch os.Getenv(testWorkerEnv) {
+	case "worker":
+		runTestWorker(os.Args[1], os.Args[2])
+		return
+	case "sleep":
+		// A subprocess of a worker, which exits after the given
+		// milliseconds.
+		ms, _ := strconv.Atoi(os.Args[1])
+		time.Sleep(time.Duration(ms) * time.Millisecond)
+		return
+	case "crash":
+		// Exit while the output is still being read.
+		for i := 0; i < 1000; i++ {
+			fmt.Printf("line %d\n", i)
+			fmt.Fprintf(os.Stderr, "line %d\n", i)
+		}
+		os.Exit(3)
+	}
+	logtest.Init(m)
+	os.Exit(m.Run())
+}
+
+// testWorkerResponse is what the test worker responds to requests with.
+type testWorkerResponse struct {
+	PID int `json:"pid"`
+	UID int `json:"uid"`
+	GID int `json:"gid"`
+	// Child is the pid of the subprocess started by /fork.
+	Child int `json:"child,omitempty"`
+	// Host and Header are the Host and the rest of the header of the
+	// request.
+	Host   string      `json:"host,omitempty"`
+	Header http.Header `json:"header,omitempty"`
+	// Env is the environment of the worker, for /env.
+	Env []string `json:"env,omitempty"`
+}
+
+// runTestWorker serves requests on the given host and port until it is
+// killed. A request sleeps for the milliseconds given by its "ms" query
+// parameter, and is responded to with the status given by "status". Its
+// response is the number of bytes given by "size" if set, and a
+// testWorkerResponse otherwise.
+//
+// /fork starts a subprocess which exits after the "ms" milliseconds, without
+// waiting for it. It is in a process group of its own, so that it outlives
+// the worker if it is killed. /env responds with the worker's environment.
+// /ws is a WebSocket which echoes what it is sent, and /grpc.Echo/Echo is a
+// gRPC method which does the same, over HTTP/2 without TLS (h2c).
+func runTestWorker(host, port string) {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/grpc.Echo/Echo", func(rw http.ResponseWriter, req *http.Request) {
+		if ms, _ := strconv.Atoi(req.URL.Query().Get("ms")); ms > 0 {
+			time.Sleep(time.Duration(ms) * time.Millisecond)
+		}
+		body, err := ioutil.ReadAll(req.Body)
+		if err != nil {
+			http.Error(rw, err.Error(), http.StatusBadRequest)
+			return
+		}
+		rw.Header().Set("Content-Type", "application/grpc")
+		rw.Header().Set("Trailer", "Grpc-Status, Grpc-Message")
+		_, _ = rw.Write(body)
+		rw.Header().Set("Grpc-Status", "0")
+		rw.Header().Set("Grpc-Message", "OK")
+	})
+	mux.Handle("/ws", websocket.Handler(func(conn *websocket.Conn) {
+		_, _ = io.Copy(conn, conn)
+	}))
+	mux.HandleFunc("/env", func(rw http.ResponseWriter, req *http.Request) {
+		_ = json.NewEncoder(rw).Encode(testWorkerResponse{PID: os.Getpid(), Env: os.Environ()})
+	})
+	mux.HandleFunc("/fork", func(rw http.ResponseWriter, req *http.Request) {
+		cmd := exec.Command(os.Args[0], req.URL.Query().Get("ms"))
+		cmd.Env = append(os.Environ(), testWorkerEnv+"=sleep")
+		cmd.SysProcAttr = processGroupAttr()
+		if err := cmd.Start(); err != nil {
+			http.Error(rw, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		_ = json.NewEncoder(rw).Encode(testWorkerResponse{PID: os.Getpid(), Child: cmd.Process.Pid})
+	})
+	mux.HandleFunc("/", func(rw http.ResponseWriter, req *http.Request) {
+		if ms, _ := strconv.Atoi(req.URL.Query().Get("ms")); ms > 0 {
+			time.Sleep(time.Duration(ms) * time.Millisecond)
+		}
+		if size, _ := strconv.Atoi(req.URL.Query().Get("size")); size > 0 {
+			_, _ = rw.Write(bytes.Repeat([]byte("x"), size))
+			return
+		}
+		rw.Header().Set("Content-Type", "application/json")
+		if status, _ := strconv.Atoi(req.URL.Query().Get("status")); status > 0 {
+			rw.WriteHeader(status)
+		}
+		_ = json.NewEncoder(rw).Encode(testWorkerResponse{
+			PID:    os.Getpid(),
+			UID:    os.Getuid(),
+			GID:    os.Getgid(),
+			Host:   req.Host,
+			Header: req.Header,
+		})
+	})
+	if err := http.ListenAndServe(net.JoinHostPort(host, port), h2c.NewHandler(mux, &http2.Server{})); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+}
+
+// testConfig returns the configuration of a Stabilizer running a single test
+// worker, which serves one request at a time.
+func testConfig() Config {
+	cfg := DefaultConfig()
+	cfg.Command = os.Args[0]
+	cfg.Args = []string{"{{.Host}}", "{{.Port}}"}
+	cfg.WorkerEnv = []string{testWorkerEnv + "=worker"}
+	cfg.Workers = 1
+	cfg.Concurrency = 1
+	return cfg
+}
+
+// startStabilizer starts a Stabilizer with the given configuration, and a
+// server for its handler. The returned func shuts both down.
+func startStabilizer(t *testing.T, cfg Config) (*Stabilizer, *httptest.Server, func()) {
+	t.Helper()
+	s := New(WithConfig(cfg), WithLogger(logtest.NoOp(t)), WithRegisterer(nil))
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+	if err := s.Start(ctx); err != nil {
+		t.Fatal(err)
+	}
+	srv := httptest.NewServer(s.Handler())
+	return s, srv, func() {
+		srv.Close()
+		ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+		defer cancel()
+		if err := s.Shutdown(ctx); err != nil {
+			t.Error(err)
+		}
+	}
+}
+
+// waitFor polls cond until it is true, failing the test if it is not within
+// timeout.
+func waitFor(t *testing.T, timeout time.Duration, what string, cond func() bool) {
+	t.Helper()
+	deadline := time.Now().Add(timeout)
+	for !cond() {
+		if time.Now().After(deadline) {
+			t.Fatalf("timed out waiting for %s", what)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+// workerPIDs returns the pids of the workers accepting requests.
+func (s *Stabilizer) workerPIDs() []int {
+	s.pool.mu.Lock()
+	defer s.pool.mu.Unlock()
+	var pids []int
+	for _, w := range s.pool.workers {
+		pids = append(pids, w.pid)
+	}
+	return pids
+}
+
+// get makes a GET request with the given header, and decodes the
+// testWorkerResponse to it.
+func get(t *testing.T, client *http.Client, url string, header http.Header) testWorkerResponse {
+	t.Helper()
+	req, err := http.NewRequest("GET", url, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for name, values := range header {
+		req.Header[name] = values
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("got status %v, want %v", resp.StatusCode, http.StatusOK)
+	}
+	var r testWorkerResponse
+	if err := json.NewDecoder(resp.Body).Decode(&r); err != nil {
+		t.Fatal(err)
+	}
+	return r
+}
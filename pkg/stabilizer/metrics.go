@@ -0,0 +1,640 @@
+package stabilizer
+
+import (
+	"net/http"
+	"net/http/httptrace"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// Request outcomes, used to label request metrics.
+const (
+	outcomeOK       = "ok"
+	outcomeTimeout  = "timeout"
+	outcomeHeaders  = "header_timeout"
+	outcomeError    = "error"
+	outcomeCanceled = "canceled"
+	outcomeUpstream = "upstream_error"
+)
+
+// Buckets of the worker lifetime and startup histograms, in seconds. Workers
+// may live from moments to weeks, and take from milliseconds to
+// -worker-startup-timeout to start up.
+var (
+	lifetimeBuckets = []float64{1, 10, 30, 60, 300, 600, 1800, 3600, 3 * 3600, 6 * 3600, 12 * 3600, 24 * 3600, 7 * 24 * 3600}
+	startupBuckets  = []float64{0.05, 0.1, 0.25, 0.5, 1, 2.5, 5, 10, 30, 60}
+)
+
+// metrics are the metrics of a Stabilizer.
+type metrics struct {
+	workerRestartsCounter      *prometheus.CounterVec
+	workerLifetime             *prometheus.HistogramVec
+	workerStartup              prometheus.Histogram
+	workerLastRestart          *prometheus.GaugeVec
+	workerConcurrency          *prometheus.GaugeVec
+	workerBuildInfo            *prometheus.GaugeVec
+	warmupFailuresCounter      prometheus.Counter
+	autoscaleCounter           *prometheus.CounterVec
+	autoscaleQueueWait         prometheus.Gauge
+	autoscaleSaturation        prometheus.Gauge
+	workerKillsCounter         *prometheus.CounterVec
+	workerExitsCounter         *prometheus.CounterVec
+	clientCancellationsCounter prometheus.Counter
+	queueRejectionsCounter     prometheus.Counter
+	shedCounter                prometheus.Counter
+	rateLimitedCounter         *prometheus.CounterVec
+	coalescedCounter           prometheus.Counter
+	mirrorCounter              *prometheus.CounterVec
+	cacheCounter               *prometheus.CounterVec
+	invalidTimeoutsCounter     prometheus.Counter
+	tooLargeCounter            prometheus.Counter
+	upstreamErrorsCounter      *prometheus.CounterVec
+	affinityCounter            *prometheus.CounterVec
+	portConflictsCounter       prometheus.Counter
+	retriesCounter             *prometheus.CounterVec
+	hedgesCounter              prometheus.Counter
+	hedgesWonCounter           prometheus.Counter
+	healthCheckFailures        *prometheus.CounterVec
+	requestsCounter            *prometheus.CounterVec
+	requestDuration            *prometheus.HistogramVec
+	upstreamDuration           prometheus.Histogram
+	workerConnsCounter         *prometheus.CounterVec
+	dialErrorsCounter          prometheus.Counter
+	queueWait                  *prometheus.HistogramVec
+	workerCPU                  *cpuCounter
+	workerRSS                  *prometheus.GaugeVec
+	workerFDs                  *prometheus.GaugeVec
+	workerThreads              *prometheus.GaugeVec
+	workerLogSuppressed        *prometheus.CounterVec
+	workerLogTruncated         *prometheus.CounterVec
+}
+
+// newMetrics returns the metrics of a Stabilizer in the given namespace,
+// which are not registered yet. With routeLabel, requests are also counted by
+// their -metrics-route-label route.
+func newMetrics(namespace string, buckets []float64, routeLabel bool) *metrics {
+	m := &metrics{}
+	m.workerRestartsCounter = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "hss_worker_restarts",
+		Help:      "The total number of worker process restarts, by the reason the previous worker died",
+	}, []string{"reason"})
+	m.workerLifetime = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: namespace,
+		Name:      "hss_worker_lifetime_seconds",
+		Help:      "How long workers ran for, from being started until they exited, by the reason they died",
+		Buckets:   lifetimeBuckets,
+	}, []string{"reason"})
+	m.workerStartup = prometheus.NewHistogram(prometheus.HistogramOpts{
+		Namespace: namespace,
+		Name:      "hss_worker_startup_seconds",
+		Help:      "How long workers took from being started until they were ready to serve requests",
+		Buckets:   startupBuckets,
+	})
+	m.workerLastRestart = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: namespace,
+		Name:      "hss_worker_last_restart_timestamp_seconds",
+		Help:      "The time the worker in each slot was last restarted, in seconds since the Unix epoch",
+	}, []string{"index"})
+	m.workerConcurrency = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: namespace,
+		Name:      "hss_worker_concurrency",
+		Help:      "The number of requests the worker in each slot may serve at once, which is raised to -concurrency over -slow-start after a restart",
+	}, []string{"index"})
+	m.workerBuildInfo = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: namespace,
+		Name:      "hss_worker_build_info",
+		Help:      "Always 1, labeled with the version the worker command printed with -worker-version-arg, if it did",
+	}, []string{"version"})
+	m.warmupFailuresCounter = prometheus.NewCounter(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "hss_worker_warmup_failures",
+		Help:      "The total number of -warmup requests which failed or got a 5xx response",
+	})
+	m.autoscaleCounter = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "hss_autoscale_decisions",
+		Help:      "The total number of times the number of workers was autoscaled, by direction and the trigger: queue_wait, saturation or request when scaling up, or idle when scaling down",
+	}, []string{"direction", "trigger"})
+	m.autoscaleQueueWait = prometheus.NewGauge(prometheus.GaugeOpts{
+		Namespace: namespace,
+		Name:      "hss_autoscale_queue_wait_seconds",
+		Help:      "How long the longest waiting request had been waiting for a worker when the autoscaler last looked, which scales up past -scale-up-queue-wait",
+	})
+	m.autoscaleSaturation = prometheus.NewGauge(prometheus.GaugeOpts{
+		Namespace: namespace,
+		Name:      "hss_autoscale_saturation",
+		Help:      "The fraction of the workers' capacity in use when the autoscaler last looked, which scales up past -scale-up-saturation",
+	})
+	m.workerExitsCounter = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "hss_worker_exits",
+		Help:      "The total number of worker processes which exited, by their exit status as a shell reports it: the exit code, or 128 plus the number of the signal which killed the worker",
+	}, []string{"status"})
+	m.workerKillsCounter = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "hss_worker_kills",
+		Help:      "The total number of worker processes killed, by whether they exited gracefully within -kill-grace or were forcibly killed",
+	}, []string{"mode"})
+	m.clientCancellationsCounter = prometheus.NewCounter(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "hss_client_cancellations",
+		Help:      "The total number of requests cancelled by the client before the worker responded",
+	})
+	m.queueRejectionsCounter = prometheus.NewCounter(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "hss_queue_rejections",
+		Help:      "The total number of requests rejected because no worker became available in time",
+	})
+	m.shedCounter = prometheus.NewCounter(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "hss_requests_shed",
+		Help:      "The total number of requests rejected because -max-inflight requests were already being served",
+	})
+	m.rateLimitedCounter = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "hss_rate_limited",
+		Help:      "The total number of requests rejected by -rate-limit, by a hash of their -rate-limit-key value",
+	}, []string{"key_hash"})
+	m.coalescedCounter = prometheus.NewCounter(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "hss_requests_coalesced",
+		Help:      "The total number of requests sent a copy of the response to an identical request by -single-flight",
+	})
+	m.mirrorCounter = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "hss_mirror_requests",
+		Help:      "The total number of requests sampled for -mirror-command, by whether a copy was sent to the shadow workers (sent) or dropped because they were busy (dropped)",
+	}, []string{"result"})
+	m.cacheCounter = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "hss_cache_requests",
+		Help:      "The total number of GET requests looked up in the -cache-ttl cache, by whether they were served from it (hit) or not (miss)",
+	}, []string{"result"})
+	m.invalidTimeoutsCounter = prometheus.NewCounter(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "hss_invalid_timeout_headers",
+		Help:      "The total number of requests whose timeout header could not be parsed, and which were given the default timeout instead",
+	})
+	m.tooLargeCounter = prometheus.NewCounter(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "hss_requests_too_large",
+		Help:      "The total number of requests rejected because their body was larger than -max-request-bytes",
+	})
+	m.upstreamErrorsCounter = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "hss_upstream_errors",
+		Help:      "The total number of worker responses with a -upstream-5xx-as-error status, which were replaced with a hss_upstream_error, by status code",
+	}, []string{"status"})
+	m.affinityCounter = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "hss_affinity_requests",
+		Help:      "The total number of requests with an -affinity-key, by whether they were served by the worker the key maps to (hit) or by another because it was busy (miss)",
+	}, []string{"result"})
+	m.portConflictsCounter = prometheus.NewCounter(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "hss_port_conflicts",
+		Help:      "The total number of workers restarted on a new port because another process was using theirs",
+	})
+	m.retriesCounter = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "hss_retries",
+		Help:      "The total number of requests retried on another worker, by the reason the previous attempt failed",
+	}, []string{"cause"})
+	m.hedgesCounter = prometheus.NewCounter(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "hss_hedges",
+		Help:      "The total number of hedged requests sent to another worker because the first was slow to respond",
+	})
+	m.hedgesWonCounter = prometheus.NewCounter(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "hss_hedges_won",
+		Help:      "The total number of hedged requests whose response was used because it came first",
+	})
+	m.healthCheckFailures = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "hss_healthcheck_failures",
+		Help:      "The total number of failed health checks, by the slot of the worker that failed them",
+	}, []string{"index"})
+	requestLabels := []string{"method", "status", "source"}
+	if routeLabel {
+		requestLabels = append(requestLabels, "route")
+	}
+	m.requestsCounter = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "hss_requests_total",
+		Help:      "The total number of requests, by method, status class, whether the response came from a worker (worker) or from the stabilizer itself, e.g. an error or cached response (stabilizer), and with -metrics-route-label their normalized path",
+	}, requestLabels)
+	m.requestDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: namespace,
+		Name:      "hss_request_duration_seconds",
+		Help:      "Time taken to serve requests, including time spent waiting for a worker, by outcome, status class and -route prefix",
+		Buckets:   buckets,
+	}, []string{"outcome", "status", "route"})
+	m.upstreamDuration = prometheus.NewHistogram(prometheus.HistogramOpts{
+		Namespace: namespace,
+		Name:      "hss_upstream_duration_seconds",
+		Help:      "Time taken for workers to respond with headers, excluding time spent waiting for a worker",
+		Buckets:   buckets,
+	})
+	m.workerConnsCounter = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "hss_worker_connections",
+		Help:      "The total number of connections to workers that requests were sent on, by whether they were newly opened (opened) or kept alive from an earlier request (reused)",
+	}, []string{"result"})
+	m.dialErrorsCounter = prometheus.NewCounter(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "hss_worker_dial_errors",
+		Help:      "The total number of failed attempts to connect to a worker",
+	})
+	m.queueWait = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: namespace,
+		Name:      "hss_queue_wait_seconds",
+		Help:      "Time requests spent waiting for a worker, by -priority-header priority",
+		Buckets:   buckets,
+	}, []string{"priority"})
+	m.workerCPU = &cpuCounter{
+		desc: prometheus.NewDesc(
+			prometheus.BuildFQName(namespace, "", "hss_worker_cpu_seconds_total"),
+			"The total CPU time used by the worker in each slot since it started, in seconds, which starts from zero again when the worker is replaced (Linux only)",
+			[]string{"index"}, nil),
+		seconds: make(map[string]float64),
+	}
+	m.workerRSS = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: namespace,
+		Name:      "hss_worker_rss_bytes",
+		Help:      "The resident memory of the worker in each slot, in bytes (Linux only)",
+	}, []string{"index"})
+	m.workerFDs = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: namespace,
+		Name:      "hss_worker_open_fds",
+		Help:      "The number of open file descriptors of the worker in each slot (Linux only)",
+	}, []string{"index"})
+	m.workerThreads = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: namespace,
+		Name:      "hss_worker_threads",
+		Help:      "The number of threads of the worker in each slot (Linux only)",
+	}, []string{"index"})
+	m.workerLogSuppressed = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "hss_worker_log_lines_suppressed",
+		Help:      "The total number of lines of worker output not logged due to -worker-log-rate, by the slot of the worker",
+	}, []string{"index"})
+	m.workerLogTruncated = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "hss_worker_log_lines_truncated",
+		Help:      "The total number of lines of worker output truncated to -worker-log-max-line-bytes, by the slot of the worker",
+	}, []string{"index"})
+	return m
+}
+
+// cpuCounter is the hss_worker_cpu_seconds_total metric, a counter of the
+// CPU time of the worker in each slot as last read from the system. It is
+// not a prometheus.CounterVec, which can only be added to, as the total is
+// read rather than counted; when a worker is replaced, it goes back to zero
+// like the counters of a restarted process.
+type cpuCounter struct {
+	desc *prometheus.Desc
+
+	mu      sync.Mutex
+	seconds map[string]float64
+}
+
+// set records the CPU time of the worker in the slot with the given index.
+func (c *cpuCounter) set(index string, seconds float64) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.seconds[index] = seconds
+}
+
+// delete forgets the CPU time of the slot with the given index.
+func (c *cpuCounter) delete(index string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	delete(c.seconds, index)
+}
+
+func (c *cpuCounter) Describe(ch chan<- *prometheus.Desc) {
+	ch <- c.desc
+}
+
+func (c *cpuCounter) Collect(ch chan<- prometheus.Metric) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for index, seconds := range c.seconds {
+		ch <- prometheus.MustNewConstMetric(c.desc, prometheus.CounterValue, seconds, index)
+	}
+}
+
+// stateMetrics returns metrics which report the stabilizer's state.
+func (s *Stabilizer) stateMetrics(namespace string) []prometheus.Collector {
+	return []prometheus.Collector{
+		prometheus.NewGaugeFunc(prometheus.GaugeOpts{
+			Namespace: namespace,
+			Name:      "hss_workers_tracked",
+			Help:      "The number of workers currently tracked by the stabilizer, which should stay close to -workers",
+		}, func() float64 {
+			s.workerByAddrMu.RLock()
+			defer s.workerByAddrMu.RUnlock()
+			return float64(len(s.workerByAddr))
+		}),
+		prometheus.NewGaugeFunc(prometheus.GaugeOpts{
+			Namespace: namespace,
+			Name:      "hss_draining",
+			Help:      "1 if the stabilizer is in drain mode, in which /readyz reports it is not ready, and 0 otherwise",
+		}, func() float64 {
+			if s.Draining() {
+				return 1
+			}
+			return 0
+		}),
+		prometheus.NewGaugeFunc(prometheus.GaugeOpts{
+			Namespace: namespace,
+			Name:      "hss_cache_bytes",
+			Help:      "Roughly how much memory the responses in the -cache-ttl cache take up",
+		}, func() float64 {
+			if s.cache == nil {
+				return 0
+			}
+			return float64(s.cache.cachedBytes())
+		}),
+		prometheus.NewGaugeFunc(prometheus.GaugeOpts{
+			Namespace: namespace,
+			Name:      "hss_workers_target",
+			Help:      "The number of workers that should be running",
+		}, func() float64 {
+			return float64(s.targetWorkers())
+		}),
+		prometheus.NewGaugeFunc(prometheus.GaugeOpts{
+			Namespace: namespace,
+			Name:      "hss_workers_alive",
+			Help:      "The number of worker processes currently running",
+		}, func() float64 {
+			return float64(s.workersAlive())
+		}),
+		prometheus.NewGaugeFunc(prometheus.GaugeOpts{
+			Namespace: namespace,
+			Name:      "hss_workers_crashlooping",
+			Help:      "The number of worker slots whose workers keep failing, and which are waiting longer and longer before restarting them",
+		}, func() float64 {
+			n, _ := s.crashLoopingSlots()
+			return float64(n)
+		}),
+		prometheus.NewGaugeFunc(prometheus.GaugeOpts{
+			Namespace: namespace,
+			Name:      "hss_pool_available_slots",
+			Help:      "The number of additional requests that could be handed to a worker immediately",
+		}, func() float64 {
+			availableSlots, _ := s.pool.stats()
+			return float64(availableSlots)
+		}),
+		prometheus.NewGaugeFunc(prometheus.GaugeOpts{
+			Namespace: namespace,
+			Name:      "hss_requests_queued",
+			Help:      "The number of requests waiting for a worker to become available",
+		}, func() float64 {
+			_, queued := s.pool.stats()
+			return float64(queued)
+		}),
+		prometheus.NewGaugeFunc(prometheus.GaugeOpts{
+			Namespace: namespace,
+			Name:      "hss_requests_inflight",
+			Help:      "The number of requests being served, including those waiting for a worker",
+		}, func() float64 {
+			return float64(atomic.LoadInt64(&s.inflight))
+		}),
+	}
+}
+
+// collectors returns all of the metrics.
+func (m *metrics) collectors() []prometheus.Collector {
+	return []prometheus.Collector{
+		m.workerRestartsCounter,
+		m.workerLifetime,
+		m.workerStartup,
+		m.workerLastRestart,
+		m.workerConcurrency,
+		m.workerBuildInfo,
+		m.warmupFailuresCounter,
+		m.autoscaleCounter,
+		m.autoscaleQueueWait,
+		m.autoscaleSaturation,
+		m.workerKillsCounter,
+		m.workerExitsCounter,
+		m.clientCancellationsCounter,
+		m.queueRejectionsCounter,
+		m.shedCounter,
+		m.rateLimitedCounter,
+		m.coalescedCounter,
+		m.mirrorCounter,
+		m.cacheCounter,
+		m.invalidTimeoutsCounter,
+		m.tooLargeCounter,
+		m.upstreamErrorsCounter,
+		m.affinityCounter,
+		m.portConflictsCounter,
+		m.retriesCounter,
+		m.hedgesCounter,
+		m.hedgesWonCounter,
+		m.healthCheckFailures,
+		m.requestsCounter,
+		m.requestDuration,
+		m.upstreamDuration,
+		m.workerConnsCounter,
+		m.dialErrorsCounter,
+		m.queueWait,
+		m.workerCPU,
+		m.workerRSS,
+		m.workerFDs,
+		m.workerThreads,
+		m.workerLogSuppressed,
+		m.workerLogTruncated,
+	}
+}
+
+// registerMetrics registers the stabilizer's metrics with the given
+// registerer, or does nothing if it is nil. If any metric can't be
+// registered, e.g. because another with the same name already is, none are
+// left registered and an error is returned.
+func (s *Stabilizer) registerMetrics(reg prometheus.Registerer, namespace string) error {
+	if reg == nil {
+		return nil
+	}
+	collectors := append(s.metrics.collectors(), s.stateMetrics(namespace)...)
+	if s.buildInfo != nil {
+		collectors = append(collectors, s.buildInfoMetric(namespace))
+	}
+	for i, c := range collectors {
+		if err := reg.Register(c); err != nil {
+			for _, registered := range collectors[:i] {
+				reg.Unregister(registered)
+			}
+			return err
+		}
+	}
+	s.registerer = reg
+	s.registered = collectors
+	return nil
+}
+
+// unregisterMetrics unregisters the metrics registered by registerMetrics.
+func (s *Stabilizer) unregisterMetrics() {
+	for _, c := range s.registered {
+		s.registerer.Unregister(c)
+	}
+	s.registered = nil
+	for _, child := range s.childStabilizers() {
+		child.unregisterMetrics()
+	}
+}
+
+// metricsNamespace returns the metric namespace for the given
+// -prometheus-app-name, with characters that are not valid in metric names
+// replaced by underscores.
+func metricsNamespace(appName string) string {
+	namespace := []byte(appName)
+	for i, c := range namespace {
+		valid := c == '_' || c == ':' || (c >= 'a' && c <= 'z') || (c >= 'A' && c <= 'Z') || (i > 0 && c >= '0' && c <= '9')
+		if !valid {
+			namespace[i] = '_'
+		}
+	}
+	return string(namespace)
+}
+
+// Sources of responses, used to label the requests metric.
+const (
+	sourceWorker     = "worker"
+	sourceStabilizer = "stabilizer"
+)
+
+// instrumentRequests wraps next to count every request, including those
+// rejected before they reach ServeHTTP, and to record how long the requests
+// which did reach it took to serve. They are recorded in the metrics of the
+// Stabilizer whose ServeHTTP handled the request, which is that of a pool or
+// variant if the request was sent to one.
+func (s *Stabilizer) instrumentRequests(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		start := time.Now()
+		entry, tracked := trackOutcome(req)
+		recorder := &statusRecorder{ResponseWriter: rw}
+		next.ServeHTTP(recorder, tracked)
+
+		served, source := s, sourceStabilizer
+		if pr := entry.pr; pr != nil {
+			served = entry.s
+			if pr.outcome == outcomeOK {
+				source = sourceWorker
+			}
+			served.metrics.requestDuration.WithLabelValues(pr.outcome, statusClass(recorder.status), pr.route.label()).Observe(time.Since(start).Seconds())
+		}
+		labels := []string{methodLabel(req.Method), statusClass(recorder.status), source}
+		if served.routeLabel != nil {
+			labels = append(labels, served.normalizePath(req.URL.Path))
+		}
+		served.metrics.requestsCounter.WithLabelValues(labels...).Inc()
+	})
+}
+
+// methodLabel returns the method label of a request with the given method,
+// which is "other" for non-standard methods so that clients cannot create
+// any number of metrics.
+func methodLabel(method string) string {
+	switch method {
+	case http.MethodGet, http.MethodHead, http.MethodPost, http.MethodPut, http.MethodPatch,
+		http.MethodDelete, http.MethodConnect, http.MethodOptions, http.MethodTrace:
+		return method
+	}
+	return "other"
+}
+
+// normalizePath returns the route label of a request with the given path for
+// -metrics-route-label: each segment of the path matching the pattern is
+// replaced with ":id".
+func (s *Stabilizer) normalizePath(path string) string {
+	segments := strings.Split(path, "/")
+	for i, segment := range segments {
+		if segment != "" && s.routeLabel.MatchString(segment) {
+			segments[i] = ":id"
+		}
+	}
+	return strings.Join(segments, "/")
+}
+
+// statusClass returns the class of an HTTP status code, e.g. "2xx".
+func statusClass(code int) string {
+	if code == 0 {
+		// Nothing was written, so net/http responds with 200.
+		code = http.StatusOK
+	}
+	return strconv.Itoa(code/100) + "xx"
+}
+
+// statusRecorder records the status code written to a ResponseWriter, and
+// the number of bytes written.
+type statusRecorder struct {
+	http.ResponseWriter
+	status int
+	bytes  int64
+}
+
+func (r *statusRecorder) WriteHeader(code int) {
+	if r.status == 0 {
+		r.status = code
+	}
+	r.ResponseWriter.WriteHeader(code)
+}
+
+func (r *statusRecorder) Write(p []byte) (int, error) {
+	if r.status == 0 {
+		r.status = http.StatusOK
+	}
+	n, err := r.ResponseWriter.Write(p)
+	r.bytes += int64(n)
+	return n, err
+}
+
+func (r *statusRecorder) Flush() {
+	if f, ok := r.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+// Unwrap allows http.ResponseController to reach the underlying
+// ResponseWriter, e.g. to hijack connections.
+func (r *statusRecorder) Unwrap() http.ResponseWriter {
+	return r.ResponseWriter
+}
+
+// instrumentedTransport records how long workers take to respond, and how
+// connections to them are used.
+type instrumentedTransport struct {
+	http.RoundTripper
+	metrics *metrics
+}
+
+func (t instrumentedTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	trace := &httptrace.ClientTrace{
+		GotConn: func(info httptrace.GotConnInfo) {
+			result := "opened"
+			if info.Reused {
+				result = "reused"
+			}
+			t.metrics.workerConnsCounter.WithLabelValues(result).Inc()
+		},
+		ConnectDone: func(network, addr string, err error) {
+			if err != nil {
+				t.metrics.dialErrorsCounter.Inc()
+			}
+		},
+	}
+	start := time.Now()
+	resp, err := t.RoundTripper.RoundTrip(req.WithContext(httptrace.WithClientTrace(req.Context(), trace)))
+	t.metrics.upstreamDuration.Observe(time.Since(start).Seconds())
+	return resp, err
+}
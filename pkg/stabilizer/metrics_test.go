@@ -0,0 +1,25 @@
+package stabilizer
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+func TestWorkerCPUCounter(t *testing.T) {
+	m := newMetrics("", nil, false)
+	m.workerCPU.set("0", 1.5)
+	m.workerCPU.set("1", 2)
+	m.workerCPU.set("1", 3)
+	m.forgetProcStats(0)
+
+	want := `
+# HELP hss_worker_cpu_seconds_total The total CPU time used by the worker in each slot since it started, in seconds, which starts from zero again when the worker is replaced (Linux only)
+# TYPE hss_worker_cpu_seconds_total counter
+hss_worker_cpu_seconds_total{index="1"} 3
+`
+	if err := testutil.CollectAndCompare(m.workerCPU, strings.NewReader(want)); err != nil {
+		t.Error(err)
+	}
+}
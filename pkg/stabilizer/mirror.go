@@ -0,0 +1,106 @@
+package stabilizer
+
+import (
+	"bytes"
+	"io"
+	"io/ioutil"
+	"math/rand"
+	"net/http"
+	"time"
+)
+
+// mirrorConfig returns the configuration of the -mirror-command workers of a
+// Stabilizer with the given configuration. They are configured the same way,
+// other than their command and number, and how requests are sent to them.
+func mirrorConfig(cfg Config) Config {
+	cfg.Command, cfg.Args = cfg.MirrorCommand, cfg.MirrorArgs
+	cfg.Workers = cfg.MirrorWorkers
+	cfg.MinWorkers, cfg.MaxWorkers = 0, 0
+	// Mirrored requests have their own timeout, and are not retried, hedged
+	// or recorded as poison requests.
+	cfg.Timeout, cfg.TimeoutHeader, cfg.TimeoutMin, cfg.TimeoutMax = cfg.MirrorTimeout, "", 0, 0
+	cfg.Routes = nil
+	cfg.MaxRetries, cfg.HedgeAfter = 0, 0
+	cfg.AffinityKey = ""
+	cfg.PoisonRequestDir = ""
+	// Drop mirrored requests rather than queueing them if no shadow worker is
+	// free, so that a shadow worker which falls behind does not pile them up.
+	cfg.QueueTimeout = time.Nanosecond
+	return cfg
+}
+
+// mirrorable reports whether a request may be mirrored: it must be
+// idempotent or a POST, and not a WebSocket upgrade.
+func mirrorable(req *http.Request) bool {
+	switch req.Method {
+	case http.MethodGet, http.MethodHead, http.MethodOptions, http.MethodPut, http.MethodDelete, http.MethodPost:
+		return !isWebSocket(req)
+	}
+	return false
+}
+
+// mirrorBody returns a copy of the request's body, if it has one no larger
+// than max, reporting whether it does or has no body. The body is read into
+// memory, and the request is left to send what was read.
+func mirrorBody(req *http.Request, max int64) (body []byte, ok bool) {
+	if req.Body == nil || req.Body == http.NoBody || req.ContentLength == 0 {
+		return nil, true
+	}
+	if req.ContentLength < 0 || req.ContentLength > max {
+		return nil, false
+	}
+	if req.GetBody != nil {
+		// The body was buffered already, e.g. so that it can be retried.
+		rc, err := req.GetBody()
+		if err != nil {
+			return nil, false
+		}
+		defer rc.Close()
+		body, err = ioutil.ReadAll(rc)
+		return body, err == nil
+	}
+	body, err := ioutil.ReadAll(io.LimitReader(req.Body, req.ContentLength))
+	req.Body = struct {
+		io.Reader
+		io.Closer
+	}{io.MultiReader(bytes.NewReader(body), req.Body), req.Body}
+	return body, err == nil && int64(len(body)) == req.ContentLength
+}
+
+// mirrorRequest sends a copy of MirrorSample of requests to the shadow
+// workers in the background, for -mirror-command. Their responses are
+// discarded, so whether they fail or how long they take never affects the
+// request. Requests are dropped rather than mirrored if no shadow worker is
+// free.
+func (s *Stabilizer) mirrorRequest(req *http.Request) {
+	if s.mirror == nil || s.cfg.MirrorSample <= 0 || rand.Float64() >= s.cfg.MirrorSample || !mirrorable(req) {
+		return
+	}
+	if available, _ := s.mirror.pool.stats(); available == 0 {
+		s.metrics.mirrorCounter.WithLabelValues("dropped").Inc()
+		return
+	}
+	body, ok := mirrorBody(req, s.cfg.MirrorMaxBodyBytes)
+	if !ok {
+		return
+	}
+	mirrored := req.Clone(s.mirror.ctx)
+	mirrored.Body, mirrored.GetBody = http.NoBody, nil
+	if body != nil {
+		mirrored.Body = ioutil.NopCloser(bytes.NewReader(body))
+	}
+	s.metrics.mirrorCounter.WithLabelValues("sent").Inc()
+	go s.mirror.instrumentRequests(s.mirror).ServeHTTP(discardWriter{header: make(http.Header)}, mirrored)
+}
+
+// discardWriter is the ResponseWriter of mirrored requests, which discards
+// the response.
+type discardWriter struct {
+	header http.Header
+}
+
+func (w discardWriter) Header() http.Header { return w.header }
+
+func (discardWriter) Write(p []byte) (int, error) { return len(p), nil }
+
+func (discardWriter) WriteHeader(int) {}
@@ -0,0 +1,513 @@
+package stabilizer
+
+import (
+	"net/http"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/sourcegraph/log"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// Protocols which may be used to talk to workers, see Config.WorkerProtocol.
+const (
+	ProtocolHTTP1 = "http1"
+	ProtocolH2C   = "h2c"
+)
+
+// Config configures a Stabilizer. Each field corresponds to the
+// http-server-stabilizer flag of the same name, whose usage describes it in
+// more detail; zero values disable optional behavior as they do for the
+// flags. DefaultConfig returns the flags' defaults.
+type Config struct {
+	// Command is the worker command, and Args its arguments, in which
+	// {{.Host}}, {{.Port}} and {{.Socket}} are replaced with the host and
+	// port, or socket, the worker should listen on. Args may also use
+	// {{.WorkerIndex}}, the worker's slot which is the same across
+	// restarts, {{.Hostname}}, and {{.Port2}} to {{.Port9}}, extra ports
+	// allocated for the worker; they are then executed as text/template
+	// templates.
+	Command string
+	Args    []string
+
+	// WorkerEnv are environment variables, KEY=VALUE, set for workers on
+	// top of the stabilizer's own, or instead of them if WorkerEnvClear is
+	// set. They may use the same template variables as Args. Workers'
+	// environments are logged at debug level, with the values of variables
+	// whose names match WorkerEnvRedact redacted.
+	WorkerEnv       []string
+	WorkerEnvClear  bool
+	WorkerEnvRedact string
+
+	// WorkerDir is the working directory of workers, which is the
+	// stabilizer's if empty. It may use the same template variables as Args,
+	// in which case each worker's directory is created for it, and removed
+	// once it exits. WorkerStdinFile is the file workers read their standard
+	// input from, /dev/null if empty. WorkerUmask is the file mode creation
+	// mask, in octal, workers are started with, or the stabilizer's if empty.
+	WorkerDir       string
+	WorkerStdinFile string
+	WorkerUmask     string
+
+	// WorkerUser and WorkerGroup are the user and group, each a name or
+	// numeric id, workers run as, which requires the stabilizer to run as
+	// root. The group defaults to the user's primary group. They are ignored
+	// on platforms other than Linux.
+	WorkerUser  string
+	WorkerGroup string
+
+	// WorkerCgroup are cgroup v2 limits, FILE=VALUE, e.g. memory.max=512M or
+	// cpu.max=50000 100000, set for each worker in a cgroup of its own under
+	// WorkerCgroupParent, DefaultWorkerCgroupParent if empty. Workers whose
+	// processes are killed by the OOM killer are restarted for reason "oom".
+	// Should cgroups not be available, workers run without limits.
+	WorkerCgroup       []string
+	WorkerCgroupParent string
+
+	// WorkerNice is the niceness, from -20 to 19, workers are run at, or 0
+	// to leave it unchanged. WorkerCPUs, if non-zero, is the number of CPUs
+	// each worker is pinned to, spread across those the stabilizer may run
+	// on, and what the WorkerCPUsEnv environment variables are set to for
+	// them. Niceness and CPU affinity are only set on Linux.
+	WorkerNice    int
+	WorkerCPUs    int
+	WorkerCPUsEnv []string
+
+	// CanaryCommand is a command, with the arguments CanaryArgs, run by
+	// CanaryWorkers extra workers which are sent CanaryWeight (from 0 to 1)
+	// of requests, e.g. to try out a new version of the worker. Metrics are
+	// then labelled with the variant, stable or canary, that served them.
+	CanaryCommand string
+	CanaryArgs    []string
+	CanaryWeight  float64
+	CanaryWorkers int
+
+	// MirrorCommand is a command, with the arguments MirrorArgs, run by
+	// MirrorWorkers shadow workers which are sent a copy of MirrorSample
+	// (from 0 to 1) of requests, whose responses are discarded. Requests
+	// with a body are only mirrored if it is no larger than
+	// MirrorMaxBodyBytes, and mirrored requests time out after
+	// MirrorTimeout. They are dropped rather than queued if the shadow
+	// workers are busy.
+	MirrorCommand      string
+	MirrorArgs         []string
+	MirrorSample       float64
+	MirrorWorkers      int
+	MirrorTimeout      time.Duration
+	MirrorMaxBodyBytes int64
+
+	// Upstreams are the URLs, such as http://10.0.0.1:4443, of servers run
+	// elsewhere to send requests to instead of running workers, in which
+	// case Command must be empty. Each upstream is a worker which is never
+	// killed: it is ejected for EjectDuration instead, e.g. after a request
+	// to it timed out, and then sent requests again once it passes a health
+	// check.
+	Upstreams     []string
+	EjectDuration time.Duration
+
+	// Pools run other sets of workers, each sent the requests whose path
+	// starts with its prefix. Requests matching no pool are sent to the
+	// workers running Command, or rejected with 404 if Command is empty.
+	// Metrics are then labelled with the pool that served them.
+	Pools []Pool
+
+	// Workers is the number of workers to run, each of which serves up to
+	// Concurrency requests at once.
+	Workers     int
+	Concurrency int
+
+	// MaxWorkers, if positive, makes the number of workers vary from
+	// MinWorkers to MaxWorkers rather than be Workers. A worker is added
+	// when the longest waiting request has waited ScaleUpQueueWait, or
+	// ScaleUpSaturation of the workers' capacity is in use, for ScaleUpAfter;
+	// and the least recently used worker is drained once it has been idle
+	// for ScaleDownIdle. With MinWorkers 0, a worker is started once a
+	// request arrives.
+	MinWorkers        int
+	MaxWorkers        int
+	ScaleUpQueueWait  time.Duration
+	ScaleUpSaturation float64
+	ScaleUpAfter      time.Duration
+	ScaleDownIdle     time.Duration
+
+	// Balance is the strategy for choosing the worker to serve a request,
+	// BalancePool (the default if empty) or BalanceLeastLoaded.
+	Balance string
+
+	// SlowStart, if positive, is how long a worker which replaces one that
+	// died or was recycled takes to be allowed Concurrency requests at once.
+	// It is allowed one at first, and more along SlowStartCurve,
+	// SlowStartLinear (the default if empty) or SlowStartExponential.
+	SlowStart      time.Duration
+	SlowStartCurve string
+
+	// AffinityKey is a header, or a query parameter given as
+	// "query:name", whose value is used to send requests with the same
+	// value to the same worker while it has capacity.
+	AffinityKey string
+
+	// PriorityHeader is a header whose value, "high" or "low", gives the
+	// priority of a request; requests of higher priority are handed workers
+	// first. PriorityReserved is the fraction of the pool's capacity which
+	// only high priority requests may use, and requests which have waited
+	// PriorityPromoteAfter are handed the next worker whatever their
+	// priority, if non-zero.
+	PriorityHeader       string
+	PriorityReserved     float64
+	PriorityPromoteAfter time.Duration
+
+	// Timeout is how long a request may take before its worker is killed,
+	// which clients may override with TimeoutHeader within TimeoutMin and
+	// TimeoutMax.
+	Timeout              time.Duration
+	TimeoutHeader        string
+	TimeoutMin           time.Duration
+	TimeoutMax           time.Duration
+	ForwardTimeoutHeader bool
+	DeadlineHeader       string
+
+	// TimeoutResetsOnActivity starts the timeout of a request over whenever
+	// its worker sends part of the response.
+	TimeoutResetsOnActivity bool
+	FlushInterval           time.Duration
+	WSIdleTimeout           time.Duration
+
+	// AccessLog logs each request, sampling successful ones at
+	// AccessLogSample (from 0 to 1); failed requests are always logged.
+	AccessLog       bool
+	AccessLogSample float64
+
+	// Routes override settings for requests by path prefix.
+	Routes []Route
+
+	// QueueTimeout is how long a request may wait for a worker (0 waits up
+	// to the request's timeout), after which it is rejected with
+	// QueueTimeoutStatus.
+	QueueTimeout       time.Duration
+	QueueTimeoutStatus int
+
+	// SingleFlight makes GET and HEAD requests identical to one being
+	// served, by URL and the SingleFlightHeaders, wait for its response and
+	// share it. Responses larger than SingleFlightMaxBytes are not shared.
+	SingleFlight         bool
+	SingleFlightHeaders  []string
+	SingleFlightMaxBytes int64
+
+	// CacheTTL caches successful responses to GET requests for this long, by
+	// URL and the CacheVary headers, if non-zero. Up to CacheMaxBytes of
+	// responses are cached, forgetting the least recently used first.
+	CacheTTL      time.Duration
+	CacheVary     []string
+	CacheMaxBytes int64
+
+	// DrainReject rejects requests with status 503 and the reason
+	// hss_draining in drain mode (see Stabilizer.Drain), rather than serving
+	// them.
+	DrainReject bool
+
+	// MaxInflight limits the number of requests served at once, including
+	// those waiting for a worker, if non-zero. Further requests are rejected
+	// with status 429 and the reason hss_overloaded.
+	MaxInflight int
+
+	// RateLimit limits each client to this many requests per second on
+	// average, in bursts of up to RateLimitBurst (RateLimit rounded up if
+	// zero), if non-zero. Further requests are rejected with status 429 and
+	// the reason hss_rate_limited. Clients are told apart by the header
+	// RateLimitKey, or by IP if it is empty.
+	RateLimit      float64
+	RateLimitBurst int
+	RateLimitKey   string
+
+	// TimeoutStatus is the status code of responses to requests that timed
+	// out, and ErrorStatus that of responses to requests that failed on
+	// their worker for any other reason.
+	TimeoutStatus int
+	ErrorStatus   int
+
+	// ErrorTemplate is the path of an html/template file used to render
+	// error responses to clients which prefer HTML, instead of a built-in
+	// page. It is executed with the fields of Err and Status, the text of
+	// the status code.
+	ErrorTemplate string
+
+	// Upstream5xxAsError are statuses of worker responses which are replaced
+	// with a hss_upstream_error, holding the worker's response body in its
+	// detail, rather than passed on as they are.
+	Upstream5xxAsError []int
+
+	MaxRequestBytes       int64
+	MaxRetries            int
+	RetryBufferMaxBytes   int64
+	HedgeAfter            time.Duration
+	HedgeMax              int
+	TrustForwardedHeaders bool
+	PreserveHost          bool
+
+	// KillGrace is how long a worker is given to exit after SIGTERM before
+	// it is sent SIGKILL (0 kills immediately).
+	KillGrace time.Duration
+
+	// DrainTimeout is how long a draining worker, e.g. one being recycled,
+	// is given to finish the requests it is serving before it is killed
+	// anyway (0 waits for them however long they take).
+	DrainTimeout time.Duration
+
+	// StuckDumpSignal is a signal, such as "SIGQUIT", sent to a worker killed
+	// for a timeout so that it dumps its stacks, which are logged. It is
+	// given StuckDumpGrace to do so before it is killed.
+	StuckDumpSignal string
+	StuckDumpGrace  time.Duration
+
+	// PoisonRequestDir is a directory to which each request that times out
+	// and gets its worker killed is written, with up to
+	// PoisonRequestBodyBytes of its body. Only the newest PoisonRequestKeep
+	// files are kept.
+	PoisonRequestDir       string
+	PoisonRequestBodyBytes int64
+	PoisonRequestKeep      int
+
+	// WorkerLogFormat is the format of the workers' output, LogFormatText
+	// or LogFormatJSON.
+	WorkerLogFormat string
+
+	// WorkerStderrLevel is the level at which lines the workers write to
+	// stderr are logged, LevelWarn if empty. Lines written to stdout are
+	// logged at LevelInfo.
+	WorkerStderrLevel string
+
+	// WorkerLogMaxLineBytes truncates longer lines of worker output, and
+	// WorkerLogRate limits the lines logged per second per worker, if
+	// non-zero.
+	WorkerLogMaxLineBytes int64
+	WorkerLogRate         float64
+
+	// WorkerLogTail is the number of lines of each worker's most recent
+	// output which are logged together when it fails, and included in error
+	// responses if DebugErrorResponses is set.
+	WorkerLogTail       int
+	DebugErrorResponses bool
+
+	// DebugHeaders sets WorkerHeader and the other debugging headers on
+	// responses to requests which were sent to a worker.
+	DebugHeaders bool
+
+	// WorkerHost is the address workers listen on and are sent requests
+	// at, e.g. ::1 on IPv6-only hosts, which replaces {{.Host}} in Args. It
+	// is 127.0.0.1 if empty.
+	WorkerHost string
+
+	WorkerSocketDir             string
+	WorkerPortFromOutput        string
+	WorkerPortRange             string
+	WorkerProtocol              string
+	WorkerDialTimeout           time.Duration
+	WorkerResponseHeaderTimeout time.Duration
+	WorkerReadyPath             string
+	WorkerStartupTimeout        time.Duration
+	WorkerMaxRequests           int
+	WorkerMaxAge                time.Duration
+	WorkerMaxRSS                int64
+	UnhealthyAfter5xx           int
+
+	// WorkerMaxIdleConnsPerHost is the number of idle keep-alive
+	// connections kept open to each worker, which is Concurrency if zero,
+	// and WorkerIdleConnTimeout how long they are kept open for (forever if
+	// zero). WorkerDisableKeepAlives opens a new connection for every
+	// request instead. They are ignored with ProtocolH2C, which sends all
+	// requests to a worker over one connection.
+	WorkerMaxIdleConnsPerHost int
+	WorkerIdleConnTimeout     time.Duration
+	WorkerDisableKeepAlives   bool
+
+	HealthCheckPath     string
+	HealthCheckInterval time.Duration
+	HealthCheckTimeout  time.Duration
+	HealthCheckFailures int
+	HealthyMinWorkers   int
+
+	// WatchWorkerBinary replaces the workers one at a time, as Rollout does,
+	// whenever the worker binary changes on disk.
+	WatchWorkerBinary bool
+
+	// Warmup are requests, such as "GET /health/full", sent to each worker
+	// once it is ready, one at a time and each within WarmupTimeout, before
+	// it is handed out. A worker whose warmup requests fail or get a 5xx
+	// response is handed out all the same, unless WarmupRequired is set, in
+	// which case it is restarted as having failed to start up.
+	Warmup         []string
+	WarmupTimeout  time.Duration
+	WarmupRequired bool
+
+	// WorkerVersionArg is an argument, such as --version, with which the
+	// worker command prints its version, if not empty. It is run with it
+	// on startup, and again whenever WatchWorkerBinary sees the binary
+	// change.
+	WorkerVersionArg string
+
+	// Reap waits for any child process that exits, such as a process a
+	// worker started which was orphaned, so that no zombies are left behind
+	// when the stabilizer runs as PID 1. Elsewhere, the stabilizer makes
+	// itself a subreaper so that orphans of its workers are its children.
+	// It is only supported on Linux.
+	Reap bool
+
+	// MaxRestarts is the number of worker failures within
+	// MaxRestartsWindow after which Exceeded is closed, if non-zero.
+	MaxRestarts       int
+	MaxRestartsWindow time.Duration
+
+	// StartupRequireReady makes Start wait for a worker to become ready,
+	// rather than only checking that the worker command runs for a moment.
+	StartupRequireReady bool
+
+	// PrometheusAppName is the namespace of metrics, in which characters
+	// that are not valid in metric names are replaced by underscores.
+	// PrometheusBuckets are the request duration histogram buckets.
+	PrometheusAppName string
+	PrometheusBuckets []float64
+
+	// ProcMetricsInterval is how often the CPU time, resident memory, open
+	// file descriptors and threads of each worker are recorded in metrics,
+	// which are disabled if zero. It is ignored on platforms other than
+	// Linux.
+	ProcMetricsInterval time.Duration
+
+	// MetricsRouteLabel is a pattern matching the segments of request paths
+	// which vary, such as IDs, if not empty. Requests are then also counted
+	// by a route label holding their path with such segments replaced by
+	// ":id".
+	MetricsRouteLabel string
+
+	// OTelEndpoint is the URL of an OTLP/HTTP collector, such as
+	// http://localhost:4318, to export a span for each request to, if not
+	// empty. OTelSampleRatio is the ratio of traces that are sampled, other
+	// than those continuing a caller's trace, which are sampled if the
+	// caller's was.
+	OTelEndpoint    string
+	OTelSampleRatio float64
+}
+
+// DefaultConfig returns the default configuration, without a command.
+func DefaultConfig() Config {
+	return Config{
+		Workers:                8,
+		CanaryWorkers:          1,
+		MirrorSample:           0.01,
+		MirrorWorkers:          1,
+		MirrorTimeout:          2 * time.Second,
+		MirrorMaxBodyBytes:     64 << 10,
+		Concurrency:            10,
+		ScaleUpQueueWait:       100 * time.Millisecond,
+		ScaleUpSaturation:      0.8,
+		ScaleUpAfter:           15 * time.Second,
+		ScaleDownIdle:          10 * time.Minute,
+		Balance:                BalancePool,
+		SlowStartCurve:         SlowStartLinear,
+		PriorityPromoteAfter:   5 * time.Second,
+		Timeout:                10 * time.Second,
+		TimeoutHeader:          "X-Stabilize-Timeout",
+		QueueTimeoutStatus:     http.StatusServiceUnavailable,
+		TimeoutStatus:          http.StatusGatewayTimeout,
+		ErrorStatus:            http.StatusServiceUnavailable,
+		RetryBufferMaxBytes:    1 << 20,
+		HedgeMax:               1,
+		AccessLogSample:        1,
+		PreserveHost:           true,
+		DebugHeaders:           true,
+		WorkerProtocol:         ProtocolHTTP1,
+		WorkerLogFormat:        LogFormatText,
+		WorkerStderrLevel:      LevelWarn,
+		WorkerLogTail:          100,
+		StuckDumpGrace:         2 * time.Second,
+		PoisonRequestBodyBytes: 64 << 10,
+		PoisonRequestKeep:      50,
+		SingleFlightHeaders:    []string{"Authorization", "Cookie", "Accept", "Accept-Encoding"},
+		SingleFlightMaxBytes:   1 << 20,
+		CacheVary:              []string{"Authorization", "Cookie", "Accept", "Accept-Encoding"},
+		CacheMaxBytes:          64 << 20,
+		WorkerHost:             defaultWorkerHost,
+		WorkerCgroupParent:     DefaultWorkerCgroupParent,
+		WorkerCPUsEnv:          DefaultWorkerCPUsEnv,
+		WorkerEnvRedact:        DefaultWorkerEnvRedact,
+		WorkerDialTimeout:      2 * time.Second,
+		WorkerIdleConnTimeout:  90 * time.Second,
+		WorkerStartupTimeout:   30 * time.Second,
+		WarmupTimeout:          30 * time.Second,
+		HealthCheckInterval:    30 * time.Second,
+		HealthCheckTimeout:     2 * time.Second,
+		HealthCheckFailures:    3,
+		HealthyMinWorkers:      1,
+		EjectDuration:          30 * time.Second,
+		MaxRestartsWindow:      5 * time.Minute,
+		StartupRequireReady:    true,
+		PrometheusBuckets:      []float64{0.005, 0.01, 0.025, 0.05, 0.1, 0.25, 0.5, 1, 2.5, 5, 10, 30, 60},
+		ProcMetricsInterval:    2 * time.Second,
+		OTelSampleRatio:        1,
+	}
+}
+
+// options are the settings of a Stabilizer, which Options change.
+type options struct {
+	cfg            Config
+	logger         log.Logger
+	registerer     prometheus.Registerer
+	tracerProvider trace.TracerProvider
+	buildInfo      *BuildInfo
+}
+
+// Option configures a Stabilizer.
+type Option func(*options)
+
+// WithConfig replaces the whole configuration, including any changes made by
+// earlier options.
+func WithConfig(c Config) Option {
+	return func(o *options) { o.cfg = c }
+}
+
+// WithCommand sets the worker command and its arguments.
+func WithCommand(command string, args ...string) Option {
+	return func(o *options) {
+		o.cfg.Command = command
+		o.cfg.Args = args
+	}
+}
+
+// WithWorkers sets the number of workers to run.
+func WithWorkers(n int) Option {
+	return func(o *options) { o.cfg.Workers = n }
+}
+
+// WithConcurrency sets the number of requests each worker serves at once.
+func WithConcurrency(n int) Option {
+	return func(o *options) { o.cfg.Concurrency = n }
+}
+
+// WithTimeout sets the default request timeout.
+func WithTimeout(d time.Duration) Option {
+	return func(o *options) { o.cfg.Timeout = d }
+}
+
+// WithLogger sets the logger used by the Stabilizer and its workers.
+func WithLogger(logger log.Logger) Option {
+	return func(o *options) { o.logger = logger }
+}
+
+// WithRegisterer sets the Prometheus registerer metrics are registered with,
+// instead of prometheus.DefaultRegisterer. A nil registerer disables metrics.
+func WithRegisterer(r prometheus.Registerer) Option {
+	return func(o *options) { o.registerer = r }
+}
+
+// WithBuildInfo sets the build info of the program embedding the Stabilizer,
+// which is exported in the hss_build_info metric and served at /buildinfo.
+func WithBuildInfo(info BuildInfo) Option {
+	return func(o *options) { o.buildInfo = &info }
+}
+
+// WithTracerProvider sets the tracer provider requests are traced with,
+// instead of one exporting to OTelEndpoint. The caller is responsible for
+// shutting it down.
+func WithTracerProvider(tp trace.TracerProvider) Option {
+	return func(o *options) { o.tracerProvider = tp }
+}
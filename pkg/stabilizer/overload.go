@@ -0,0 +1,28 @@
+package stabilizer
+
+import (
+	"fmt"
+	"net/http"
+	"sync/atomic"
+
+	"github.com/slimsag/http-server-stabilizer/pkg/hsserr"
+)
+
+// limitInflight wraps next to count the requests being served, and to reject
+// requests with 429 once -max-inflight requests are being served, before they
+// take up a worker or their body is read.
+func (s *Stabilizer) limitInflight(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		defer atomic.AddInt64(&s.inflight, -1)
+		if n := atomic.AddInt64(&s.inflight, 1); s.cfg.MaxInflight > 0 && n > int64(s.cfg.MaxInflight) {
+			s.metrics.shedCounter.Inc()
+			if id := requestID(req); id != "" {
+				rw.Header().Set(requestIDHeader, id)
+			}
+			s.writeError(rw, req, http.StatusTooManyRequests, hsserr.ReasonOverloaded,
+				fmt.Sprintf("Too many requests are in flight, the limit is %d", s.cfg.MaxInflight), true)
+			return
+		}
+		next.ServeHTTP(rw, req)
+	})
+}
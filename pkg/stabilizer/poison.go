@@ -0,0 +1,159 @@
+package stabilizer
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// poisonRedactedHeaders are the request headers whose values are not written
+// to -poison-request-dir, as they hold credentials.
+var poisonRedactedHeaders = []string{"Authorization", "Proxy-Authorization", "Cookie"}
+
+// poisonRequest is a request that timed out and got its worker killed, as
+// written to -poison-request-dir so that it can be replayed.
+type poisonRequest struct {
+	Time      time.Time           `json:"time"`
+	RequestID string              `json:"request_id"`
+	WorkerPID int                 `json:"worker_pid"`
+	Method    string              `json:"method"`
+	URL       string              `json:"url"`
+	Header    map[string][]string `json:"header"`
+
+	// Body is the request body (base64 encoded in JSON), or its first
+	// -poison-request-body-bytes if BodyTruncated is set.
+	Body          []byte `json:"body,omitempty"`
+	BodyTruncated bool   `json:"body_truncated,omitempty"`
+}
+
+// bodyCapture keeps the first bytes read from a request body, so that they
+// can be written to -poison-request-dir.
+type bodyCapture struct {
+	io.ReadCloser
+	max int64
+
+	mu        sync.Mutex
+	data      []byte
+	truncated bool
+}
+
+func (c *bodyCapture) Read(p []byte) (int, error) {
+	n, err := c.ReadCloser.Read(p)
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	keep := p[:n]
+	if room := c.max - int64(len(c.data)); int64(len(keep)) > room {
+		keep = keep[:room]
+		c.truncated = true
+	}
+	c.data = append(c.data, keep...)
+	return n, err
+}
+
+// captured returns the bytes of the body read so far, and whether any were
+// left out.
+func (c *bodyCapture) captured() ([]byte, bool) {
+	if c == nil {
+		return nil, false
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return append([]byte(nil), c.data...), c.truncated
+}
+
+// capturePoisonBody starts capturing the body of a request, for it to be
+// written to -poison-request-dir should it time out.
+func (s *Stabilizer) capturePoisonBody(req *http.Request, pr *proxyRequest) {
+	pr.req = req
+	if s.cfg.PoisonRequestBodyBytes <= 0 || req.Body == nil || req.Body == http.NoBody {
+		return
+	}
+	pr.body = &bodyCapture{ReadCloser: req.Body, max: s.cfg.PoisonRequestBodyBytes}
+	req.Body = pr.body
+}
+
+// writePoisonRequest writes the request that killed worker w by timing out to
+// -poison-request-dir, and returns the path of the file. Only the newest
+// -poison-request-keep files are kept.
+func (s *Stabilizer) writePoisonRequest(pr *proxyRequest, w *worker) (string, error) {
+	req := pr.req
+	header := req.Header.Clone()
+	for _, name := range poisonRedactedHeaders {
+		if _, ok := header[name]; ok {
+			header[name] = []string{"REDACTED"}
+		}
+	}
+	scheme := "http"
+	if req.TLS != nil {
+		scheme = "https"
+	}
+	entry := poisonRequest{
+		Time:      time.Now().UTC(),
+		RequestID: pr.id,
+		WorkerPID: w.pid,
+		Method:    req.Method,
+		URL:       scheme + "://" + req.Host + req.URL.RequestURI(),
+		Header:    header,
+	}
+	entry.Body, entry.BodyTruncated = pr.body.captured()
+	data, err := json.MarshalIndent(entry, "", "  ")
+	if err != nil {
+		return "", err
+	}
+
+	s.poisonMu.Lock()
+	defer s.poisonMu.Unlock()
+	name := fmt.Sprintf("poison-%s-%s.json", entry.Time.Format("20060102T150405.000000000Z"), poisonFileID(pr.id))
+	path := filepath.Join(s.cfg.PoisonRequestDir, name)
+	if err := ioutil.WriteFile(path, data, 0600); err != nil {
+		return "", err
+	}
+	return path, s.prunePoisonRequests()
+}
+
+// prunePoisonRequests removes all but the newest -poison-request-keep files
+// from -poison-request-dir. s.poisonMu must be held.
+func (s *Stabilizer) prunePoisonRequests() error {
+	if s.cfg.PoisonRequestKeep <= 0 {
+		return nil
+	}
+	paths, err := filepath.Glob(filepath.Join(s.cfg.PoisonRequestDir, "poison-*.json"))
+	if err != nil {
+		return err
+	}
+	// The names start with the time, so sort oldest first.
+	sort.Strings(paths)
+	for len(paths) > s.cfg.PoisonRequestKeep {
+		if err := os.Remove(paths[0]); err != nil {
+			return err
+		}
+		paths = paths[1:]
+	}
+	return nil
+}
+
+// poisonFileID returns the request ID made safe for use in a file name, as it
+// may have been given by the client.
+func poisonFileID(id string) string {
+	safe := strings.Map(func(r rune) rune {
+		if r >= 'a' && r <= 'z' || r >= 'A' && r <= 'Z' || r >= '0' && r <= '9' || r == '-' || r == '_' {
+			return r
+		}
+		return '_'
+	}, id)
+	if len(safe) > 64 {
+		safe = safe[:64]
+	}
+	if safe == "" {
+		safe = "unknown"
+	}
+	return safe
+}
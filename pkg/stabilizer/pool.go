@@ -0,0 +1,613 @@
+package stabilizer
+
+import (
+	"container/list"
+	"context"
+	"math"
+	"math/rand"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/sourcegraph/log"
+)
+
+// Strategies for choosing the worker to serve a request, see Config.Balance.
+const (
+	BalancePool        = "pool"
+	BalanceLeastLoaded = "least-loaded"
+)
+
+// Curves along which the concurrency of a restarted worker is raised during
+// -slow-start, see Config.SlowStartCurve.
+const (
+	SlowStartLinear      = "linear"
+	SlowStartExponential = "exponential"
+)
+
+// Bounds on how often the concurrency of a worker in -slow-start is raised.
+const (
+	minRampInterval = 10 * time.Millisecond
+	maxRampInterval = time.Second
+)
+
+// Priorities of requests, given by -priority-header, from highest to lowest.
+const (
+	priorityHigh = iota
+	priorityNormal
+	priorityLow
+	numPriorities
+)
+
+// priorityNames are the values of -priority-header for each priority, which
+// also label metrics.
+var priorityNames = [numPriorities]string{"high", "normal", "low"}
+
+// parsePriority returns the priority named by a -priority-header value,
+// which is normal if it is empty or unknown.
+func parsePriority(value string) int {
+	for priority, name := range priorityNames {
+		if strings.EqualFold(strings.TrimSpace(value), name) {
+			return priority
+		}
+	}
+	return priorityNormal
+}
+
+// pool hands out workers to requests, allowing each worker to serve up to
+// -concurrency requests at once, or fewer while it is in -slow-start.
+// Requests which cannot be served immediately wait in FIFO order for their
+// priority until a worker becomes available, or until their context is
+// cancelled.
+type pool struct {
+	mu sync.Mutex
+
+	// workers are the workers that are accepting requests. Workers are
+	// removed as soon as they are killed, so a dead worker is never handed
+	// out.
+	workers []*worker
+
+	// ring maps -affinity-key values to workers, and is rebuilt from
+	// workers when next needed if nil.
+	ring *hashRing
+
+	// next is the index in workers at which to begin looking for a worker
+	// with spare capacity, so that requests are spread across workers.
+	next int
+
+	// waiters are FIFO queues of requests waiting for a worker, one for
+	// each priority.
+	waiters [numPriorities]list.List
+
+	// concurrency is the number of requests each worker may serve at once.
+	concurrency int
+
+	// slowStart is -slow-start, and slowStartCurve -slow-start-curve.
+	slowStart      time.Duration
+	slowStartCurve string
+
+	// drainTimeout is -drain-timeout, and balance -balance.
+	drainTimeout time.Duration
+	balance      string
+
+	// pack is set when autoscaling, in which case requests are handed the
+	// worker in the lowest slot with spare capacity, or with
+	// -balance=least-loaded the lowest of the least loaded workers, so that
+	// the workers in the highest slots are the least recently used and are
+	// the first to be scaled down.
+	pack bool
+
+	// reserved is -priority-reserved, and promoteAfter
+	// -priority-promote-after.
+	reserved     float64
+	promoteAfter time.Duration
+}
+
+// lease is a worker handed out to a request by the pool. It must be closed
+// once the request is complete, which returns the worker to the pool. Only the
+// first Close has any effect, so a lease may be both closed early and in a
+// deferred call.
+type lease struct {
+	pool   *pool
+	worker *worker
+	once   sync.Once
+}
+
+// Close returns the leased worker to the pool, if it has not been already.
+func (l *lease) Close() {
+	l.once.Do(func() { l.pool.release(l.worker) })
+}
+
+// waiter is a request waiting for a worker.
+type waiter struct {
+	ch       chan *worker
+	priority int
+	queued   time.Time
+}
+
+// add makes the worker available to requests, unless it is draining. A
+// worker which replaces one that died or was recycled is only handed one
+// request at a time at first, and more over -slow-start until it may serve
+// -concurrency requests at once.
+func (p *pool) add(w *worker) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if w.draining {
+		return
+	}
+	p.workers = append(p.workers, w)
+	p.ring = nil
+	w.lastUsed = time.Now()
+	if p.slowStart > 0 && w.restartReason != "" {
+		w.slowStartTime = time.Now()
+		go p.rampUp(w)
+	}
+	p.fill(w)
+}
+
+// limit returns the number of requests the worker may serve at once, which
+// is -concurrency unless it is in -slow-start. p.mu must be held.
+func (p *pool) limit(w *worker) int {
+	elapsed := time.Since(w.slowStartTime)
+	if w.slowStartTime.IsZero() || elapsed >= p.slowStart || p.concurrency <= 1 {
+		return p.concurrency
+	}
+	progress := float64(elapsed) / float64(p.slowStart)
+	n := 1 + progress*float64(p.concurrency-1)
+	if p.slowStartCurve == SlowStartExponential {
+		n = math.Pow(float64(p.concurrency), progress)
+	}
+	return int(n)
+}
+
+// fill hands the worker to waiting requests until it is serving as many as
+// it may, and updates the hss_worker_concurrency metric. p.mu must be held.
+func (p *pool) fill(w *worker) {
+	limit := p.limit(w)
+	if w.metrics != nil {
+		w.metrics.workerConcurrency.WithLabelValues(strconv.Itoa(w.index)).Set(float64(limit))
+	}
+	for w.inflight < limit && p.handoff(w) {
+	}
+}
+
+// rampUp raises the number of requests a worker in -slow-start may serve
+// along -slow-start-curve, handing it to waiting requests as it goes, until
+// it may serve -concurrency or is no longer accepting requests.
+func (p *pool) rampUp(w *worker) {
+	p.mu.Lock()
+	interval := p.slowStart / time.Duration(p.concurrency)
+	p.mu.Unlock()
+	if interval < minRampInterval {
+		interval = minRampInterval
+	}
+	if interval > maxRampInterval {
+		interval = maxRampInterval
+	}
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-w.done:
+			return
+		case <-ticker.C:
+		}
+		p.mu.Lock()
+		if !p.contains(w) {
+			p.mu.Unlock()
+			return
+		}
+		p.fill(w)
+		ramped := p.limit(w) >= p.concurrency
+		p.mu.Unlock()
+		if ramped {
+			return
+		}
+	}
+}
+
+// remove stops the worker from being handed out to requests. Requests
+// already being served by it are unaffected.
+func (p *pool) remove(w *worker) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.removeLocked(w)
+}
+
+// drain stops the worker from being handed out to requests, and kills it for
+// the given reason once the requests it is serving have completed, or once
+// -drain-timeout has passed.
+func (p *pool) drain(w *worker, reason string) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if w.draining {
+		return
+	}
+	w.log.Info("draining", log.String("reason", reason), log.Int("inflight", w.inflight))
+	w.draining = true
+	w.drainReason = reason
+	p.removeLocked(w)
+	if w.inflight == 0 {
+		w.kill(reason)
+		return
+	}
+	if p.drainTimeout > 0 {
+		w.drainTimer = time.AfterFunc(p.drainTimeout, func() { p.drainTimedOut(w) })
+	}
+}
+
+// drainTimedOut kills a worker which is still serving requests
+// -drain-timeout after it began draining.
+func (p *pool) drainTimedOut(w *worker) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	// The last request may have completed, and killed the worker, just as
+	// the timer fired.
+	if w.inflight == 0 {
+		return
+	}
+	if w.kill(w.drainReason) {
+		w.log.Warn("killing worker that did not drain in time", log.String("reason", w.drainReason), log.Int("inflight", w.inflight), log.Duration("timeout", p.drainTimeout))
+	}
+}
+
+// draining reports whether the worker is draining.
+func (p *pool) draining(w *worker) bool {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return w.draining
+}
+
+// drainReason returns the reason the worker is draining, if it is.
+func (p *pool) drainReason(w *worker) string {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return w.drainReason
+}
+
+// removeLocked is like remove, but p.mu must be held.
+func (p *pool) removeLocked(w *worker) {
+	for i, pw := range p.workers {
+		if pw == w {
+			p.workers = append(p.workers[:i], p.workers[i+1:]...)
+			p.ring = nil
+			return
+		}
+	}
+}
+
+// acquire returns a lease on a worker to serve a request of the given
+// priority, blocking until one has capacity or ctx is done. Requests of higher
+// priority are handed workers first.
+func (p *pool) acquire(ctx context.Context, priority int) (*lease, error) {
+	p.mu.Lock()
+	if p.mayTake(priority) {
+		if w := p.available(); w != nil {
+			w.inflight++
+			p.mu.Unlock()
+			return &lease{pool: p, worker: w}, nil
+		}
+	}
+	wt := &waiter{ch: make(chan *worker, 1), priority: priority, queued: time.Now()}
+	elem := p.waiters[priority].PushBack(wt)
+	p.mu.Unlock()
+
+	select {
+	case w := <-wt.ch:
+		return &lease{pool: p, worker: w}, nil
+	case <-ctx.Done():
+		p.mu.Lock()
+		select {
+		case w := <-wt.ch:
+			// A worker was handed to us just as ctx was cancelled, give it
+			// to someone else.
+			p.mu.Unlock()
+			p.release(w)
+		default:
+			p.waiters[priority].Remove(elem)
+			p.mu.Unlock()
+		}
+		return nil, ctx.Err()
+	}
+}
+
+// queued returns the number of requests waiting for a worker. p.mu must be
+// held.
+func (p *pool) queued() int {
+	n := 0
+	for i := range p.waiters {
+		n += p.waiters[i].Len()
+	}
+	return n
+}
+
+// mayTake reports whether a request of the given priority may take a worker
+// without waiting: no request of the same or higher priority is waiting, and
+// the capacity it would use is not reserved. p.mu must be held.
+func (p *pool) mayTake(priority int) bool {
+	for i := 0; i <= priority; i++ {
+		if p.waiters[i].Len() > 0 {
+			return false
+		}
+	}
+	return p.allowed(priority)
+}
+
+// allowed reports whether a request of the given priority may be handed a
+// worker, given that -priority-reserved of the pool's capacity is kept for
+// high priority requests. p.mu must be held.
+func (p *pool) allowed(priority int) bool {
+	if priority == priorityHigh || p.reserved <= 0 {
+		return true
+	}
+	inflight, capacity := 0, 0
+	for _, w := range p.workers {
+		inflight += w.inflight
+		capacity += p.limit(w)
+	}
+	return float64(inflight) < (1-p.reserved)*float64(capacity)
+}
+
+// acquireAffine returns a lease on the worker the given -affinity-key value
+// maps to if it has spare capacity and no requests are queued, or nil
+// otherwise.
+func (p *pool) acquireAffine(key string, priority int) *lease {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if !p.mayTake(priority) {
+		return nil
+	}
+	if p.ring == nil {
+		p.ring = newHashRing(p.workers)
+	}
+	w := p.ring.lookup(key)
+	if w == nil || w.inflight >= p.limit(w) {
+		return nil
+	}
+	w.inflight++
+	return &lease{pool: p, worker: w}
+}
+
+// release returns a worker handed out by the pool to it. Other than by acquire
+// itself, it is only called by Close, so that it is called exactly once for
+// each worker handed out.
+func (p *pool) release(w *worker) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	w.inflight--
+	w.lastUsed = time.Now()
+	switch {
+	case w.draining && w.inflight == 0:
+		if w.drainTimer != nil {
+			w.drainTimer.Stop()
+		}
+		w.kill(w.drainReason)
+	case w.isKilled():
+		// The worker was killed, e.g. because the request timed out, but
+		// has not been removed yet: don't hand it to a waiting request.
+		p.removeLocked(w)
+	case p.contains(w) && w.inflight < p.limit(w):
+		p.handoff(w)
+	}
+}
+
+// setConcurrency changes the number of requests each worker may serve at
+// once, handing workers to waiting requests if it was raised.
+func (p *pool) setConcurrency(n int) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.concurrency = n
+	for _, w := range p.workers {
+		p.fill(w)
+	}
+}
+
+// size returns the number of workers accepting requests.
+func (p *pool) size() int {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return len(p.workers)
+}
+
+// inflight returns the number of requests the worker is serving.
+func (p *pool) inflight(w *worker) int {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return w.inflight
+}
+
+// load returns the number of requests the worker is serving, and the number
+// it may serve at once.
+func (p *pool) load(w *worker) (inflight, limit int) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return w.inflight, p.limit(w)
+}
+
+// stats returns the number of requests that could be handed a worker
+// immediately, and the number of requests waiting for a worker.
+func (p *pool) stats() (availableSlots, queued int) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	for _, w := range p.workers {
+		if free := p.limit(w) - w.inflight; free > 0 {
+			availableSlots += free
+		}
+	}
+	return availableSlots, p.queued()
+}
+
+// pressure returns how long the longest waiting request has been waiting,
+// the fraction of the workers' capacity that is in use, and the number of
+// requests waiting. Capacity is fully used if there are no workers and
+// requests are waiting.
+func (p *pool) pressure() (queueWait time.Duration, saturation float64, queued int) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	for i := range p.waiters {
+		if front := p.waiters[i].Front(); front != nil {
+			if wait := time.Since(front.Value.(*waiter).queued); wait > queueWait {
+				queueWait = wait
+			}
+		}
+	}
+	inflight, capacity := 0, 0
+	for _, w := range p.workers {
+		inflight += w.inflight
+		capacity += p.limit(w)
+	}
+	queued = p.queued()
+	switch {
+	case capacity > 0:
+		saturation = float64(inflight) / float64(capacity)
+	case queued > 0:
+		saturation = 1
+	}
+	return queueWait, saturation, queued
+}
+
+// idleSince returns when the worker last finished serving a request, or was
+// added if it has served none. It reports false if the worker is serving
+// requests or is not accepting them.
+func (p *pool) idleSince(w *worker) (time.Time, bool) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if w.inflight > 0 || !p.contains(w) {
+		return time.Time{}, false
+	}
+	return w.lastUsed, true
+}
+
+// tryAcquire is like acquire, but returns nil rather than waiting if no
+// worker other than except has spare capacity. It never takes a worker that
+// requests are queued for.
+func (p *pool) tryAcquire(except *worker) *lease {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.queued() > 0 {
+		return nil
+	}
+	w := p.pick(except)
+	if w == nil {
+		return nil
+	}
+	w.inflight++
+	return &lease{pool: p, worker: w}
+}
+
+// available returns a worker with spare capacity, or nil if there is none.
+// p.mu must be held.
+func (p *pool) available() *worker {
+	return p.pick(nil)
+}
+
+// pick returns a worker other than except with spare capacity according to
+// -balance, or nil if there is none. p.mu must be held.
+func (p *pool) pick(except *worker) *worker {
+	if p.balance == BalanceLeastLoaded {
+		return p.leastLoaded(except)
+	}
+	if p.pack {
+		return p.lowest(except)
+	}
+	for i := range p.workers {
+		w := p.workers[(p.next+i)%len(p.workers)]
+		if w != except && w.inflight < p.limit(w) {
+			p.next = (p.next + i + 1) % len(p.workers)
+			return w
+		}
+	}
+	return nil
+}
+
+// leastLoaded returns the worker other than except serving the fewest
+// requests, choosing randomly between those serving equally few (or the one
+// in the lowest slot if p.pack is set), or nil if none has spare capacity.
+// p.mu must be held.
+func (p *pool) leastLoaded(except *worker) *worker {
+	var (
+		best *worker
+		ties int
+	)
+	for _, w := range p.workers {
+		if w == except || w.inflight >= p.limit(w) {
+			continue
+		}
+		switch {
+		case best == nil || w.inflight < best.inflight:
+			best, ties = w, 1
+		case w.inflight == best.inflight && p.pack:
+			if w.index < best.index {
+				best = w
+			}
+		case w.inflight == best.inflight:
+			// Reservoir sampling, so each tied worker is equally likely.
+			ties++
+			if rand.Intn(ties) == 0 {
+				best = w
+			}
+		}
+	}
+	return best
+}
+
+// lowest returns the worker other than except in the lowest slot which has
+// spare capacity, or nil if there is none. p.mu must be held.
+func (p *pool) lowest(except *worker) *worker {
+	var best *worker
+	for _, w := range p.workers {
+		if w != except && w.inflight < p.limit(w) && (best == nil || w.index < best.index) {
+			best = w
+		}
+	}
+	return best
+}
+
+// handoff gives the worker to the next waiting request, if any, reporting
+// whether it did so. That is the longest waiting request of the highest
+// priority, unless a request has waited longer than -priority-promote-after,
+// in which case the longest waiting of those goes first so that lower
+// priority requests are not starved. Requests are never handed capacity
+// reserved by -priority-reserved. p.mu must be held.
+func (p *pool) handoff(w *worker) bool {
+	var next *list.Element
+	priority := -1
+	if p.promoteAfter > 0 {
+		for i := range p.waiters {
+			front := p.waiters[i].Front()
+			if front == nil || !p.allowed(i) || time.Since(front.Value.(*waiter).queued) < p.promoteAfter {
+				continue
+			}
+			if next == nil || front.Value.(*waiter).queued.Before(next.Value.(*waiter).queued) {
+				next, priority = front, i
+			}
+		}
+	}
+	for i := range p.waiters {
+		if next != nil {
+			break
+		}
+		if front := p.waiters[i].Front(); front != nil && p.allowed(i) {
+			next, priority = front, i
+		}
+	}
+	if next == nil {
+		return false
+	}
+	p.waiters[priority].Remove(next)
+	w.inflight++
+	next.Value.(*waiter).ch <- w
+	return true
+}
+
+// contains reports whether the worker is accepting requests. p.mu must be
+// held.
+func (p *pool) contains(w *worker) bool {
+	for _, pw := range p.workers {
+		if pw == w {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,299 @@
+package stabilizer
+
+import (
+	"context"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/sourcegraph/log"
+	"github.com/sourcegraph/log/logtest"
+)
+
+// TestPoolCapacityRestored checks that every request returns its worker to
+// the pool however it ends: by succeeding, by timing out (which kills the
+// worker), or by the client going away before or while the response is
+// copied to it.
+func TestPoolCapacityRestored(t *testing.T) {
+	cfg := testConfig()
+	cfg.Workers = 2
+	cfg.Concurrency = 3
+	cfg.Timeout = 500 * time.Millisecond
+	s, srv, stop := startStabilizer(t, cfg)
+	defer stop()
+
+	var wg sync.WaitGroup
+	for i := 0; i < 80; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			ctx, cancel := context.WithCancel(context.Background())
+			defer cancel()
+			var url string
+			switch i % 4 {
+			case 0:
+				url = srv.URL + "/?ms=10"
+			case 1:
+				url = srv.URL + "/?ms=2000"
+			case 2:
+				url = srv.URL + "/?ms=300"
+				time.AfterFunc(50*time.Millisecond, cancel)
+			case 3:
+				url = srv.URL + "/?size=10000000"
+			}
+			req, err := http.NewRequestWithContext(ctx, "GET", url, nil)
+			if err != nil {
+				t.Error(err)
+				return
+			}
+			resp, err := http.DefaultClient.Do(req)
+			if err != nil {
+				return
+			}
+			if i%4 == 3 {
+				// Go away while the body is being copied.
+				_, _ = io.CopyN(ioutil.Discard, resp.Body, 1000)
+			} else {
+				_, _ = io.Copy(ioutil.Discard, resp.Body)
+			}
+			resp.Body.Close()
+		}(i)
+		time.Sleep(5 * time.Millisecond)
+	}
+	wg.Wait()
+
+	want := cfg.Workers * cfg.Concurrency
+	waitFor(t, 30*time.Second, "pool capacity to be restored", func() bool {
+		available, queued := s.pool.stats()
+		return available == want && queued == 0
+	})
+}
+
+// newPoolWorker returns a worker without a process, for testing the pool.
+func newPoolWorker(logger log.Logger) *worker {
+	ctx, cancel := context.WithCancel(context.Background())
+	return &worker{
+		log:       logger,
+		ctx:       ctx,
+		cancel:    cancel,
+		done:      make(chan struct{}),
+		recycling: make(chan struct{}),
+	}
+}
+
+// acquireN acquires n leases from the pool, failing the test if it can't.
+func acquireN(t *testing.T, p *pool, n int) []*lease {
+	t.Helper()
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	var leases []*lease
+	for i := 0; i < n; i++ {
+		l, err := p.acquire(ctx, priorityNormal)
+		if err != nil {
+			t.Fatal(err)
+		}
+		leases = append(leases, l)
+	}
+	return leases
+}
+
+func TestPoolDrain(t *testing.T) {
+	p := &pool{concurrency: 2}
+	w := newPoolWorker(logtest.NoOp(t))
+	p.add(w)
+	leases := acquireN(t, p, 2)
+
+	p.drain(w, reasonAdmin)
+	if p.size() != 0 {
+		t.Error("draining worker is still handed out")
+	}
+	leases[0].Close()
+	if w.isKilled() {
+		t.Fatal("worker killed while still serving a request")
+	}
+	if p.size() != 0 {
+		t.Error("draining worker was returned to the pool")
+	}
+	leases[1].Close()
+	if !w.isKilled() || w.exitReason() != reasonAdmin {
+		t.Fatalf("got killed %v for %q, want killed for %q", w.isKilled(), w.exitReason(), reasonAdmin)
+	}
+}
+
+func TestPoolDrainIdle(t *testing.T) {
+	p := &pool{concurrency: 2}
+	w := newPoolWorker(logtest.NoOp(t))
+	p.add(w)
+	p.drain(w, reasonScaleDown)
+	if !w.isKilled() {
+		t.Fatal("idle worker not killed when drained")
+	}
+}
+
+func TestPoolDrainTimeout(t *testing.T) {
+	p := &pool{concurrency: 1, drainTimeout: 10 * time.Millisecond}
+	w := newPoolWorker(logtest.NoOp(t))
+	p.add(w)
+	leases := acquireN(t, p, 1)
+
+	p.drain(w, reasonMaxAge)
+	waitFor(t, time.Second, "the worker to be killed", w.isKilled)
+	if reason := w.exitReason(); reason != reasonMaxAge {
+		t.Errorf("got reason %q, want %q", reason, reasonMaxAge)
+	}
+	leases[0].Close()
+	if n := p.inflight(w); n != 0 {
+		t.Errorf("got %v requests in flight, want 0", n)
+	}
+}
+
+// TestPoolDrainTimeoutRace checks that the drain timer firing just as the last
+// request completes kills the worker only once, and without warning that it
+// did not drain in time.
+func TestPoolDrainTimeoutRace(t *testing.T) {
+	logger, exportLogs := logtest.Captured(t)
+
+	// The timer fires once the last request has completed, but before it
+	// could be stopped.
+	p := &pool{concurrency: 1, drainTimeout: time.Hour}
+	w := newPoolWorker(logger)
+	p.add(w)
+	leases := acquireN(t, p, 1)
+	p.drain(w, reasonRollout)
+	leases[0].Close()
+	p.drainTimedOut(w)
+	if !w.isKilled() || w.exitReason() != reasonRollout {
+		t.Fatalf("got killed %v for %q, want killed for %q", w.isKilled(), w.exitReason(), reasonRollout)
+	}
+	for _, entry := range exportLogs() {
+		if entry.Message == "killing worker that did not drain in time" {
+			t.Error("warned about a worker that drained in time")
+		}
+	}
+
+	// The timer fires while the last request completes.
+	for i := 0; i < 100; i++ {
+		p := &pool{concurrency: 1, drainTimeout: time.Millisecond}
+		w := newPoolWorker(logtest.NoOp(t))
+		p.add(w)
+		leases := acquireN(t, p, 1)
+		p.drain(w, reasonRollout)
+		time.Sleep(time.Millisecond)
+		leases[0].Close()
+		waitFor(t, time.Second, "the worker to be killed", w.isKilled)
+		if reason := w.exitReason(); reason != reasonRollout {
+			t.Fatalf("got reason %q, want %q", reason, reasonRollout)
+		}
+		if n := p.inflight(w); n != 0 {
+			t.Fatalf("got %v requests in flight, want 0", n)
+		}
+	}
+}
+
+// TestPoolLeastLoadedPack checks that when autoscaling with
+// -balance=least-loaded, requests go to the lowest of the least loaded
+// workers, so that the worker in the highest slot is left idle to be scaled
+// down.
+func TestPoolLeastLoadedPack(t *testing.T) {
+	p := &pool{concurrency: 2, balance: BalanceLeastLoaded, pack: true}
+	for i := 2; i >= 0; i-- {
+		w := newPoolWorker(logtest.NoOp(t))
+		w.index = i
+		p.add(w)
+	}
+	for i := 0; i < 10; i++ {
+		leases := acquireN(t, p, 1)
+		if index := leases[0].worker.index; index != 0 {
+			t.Fatalf("idle pool handed out the worker in slot %v, want 0", index)
+		}
+		leases[0].Close()
+	}
+	leases := acquireN(t, p, 4)
+	for i, want := range []int{0, 1, 2, 0} {
+		if index := leases[i].worker.index; index != want {
+			t.Errorf("request %v handed the worker in slot %v, want %v", i, index, want)
+		}
+	}
+}
+
+// BenchmarkBalance compares the latency of a mix of slow and fast requests
+// with each -balance strategy, reporting the 95th percentile. The workers are
+// simulated: each has a single CPU, which the requests it is serving take
+// turns on for one millisecond at a time, so that fast requests are slowed
+// down by the slow requests on the same worker.
+func BenchmarkBalance(b *testing.B) {
+	const (
+		workers     = 4
+		concurrency = 4
+		clients     = 8
+		// One request in slowEvery needs slowCost milliseconds of CPU,
+		// and the others one millisecond.
+		slowEvery = 25
+		slowCost  = 50
+	)
+	for _, balance := range []string{BalancePool, BalanceLeastLoaded} {
+		b.Run(balance, func(b *testing.B) {
+			p := &pool{concurrency: concurrency, balance: balance}
+			cpus := make(map[*worker]*sync.Mutex)
+			for i := 0; i < workers; i++ {
+				w := newPoolWorker(log.NoOp())
+				w.index = i
+				cpus[w] = &sync.Mutex{}
+				p.add(w)
+			}
+
+			var (
+				next      int64
+				mu        sync.Mutex
+				latencies []time.Duration
+				wg        sync.WaitGroup
+			)
+			b.ResetTimer()
+			for c := 0; c < clients; c++ {
+				wg.Add(1)
+				go func() {
+					defer wg.Done()
+					for {
+						i := atomic.AddInt64(&next, 1)
+						if i > int64(b.N) {
+							return
+						}
+						cost := 1
+						if i%slowEvery == 0 {
+							cost = slowCost
+						}
+						start := time.Now()
+						l, err := p.acquire(context.Background(), priorityNormal)
+						if err != nil {
+							b.Error(err)
+							return
+						}
+						cpu := cpus[l.worker]
+						for j := 0; j < cost; j++ {
+							cpu.Lock()
+							time.Sleep(time.Millisecond)
+							cpu.Unlock()
+						}
+						l.Close()
+						mu.Lock()
+						latencies = append(latencies, time.Since(start))
+						mu.Unlock()
+					}
+				}()
+			}
+			wg.Wait()
+			b.StopTimer()
+
+			sort.Slice(latencies, func(i, j int) bool { return latencies[i] < latencies[j] })
+			if len(latencies) > 0 {
+				p95 := latencies[len(latencies)*95/100]
+				b.ReportMetric(float64(p95)/float64(time.Millisecond), "p95-ms")
+			}
+		})
+	}
+}
@@ -0,0 +1,230 @@
+package stabilizer
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/slimsag/http-server-stabilizer/pkg/hsserr"
+)
+
+// poolDefault is the pool label of requests which match no pool.
+const poolDefault = "default"
+
+// Pool is a set of workers which serve the requests whose path starts with
+// its prefix.
+type Pool struct {
+	Name   string
+	Prefix string
+
+	// Command is the pool's worker command, and Args its arguments.
+	Command string
+	Args    []string
+
+	// Workers, Concurrency and Timeout override Config.Workers,
+	// Config.Concurrency and Config.Timeout for the pool if non-zero.
+	Workers     int
+	Concurrency int
+	Timeout     time.Duration
+}
+
+// poolNamePattern matches valid pool names, which are used in metric labels
+// and socket paths.
+var poolNamePattern = regexp.MustCompile(`^[a-zA-Z0-9_-]+$`)
+
+// ParsePool parses a pool such as
+// "name=highlight,prefix=/highlight,workers=6,cmd=./highlighter --port {{.Port}}".
+// The command is split on spaces, and cmd must come last as it takes the rest
+// of the pool, commas included.
+func ParsePool(s string) (Pool, error) {
+	var p Pool
+	for rest := s; rest != ""; {
+		field := rest
+		rest = ""
+		if !strings.HasPrefix(strings.TrimSpace(field), "cmd=") {
+			if i := strings.Index(field, ","); i >= 0 {
+				field, rest = field[:i], field[i+1:]
+			}
+		}
+		kv := strings.SplitN(strings.TrimSpace(field), "=", 2)
+		if len(kv) != 2 {
+			return Pool{}, fmt.Errorf("invalid pool option %q, expected key=value", field)
+		}
+		var err error
+		switch kv[0] {
+		case "name":
+			p.Name = kv[1]
+			if !poolNamePattern.MatchString(p.Name) {
+				err = errors.New("must only contain letters, digits, - and _")
+			}
+		case "prefix":
+			p.Prefix = kv[1]
+			if !strings.HasPrefix(p.Prefix, "/") {
+				err = errors.New("must be a path prefix such as /highlight")
+			}
+		case "cmd":
+			fields := strings.Fields(kv[1])
+			if len(fields) == 0 {
+				err = errors.New("must not be empty")
+			} else {
+				p.Command, p.Args = fields[0], fields[1:]
+			}
+		case "workers":
+			p.Workers, err = strconv.Atoi(kv[1])
+			if err == nil && p.Workers <= 0 {
+				err = errors.New("must be positive")
+			}
+		case "concurrency":
+			p.Concurrency, err = strconv.Atoi(kv[1])
+			if err == nil && p.Concurrency <= 0 {
+				err = errors.New("must be positive")
+			}
+		case "timeout":
+			p.Timeout, err = time.ParseDuration(kv[1])
+			if err == nil && p.Timeout <= 0 {
+				err = errors.New("must be positive")
+			}
+		default:
+			err = errors.New("unknown option, expected name, prefix, workers, concurrency, timeout or cmd")
+		}
+		if err != nil {
+			return Pool{}, fmt.Errorf("invalid pool option %q: %v", field, err)
+		}
+	}
+	if p.Name == "" || p.Prefix == "" || p.Command == "" {
+		return Pool{}, fmt.Errorf("pool %q must have a name, prefix and cmd", s)
+	}
+	return p, nil
+}
+
+// String returns the pool in the form accepted by ParsePool.
+func (p Pool) String() string {
+	s := "name=" + p.Name + ",prefix=" + p.Prefix
+	if p.Workers > 0 {
+		s += ",workers=" + strconv.Itoa(p.Workers)
+	}
+	if p.Concurrency > 0 {
+		s += ",concurrency=" + strconv.Itoa(p.Concurrency)
+	}
+	if p.Timeout > 0 {
+		s += ",timeout=" + p.Timeout.String()
+	}
+	return s + ",cmd=" + strings.Join(append([]string{p.Command}, p.Args...), " ")
+}
+
+// workerPool is a Pool in use, with the Stabilizer running its workers.
+type workerPool struct {
+	Pool
+	s *Stabilizer
+}
+
+// poolConfig returns the configuration of the workers of a pool of a
+// Stabilizer with the given configuration. They are configured the same way,
+// other than what the pool overrides, and the stabilizer's routes do not
+// apply to them.
+func poolConfig(cfg Config, p Pool) Config {
+	cfg.Command, cfg.Args = p.Command, p.Args
+	if p.Workers > 0 {
+		cfg.Workers = p.Workers
+	}
+	cfg.MinWorkers, cfg.MaxWorkers = 0, 0
+	if p.Concurrency > 0 {
+		cfg.Concurrency = p.Concurrency
+	}
+	if p.Timeout > 0 {
+		cfg.Timeout = p.Timeout
+	}
+	cfg.Routes = nil
+	return cfg
+}
+
+// checkPools returns an error if the pools are not valid together.
+func checkPools(pools []Pool) error {
+	names, prefixes := make(map[string]bool), make(map[string]bool)
+	for _, p := range pools {
+		if !poolNamePattern.MatchString(p.Name) {
+			return fmt.Errorf("invalid pool name %q: must only contain letters, digits, - and _", p.Name)
+		}
+		switch p.Name {
+		case poolDefault, variantStable, variantCanary, variantShadow:
+			return fmt.Errorf("invalid pool name %q: reserved", p.Name)
+		}
+		if !strings.HasPrefix(p.Prefix, "/") {
+			return fmt.Errorf("invalid prefix %q of pool %q: must start with /", p.Prefix, p.Name)
+		}
+		if p.Command == "" {
+			return fmt.Errorf("no worker command given for pool %q", p.Name)
+		}
+		if names[p.Name] {
+			return fmt.Errorf("duplicate pool name %q", p.Name)
+		}
+		if prefixes[p.Prefix] {
+			return fmt.Errorf("duplicate pool prefix %q", p.Prefix)
+		}
+		names[p.Name], prefixes[p.Prefix] = true, true
+	}
+	return nil
+}
+
+// matchPool returns the pool with the longest prefix that path starts with,
+// or nil if there is none.
+func (s *Stabilizer) matchPool(path string) *workerPool {
+	var best *workerPool
+	for i, p := range s.pools {
+		if strings.HasPrefix(path, p.Prefix) && (best == nil || len(p.Prefix) > len(best.Prefix)) {
+			best = &s.pools[i]
+		}
+	}
+	return best
+}
+
+// servePool sends a request to the pool matching its path, if any, and
+// reports whether it was served. Requests matching no pool are rejected if
+// there are no workers of the stabilizer's own to serve them.
+func (s *Stabilizer) servePool(rw http.ResponseWriter, req *http.Request) bool {
+	if len(s.pools) == 0 {
+		return false
+	}
+	if p := s.matchPool(req.URL.Path); p != nil {
+		p.s.ServeHTTP(rw, req)
+		return true
+	}
+	if s.runsWorkers() {
+		return false
+	}
+	if id := requestID(req); id != "" {
+		rw.Header().Set(requestIDHeader, id)
+	}
+	s.writeError(rw, req, http.StatusNotFound, hsserr.ReasonNoPool,
+		"No worker pool serves this path", false)
+	return true
+}
+
+// countWorkers returns the sum of count over the stabilizer and its pools,
+// and whether it is at least -healthy-min-workers for each of them which
+// runs workers. When autoscaling, it need only be -min-workers if that is
+// fewer, so that requests are still sent to start workers once there are
+// none.
+func (s *Stabilizer) countWorkers(count func(*Stabilizer) int) (total int, healthy bool) {
+	healthy = true
+	instances := []*Stabilizer{s}
+	for _, p := range s.pools {
+		instances = append(instances, p.s)
+	}
+	for _, in := range instances {
+		n := count(in)
+		total += n
+		minimum := s.cfg.HealthyMinWorkers
+		if in.autoscaling() && in.cfg.MinWorkers < minimum {
+			minimum = in.cfg.MinWorkers
+		}
+		if in.runsWorkers() && n < minimum {
+			healthy = false
+		}
+	}
+	return total, healthy
+}
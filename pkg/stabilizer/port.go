@@ -0,0 +1,177 @@
+package stabilizer
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+
+	oldfreeport "github.com/phayes/freeport"
+	freeport "github.com/slimsag/freeport"
+)
+
+// portAllocator hands out TCP ports for workers to listen on.
+type portAllocator interface {
+	// allocate returns a port for a new worker.
+	allocate() (int, error)
+
+	// release makes a port allocated earlier available again, once the
+	// worker using it has died.
+	release(port int)
+
+	// capacity returns the number of ports that can be allocated at once, or
+	// 0 if there is no limit.
+	capacity() int
+}
+
+// defaultWorkerHost is the default -worker-host.
+const defaultWorkerHost = "127.0.0.1"
+
+// checkWorkerHost returns an error if host is not a valid -worker-host: an IP
+// address, without brackets, or a host name.
+func checkWorkerHost(host string) error {
+	if net.ParseIP(host) != nil {
+		return nil
+	}
+	if host == "" || strings.ContainsAny(host, ":[]/ ") {
+		return fmt.Errorf("%q must be an IP address or host name, without a port", host)
+	}
+	return nil
+}
+
+// newPortAllocator returns a port allocator for the given -worker-port-range:
+// ports from the range if set, which must be free on the given host, and
+// otherwise any free port.
+func newPortAllocator(portRange, host string) (portAllocator, error) {
+	if portRange == "" {
+		useOld, _ := strconv.ParseBool(os.Getenv("USE_OLD_FREEPORT"))
+		return freePortAllocator{old: useOld}, nil
+	}
+	bounds := strings.SplitN(portRange, "-", 2)
+	if len(bounds) != 2 {
+		return nil, fmt.Errorf("invalid port range %q, expected e.g. 20000-20100", portRange)
+	}
+	min, err := strconv.Atoi(strings.TrimSpace(bounds[0]))
+	if err != nil {
+		return nil, fmt.Errorf("invalid port range %q: %v", portRange, err)
+	}
+	max, err := strconv.Atoi(strings.TrimSpace(bounds[1]))
+	if err != nil {
+		return nil, fmt.Errorf("invalid port range %q: %v", portRange, err)
+	}
+	if min < 1 || max > 65535 || min > max {
+		return nil, fmt.Errorf("invalid port range %q", portRange)
+	}
+	return &rangePortAllocator{host: host, min: min, max: max, next: min, inUse: make(map[int]bool)}, nil
+}
+
+// freePortAllocator allocates any port that is free at the time. If old is
+// true, github.com/phayes/freeport is used to find one (set
+// USE_OLD_FREEPORT=true to use it).
+type freePortAllocator struct {
+	old bool
+}
+
+func (a freePortAllocator) allocate() (int, error) {
+	if a.old {
+		return oldfreeport.GetFreePort()
+	}
+	return freeport.GetFreePort()
+}
+
+func (freePortAllocator) release(port int) {}
+
+func (freePortAllocator) capacity() int { return 0 }
+
+// rangePortAllocator allocates ports from -worker-port-range, in turn so
+// that a port is not reused immediately after its worker dies.
+type rangePortAllocator struct {
+	host     string
+	min, max int
+
+	mu    sync.Mutex
+	next  int
+	inUse map[int]bool
+}
+
+func (a *rangePortAllocator) allocate() (int, error) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	for i := 0; i <= a.max-a.min; i++ {
+		port := a.next
+		a.next++
+		if a.next > a.max {
+			a.next = a.min
+		}
+		if a.inUse[port] || !portFree(a.host, port) {
+			continue
+		}
+		a.inUse[port] = true
+		return port, nil
+	}
+	return 0, fmt.Errorf("no free port in range %v-%v", a.min, a.max)
+}
+
+func (a *rangePortAllocator) release(port int) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	delete(a.inUse, port)
+}
+
+func (a *rangePortAllocator) capacity() int { return a.max - a.min + 1 }
+
+// portFree reports whether the given port can currently be listened on, on the
+// given host.
+func portFree(host string, port int) bool {
+	l, err := net.Listen("tcp", net.JoinHostPort(host, strconv.Itoa(port)))
+	if err != nil {
+		return false
+	}
+	l.Close()
+	return true
+}
+
+// errPortConflict is returned when a worker's port turns out to be used by
+// another process. The port allocator can only tell that a port was free at
+// the time it was called, so this happens if something else binds it before
+// the worker does.
+var errPortConflict = errors.New("port is in use by another process")
+
+// checkPortOwner returns errPortConflict if the worker's port is being
+// listened on by a process other than the worker or its subprocesses. It is
+// only able to tell on Linux, and does nothing in -worker-socket-dir mode.
+func checkPortOwner(w *worker) error {
+	if w.socket != "" || !portCheckSupported {
+		return nil
+	}
+	inodes, err := listeningInodes(w.port)
+	if err != nil || len(inodes) == 0 {
+		// Either we can't tell, or the listener is not visible to us (e.g.
+		// it is in another network namespace).
+		return nil
+	}
+	sockets, err := processGroupSockets(w.pid)
+	if err != nil {
+		return nil
+	}
+	for _, inode := range inodes {
+		if sockets[inode] {
+			return nil
+		}
+	}
+	return errPortConflict
+}
+
+// portTaken reports whether something is listening on the given port. It is
+// used to tell whether a worker that exited during startup did so because it
+// could not bind its port.
+func portTaken(port int) bool {
+	if port == 0 || !portCheckSupported {
+		return false
+	}
+	inodes, err := listeningInodes(port)
+	return err == nil && len(inodes) > 0
+}
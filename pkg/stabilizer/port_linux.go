@@ -0,0 +1,90 @@
+package stabilizer
+
+import (
+	"bufio"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+// portCheckSupported reports whether listeningInodes and
+// processGroupSockets work on this platform.
+const portCheckSupported = true
+
+// tcpListen is the state of listening sockets in /proc/net/tcp.
+const tcpListen = "0A"
+
+// listeningInodes returns the inodes of the sockets listening on the given
+// TCP port, from /proc/net/tcp and /proc/net/tcp6.
+func listeningInodes(port int) ([]string, error) {
+	var inodes []string
+	for _, name := range []string{"/proc/net/tcp", "/proc/net/tcp6"} {
+		f, err := os.Open(name)
+		if err != nil {
+			if os.IsNotExist(err) {
+				continue
+			}
+			return nil, err
+		}
+		scanner := bufio.NewScanner(f)
+		scanner.Scan() // Skip the header.
+		for scanner.Scan() {
+			fields := strings.Fields(scanner.Text())
+			if len(fields) < 10 || fields[3] != tcpListen {
+				continue
+			}
+			i := strings.LastIndex(fields[1], ":")
+			localPort, err := strconv.ParseInt(fields[1][i+1:], 16, 32)
+			if err != nil || int(localPort) != port {
+				continue
+			}
+			inodes = append(inodes, fields[9])
+		}
+		err = scanner.Err()
+		f.Close()
+		if err != nil {
+			return nil, err
+		}
+	}
+	return inodes, nil
+}
+
+// processGroupSockets returns the inodes of the sockets open in any process
+// in the given process group. Processes which exit while being inspected are
+// skipped.
+func processGroupSockets(pgid int) (map[string]bool, error) {
+	stats, err := filepath.Glob("/proc/[0-9]*/stat")
+	if err != nil {
+		return nil, err
+	}
+	sockets := make(map[string]bool)
+	for _, stat := range stats {
+		data, err := ioutil.ReadFile(stat)
+		if err != nil {
+			continue
+		}
+		// The process group is the third field after the command name,
+		// which is in parentheses and may contain spaces.
+		fields := strings.Fields(string(data[strings.LastIndex(string(data), ")")+1:]))
+		if len(fields) < 3 || fields[2] != strconv.Itoa(pgid) {
+			continue
+		}
+		fdDir := filepath.Join(filepath.Dir(stat), "fd")
+		fds, err := ioutil.ReadDir(fdDir)
+		if err != nil {
+			continue
+		}
+		for _, fd := range fds {
+			link, err := os.Readlink(filepath.Join(fdDir, fd.Name()))
+			if err != nil {
+				continue
+			}
+			if strings.HasPrefix(link, "socket:[") {
+				sockets[strings.TrimSuffix(strings.TrimPrefix(link, "socket:["), "]")] = true
+			}
+		}
+	}
+	return sockets, nil
+}
@@ -0,0 +1,22 @@
+//go:build !linux
+// +build !linux
+
+package stabilizer
+
+import "errors"
+
+// portCheckSupported reports whether listeningInodes and
+// processGroupSockets work on this platform.
+const portCheckSupported = false
+
+var errPortCheckUnsupported = errors.New("checking which process owns a port is not supported on this platform")
+
+// listeningInodes is only implemented on Linux.
+func listeningInodes(port int) ([]string, error) {
+	return nil, errPortCheckUnsupported
+}
+
+// processGroupSockets is only implemented on Linux.
+func processGroupSockets(pgid int) (map[string]bool, error) {
+	return nil, errPortCheckUnsupported
+}
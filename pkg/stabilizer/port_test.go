@@ -0,0 +1,163 @@
+package stabilizer
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	freeport "github.com/slimsag/freeport"
+)
+
+// freePort returns a port which is free at the time.
+func freePort(t *testing.T) int {
+	t.Helper()
+	port, err := freeport.GetFreePort()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return port
+}
+
+func TestRangePortAllocatorExhaustion(t *testing.T) {
+	min := freePort(t)
+	a, err := newPortAllocator(fmt.Sprintf("%d-%d", min, min+2), defaultWorkerHost)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// A port which is being listened on is skipped.
+	l, err := net.Listen("tcp", net.JoinHostPort(defaultWorkerHost, strconv.Itoa(min+1)))
+	if err == nil {
+		defer l.Close()
+	}
+
+	allocated := make(map[int]bool)
+	for {
+		port, err := a.allocate()
+		if err != nil {
+			if !strings.Contains(err.Error(), "no free port") {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			break
+		}
+		if port < min || port > min+2 {
+			t.Fatalf("allocated port %v outside of the range %v-%v", port, min, min+2)
+		}
+		if allocated[port] {
+			t.Fatalf("allocated port %v twice", port)
+		}
+		if l != nil && port == min+1 {
+			t.Fatalf("allocated port %v, which is in use", port)
+		}
+		allocated[port] = true
+	}
+	if !allocated[min] {
+		t.Fatalf("port %v was not allocated before the range was exhausted", min)
+	}
+
+	// Once released, a port is allocated again, as it is the only one.
+	a.release(min)
+	if port, err := a.allocate(); err != nil || port != min {
+		t.Fatalf("got port %v, %v, want the released port %v", port, err, min)
+	}
+	if _, err := a.allocate(); err == nil {
+		t.Fatal("allocated a port from an exhausted range")
+	}
+}
+
+func TestPortRangeTooSmall(t *testing.T) {
+	cfg := testConfig()
+	cfg.Workers = 2
+	port := freePort(t)
+	cfg.WorkerPortRange = fmt.Sprintf("%d-%d", port, port)
+	s := New(WithConfig(cfg), WithRegisterer(nil))
+	err := s.Start(context.Background())
+	if err == nil || !strings.Contains(err.Error(), "-worker-port-range") {
+		t.Fatalf("got error %v, want one about -worker-port-range", err)
+	}
+}
+
+// TestPortReuse checks that the port of a worker which died is used by its
+// replacement, when it is the only port in -worker-port-range.
+func TestPortReuse(t *testing.T) {
+	cfg := testConfig()
+	cfg.Timeout = 100 * time.Millisecond
+	port := freePort(t)
+	cfg.WorkerPortRange = fmt.Sprintf("%d-%d", port, port)
+	s, srv, stop := startStabilizer(t, cfg)
+	defer stop()
+
+	first := s.workerPIDs()
+	resp, err := http.Get(srv.URL + "/?ms=5000")
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	waitFor(t, 10*time.Second, "the worker to be replaced", func() bool {
+		pids := s.workerPIDs()
+		return len(pids) == 1 && pids[0] != first[0]
+	})
+	resp, err = http.Get(srv.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("got status %v from the replacement, want %v", resp.StatusCode, http.StatusOK)
+	}
+	s.pool.mu.Lock()
+	got := s.pool.workers[0].port
+	s.pool.mu.Unlock()
+	if got != port {
+		t.Fatalf("replacement listens on port %v, want %v", got, port)
+	}
+}
+
+func TestCheckWorkerHost(t *testing.T) {
+	for host, valid := range map[string]bool{
+		"127.0.0.1":      true,
+		"::1":            true,
+		"localhost":      true,
+		"worker.local":   true,
+		"[::1]":          false,
+		"127.0.0.1:8080": false,
+		"":               false,
+	} {
+		if err := checkWorkerHost(host); (err == nil) != valid {
+			t.Errorf("checkWorkerHost(%q) = %v, want valid %v", host, err, valid)
+		}
+	}
+}
+
+// TestIPv6Worker checks that requests are proxied to a worker which only
+// listens on the IPv6 loopback address.
+func TestIPv6Worker(t *testing.T) {
+	l, err := net.Listen("tcp", "[::1]:0")
+	if err != nil {
+		t.Skip("IPv6 is not available")
+	}
+	l.Close()
+
+	cfg := testConfig()
+	cfg.WorkerHost = "::1"
+	// The readiness probe connects to it as well.
+	cfg.WorkerReadyPath = "/"
+	s, srv, stop := startStabilizer(t, cfg)
+	defer stop()
+
+	r := get(t, srv.Client(), srv.URL, nil)
+	s.pool.mu.Lock()
+	w := s.pool.workers[0]
+	s.pool.mu.Unlock()
+	if r.PID != w.pid {
+		t.Errorf("request served by pid %v, want %v", r.PID, w.pid)
+	}
+	if want := fmt.Sprintf("[::1]:%d", w.port); w.host() != want {
+		t.Errorf("worker host is %q, want %q", w.host(), want)
+	}
+}
@@ -0,0 +1,69 @@
+//go:build !windows
+// +build !windows
+
+package stabilizer
+
+import (
+	"fmt"
+	"strings"
+	"syscall"
+)
+
+// umaskSupported reports whether setUmask works on this platform.
+const umaskSupported = true
+
+// processGroupAttr returns the attributes workers are started with: a new
+// process group, so that any subprocesses a worker spawns can be killed
+// together with it.
+func processGroupAttr() *syscall.SysProcAttr {
+	return &syscall.SysProcAttr{Setpgid: true}
+}
+
+// processGroup is a worker and the subprocesses it spawns, which are signaled
+// together: on Unix, its process group.
+type processGroup struct {
+	pgid int
+}
+
+// newProcessGroup returns the process group of a worker which was just
+// started with processGroupAttr. It is looked up while the worker cannot have
+// been reaped yet, as it cannot be found afterwards.
+func newProcessGroup(pid int) (*processGroup, error) {
+	pgid, err := syscall.Getpgid(pid)
+	if err != nil {
+		return nil, err
+	}
+	return &processGroup{pgid: pgid}, nil
+}
+
+// signal sends sig to every process in the group.
+func (g *processGroup) signal(sig syscall.Signal) error {
+	return syscall.Kill(-g.pgid, sig)
+}
+
+// close releases the group once the worker has exited.
+func (g *processGroup) close() {}
+
+// setUmask sets the process-wide file mode creation mask, and returns the
+// previous one.
+func setUmask(mask int) int {
+	return syscall.Umask(mask)
+}
+
+// parseSignal parses a -stuck-dump-signal value, such as SIGQUIT or ABRT. An
+// empty value or "none" returns 0.
+func parseSignal(name string) (syscall.Signal, error) {
+	switch strings.TrimPrefix(strings.ToUpper(name), "SIG") {
+	case "", "NONE":
+		return 0, nil
+	case "QUIT":
+		return syscall.SIGQUIT, nil
+	case "ABRT":
+		return syscall.SIGABRT, nil
+	case "USR1":
+		return syscall.SIGUSR1, nil
+	case "USR2":
+		return syscall.SIGUSR2, nil
+	}
+	return 0, fmt.Errorf("unsupported signal %q, expected SIGQUIT, SIGABRT, SIGUSR1 or SIGUSR2", name)
+}
@@ -0,0 +1,119 @@
+package stabilizer
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+	"syscall"
+	"unsafe"
+
+	"golang.org/x/sys/windows"
+)
+
+// umaskSupported reports whether setUmask works on this platform.
+const umaskSupported = false
+
+// processGroupAttr returns the attributes workers are started with: a new
+// console process group, so that a worker can be sent CTRL_BREAK_EVENT
+// without it reaching the stabilizer.
+func processGroupAttr() *syscall.SysProcAttr {
+	return &syscall.SysProcAttr{CreationFlags: syscall.CREATE_NEW_PROCESS_GROUP}
+}
+
+// processGroup is a worker and the subprocesses it spawns, which are signaled
+// together: on Windows, a job object the worker is assigned to, which the
+// processes it starts then belong to as well.
+type processGroup struct {
+	pid int
+	job jobObject
+}
+
+// jobObject is what processGroup needs of a job object, so that it can be
+// mocked in tests.
+type jobObject interface {
+	// terminate ends every process in the job with the given exit code.
+	terminate(exitCode uint32) error
+	close() error
+}
+
+// windowsJob is a job object handle.
+type windowsJob windows.Handle
+
+func (j windowsJob) terminate(exitCode uint32) error {
+	return windows.TerminateJobObject(windows.Handle(j), exitCode)
+}
+
+func (j windowsJob) close() error {
+	return windows.CloseHandle(windows.Handle(j))
+}
+
+// generateConsoleCtrlEvent sends a console control event to a console
+// process group, and is replaced in tests.
+var generateConsoleCtrlEvent = windows.GenerateConsoleCtrlEvent
+
+// newProcessGroup assigns a worker which was just started to a new job
+// object. The job is set up to kill the processes in it once it is closed, so
+// that none outlive the worker. Subprocesses the worker spawned before it was
+// assigned are not in the job.
+func newProcessGroup(pid int) (*processGroup, error) {
+	job, err := windows.CreateJobObject(nil, nil)
+	if err != nil {
+		return nil, err
+	}
+	info := windows.JOBOBJECT_EXTENDED_LIMIT_INFORMATION{
+		BasicLimitInformation: windows.JOBOBJECT_BASIC_LIMIT_INFORMATION{
+			LimitFlags: windows.JOB_OBJECT_LIMIT_KILL_ON_JOB_CLOSE,
+		},
+	}
+	if _, err := windows.SetInformationJobObject(job, windows.JobObjectExtendedLimitInformation, uintptr(unsafe.Pointer(&info)), uint32(unsafe.Sizeof(info))); err != nil {
+		windows.CloseHandle(job)
+		return nil, err
+	}
+	process, err := windows.OpenProcess(windows.PROCESS_SET_QUOTA|windows.PROCESS_TERMINATE, false, uint32(pid))
+	if err != nil {
+		windows.CloseHandle(job)
+		return nil, err
+	}
+	defer windows.CloseHandle(process)
+	if err := windows.AssignProcessToJobObject(job, process); err != nil {
+		windows.CloseHandle(job)
+		return nil, err
+	}
+	return &processGroup{pid: pid, job: windowsJob(job)}, nil
+}
+
+// signal terminates every process in the job for SIGKILL. For SIGTERM and
+// SIGINT, which Windows does not have, the worker's console process group is
+// sent CTRL_BREAK_EVENT instead, which e.g. Go programs receive as
+// os.Interrupt. Other signals are not supported.
+func (g *processGroup) signal(sig syscall.Signal) error {
+	switch sig {
+	case syscall.SIGKILL:
+		return g.job.terminate(1)
+	case syscall.SIGTERM, syscall.SIGINT:
+		return generateConsoleCtrlEvent(windows.CTRL_BREAK_EVENT, uint32(g.pid))
+	}
+	return fmt.Errorf("sending %v is not supported on Windows", sig)
+}
+
+// close closes the job once the worker has exited, which kills any
+// subprocesses it left behind.
+func (g *processGroup) close() {
+	g.job.close()
+}
+
+// setUmask is only implemented on Unix.
+func setUmask(mask int) int {
+	return 0
+}
+
+// parseSignal parses a -stuck-dump-signal value, which on Windows may only be
+// empty or "none", returning 0, as workers cannot be sent signals which make
+// them dump their stacks.
+func parseSignal(name string) (syscall.Signal, error) {
+	switch strings.TrimPrefix(strings.ToUpper(name), "SIG") {
+	case "", "NONE":
+		return 0, nil
+	}
+	return 0, errors.New("stack dump signals are not supported on Windows")
+}
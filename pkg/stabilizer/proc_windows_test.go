@@ -0,0 +1,121 @@
+//go:build windows
+// +build windows
+
+package stabilizer
+
+import (
+	"encoding/json"
+	"net/http"
+	"syscall"
+	"testing"
+	"time"
+
+	"golang.org/x/sys/windows"
+)
+
+// mockJob is a job object which records what is done with it.
+type mockJob struct {
+	terminated []uint32
+	closed     bool
+}
+
+func (j *mockJob) terminate(exitCode uint32) error {
+	j.terminated = append(j.terminated, exitCode)
+	return nil
+}
+
+func (j *mockJob) close() error {
+	j.closed = true
+	return nil
+}
+
+func TestProcessGroupSignal(t *testing.T) {
+	var breaks []uint32
+	defer func(f func(uint32, uint32) error) { generateConsoleCtrlEvent = f }(generateConsoleCtrlEvent)
+	generateConsoleCtrlEvent = func(event, pid uint32) error {
+		if event != windows.CTRL_BREAK_EVENT {
+			t.Errorf("got console event %v, want CTRL_BREAK_EVENT", event)
+		}
+		breaks = append(breaks, pid)
+		return nil
+	}
+
+	job := &mockJob{}
+	g := &processGroup{pid: 42, job: job}
+
+	// SIGKILL terminates the whole job, and the others only reach the
+	// worker's console process group.
+	if err := g.signal(syscall.SIGTERM); err != nil {
+		t.Fatal(err)
+	}
+	if err := g.signal(syscall.SIGINT); err != nil {
+		t.Fatal(err)
+	}
+	if len(job.terminated) != 0 {
+		t.Fatalf("job terminated by %v, want only SIGKILL to", job.terminated)
+	}
+	if err := g.signal(syscall.SIGKILL); err != nil {
+		t.Fatal(err)
+	}
+	if len(job.terminated) != 1 || job.terminated[0] != 1 {
+		t.Errorf("got job terminated with %v, want once with exit code 1", job.terminated)
+	}
+	if len(breaks) != 2 || breaks[0] != 42 || breaks[1] != 42 {
+		t.Errorf("got CTRL_BREAK_EVENT sent to %v, want to 42 twice", breaks)
+	}
+
+	if err := g.signal(syscall.SIGQUIT); err == nil {
+		t.Error("expected an error for an unsupported signal")
+	}
+
+	// Closing the job, once the worker has exited, kills what it left
+	// behind.
+	g.close()
+	if !job.closed {
+		t.Error("job not closed")
+	}
+}
+
+// processExited reports whether the process with the given pid has exited.
+func processExited(pid int) bool {
+	h, err := windows.OpenProcess(windows.SYNCHRONIZE, false, uint32(pid))
+	if err != nil {
+		// There is no such process anymore.
+		return true
+	}
+	defer windows.CloseHandle(h)
+	event, err := windows.WaitForSingleObject(h, 0)
+	return err == nil && event == windows.WAIT_OBJECT_0
+}
+
+// TestKillTree checks that killing a worker also kills the subprocesses it
+// started, which are in its job object.
+func TestKillTree(t *testing.T) {
+	cfg := testConfig()
+	cfg.Timeout = 500 * time.Millisecond
+	_, srv, stop := startStabilizer(t, cfg)
+	defer stop()
+
+	resp, err := http.Get(srv.URL + "/fork?ms=60000")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var forked testWorkerResponse
+	err = json.NewDecoder(resp.Body).Decode(&forked)
+	resp.Body.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if processExited(forked.PID) || processExited(forked.Child) {
+		t.Fatal("worker or subprocess exited before the worker was killed")
+	}
+
+	// Kill the worker by timing out a request to it.
+	resp, err = http.Get(srv.URL + "/?ms=5000")
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	waitFor(t, 10*time.Second, "the worker to be killed", func() bool { return processExited(forked.PID) })
+	waitFor(t, 10*time.Second, "the subprocess to be killed", func() bool { return processExited(forked.Child) })
+}
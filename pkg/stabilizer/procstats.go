@@ -0,0 +1,76 @@
+package stabilizer
+
+import (
+	"strconv"
+	"time"
+
+	"github.com/sourcegraph/log"
+)
+
+// rssPollInterval is how often the memory usage of workers is checked for
+// -worker-max-rss when -proc-metrics-interval is zero.
+const rssPollInterval = 2 * time.Second
+
+// procStats is the resource usage of a process.
+type procStats struct {
+	// cpuSeconds is the CPU time the process has used, in user and system
+	// mode, and rss its resident memory in bytes.
+	cpuSeconds float64
+	rss        int64
+	// fds is the number of open file descriptors of the process, or -1 if
+	// they could not be counted, e.g. as it runs as another user.
+	fds     int
+	threads int
+}
+
+// monitorProc records the resource usage of the worker every
+// -proc-metrics-interval, and drains it once its resident memory exceeds
+// -worker-max-rss. It returns once the worker is done.
+func (s *Stabilizer) monitorProc(w *worker) {
+	index := strconv.Itoa(w.index)
+	interval := s.cfg.ProcMetricsInterval
+	if interval <= 0 {
+		interval = rssPollInterval
+	}
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-w.done:
+			return
+		case <-ticker.C:
+		}
+
+		stats, err := readProcStats(w.pid)
+		if err != nil {
+			// The worker may have exited since it was last checked.
+			if w.alive() {
+				w.log.Debug("failed to read resource usage", log.Error(err))
+			}
+			continue
+		}
+		if s.cfg.ProcMetricsInterval > 0 {
+			s.metrics.workerCPU.set(index, stats.cpuSeconds)
+			s.metrics.workerRSS.WithLabelValues(index).Set(float64(stats.rss))
+			s.metrics.workerThreads.WithLabelValues(index).Set(float64(stats.threads))
+			if stats.fds >= 0 {
+				s.metrics.workerFDs.WithLabelValues(index).Set(float64(stats.fds))
+			}
+		}
+		if s.cfg.WorkerMaxRSS > 0 && stats.rss > s.cfg.WorkerMaxRSS && !s.pool.draining(w) {
+			w.log.Warn("recycling due to memory usage",
+				log.Int64("rss", stats.rss),
+				log.Int64("max", s.cfg.WorkerMaxRSS))
+			s.pool.drain(w, reasonMemory)
+		}
+	}
+}
+
+// forgetProcStats removes the resource usage metrics of the given slot.
+func (m *metrics) forgetProcStats(index int) {
+	label := strconv.Itoa(index)
+	m.workerCPU.delete(label)
+	m.workerRSS.DeleteLabelValues(label)
+	m.workerFDs.DeleteLabelValues(label)
+	m.workerThreads.DeleteLabelValues(label)
+}
@@ -0,0 +1,82 @@
+package stabilizer
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"strconv"
+	"strings"
+)
+
+// procStatsSupported reports whether readProcStats works on this platform.
+const procStatsSupported = true
+
+// userHZ is the number of clock ticks per second in which /proc/<pid>/stat
+// reports CPU time, which is 100 on all supported architectures.
+const userHZ = 100
+
+// readProcStats returns the resource usage of the process with the given pid,
+// as reported by /proc/<pid>/stat, /proc/<pid>/statm and /proc/<pid>/fd.
+func readProcStats(pid int) (procStats, error) {
+	stats := procStats{fds: -1}
+	data, err := ioutil.ReadFile(fmt.Sprintf("/proc/%d/stat", pid))
+	if err != nil {
+		return stats, err
+	}
+	// The command name in parentheses may contain spaces and parentheses, so
+	// the fields after it are found from the last closing parenthesis.
+	i := strings.LastIndexByte(string(data), ')')
+	if i < 0 {
+		return stats, fmt.Errorf("unexpected /proc/%d/stat contents %q", pid, data)
+	}
+	// These are the fields from the state (the third) onwards.
+	fields := strings.Fields(string(data[i+1:]))
+	if len(fields) < 18 {
+		return stats, fmt.Errorf("unexpected /proc/%d/stat contents %q", pid, data)
+	}
+	utime, err := strconv.ParseUint(fields[11], 10, 64)
+	if err != nil {
+		return stats, err
+	}
+	stime, err := strconv.ParseUint(fields[12], 10, 64)
+	if err != nil {
+		return stats, err
+	}
+	stats.cpuSeconds = float64(utime+stime) / userHZ
+	if stats.threads, err = strconv.Atoi(fields[17]); err != nil {
+		return stats, err
+	}
+
+	if stats.rss, err = readRSS(pid); err != nil {
+		return stats, err
+	}
+
+	// The file descriptors of workers run as another user cannot be
+	// listed, which is not an error.
+	if dir, err := os.Open(fmt.Sprintf("/proc/%d/fd", pid)); err == nil {
+		names, err := dir.Readdirnames(-1)
+		dir.Close()
+		if err == nil {
+			stats.fds = len(names)
+		}
+	}
+	return stats, nil
+}
+
+// readRSS returns the resident memory of the process with the given pid, in
+// bytes, as reported by /proc/<pid>/statm.
+func readRSS(pid int) (int64, error) {
+	data, err := ioutil.ReadFile(fmt.Sprintf("/proc/%d/statm", pid))
+	if err != nil {
+		return 0, err
+	}
+	fields := strings.Fields(string(data))
+	if len(fields) < 2 {
+		return 0, fmt.Errorf("unexpected /proc/%d/statm contents %q", pid, data)
+	}
+	pages, err := strconv.ParseInt(fields[1], 10, 64)
+	if err != nil {
+		return 0, err
+	}
+	return pages * int64(os.Getpagesize()), nil
+}
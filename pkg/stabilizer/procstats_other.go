@@ -0,0 +1,14 @@
+//go:build !linux
+// +build !linux
+
+package stabilizer
+
+import "errors"
+
+// procStatsSupported reports whether readProcStats works on this platform.
+const procStatsSupported = false
+
+// readProcStats is only implemented on Linux.
+func readProcStats(pid int) (procStats, error) {
+	return procStats{}, errors.New("reading worker resource usage is not supported on this platform")
+}
@@ -0,0 +1,716 @@
+package stabilizer
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/slimsag/http-server-stabilizer/pkg/hsserr"
+	"github.com/sourcegraph/log"
+	"go.opentelemetry.io/otel/propagation"
+)
+
+// statusClientClosedRequest is the (non-standard) status code used when the
+// client closes the connection before a response is written.
+const statusClientClosedRequest = 499
+
+// requestIDHeader is the header used to correlate a request across the
+// client, the stabilizer and the worker.
+const requestIDHeader = "X-Request-ID"
+
+// Headers set on responses from workers with -debug-headers, for tracing a
+// request back to the worker which served it.
+const (
+	// WorkerHeader identifies the worker, as in "pid=1234 port=54321", or
+	// "upstream=10.0.0.1:4443" for -upstreams.
+	WorkerHeader = "X-Worker"
+	// WorkerDurationHeader is how long the worker took to respond, or to
+	// fail, from when the request was sent to it, as in "1.500ms".
+	WorkerDurationHeader = "X-Worker-Duration"
+	// QueueDurationHeader is how long the request waited for a worker.
+	QueueDurationHeader = "X-Queue-Duration"
+	// WorkerRetriesHeader is the number of times the request was retried
+	// on another worker, if it was.
+	WorkerRetriesHeader = "X-Worker-Retries"
+	// WorkerHedgedHeader is "true" if the response came from a hedged
+	// request.
+	WorkerHedgedHeader = "X-Worker-Hedged"
+)
+
+// Err is the error returned to clients when a request could not be served by
+// a worker. It is defined in package hsserr, which clients can import along
+// with the reasons it has.
+type Err = hsserr.Err
+
+// retryAfter is the Retry-After header value sent with retriable errors,
+// unless a more accurate one was set already.
+const retryAfter = "1"
+
+// writeError writes an error response with the given status code. The
+// request ID is taken from the response headers set by ServeHTTP. Retriable
+// errors are sent with a Retry-After header. gRPC requests get a gRPC error
+// instead, as gRPC clients can't read the JSON, and clients which prefer HTML
+// or plain text according to their Accept header get that. Other than gRPC
+// errors, they are marked with the hsserr.Header header.
+func (s *Stabilizer) writeError(rw http.ResponseWriter, req *http.Request, code int, reason, description string, retriable bool) {
+	if retriable && rw.Header().Get("Retry-After") == "" {
+		rw.Header().Set("Retry-After", retryAfter)
+	}
+	if isGRPC(req) {
+		writeGRPCError(rw, code, reason, description)
+		return
+	}
+	rw.Header().Set(hsserr.Header, "1")
+	e := Err{
+		Code:        code,
+		Reason:      reason,
+		Description: description,
+		RequestID:   rw.Header().Get(requestIDHeader),
+		Retriable:   retriable,
+	}
+	switch negotiateErrorFormat(req.Header.Get("Accept")) {
+	case errorFormatHTML:
+		s.writeErrorPage(rw, e)
+	case errorFormatPlain:
+		writeErrorText(rw, e)
+	default:
+		rw.Header().Set("Content-Type", "application/json")
+		rw.WriteHeader(code)
+		_ = json.NewEncoder(rw).Encode(&hsserr.Response{Error: e})
+	}
+}
+
+// writeTooLarge writes the error response for a request whose body is larger
+// than -max-request-bytes.
+func (s *Stabilizer) writeTooLarge(rw http.ResponseWriter, req *http.Request) {
+	s.metrics.tooLargeCounter.Inc()
+	s.writeError(rw, req, http.StatusRequestEntityTooLarge, hsserr.ReasonRequestTooLarge,
+		fmt.Sprintf("Request body is larger than the limit of %v bytes", s.cfg.MaxRequestBytes), false)
+}
+
+// isTooLarge reports whether err is from reading a request body larger than
+// -max-request-bytes.
+func isTooLarge(err error) bool {
+	var tooLarge *http.MaxBytesError
+	return errors.As(err, &tooLarge)
+}
+
+// isHeaderTimeout reports whether err is from a worker not sending response
+// headers within -worker-response-header-timeout. net/http does not export
+// this error, so it is recognized by its message.
+func (s *Stabilizer) isHeaderTimeout(err error) bool {
+	return s.cfg.WorkerResponseHeaderTimeout > 0 && strings.Contains(err.Error(), "timeout awaiting response headers")
+}
+
+// requestID returns the ID of the given request, from its X-Request-ID header
+// if it has one or else randomly generated.
+func requestID(req *http.Request) string {
+	if id := req.Header.Get(requestIDHeader); id != "" {
+		return id
+	}
+	var b [16]byte
+	if _, err := rand.Read(b[:]); err != nil {
+		return ""
+	}
+	return hex.EncodeToString(b[:])
+}
+
+// proxyRequest tracks a single request as it passes through the proxy.
+type proxyRequest struct {
+	// id is the ID of the request (see requestID).
+	id string
+
+	// lease is the lease on the worker serving the request, which is
+	// worker. Retries and hedging may replace it with a lease on another
+	// worker, in which case they close the one it replaces.
+	lease  *lease
+	worker *worker
+
+	// outcome is the outcome of the request, one of the outcome* constants.
+	outcome string
+
+	// retries is the number of times the request was retried on another
+	// worker, and hedged whether the response came from a hedged request.
+	retries int
+	hedged  bool
+
+	// route is the -route the request matched, or nil.
+	route *route
+
+	// priority is the priority of the request, given by -priority-header.
+	priority int
+
+	// queueWait is how long the request waited for a worker, timeout its
+	// timeout, and timeoutRequested whether it was given with -header.
+	queueWait        time.Duration
+	timeout          time.Duration
+	timeoutRequested bool
+
+	// sent is when the request was sent to its worker.
+	sent time.Time
+
+	// req is the request as received, and body captures its body, if
+	// -poison-request-dir is set.
+	req  *http.Request
+	body *bodyCapture
+
+	// activity is the request's context if -timeout-resets-on-activity is
+	// set or the request is a WebSocket upgrade, and nil otherwise.
+	activity *activityContext
+}
+
+// use makes the worker of the given lease the one serving the request.
+func (pr *proxyRequest) use(l *lease) {
+	pr.lease, pr.worker = l, l.worker
+}
+
+// release returns the worker serving the request, if any, to the pool.
+func (pr *proxyRequest) release() {
+	if pr.lease != nil {
+		pr.lease.Close()
+	}
+}
+
+// isWebSocket reports whether the request asks to upgrade to a WebSocket.
+func isWebSocket(req *http.Request) bool {
+	return strings.EqualFold(req.Header.Get("Upgrade"), "websocket")
+}
+
+type proxyRequestKey struct{}
+
+// getProxyRequest returns the proxyRequest stored in ctx by ServeHTTP.
+func getProxyRequest(ctx context.Context) *proxyRequest {
+	pr, _ := ctx.Value(proxyRequestKey{}).(*proxyRequest)
+	return pr
+}
+
+// requestTimeout returns the timeout for the given request, which may be
+// overridden by its route and then by the -header request header within
+// -timeout-min and -timeout-max (or the route's timeout-max). s.configMu
+// must be held.
+func (s *Stabilizer) requestTimeout(req *http.Request, rt *route) time.Duration {
+	defaultTimeout, timeoutMax := s.cfg.Timeout, s.cfg.TimeoutMax
+	if rt != nil && rt.Timeout > 0 {
+		defaultTimeout = rt.Timeout
+	}
+	if rt != nil && rt.TimeoutMax > 0 {
+		timeoutMax = rt.TimeoutMax
+	}
+	if s.cfg.TimeoutHeader == "" {
+		return defaultTimeout
+	}
+	value := req.Header.Get(s.cfg.TimeoutHeader)
+	if value == "" {
+		return defaultTimeout
+	}
+	timeout, err := time.ParseDuration(value)
+	if err != nil || timeout <= 0 {
+		s.metrics.invalidTimeoutsCounter.Inc()
+		return defaultTimeout
+	}
+	clamped := timeout
+	if s.cfg.TimeoutMin > 0 && clamped < s.cfg.TimeoutMin {
+		clamped = s.cfg.TimeoutMin
+	}
+	if timeoutMax > 0 && clamped > timeoutMax {
+		clamped = timeoutMax
+	}
+	if clamped != timeout {
+		s.log.Warn("clamped requested timeout",
+			log.Duration("requested", timeout),
+			log.Duration("timeout", clamped))
+	}
+	return clamped
+}
+
+// ServeHTTP proxies the request to a worker, of the pool matching its path if
+// any. The request timeout is owned here rather than in the director, so that
+// it is released as soon as the response has been written.
+func (s *Stabilizer) ServeHTTP(rw http.ResponseWriter, req *http.Request) {
+	if s.servePool(rw, req) || s.serveCanary(rw, req) {
+		return
+	}
+	pr := &proxyRequest{id: requestID(req), outcome: outcomeOK, priority: priorityNormal}
+	if s.cfg.PriorityHeader != "" {
+		pr.priority = parsePriority(req.Header.Get(s.cfg.PriorityHeader))
+	}
+	if pr.id != "" {
+		// Pass the ID on to the worker, and back to the client even if the
+		// request fails.
+		req.Header.Set(requestIDHeader, pr.id)
+		rw.Header().Set(requestIDHeader, pr.id)
+	}
+	if entry := getAccessEntry(req.Context()); entry != nil {
+		entry.pr, entry.s = pr, s
+	}
+
+	var (
+		ctx    context.Context
+		cancel context.CancelFunc
+	)
+	s.configMu.RLock()
+	pr.route = s.routes.match(req.URL.Path)
+	timeout := s.requestTimeout(req, pr.route)
+	queueTimeout := s.cfg.QueueTimeout
+	s.configMu.RUnlock()
+	pr.timeout = timeout
+	pr.timeoutRequested = s.cfg.TimeoutHeader != "" && req.Header.Get(s.cfg.TimeoutHeader) != ""
+	if s.cfg.TimeoutResetsOnActivity || isWebSocket(req) {
+		pr.activity, cancel = withActivityTimeout(req.Context(), timeout)
+		ctx = pr.activity
+	} else {
+		ctx, cancel = context.WithTimeout(req.Context(), timeout)
+	}
+	defer cancel()
+
+	// Reject requests which are too large before they take up a worker, if
+	// their size is known. Otherwise they are rejected once too much of the
+	// body has been read.
+	if s.cfg.MaxRequestBytes > 0 {
+		if req.ContentLength > s.cfg.MaxRequestBytes {
+			pr.outcome = outcomeError
+			s.writeTooLarge(rw, req)
+			return
+		}
+		req.Body = http.MaxBytesReader(rw, req.Body, s.cfg.MaxRequestBytes)
+	}
+
+	// Read small request bodies up front so that the request can be retried
+	// or hedged if need be.
+	if s.cfg.MaxRetries > 0 || s.cfg.HedgeAfter > 0 {
+		release, err := s.bufferBody(req)
+		defer release()
+		if err != nil {
+			pr.outcome = outcomeError
+			if isTooLarge(err) {
+				s.writeTooLarge(rw, req)
+				return
+			}
+			s.writeError(rw, req, http.StatusBadRequest, hsserr.ReasonRequestBodyError,
+				fmt.Sprintf("Failed to read request body: %v", err), false)
+			return
+		}
+	}
+
+	if s.cfg.PoisonRequestDir != "" {
+		s.capturePoisonBody(req, pr)
+	}
+	if s.mirror != nil {
+		s.mirrorRequest(req)
+	}
+
+	// Pull a worker from the pool, waiting up to -queue-timeout (or the
+	// request timeout, if shorter) for one to become available, and for the
+	// route to allow another request.
+	acquireCtx := ctx
+	if queueTimeout > 0 {
+		var cancelAcquire func()
+		acquireCtx, cancelAcquire = context.WithTimeout(ctx, queueTimeout)
+		defer cancelAcquire()
+	}
+	queueStart := time.Now()
+	releaseRoute, err := pr.route.acquire(acquireCtx)
+	var l *lease
+	if err == nil {
+		defer releaseRoute()
+		// Send requests with the same -affinity-key to the same worker
+		// while it has capacity.
+		if key := s.affinityKey(req); key != "" {
+			l = s.pool.acquireAffine(key, pr.priority)
+			result := "hit"
+			if l == nil {
+				result = "miss"
+			}
+			s.metrics.affinityCounter.WithLabelValues(result).Inc()
+		}
+		if l == nil {
+			l, err = s.pool.acquire(acquireCtx, pr.priority)
+		}
+	}
+	pr.queueWait = time.Since(queueStart)
+	s.metrics.queueWait.WithLabelValues(priorityNames[pr.priority]).Observe(pr.queueWait.Seconds())
+	if err != nil {
+		if err == context.Canceled {
+			pr.outcome = outcomeCanceled
+			s.metrics.clientCancellationsCounter.Inc()
+			rw.WriteHeader(statusClientClosedRequest)
+			return
+		}
+		pr.outcome = outcomeError
+		s.metrics.queueRejectionsCounter.Inc()
+		s.writeError(rw, req, s.cfg.QueueTimeoutStatus, hsserr.ReasonNoWorkerAvailable,
+			"No worker became available to serve the request in time", true)
+		return
+	}
+
+	// Keep the worker until the proxy is done with the request, however it
+	// ends: this is after the response body has been copied to the client
+	// (or the WebSocket closed), so that the worker is not killed
+	// mid-response if it is draining, and also if the copy fails or the
+	// proxy panics.
+	pr.use(l)
+	defer pr.release()
+	ctx = context.WithValue(ctx, proxyRequestKey{}, pr)
+	s.proxy.ServeHTTP(rw, req.WithContext(ctx))
+}
+
+func (s *Stabilizer) director(req *http.Request) {
+	// Set the worker acquired for this request as our target.
+	pr := getProxyRequest(req.Context())
+	pr.sent = time.Now()
+	target, _ := url.Parse("http://" + pr.worker.host())
+	s.log.Debug("handling request",
+		log.String("requestID", pr.id),
+		log.String("url", req.URL.String()),
+		log.String("target", target.String()))
+
+	// Copy what httputil.NewSingleHostReverseProxy would do.
+	req.URL.Scheme = target.Scheme
+	req.URL.Host = target.Host
+	req.URL.Path, req.URL.RawPath = joinURLPath(target, req.URL)
+	if target.RawQuery == "" || req.URL.RawQuery == "" {
+		req.URL.RawQuery = target.RawQuery + req.URL.RawQuery
+	} else {
+		req.URL.RawQuery = target.RawQuery + "&" + req.URL.RawQuery
+	}
+	s.setForwardedHeaders(req)
+	if s.cfg.TimeoutHeader != "" && !s.cfg.ForwardTimeoutHeader {
+		req.Header.Del(s.cfg.TimeoutHeader)
+	}
+	s.setDeadlineHeader(req)
+	if s.tracer != nil {
+		// Continue the request's trace in the worker.
+		traceContext.Inject(req.Context(), propagation.HeaderCarrier(req.Header))
+	}
+	if !s.cfg.PreserveHost {
+		req.Host = ""
+	}
+	if _, ok := req.Header["User-Agent"]; !ok {
+		// explicitly disable User-Agent so it's not set to default value
+		req.Header.Set("User-Agent", "")
+	}
+}
+
+// joinURLPath joins the paths of a and b as httputil.NewSingleHostReverseProxy
+// does, keeping trailing slashes and percent-encoded characters (such as
+// %2F) as they were.
+func joinURLPath(a, b *url.URL) (path, rawpath string) {
+	if a.RawPath == "" && b.RawPath == "" {
+		return singleJoiningSlash(a.Path, b.Path), ""
+	}
+	// Same as singleJoiningSlash, but uses EscapedPath to determine whether
+	// a slash should be added.
+	apath := a.EscapedPath()
+	bpath := b.EscapedPath()
+
+	aslash := strings.HasSuffix(apath, "/")
+	bslash := strings.HasPrefix(bpath, "/")
+
+	switch {
+	case aslash && bslash:
+		return a.Path + b.Path[1:], apath + bpath[1:]
+	case !aslash && !bslash:
+		return a.Path + "/" + b.Path, apath + "/" + bpath
+	}
+	return a.Path + b.Path, apath + bpath
+}
+
+// singleJoiningSlash joins a and b with exactly one slash between them.
+func singleJoiningSlash(a, b string) string {
+	aslash := strings.HasSuffix(a, "/")
+	bslash := strings.HasPrefix(b, "/")
+	switch {
+	case aslash && bslash:
+		return a + b[1:]
+	case !aslash && !bslash:
+		return a + "/" + b
+	}
+	return a + b
+}
+
+// setForwardedHeaders sets the X-Forwarded-Proto and X-Forwarded-Host headers
+// of a request to a worker, keeping the client's values if
+// -trust-forwarded-headers is set. The client's IP is appended to
+// X-Forwarded-For by httputil.ReverseProxy after the director has run.
+func (s *Stabilizer) setForwardedHeaders(req *http.Request) {
+	if !s.cfg.TrustForwardedHeaders {
+		req.Header.Del("X-Forwarded-For")
+		req.Header.Del("X-Forwarded-Proto")
+		req.Header.Del("X-Forwarded-Host")
+	}
+	if req.Header.Get("X-Forwarded-Proto") == "" {
+		proto := "http"
+		if req.TLS != nil {
+			proto = "https"
+		}
+		req.Header.Set("X-Forwarded-Proto", proto)
+	}
+	if req.Header.Get("X-Forwarded-Host") == "" {
+		req.Header.Set("X-Forwarded-Host", req.Host)
+	}
+}
+
+// setDeadlineHeader sets the -deadline-header header of a request to a worker
+// to the time left until the request times out, so that the worker can give
+// up on it rather than being killed.
+func (s *Stabilizer) setDeadlineHeader(req *http.Request) {
+	if s.cfg.DeadlineHeader == "" {
+		return
+	}
+	deadline, ok := req.Context().Deadline()
+	if !ok {
+		return
+	}
+	remaining := time.Until(deadline).Milliseconds()
+	if remaining < 0 {
+		remaining = 0
+	}
+	req.Header.Set(s.cfg.DeadlineHeader, strconv.FormatInt(remaining, 10))
+}
+
+func (s *Stabilizer) modifyResponse(r *http.Response) error {
+	pr := getProxyRequest(r.Request.Context())
+	if pr == nil || pr.worker == nil {
+		return nil
+	}
+	w := pr.worker
+	// For WebSockets, the body is the connection to the worker, which is
+	// kept until either side closes it and counts towards -concurrency until
+	// then.
+	if conn, ok := r.Body.(io.ReadWriteCloser); ok && r.StatusCode == http.StatusSwitchingProtocols && pr.activity != nil {
+		pr.activity.setTimeout(s.cfg.WSIdleTimeout)
+		r.Body = activityConn{ReadWriteCloser: conn, ctx: pr.activity}
+	} else if pr.activity != nil {
+		r.Body = activityReader{ReadCloser: r.Body, ctx: pr.activity}
+	}
+	w.mu.Lock()
+	w.requests++
+	requests := w.requests
+	if r.StatusCode >= 500 {
+		w.responses5xx++
+		w.consecutive5xx++
+	} else {
+		w.consecutive5xx = 0
+	}
+	unhealthy := s.cfg.UnhealthyAfter5xx > 0 && w.consecutive5xx == s.cfg.UnhealthyAfter5xx
+	w.mu.Unlock()
+	if unhealthy {
+		withTrace(r.Request.Context(), w.log).Warn("restarting due to consecutive 5xx responses", log.String("requestID", pr.id), log.Int("responses", s.cfg.UnhealthyAfter5xx))
+		s.pool.drain(w, reasonUnhealthy)
+	}
+	if s.cfg.WorkerMaxRequests > 0 && requests >= s.cfg.WorkerMaxRequests {
+		if w.recycle(reasonMaxRequests) {
+			w.log.Info("recycling", log.String("reason", reasonMaxRequests), log.Int("requests", requests))
+		}
+	}
+
+	s.setDebugHeaders(r.Header, pr)
+	// ServeHTTP has already set the request ID on the response, so drop
+	// the worker's copy of it rather than sending it twice.
+	r.Header.Del(requestIDHeader)
+	if s.upstreamErrors[r.StatusCode] && !isGRPC(r.Request) {
+		return s.wrapUpstreamError(r, pr)
+	}
+	return nil
+}
+
+// setDebugHeaders sets the -debug-headers headers of a response to a request
+// which was sent to a worker.
+func (s *Stabilizer) setDebugHeaders(h http.Header, pr *proxyRequest) {
+	if !s.cfg.DebugHeaders {
+		return
+	}
+	w := pr.worker
+	switch {
+	case w.upstream != "":
+		h.Set(WorkerHeader, "upstream="+w.upstream)
+	case w.socket != "":
+		h.Set(WorkerHeader, fmt.Sprintf("pid=%d socket=%s", w.pid, w.socket))
+	default:
+		h.Set(WorkerHeader, fmt.Sprintf("pid=%d port=%d", w.pid, w.port))
+	}
+	h.Set(WorkerDurationHeader, headerDuration(time.Since(pr.sent)))
+	h.Set(QueueDurationHeader, headerDuration(pr.queueWait))
+	if pr.retries > 0 {
+		h.Set(WorkerRetriesHeader, strconv.Itoa(pr.retries))
+	}
+	if pr.hedged {
+		h.Set(WorkerHedgedHeader, "true")
+	}
+}
+
+// headerDuration formats a duration for a header in milliseconds, as in
+// "1.500ms", which time.ParseDuration accepts. Unlike time.Duration's String,
+// it never uses the non-ASCII "µs".
+func headerDuration(d time.Duration) string {
+	return strconv.FormatFloat(float64(d)/float64(time.Millisecond), 'f', 3, 64) + "ms"
+}
+
+// upstreamErrorDetailMaxBytes is the most of a worker's error response body
+// that is kept in the detail of hss_upstream_error.
+const upstreamErrorDetailMaxBytes = 64 << 10
+
+// wrapUpstreamError replaces a response with one of the -upstream-5xx-as-error
+// statuses with a hss_upstream_error, whose detail is the worker's response
+// body.
+func (s *Stabilizer) wrapUpstreamError(r *http.Response, pr *proxyRequest) error {
+	defer r.Body.Close()
+	var body io.Reader = r.Body
+	if r.Header.Get("Content-Encoding") == "gzip" {
+		gz, err := gzip.NewReader(r.Body)
+		if err != nil {
+			return err
+		}
+		body = gz
+	}
+	detail, err := ioutil.ReadAll(io.LimitReader(body, upstreamErrorDetailMaxBytes))
+	if err != nil {
+		return err
+	}
+
+	pr.outcome = outcomeUpstream
+	s.metrics.upstreamErrorsCounter.WithLabelValues(strconv.Itoa(r.StatusCode)).Inc()
+	e := Err{
+		Code:        r.StatusCode,
+		Reason:      hsserr.ReasonUpstreamError,
+		Description: fmt.Sprintf("Worker (%v) responded with status %d", pr.worker.describe(), r.StatusCode),
+		RequestID:   pr.id,
+		Retriable:   r.StatusCode == http.StatusBadGateway || r.StatusCode == http.StatusServiceUnavailable,
+		Detail:      string(detail),
+	}
+	wrapped, err := json.Marshal(&hsserr.Response{Error: e})
+	if err != nil {
+		return err
+	}
+	wrapped = append(wrapped, '\n')
+	r.Body = ioutil.NopCloser(bytes.NewReader(wrapped))
+	r.ContentLength = int64(len(wrapped))
+	r.TransferEncoding = nil
+	r.Header.Del("Content-Encoding")
+	r.Header.Set("Content-Type", "application/json")
+	r.Header.Set("Content-Length", strconv.Itoa(len(wrapped)))
+	r.Header.Set(hsserr.Header, "1")
+	if e.Retriable {
+		r.Header.Set("Retry-After", retryAfter)
+	}
+	return nil
+}
+
+func (s *Stabilizer) errorHandler(rw http.ResponseWriter, r *http.Request, err error) {
+	pr := getProxyRequest(r.Context())
+	pr.outcome = outcomeError
+	w := pr.worker
+	if w == nil {
+		// ServeHTTP always acquires a worker before proxying, but don't take
+		// down the request if that ever isn't the case.
+		if r.Context().Err() == context.Canceled {
+			pr.outcome = outcomeCanceled
+			s.metrics.clientCancellationsCounter.Inc()
+			rw.WriteHeader(statusClientClosedRequest)
+			return
+		}
+		withTrace(r.Context(), s.log).Error("error encountered before a worker was assigned", log.String("requestID", pr.id), log.Error(err))
+		s.writeError(rw, r, s.cfg.ErrorStatus, hsserr.ReasonWorkerUnknownError,
+			fmt.Sprintf("No worker was assigned to the request: %v", err), true)
+		return
+	}
+	// ServeHTTP returns the worker to the pool after this returns. A stuck
+	// worker is killed below before then, so that it is not handed to
+	// another request.
+
+	s.setDebugHeaders(rw.Header(), pr)
+	logger := withTrace(r.Context(), w.log)
+
+	// The worker is not at fault if the client sent too large a body.
+	if isTooLarge(err) {
+		s.writeTooLarge(rw, r)
+		return
+	}
+
+	// If the client went away the worker is not at fault, so it is left
+	// alone.
+	if r.Context().Err() == context.Canceled {
+		logger.Debug("client canceled request", log.String("requestID", pr.id))
+		pr.outcome = outcomeCanceled
+		s.metrics.clientCancellationsCounter.Inc()
+		rw.WriteHeader(statusClientClosedRequest)
+		return
+	}
+
+	// If the request timed out, kill the worker since it may be stuck. It
+	// will automatically restart. Other requests on the same worker are
+	// likely to time out too, but only the first kills it.
+	if ctxErr := r.Context().Err(); ctxErr == context.DeadlineExceeded {
+		pr.outcome = outcomeTimeout
+		if w.killStuck(reasonTimeout, pr.id) {
+			traceWorkerKilled(r.Context(), w, reasonTimeout)
+			fields := []log.Field{log.String("requestID", pr.id), log.String("ctxErr", ctxErr.Error())}
+			if s.cfg.PoisonRequestDir != "" {
+				path, err := s.writePoisonRequest(pr, w)
+				if err != nil {
+					fields = append(fields, log.NamedError("poisonRequestError", err))
+				}
+				if path != "" {
+					fields = append(fields, log.String("poisonRequest", path))
+				}
+			}
+			logger.Warn("restarting due to timeout", fields...)
+		} else {
+			logger.Debug("timed out on worker that is already restarting", log.String("requestID", pr.id))
+		}
+		s.writeError(rw, r, s.cfg.TimeoutStatus, hsserr.ReasonWorkerTimeout,
+			s.describeWorkerError(w, fmt.Sprintf("Worker (%v) failed to highlight file; restarting it", w.describe())), false)
+		return
+	}
+
+	// A worker that accepted the request but did not start responding
+	// within -worker-response-header-timeout is likely stuck too.
+	if s.isHeaderTimeout(err) {
+		pr.outcome = outcomeHeaders
+		if w.killStuck(reasonHeaderTimeout, pr.id) {
+			traceWorkerKilled(r.Context(), w, reasonHeaderTimeout)
+			logger.Warn("restarting due to response header timeout", log.String("requestID", pr.id), log.Duration("timeout", s.cfg.WorkerResponseHeaderTimeout))
+		}
+		s.writeError(rw, r, s.cfg.TimeoutStatus, hsserr.ReasonWorkerTimeout,
+			s.describeWorkerError(w, fmt.Sprintf("Worker (%v) did not respond in time; restarting it", w.describe())), false)
+		return
+	}
+
+	// Technically we could hit other errors here if e.g. communication
+	// between our reverse proxy and the worker was failing for some other
+	// reason like the network being flooded, but in practice this is
+	// unlikely to happen and instead the most likely case is that the worker
+	// was killed due to another request on the same worker timing out. The
+	// request was collateral damage then, so it is likely to succeed if
+	// retried.
+	logger.Error("error encountered", log.String("requestID", pr.id), log.Error(err))
+	s.writeError(rw, r, s.cfg.ErrorStatus, hsserr.ReasonWorkerUnknownError,
+		s.describeWorkerError(w, fmt.Sprintf("Worker (%v) unknown error: %v", w.describe(), err)), true)
+}
+
+// describeWorkerError returns the description of an error response for a
+// request that failed on the worker. With -debug-error-responses, the
+// worker's recent output is appended to it. That output is not PII-safe, so
+// this is only for debugging outside of production.
+func (s *Stabilizer) describeWorkerError(w *worker, description string) string {
+	if !s.cfg.DebugErrorResponses {
+		return description
+	}
+	tail := w.tail.get()
+	if len(tail) == 0 {
+		return description
+	}
+	return description + "\n\nLast worker output:\n" + strings.Join(tail, "\n")
+}
@@ -0,0 +1,427 @@
+package stabilizer
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"net/http/httputil"
+	"net/url"
+	"runtime"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"golang.org/x/net/websocket"
+)
+
+func TestSingleJoiningSlash(t *testing.T) {
+	tests := []struct {
+		a, b, want string
+	}{
+		{"", "", "/"},
+		{"", "/", "/"},
+		{"/", "/", "/"},
+		{"", "/dir/", "/dir/"},
+		{"/base", "dir", "/base/dir"},
+		{"/base", "/dir", "/base/dir"},
+		{"/base/", "/dir", "/base/dir"},
+		{"/base/", "dir/", "/base/dir/"},
+		{"/base/", "//dir//", "/base//dir//"},
+		{"/base//", "/dir", "/base//dir"},
+	}
+	for _, test := range tests {
+		if got := singleJoiningSlash(test.a, test.b); got != test.want {
+			t.Errorf("singleJoiningSlash(%q, %q) = %q, want %q", test.a, test.b, got, test.want)
+		}
+	}
+}
+
+func TestJoinURLPath(t *testing.T) {
+	tests := []struct {
+		target, request   string
+		wantPath, wantRaw string
+	}{
+		// Trailing slashes are kept.
+		{"http://worker", "/", "/", ""},
+		{"http://worker", "/dir/", "/dir/", ""},
+		{"http://worker/base", "/dir/", "/base/dir/", ""},
+		{"http://worker/base/", "/dir", "/base/dir", ""},
+		{"http://worker/base/", "/dir/", "/base/dir/", ""},
+
+		// Double slashes in the request are kept, and only the slash
+		// between the paths is collapsed.
+		{"http://worker", "//dir//file", "//dir//file", ""},
+		{"http://worker/base/", "//dir", "/base//dir", ""},
+		{"http://worker/base", "/dir//", "/base/dir//", ""},
+
+		// Encoded separators survive in RawPath.
+		{"http://worker", "/a%2Fb/c", "/a/b/c", "/a%2Fb/c"},
+		{"http://worker", "/a%2Fb/", "/a/b/", "/a%2Fb/"},
+		{"http://worker/base", "/a%2Fb", "/base/a/b", "/base/a%2Fb"},
+		{"http://worker/base/", "/a%2Fb/", "/base/a/b/", "/base/a%2Fb/"},
+		{"http://worker/x%2Fy/", "/z", "/x/y/z", "/x%2Fy/z"},
+		{"http://worker/x%2Fy", "/a%2Fb", "/x/y/a/b", "/x%2Fy/a%2Fb"},
+		{"http://worker", "//a%2Fb", "//a/b", "//a%2Fb"},
+
+		// Other escapes are left as they were, without a RawPath if it
+		// would be the same as the default encoding.
+		{"http://worker", "/a%20b", "/a b", ""},
+		{"http://worker", "/a%3Bb", "/a;b", "/a%3Bb"},
+	}
+	for _, test := range tests {
+		target, err := url.Parse(test.target)
+		if err != nil {
+			t.Fatal(err)
+		}
+		// Parse the request URI as the server does, so that a path
+		// beginning with // is not taken for a host.
+		request, err := url.ParseRequestURI(test.request)
+		if err != nil {
+			t.Fatal(err)
+		}
+		path, raw := joinURLPath(target, request)
+		if path != test.wantPath || raw != test.wantRaw {
+			t.Errorf("joinURLPath(%q, %q) = %q, %q, want %q, %q", test.target, test.request, path, raw, test.wantPath, test.wantRaw)
+		}
+	}
+}
+
+// trackedContext is a context which is never done, and counts the contexts
+// derived from it which are waiting for it to be, such as those with a
+// timeout whose timer has not been stopped.
+type trackedContext struct {
+	context.Context
+	done chan struct{}
+
+	mu      sync.Mutex
+	waiting int
+}
+
+func newTrackedContext() *trackedContext {
+	return &trackedContext{Context: context.Background(), done: make(chan struct{})}
+}
+
+func (c *trackedContext) Done() <-chan struct{} {
+	return c.done
+}
+
+// AfterFunc is used by the context package to cancel the contexts derived
+// from c once it is done, instead of a goroutine for each.
+func (c *trackedContext) AfterFunc(f func()) (stop func() bool) {
+	c.mu.Lock()
+	c.waiting++
+	c.mu.Unlock()
+	var once sync.Once
+	return func() bool {
+		stopped := false
+		once.Do(func() {
+			c.mu.Lock()
+			c.waiting--
+			c.mu.Unlock()
+			stopped = true
+		})
+		return stopped
+	}
+}
+
+func (c *trackedContext) derived() int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.waiting
+}
+
+// TestServeHTTPReleasesTimeout checks that the timeout of a request is
+// released once it has been served, rather than once it would have expired,
+// and that a worker is still killed once a request times out.
+func TestServeHTTPReleasesTimeout(t *testing.T) {
+	cfg := testConfig()
+	cfg.Timeout = time.Hour
+	s, _, stop := startStabilizer(t, cfg)
+	defer stop()
+
+	ctx := newTrackedContext()
+	serve := func(target string, header http.Header) int {
+		req := httptest.NewRequest("GET", target, nil).WithContext(ctx)
+		for name, values := range header {
+			req.Header[name] = values
+		}
+		rec := httptest.NewRecorder()
+		s.Handler().ServeHTTP(rec, req)
+		return rec.Code
+	}
+
+	// The first request connects to the worker, which takes goroutines
+	// that are kept around for the next.
+	if code := serve("/", nil); code != http.StatusOK {
+		t.Fatalf("got status %v, want %v", code, http.StatusOK)
+	}
+	goroutines := runtime.NumGoroutine()
+	for i := 0; i < 200; i++ {
+		if code := serve("/", nil); code != http.StatusOK {
+			t.Fatalf("got status %v, want %v", code, http.StatusOK)
+		}
+	}
+	waitFor(t, 5*time.Second, "the timeouts of the requests to be released", func() bool {
+		return ctx.derived() == 0
+	})
+	waitFor(t, 5*time.Second, "the goroutines of the requests to exit", func() bool {
+		return runtime.NumGoroutine() <= goroutines
+	})
+
+	header := http.Header{cfg.TimeoutHeader: {"100ms"}}
+	if code := serve("/?ms=5000", header); code != cfg.TimeoutStatus {
+		t.Fatalf("got status %v, want %v", code, cfg.TimeoutStatus)
+	}
+	waitFor(t, 5*time.Second, "the worker to be restarted", func() bool {
+		s.restartCountMu.Lock()
+		defer s.restartCountMu.Unlock()
+		return s.restartCount[reasonTimeout] == 1
+	})
+}
+
+// TestTimeoutsRestartWorkerOnce checks that a worker is killed, and counted as
+// restarted, only once when all of the requests it is serving time out.
+func TestTimeoutsRestartWorkerOnce(t *testing.T) {
+	cfg := testConfig()
+	cfg.Concurrency = 10
+	cfg.Timeout = time.Second
+	s, srv, stop := startStabilizer(t, cfg)
+	defer stop()
+
+	var wg sync.WaitGroup
+	for i := 0; i < cfg.Concurrency; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			resp, err := http.Get(srv.URL + "/?ms=10000")
+			if err != nil {
+				t.Error(err)
+				return
+			}
+			resp.Body.Close()
+			if resp.StatusCode != cfg.TimeoutStatus {
+				t.Errorf("got status %v, want %v", resp.StatusCode, cfg.TimeoutStatus)
+			}
+		}()
+	}
+	wg.Wait()
+	waitFor(t, 10*time.Second, "the worker to be replaced", func() bool {
+		return s.pool.size() == 1
+	})
+	// The counter is only incremented for the timeout reason, so it has
+	// one series.
+	if got := testutil.ToFloat64(s.metrics.workerRestartsCounter); got != 1 {
+		t.Errorf("got %v restarts, want 1", got)
+	}
+}
+
+// TestDeadlineHeader checks that workers are told the time left until their
+// request times out, which may be overridden by the timeout header within
+// the timeout bounds.
+func TestDeadlineHeader(t *testing.T) {
+	cfg := testConfig()
+	cfg.DeadlineHeader = "X-Stabilize-Deadline-Ms"
+	cfg.Timeout = 10 * time.Second
+	cfg.TimeoutMin = time.Second
+	cfg.TimeoutMax = 20 * time.Second
+	_, srv, stop := startStabilizer(t, cfg)
+	defer stop()
+
+	tests := []struct {
+		timeout string
+		want    time.Duration
+	}{
+		{"", 10 * time.Second},
+		{"2s", 2 * time.Second},
+		{"15s", 15 * time.Second},
+		{"100ms", time.Second},
+		{"1m", 20 * time.Second},
+		{"invalid", 10 * time.Second},
+	}
+	for _, test := range tests {
+		header := http.Header{}
+		if test.timeout != "" {
+			header.Set(cfg.TimeoutHeader, test.timeout)
+		}
+		r := get(t, srv.Client(), srv.URL, header)
+		ms, err := strconv.Atoi(r.Header.Get(cfg.DeadlineHeader))
+		if err != nil {
+			t.Fatalf("timeout %q: %v", test.timeout, err)
+		}
+		// Some of the time will have passed by the time the request is
+		// sent to the worker.
+		if got := time.Duration(ms) * time.Millisecond; got > test.want || got < test.want-time.Second {
+			t.Errorf("timeout %q: got deadline in %v, want %v", test.timeout, got, test.want)
+		}
+	}
+}
+
+// TestForwardedHeaders checks the X-Forwarded headers workers see, from
+// clients and from proxies in front of the stabilizer, over HTTP and TLS.
+func TestForwardedHeaders(t *testing.T) {
+	spoofed := http.Header{
+		"X-Forwarded-For":   {"192.0.2.1"},
+		"X-Forwarded-Proto": {"https"},
+		"X-Forwarded-Host":  {"spoofed.example.com"},
+	}
+	check := func(t *testing.T, r testWorkerResponse, xff, proto, host string) {
+		t.Helper()
+		for name, want := range map[string]string{
+			"X-Forwarded-For":   xff,
+			"X-Forwarded-Proto": proto,
+			"X-Forwarded-Host":  host,
+		} {
+			if got := strings.Join(r.Header[name], ", "); got != want {
+				t.Errorf("got %s %q, want %q", name, got, want)
+			}
+		}
+	}
+
+	t.Run("untrusted", func(t *testing.T) {
+		_, srv, stop := startStabilizer(t, testConfig())
+		defer stop()
+		host := strings.TrimPrefix(srv.URL, "http://")
+		r := get(t, srv.Client(), srv.URL, spoofed)
+		check(t, r, "127.0.0.1", "http", host)
+		if r.Host != host {
+			t.Errorf("got Host %q, want %q", r.Host, host)
+		}
+	})
+
+	t.Run("untrusted TLS", func(t *testing.T) {
+		s, _, stop := startStabilizer(t, testConfig())
+		defer stop()
+		srv := httptest.NewTLSServer(s.Handler())
+		defer srv.Close()
+		host := strings.TrimPrefix(srv.URL, "https://")
+		check(t, get(t, srv.Client(), srv.URL, spoofed), "127.0.0.1", "https", host)
+	})
+
+	t.Run("chained TLS", func(t *testing.T) {
+		cfg := testConfig()
+		cfg.TrustForwardedHeaders = true
+		s, _, stop := startStabilizer(t, cfg)
+		defer stop()
+		srv := httptest.NewTLSServer(s.Handler())
+		defer srv.Close()
+
+		// A proxy in front of the stabilizer, which appends the client's IP
+		// to X-Forwarded-For.
+		target, err := url.Parse(srv.URL)
+		if err != nil {
+			t.Fatal(err)
+		}
+		front := httputil.NewSingleHostReverseProxy(target)
+		front.Transport = srv.Client().Transport
+		director := front.Director
+		front.Director = func(req *http.Request) {
+			director(req)
+			req.Header.Set("X-Forwarded-Proto", "https")
+			req.Header.Set("X-Forwarded-Host", "www.example.com")
+		}
+		frontSrv := httptest.NewServer(front)
+		defer frontSrv.Close()
+
+		header := http.Header{"X-Forwarded-For": {"192.0.2.1"}}
+		r := get(t, frontSrv.Client(), frontSrv.URL, header)
+		check(t, r, "192.0.2.1, 127.0.0.1, 127.0.0.1", "https", "www.example.com")
+	})
+
+	t.Run("without preserving Host", func(t *testing.T) {
+		cfg := testConfig()
+		cfg.PreserveHost = false
+		s, srv, stop := startStabilizer(t, cfg)
+		defer stop()
+		r := get(t, srv.Client(), srv.URL, nil)
+		host := strings.TrimPrefix(srv.URL, "http://")
+		check(t, r, "127.0.0.1", "http", host)
+		s.pool.mu.Lock()
+		workerHost := s.pool.workers[0].host()
+		s.pool.mu.Unlock()
+		if r.Host != workerHost {
+			t.Errorf("got Host %q, want the worker's %q", r.Host, workerHost)
+		}
+	})
+}
+
+// TestWebSocket checks that a WebSocket is kept open past the request timeout
+// while it is in use, and holds on to its worker until it is closed.
+func TestWebSocket(t *testing.T) {
+	cfg := testConfig()
+	cfg.Timeout = 200 * time.Millisecond
+	cfg.QueueTimeout = 100 * time.Millisecond
+	s, srv, stop := startStabilizer(t, cfg)
+	defer stop()
+
+	conn, err := websocket.Dial("ws"+strings.TrimPrefix(srv.URL, "http")+"/ws", "", srv.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	for i := 0; i < 10; i++ {
+		sent := fmt.Sprintf("message %d", i)
+		if err := websocket.Message.Send(conn, sent); err != nil {
+			t.Fatal(err)
+		}
+		var received string
+		if err := websocket.Message.Receive(conn, &received); err != nil {
+			t.Fatal(err)
+		}
+		if received != sent {
+			t.Fatalf("got %q back, want %q", received, sent)
+		}
+		time.Sleep(cfg.Timeout / 4)
+	}
+
+	// The WebSocket takes up the worker until it is closed.
+	resp, err := http.Get(srv.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != cfg.QueueTimeoutStatus {
+		t.Errorf("got status %v while the WebSocket is open, want %v", resp.StatusCode, cfg.QueueTimeoutStatus)
+	}
+	conn.Close()
+	waitFor(t, 5*time.Second, "the worker to be released", func() bool {
+		available, _ := s.pool.stats()
+		return available == 1
+	})
+	get(t, srv.Client(), srv.URL, nil)
+
+	s.restartCountMu.Lock()
+	defer s.restartCountMu.Unlock()
+	if len(s.restartCount) > 0 {
+		t.Errorf("worker restarted: %v", s.restartCount)
+	}
+}
+
+// TestWebSocketIdleTimeout checks that a WebSocket is closed once it has been
+// idle for -ws-idle-timeout.
+func TestWebSocketIdleTimeout(t *testing.T) {
+	cfg := testConfig()
+	cfg.WSIdleTimeout = 200 * time.Millisecond
+	_, srv, stop := startStabilizer(t, cfg)
+	defer stop()
+
+	conn, err := websocket.Dial("ws"+strings.TrimPrefix(srv.URL, "http")+"/ws", "", srv.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	start := time.Now()
+	if err := conn.SetReadDeadline(time.Now().Add(5 * time.Second)); err != nil {
+		t.Fatal(err)
+	}
+	var received string
+	if err := websocket.Message.Receive(conn, &received); err == nil {
+		t.Fatalf("received %q from an idle WebSocket", received)
+	}
+	if elapsed := time.Since(start); elapsed < cfg.WSIdleTimeout || elapsed > 4*time.Second {
+		t.Errorf("WebSocket closed after %v, want after %v", elapsed, cfg.WSIdleTimeout)
+	}
+}
@@ -0,0 +1,133 @@
+package stabilizer
+
+import (
+	"container/list"
+	"fmt"
+	"hash/fnv"
+	"math"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/slimsag/http-server-stabilizer/pkg/hsserr"
+)
+
+const (
+	// rateLimitMaxKeys is the number of -rate-limit-key values whose buckets
+	// are kept. The buckets of the keys seen least recently are forgotten
+	// beyond that, which only lets those clients start over with a full
+	// bucket.
+	rateLimitMaxKeys = 10000
+
+	// rateLimitKeyHashes is the number of values of the key_hash label of
+	// hss_rate_limited, into which keys are hashed so that clients cannot
+	// create any number of metrics.
+	rateLimitKeyHashes = 64
+)
+
+// rateLimiter limits the rate of requests for each key with a token bucket,
+// which holds up to burst tokens and gains rate tokens per second.
+type rateLimiter struct {
+	rate  float64
+	burst float64
+
+	mu sync.Mutex
+	// buckets holds the element of lru for each key, and lru the buckets
+	// with the most recently used first.
+	buckets map[string]*list.Element
+	lru     list.List
+}
+
+// tokenBucket is the bucket of a key, as of updated.
+type tokenBucket struct {
+	key     string
+	tokens  float64
+	updated time.Time
+}
+
+func newRateLimiter(rate float64, burst int) *rateLimiter {
+	if burst <= 0 {
+		burst = int(math.Ceil(rate))
+	}
+	return &rateLimiter{rate: rate, burst: float64(burst), buckets: make(map[string]*list.Element)}
+}
+
+// allow takes a token from the bucket of key at time now, reporting whether
+// there was one. If not, it returns how long until there will be.
+func (l *rateLimiter) allow(key string, now time.Time) (ok bool, wait time.Duration) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	var b *tokenBucket
+	if elem, ok := l.buckets[key]; ok {
+		l.lru.MoveToFront(elem)
+		b = elem.Value.(*tokenBucket)
+		b.tokens = math.Min(l.burst, b.tokens+now.Sub(b.updated).Seconds()*l.rate)
+		b.updated = now
+	} else {
+		b = &tokenBucket{key: key, tokens: l.burst, updated: now}
+		l.buckets[key] = l.lru.PushFront(b)
+		if l.lru.Len() > rateLimitMaxKeys {
+			oldest := l.lru.Back()
+			l.lru.Remove(oldest)
+			delete(l.buckets, oldest.Value.(*tokenBucket).key)
+		}
+	}
+	if b.tokens >= 1 {
+		b.tokens--
+		return true, 0
+	}
+	return false, time.Duration((1 - b.tokens) / l.rate * float64(time.Second))
+}
+
+// rateLimitKey returns the -rate-limit-key value of a request: the value of
+// the header it names, or the client's IP if it is empty or the request does
+// not have the header. The client's IP is taken from X-Forwarded-For if
+// -trust-forwarded-headers is set.
+func (s *Stabilizer) rateLimitKey(req *http.Request) string {
+	if s.cfg.RateLimitKey != "" {
+		if key := req.Header.Get(s.cfg.RateLimitKey); key != "" {
+			return "header:" + key
+		}
+	}
+	if s.cfg.TrustForwardedHeaders {
+		if forwarded := req.Header.Get("X-Forwarded-For"); forwarded != "" {
+			return strings.TrimSpace(strings.Split(forwarded, ",")[0])
+		}
+	}
+	host, _, err := net.SplitHostPort(req.RemoteAddr)
+	if err != nil {
+		return req.RemoteAddr
+	}
+	return host
+}
+
+// rateLimitKeyHash returns the key_hash label of hss_rate_limited for a key.
+func rateLimitKeyHash(key string) string {
+	h := fnv.New32a()
+	h.Write([]byte(key))
+	return fmt.Sprintf("%02x", h.Sum32()%rateLimitKeyHashes)
+}
+
+// limitRate wraps next to reject requests with 429 once their
+// -rate-limit-key has exceeded -rate-limit, before they take up a worker or
+// their body is read.
+func (s *Stabilizer) limitRate(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		key := s.rateLimitKey(req)
+		ok, wait := s.rateLimiter.allow(key, time.Now())
+		if ok {
+			next.ServeHTTP(rw, req)
+			return
+		}
+		s.metrics.rateLimitedCounter.WithLabelValues(rateLimitKeyHash(key)).Inc()
+		if id := requestID(req); id != "" {
+			rw.Header().Set(requestIDHeader, id)
+		}
+		rw.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(wait.Seconds()))))
+		s.writeError(rw, req, http.StatusTooManyRequests, hsserr.ReasonRateLimited,
+			fmt.Sprintf("Too many requests from this client, the limit is %g per second", s.cfg.RateLimit), true)
+	})
+}
@@ -0,0 +1,175 @@
+package stabilizer
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/sourcegraph/log"
+)
+
+// readyPollInterval is how often a starting worker is polled for readiness.
+const readyPollInterval = 100 * time.Millisecond
+
+// waitReady blocks until the worker is ready to serve requests. An error is
+// returned if the worker exits or does not become ready within
+// -worker-startup-timeout.
+func (s *Stabilizer) waitReady(w *worker) error {
+	start := time.Now()
+	ctx, cancel := context.WithTimeout(w.ctx, s.cfg.WorkerStartupTimeout)
+	defer cancel()
+
+	ticker := time.NewTicker(readyPollInterval)
+	defer ticker.Stop()
+	for {
+		probeCtx, cancelProbe := context.WithTimeout(ctx, time.Second)
+		err := s.probeWorker(probeCtx, w.host(), s.cfg.WorkerReadyPath)
+		cancelProbe()
+		if err == nil {
+			if err := checkPortOwner(w); err != nil {
+				return err
+			}
+			w.log.Info("ready", log.Duration("startup", time.Since(start)))
+			return nil
+		}
+		select {
+		case <-w.exited:
+			return startupExitError(w)
+		case <-ctx.Done():
+			select {
+			case <-w.exited:
+				return startupExitError(w)
+			default:
+			}
+			return fmt.Errorf("not ready after %v: %v", s.cfg.WorkerStartupTimeout, err)
+		case <-ticker.C:
+		}
+	}
+}
+
+// startupExitError describes a worker that exited before becoming ready.
+func startupExitError(w *worker) error {
+	if w.state == nil {
+		return errors.New("worker could not be waited for")
+	}
+	if portTaken(w.port) {
+		return errPortConflict
+	}
+	return fmt.Errorf("worker exited during startup (%v)", w.state)
+}
+
+// probeWorker checks once whether the worker with the given host is ready,
+// by making a GET request to the given path which must return 2xx, or if path
+// is empty by connecting to it.
+func (s *Stabilizer) probeWorker(ctx context.Context, host, path string) error {
+	if path == "" {
+		conn, err := s.dialWorker(ctx, "tcp", host)
+		if err != nil {
+			return err
+		}
+		return conn.Close()
+	}
+
+	req, err := http.NewRequestWithContext(ctx, "GET", "http://"+host+path, nil)
+	if err != nil {
+		return err
+	}
+	resp, err := s.probeTransport.RoundTrip(req)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return fmt.Errorf("unexpected status %v from %v", resp.StatusCode, path)
+	}
+	return nil
+}
+
+// findPort looks for the port the worker listens on in a line of its output,
+// in -worker-port-from-output mode.
+func (w *worker) findPort(line string) {
+	if w.portFound == nil {
+		return
+	}
+	w.portMu.Lock()
+	defer w.portMu.Unlock()
+	if w.port != 0 {
+		return
+	}
+	match := w.portPattern.FindStringSubmatch(line)
+	if match == nil {
+		return
+	}
+	port, err := strconv.Atoi(match[1])
+	if err != nil || port <= 0 {
+		return
+	}
+	w.port = port
+	close(w.portFound)
+}
+
+// waitPort blocks until the worker has reported the port it listens on, in
+// -worker-port-from-output mode. An error is returned if the worker exits or
+// does not report it within -worker-startup-timeout.
+func (s *Stabilizer) waitPort(w *worker) error {
+	if w.portFound == nil {
+		return nil
+	}
+	timeout := time.NewTimer(s.cfg.WorkerStartupTimeout)
+	defer timeout.Stop()
+	select {
+	case <-w.portFound:
+		w.log.Info("port found", log.Int("port", w.port))
+		return nil
+	case <-w.exited:
+		return startupExitError(w)
+	case <-w.ctx.Done():
+		return w.ctx.Err()
+	case <-timeout.C:
+		return fmt.Errorf("port not found in output after %v", s.cfg.WorkerStartupTimeout)
+	}
+}
+
+// startupProbation is how long a worker must keep running at startup for the
+// worker command to be considered to work, when -startup-require-ready is
+// false.
+const startupProbation = time.Second
+
+// waitStartup waits for the workers to start up, and returns an error if they
+// fail to. If requireReady is true, it waits for a worker to become ready;
+// otherwise it only waits for the workers to survive startupProbation. It
+// also returns an error once ctx is done.
+func (s *Stabilizer) waitStartup(ctx context.Context, requireReady bool) error {
+	if s.targetWorkers() == 0 {
+		return nil
+	}
+	start := time.Now()
+	ticker := time.NewTicker(readyPollInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-ticker.C:
+		}
+		if n, reason := s.crashLoopingSlots(); n > 0 {
+			return fmt.Errorf("worker failed (reason: %v)", reason)
+		}
+		if !requireReady {
+			if time.Since(start) >= startupProbation {
+				return nil
+			}
+			continue
+		}
+		if s.workersReady() > 0 {
+			s.log.Info("workers started", log.Duration("startup", time.Since(start)))
+			return nil
+		}
+		if time.Since(start) >= s.cfg.WorkerStartupTimeout+readyPollInterval {
+			return fmt.Errorf("no worker became ready within %v", s.cfg.WorkerStartupTimeout)
+		}
+	}
+}
@@ -0,0 +1,93 @@
+package stabilizer
+
+import (
+	"io/ioutil"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/sourcegraph/log"
+	"golang.org/x/sys/unix"
+)
+
+// reapInterval is how often orphaned zombies are looked for, in case SIGCHLD
+// signals were coalesced.
+const reapInterval = 10 * time.Second
+
+// startReaper makes the stabilizer reap its orphaned descendants, for -reap.
+// Unless it is PID 1, to which orphans are reparented anyway, it becomes a
+// subreaper so that orphans are reparented to it.
+func (s *Stabilizer) startReaper() error {
+	if os.Getpid() != 1 {
+		if err := unix.Prctl(unix.PR_SET_CHILD_SUBREAPER, 1, 0, 0, 0); err != nil {
+			return err
+		}
+	}
+	sigchld := make(chan os.Signal, 1)
+	signal.Notify(sigchld, syscall.SIGCHLD)
+	go func() {
+		defer signal.Stop(sigchld)
+		ticker := time.NewTicker(reapInterval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-s.ctx.Done():
+				return
+			case <-sigchld:
+			case <-ticker.C:
+			}
+			s.reapZombies()
+		}
+	}()
+	return nil
+}
+
+// childWorker reports whether pid is a worker of another variant or of a pool
+// which has not been waited for yet.
+func (s *Stabilizer) childWorker(pid int) bool {
+	for _, c := range s.childStabilizers() {
+		c.childMu.Lock()
+		child := c.children[pid]
+		c.childMu.Unlock()
+		if child {
+			return true
+		}
+	}
+	return false
+}
+
+// reapZombies waits for the children of the stabilizer which have exited,
+// other than workers, which are waited for by their watch goroutine.
+func (s *Stabilizer) reapZombies() {
+	stats, err := filepath.Glob("/proc/[0-9]*/stat")
+	if err != nil {
+		return
+	}
+	self := strconv.Itoa(os.Getpid())
+	s.childMu.Lock()
+	defer s.childMu.Unlock()
+	for _, stat := range stats {
+		data, err := ioutil.ReadFile(stat)
+		if err != nil {
+			continue
+		}
+		// The state and parent pid are the first fields after the command
+		// name, which is in parentheses and may contain spaces.
+		fields := strings.Fields(string(data[strings.LastIndex(string(data), ")")+1:]))
+		if len(fields) < 2 || fields[0] != "Z" || fields[1] != self {
+			continue
+		}
+		pid, err := strconv.Atoi(filepath.Base(filepath.Dir(stat)))
+		if err != nil || s.children[pid] || s.childWorker(pid) {
+			continue
+		}
+		var status syscall.WaitStatus
+		if _, err := syscall.Wait4(pid, &status, syscall.WNOHANG, nil); err == nil {
+			s.log.Debug("reaped orphaned process", log.Int("pid", pid), log.Int("status", status.ExitStatus()))
+		}
+	}
+}
@@ -0,0 +1,118 @@
+package stabilizer
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+// procState returns the state and parent pid of a process, from /proc.
+func procState(stat string) (state, ppid string, ok bool) {
+	data, err := ioutil.ReadFile(stat)
+	if err != nil {
+		return "", "", false
+	}
+	// They are the first fields after the command name, which is in
+	// parentheses and may contain spaces.
+	fields := strings.Fields(string(data[strings.LastIndex(string(data), ")")+1:]))
+	if len(fields) < 2 {
+		return "", "", false
+	}
+	return fields[0], fields[1], true
+}
+
+// zombies returns the pids of the exited children of this process which have
+// not been waited for.
+func zombies() []int {
+	stats, _ := filepath.Glob("/proc/[0-9]*/stat")
+	self := strconv.Itoa(os.Getpid())
+	var pids []int
+	for _, stat := range stats {
+		if state, ppid, ok := procState(stat); ok && state == "Z" && ppid == self {
+			pid, _ := strconv.Atoi(filepath.Base(filepath.Dir(stat)))
+			pids = append(pids, pid)
+		}
+	}
+	return pids
+}
+
+// TestReap checks that with -reap, a subprocess which outlives its worker is
+// reaped once it exits, rather than being left a zombie.
+func TestReap(t *testing.T) {
+	cfg := testConfig()
+	cfg.Reap = true
+	cfg.Timeout = 500 * time.Millisecond
+	_, srv, stop := startStabilizer(t, cfg)
+	defer stop()
+
+	resp, err := http.Get(srv.URL + "/fork?ms=1000")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var forked testWorkerResponse
+	err = json.NewDecoder(resp.Body).Decode(&forked)
+	resp.Body.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Kill the worker, leaving the subprocess to be reparented to the
+	// stabilizer.
+	resp, err = http.Get(srv.URL + "/?ms=5000")
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	stat := "/proc/" + strconv.Itoa(forked.Child) + "/stat"
+	waitFor(t, 5*time.Second, "the subprocess to be reparented", func() bool {
+		_, ppid, _ := procState(stat)
+		return ppid == strconv.Itoa(os.Getpid())
+	})
+	waitFor(t, 10*time.Second, "the subprocess to be reaped", func() bool {
+		_, _, ok := procState(stat)
+		return !ok
+	})
+	waitFor(t, 10*time.Second, "no zombies to be left", func() bool {
+		return len(zombies()) == 0
+	})
+}
+
+// TestReapWorkerVersion checks that with -reap, the worker command run with
+// -worker-version-arg is waited for by the stabilizer rather than reaped as
+// an orphan, which would lose its version.
+func TestReapWorkerVersion(t *testing.T) {
+	dir, err := ioutil.TempDir("", "hss-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	// A worker command which prints its version, and otherwise runs the
+	// test worker.
+	command := filepath.Join(dir, "worker.sh")
+	script := "#!/bin/sh\n[ \"$1\" = --version ] && echo v1.2.3 && exit\nexec " + os.Args[0] + " \"$@\"\n"
+	if err := ioutil.WriteFile(command, []byte(script), 0755); err != nil {
+		t.Fatal(err)
+	}
+
+	cfg := testConfig()
+	cfg.Command = command
+	cfg.Reap = true
+	cfg.WorkerVersionArg = "--version"
+	s, _, stop := startStabilizer(t, cfg)
+	defer stop()
+
+	for i := 0; i < 100; i++ {
+		if i > 0 {
+			s.updateWorkerVersion()
+		}
+		if version := s.currentWorkerVersion(); version != "v1.2.3" {
+			t.Fatalf("got worker version %q, want %q", version, "v1.2.3")
+		}
+	}
+}
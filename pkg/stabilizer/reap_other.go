@@ -0,0 +1,11 @@
+//go:build !linux
+// +build !linux
+
+package stabilizer
+
+import "errors"
+
+// startReaper is only implemented on Linux.
+func (s *Stabilizer) startReaper() error {
+	return errors.New("not supported on this platform")
+}
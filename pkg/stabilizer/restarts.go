@@ -0,0 +1,76 @@
+package stabilizer
+
+import (
+	"fmt"
+	"sync"
+	"time"
+)
+
+// failure describes a worker that failed.
+type failure struct {
+	time   time.Time
+	reason string
+	state  string
+}
+
+func (f failure) String() string {
+	return fmt.Sprintf("%v (%v)", f.reason, f.state)
+}
+
+// restartLimiter tracks worker failures, to exit the stabilizer once there
+// have been more than -max-restarts within -max-restarts-window.
+type restartLimiter struct {
+	max    int
+	window time.Duration
+
+	mu       sync.Mutex
+	failures []failure
+
+	// exceeded is closed once the limit has been exceeded.
+	exceeded     chan struct{}
+	exceededOnce sync.Once
+}
+
+// isFailure reports whether a worker that died for the given reason counts
+// towards -max-restarts. Planned restarts, such as recycling, do not.
+func isFailure(reason string) bool {
+	switch reason {
+	case reasonTimeout, reasonHeaderTimeout, reasonCrash, reasonOOM, reasonStartupFailure, reasonUnhealthy, reasonHealthCheck:
+		return true
+	}
+	return false
+}
+
+// record records a worker failure, closing exceeded if that takes the number
+// of failures within -max-restarts-window above -max-restarts.
+func (l *restartLimiter) record(f failure) {
+	if l.max <= 0 {
+		return
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	l.failures = append(l.failures, f)
+	cutoff := f.time.Add(-l.window)
+	for len(l.failures) > 0 && l.failures[0].time.Before(cutoff) {
+		l.failures = l.failures[1:]
+	}
+	if len(l.failures) > l.max {
+		l.exceededOnce.Do(func() { close(l.exceeded) })
+	}
+}
+
+// recent returns a description of the most recent failures, up to max.
+func (l *restartLimiter) recent(max int) []string {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	failures := l.failures
+	if len(failures) > max {
+		failures = failures[len(failures)-max:]
+	}
+	var recent []string
+	for _, f := range failures {
+		recent = append(recent, f.String())
+	}
+	return recent
+}
@@ -0,0 +1,166 @@
+package stabilizer
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"strconv"
+	"syscall"
+
+	"github.com/sourcegraph/log"
+)
+
+// Causes of retries, used to label the retries metric.
+const (
+	retryCauseConnectionRefused = "connection_refused"
+	retryCauseConnectionReset   = "connection_reset"
+)
+
+// retryingTransport retries requests on another worker when the worker they
+// were sent to turns out to be gone, which typically happens when it was
+// killed because a different request on it timed out.
+type retryingTransport struct {
+	s    *Stabilizer
+	next http.RoundTripper
+}
+
+func (t retryingTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	pr := getProxyRequest(req.Context())
+	for {
+		resp, err := t.next.RoundTrip(req)
+		if err == nil || pr == nil || pr.worker == nil {
+			return resp, err
+		}
+		cause := retryCause(err)
+		if cause == "" || pr.retries >= t.s.cfg.MaxRetries || !retriable(req) || req.Context().Err() != nil {
+			return resp, err
+		}
+
+		// Give up the worker and try another one, within what remains of the
+		// request timeout.
+		failed := pr.worker
+		pr.release()
+		pr.lease, pr.worker = nil, nil
+		l, acquireErr := t.s.pool.acquire(req.Context(), pr.priority)
+		if acquireErr != nil {
+			return nil, err
+		}
+		if req.GetBody != nil {
+			body, bodyErr := req.GetBody()
+			if bodyErr != nil {
+				l.Close()
+				return nil, err
+			}
+			req.Body = body
+		}
+		pr.use(l)
+		w := l.worker
+		pr.retries++
+		req.URL.Host = w.host()
+		t.s.setDeadlineHeader(req)
+		t.s.metrics.retriesCounter.WithLabelValues(cause).Inc()
+		withTrace(req.Context(), failed.log).Debug("retrying request on another worker",
+			log.String("requestID", pr.id),
+			log.String("cause", cause),
+			log.Int("retry.pid", w.pid),
+			log.Error(err))
+	}
+}
+
+// retryCause returns why a request that failed with err may be retried, or
+// an empty string if it may not be. Timeouts are never retried, as the
+// request is likely the one that was too slow.
+func retryCause(err error) string {
+	switch {
+	case errors.Is(err, syscall.ECONNREFUSED), errors.Is(err, os.ErrNotExist):
+		// os.ErrNotExist is returned when the socket of a worker in
+		// -worker-socket-dir mode has been removed.
+		return retryCauseConnectionRefused
+	case errors.Is(err, syscall.ECONNRESET), errors.Is(err, syscall.EPIPE),
+		errors.Is(err, io.EOF), errors.Is(err, io.ErrUnexpectedEOF):
+		return retryCauseConnectionReset
+	}
+	return ""
+}
+
+// retriable reports whether the request can safely be sent again: it must be
+// idempotent and have no body, or have a body that can be replayed.
+func retriable(req *http.Request) bool {
+	if req.Body == nil || req.Body == http.NoBody {
+		return req.Method == "GET" || req.Method == "HEAD"
+	}
+	return req.GetBody != nil
+}
+
+// retryBufferMemoryBytes is the size above which request bodies buffered for
+// retries are spooled to a temporary file rather than kept in memory.
+const retryBufferMemoryBytes = 64 << 10
+
+// bufferBody reads the request body, if it is no larger than
+// -retry-buffer-max-bytes, so that it can be replayed if the request is
+// retried. Larger bodies are streamed to the worker as usual, and the request
+// is not retried. The returned cleanup function must be called once the
+// request has completed to release the buffer.
+func (s *Stabilizer) bufferBody(req *http.Request) (cleanup func(), err error) {
+	cleanup = func() {}
+	max := s.cfg.RetryBufferMaxBytes
+	if req.Body == nil || req.Body == http.NoBody || req.ContentLength == 0 || max <= 0 || req.ContentLength > max {
+		return cleanup, nil
+	}
+
+	// Read the body into memory, spilling over into a temporary file once it
+	// is larger than retryBufferMemoryBytes.
+	var (
+		memory bytes.Buffer
+		file   *os.File
+	)
+	n, err := io.CopyN(&memory, req.Body, retryBufferMemoryBytes)
+	if err == nil {
+		file, err = ioutil.TempFile("", "hss-body-")
+		if err != nil {
+			return cleanup, err
+		}
+		cleanup = func() {
+			file.Close()
+			os.Remove(file.Name())
+		}
+		var spooled int64
+		spooled, err = io.CopyN(file, req.Body, max+1-n)
+		n += spooled
+	}
+	if err != nil && err != io.EOF {
+		cleanup()
+		return func() {}, err
+	}
+
+	body := func() io.Reader { return bytes.NewReader(memory.Bytes()) }
+	if file != nil {
+		size := n - int64(memory.Len())
+		body = func() io.Reader {
+			return io.MultiReader(bytes.NewReader(memory.Bytes()), io.NewSectionReader(file, 0, size))
+		}
+	}
+	if n > max {
+		// Too large to buffer (this only happens for bodies of unknown
+		// length): stream what was read followed by the rest of the body.
+		req.Body = struct {
+			io.Reader
+			io.Closer
+		}{io.MultiReader(body(), req.Body), req.Body}
+		return cleanup, nil
+	}
+
+	// The body is fully buffered, so send it with a known length.
+	req.Body.Close()
+	req.ContentLength = n
+	req.TransferEncoding = nil
+	req.Header.Set("Content-Length", strconv.FormatInt(n, 10))
+	req.GetBody = func() (io.ReadCloser, error) {
+		return ioutil.NopCloser(body()), nil
+	}
+	req.Body, _ = req.GetBody()
+	return cleanup, nil
+}
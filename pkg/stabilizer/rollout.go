@@ -0,0 +1,114 @@
+package stabilizer
+
+import (
+	"os"
+	"os/exec"
+	"time"
+
+	"github.com/sourcegraph/log"
+)
+
+// binaryPollInterval is how often the worker binary is checked for changes
+// with -watch-worker-binary.
+const binaryPollInterval = 2 * time.Second
+
+// Rollout replaces every worker, one at a time, e.g. so that a new version of
+// the worker binary is picked up. Each worker keeps serving requests until
+// its replacement is ready, and is then drained and killed before the next
+// worker is replaced, so capacity never drops. The trigger is logged as the
+// cause of the rollout. The canary and shadow workers and the pools, if any,
+// are replaced after the others. It returns the pids of the workers that were
+// replaced.
+func (s *Stabilizer) Rollout(trigger string) ([]int, error) {
+	replaced, err := s.rollout(trigger)
+	for _, child := range s.childStabilizers() {
+		if err != nil {
+			break
+		}
+		var childReplaced []int
+		childReplaced, err = child.rollout(trigger)
+		replaced = append(replaced, childReplaced...)
+	}
+	return replaced, err
+}
+
+// rollout is like Rollout, but does not replace the workers of other
+// variants.
+func (s *Stabilizer) rollout(trigger string) ([]int, error) {
+	if len(s.upstreams) > 0 {
+		return nil, errUpstreams
+	}
+	s.restartAllMu.Lock()
+	defer s.restartAllMu.Unlock()
+
+	workers := s.workersByIndex()
+	s.log.Info("rollout started", log.String("trigger", trigger), log.Int("workers", len(workers)))
+	var replaced []int
+	for _, w := range workers {
+		if !w.recycle(reasonRollout) {
+			// Already dead, restarting or being recycled.
+			continue
+		}
+		w.log.Info("recycling", log.String("reason", reasonRollout))
+		replaced = append(replaced, w.pid)
+		err := s.waitReplaced(w)
+		if err == nil {
+			select {
+			case <-w.done:
+			case <-s.ctx.Done():
+				err = s.ctx.Err()
+			}
+		}
+		if err != nil {
+			s.log.Error("rollout aborted", log.Int("pid", w.pid), log.Error(err))
+			return replaced, err
+		}
+	}
+	s.log.Info("rollout complete", log.String("trigger", trigger), log.Ints("pids", replaced))
+	return replaced, nil
+}
+
+// watchWorkerBinary rolls out the workers whenever the worker binary is
+// replaced or modified, for -watch-worker-binary. A change is only acted on
+// once the file has stayed the same for a poll interval, so that a binary
+// still being written is not run.
+func (s *Stabilizer) watchWorkerBinary() {
+	path, err := exec.LookPath(s.command)
+	if err != nil {
+		s.log.Error("not watching worker binary", log.Error(err))
+		return
+	}
+	current, _ := os.Stat(path)
+	var pending os.FileInfo
+	ticker := time.NewTicker(binaryPollInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-s.ctx.Done():
+			return
+		case <-ticker.C:
+		}
+		info, err := os.Stat(path)
+		if err != nil || sameFile(info, current) {
+			pending = nil
+			continue
+		}
+		if !sameFile(info, pending) {
+			// Wait for the file to settle.
+			pending = info
+			continue
+		}
+		s.log.Info("worker binary changed", log.String("path", path))
+		current, pending = info, nil
+		if s.cfg.WorkerVersionArg != "" {
+			s.updateWorkerVersion()
+		}
+		_, _ = s.rollout("worker binary changed")
+	}
+}
+
+// sameFile reports whether a and b describe the same file with the same
+// size and modification time.
+func sameFile(a, b os.FileInfo) bool {
+	return a != nil && b != nil && os.SameFile(a, b) && a.ModTime().Equal(b.ModTime()) && a.Size() == b.Size()
+}
@@ -0,0 +1,139 @@
+package stabilizer
+
+import (
+	"context"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// routeDefault is the route label of requests which match no route.
+const routeDefault = "default"
+
+// Route overrides settings for requests whose path starts with its prefix.
+type Route struct {
+	Prefix string
+
+	// Timeout and TimeoutMax override Config.Timeout and Config.TimeoutMax
+	// if non-zero.
+	Timeout    time.Duration
+	TimeoutMax time.Duration
+
+	// Concurrency limits the number of concurrent requests to the route if
+	// non-zero.
+	Concurrency int
+}
+
+// ParseRoute parses a route such as "/render,timeout=30s,concurrency=2".
+func ParseRoute(s string) (Route, error) {
+	fields := strings.Split(s, ",")
+	rt := Route{Prefix: strings.TrimSpace(fields[0])}
+	if !strings.HasPrefix(rt.Prefix, "/") {
+		return Route{}, fmt.Errorf("route %q must start with a path prefix such as /render", s)
+	}
+	for _, field := range fields[1:] {
+		kv := strings.SplitN(strings.TrimSpace(field), "=", 2)
+		if len(kv) != 2 {
+			return Route{}, fmt.Errorf("invalid route option %q, expected key=value", field)
+		}
+		var err error
+		switch kv[0] {
+		case "timeout":
+			rt.Timeout, err = time.ParseDuration(kv[1])
+			if err == nil && rt.Timeout <= 0 {
+				err = fmt.Errorf("must be positive")
+			}
+		case "timeout-max":
+			rt.TimeoutMax, err = time.ParseDuration(kv[1])
+			if err == nil && rt.TimeoutMax <= 0 {
+				err = fmt.Errorf("must be positive")
+			}
+		case "concurrency":
+			rt.Concurrency, err = strconv.Atoi(kv[1])
+			if err == nil && rt.Concurrency <= 0 {
+				err = fmt.Errorf("must be positive")
+			}
+		default:
+			err = fmt.Errorf("unknown option, expected timeout, timeout-max or concurrency")
+		}
+		if err != nil {
+			return Route{}, fmt.Errorf("invalid route option %q: %v", field, err)
+		}
+	}
+	return rt, nil
+}
+
+// String returns the route in the form accepted by ParseRoute.
+func (rt Route) String() string {
+	s := rt.Prefix
+	if rt.Timeout > 0 {
+		s += ",timeout=" + rt.Timeout.String()
+	}
+	if rt.TimeoutMax > 0 {
+		s += ",timeout-max=" + rt.TimeoutMax.String()
+	}
+	if rt.Concurrency > 0 {
+		s += ",concurrency=" + strconv.Itoa(rt.Concurrency)
+	}
+	return s
+}
+
+// route is a Route in use, which tracks the requests it is serving.
+type route struct {
+	Route
+
+	// sem limits the number of concurrent requests to the route if
+	// non-nil.
+	sem chan struct{}
+}
+
+// routes are the routes requests are matched against.
+type routes []*route
+
+// newRoutes returns the routes in use for the given Routes.
+func newRoutes(rs []Route) routes {
+	var r routes
+	for _, rt := range rs {
+		in := &route{Route: rt}
+		if rt.Concurrency > 0 {
+			in.sem = make(chan struct{}, rt.Concurrency)
+		}
+		r = append(r, in)
+	}
+	return r
+}
+
+// match returns the route with the longest prefix that path starts with, or
+// nil if there is none.
+func (r routes) match(path string) *route {
+	var best *route
+	for _, rt := range r {
+		if strings.HasPrefix(path, rt.Prefix) && (best == nil || len(rt.Prefix) > len(best.Prefix)) {
+			best = rt
+		}
+	}
+	return best
+}
+
+// label returns the route's label in metrics.
+func (rt *route) label() string {
+	if rt == nil {
+		return routeDefault
+	}
+	return rt.Prefix
+}
+
+// acquire waits for the route to have capacity for another request, and
+// returns a function which gives it back.
+func (rt *route) acquire(ctx context.Context) (release func(), err error) {
+	if rt == nil || rt.sem == nil {
+		return func() {}, nil
+	}
+	select {
+	case rt.sem <- struct{}{}:
+		return func() { <-rt.sem }, nil
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+}
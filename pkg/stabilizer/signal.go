@@ -0,0 +1,53 @@
+package stabilizer
+
+import (
+	"sort"
+	"syscall"
+)
+
+// signal sends sig to the worker's process group, unless it is not ready yet
+// (it may not handle sig until then), is being killed, or has exited, so that
+// a pid which was reaped and possibly reused is never signaled. It reports
+// whether the worker was signaled.
+func (w *worker) signal(sig syscall.Signal) bool {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if !w.ready || w.killed || w.upstream != "" {
+		return false
+	}
+	select {
+	case <-w.exited:
+		return false
+	default:
+	}
+	return w.group != nil && w.group.signal(sig) == nil
+}
+
+// SignalWorkers sends sig to the process group of every live and ready
+// worker, including canary and shadow workers and those of pools, and returns
+// the pids of the workers that were signaled. Workers which are starting or
+// being killed, e.g. to be restarted, are skipped, as are -upstreams.
+func (s *Stabilizer) SignalWorkers(sig syscall.Signal) []int {
+	s.workerByAddrMu.RLock()
+	var workers []*worker
+	for _, w := range s.workerByAddr {
+		workers = append(workers, w)
+	}
+	s.workerByAddrMu.RUnlock()
+	for _, child := range s.childStabilizers() {
+		child.workerByAddrMu.RLock()
+		for _, w := range child.workerByAddr {
+			workers = append(workers, w)
+		}
+		child.workerByAddrMu.RUnlock()
+	}
+
+	var pids []int
+	for _, w := range workers {
+		if w.signal(sig) {
+			pids = append(pids, w.pid)
+		}
+	}
+	sort.Ints(pids)
+	return pids
+}
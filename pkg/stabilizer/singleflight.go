@@ -0,0 +1,168 @@
+package stabilizer
+
+import (
+	"bytes"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+// coalescedHeader is the response header which tells how many requests
+// shared a response that was duplicated by -single-flight.
+const coalescedHeader = "X-Coalesced"
+
+// flight is a request being served whose response identical requests wait
+// for, with -single-flight.
+type flight struct {
+	// done is closed once the response is known. followers is the number of
+	// requests waiting for it, guarded by Stabilizer.flightsMu.
+	done      chan struct{}
+	followers int
+
+	// ok reports whether the response may be duplicated, and requests the
+	// number of requests sharing it. They are set before done is closed.
+	ok       bool
+	requests int
+	status   int
+	header   http.Header
+	body     []byte
+}
+
+// copyRecorder passes on a response, keeping a copy of it to be sent to
+// other requests, unless the body is larger than max.
+type copyRecorder struct {
+	http.ResponseWriter
+	max int64
+
+	status   int
+	header   http.Header
+	body     bytes.Buffer
+	overflow bool
+}
+
+func (r *copyRecorder) WriteHeader(code int) {
+	if r.status == 0 {
+		r.status = code
+		r.header = r.ResponseWriter.Header().Clone()
+	}
+	r.ResponseWriter.WriteHeader(code)
+}
+
+func (r *copyRecorder) Write(p []byte) (int, error) {
+	if r.status == 0 {
+		r.WriteHeader(http.StatusOK)
+	}
+	if !r.overflow {
+		if int64(r.body.Len()+len(p)) > r.max {
+			r.overflow = true
+			r.body = bytes.Buffer{}
+		} else {
+			r.body.Write(p)
+		}
+	}
+	return r.ResponseWriter.Write(p)
+}
+
+func (r *copyRecorder) Flush() {
+	if f, ok := r.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+// Unwrap allows http.ResponseController to reach the underlying
+// ResponseWriter.
+func (r *copyRecorder) Unwrap() http.ResponseWriter {
+	return r.ResponseWriter
+}
+
+// coalescable reports whether a request may share its response with
+// identical ones, or be served a cached response: it must be a GET or HEAD
+// request without a body, and not a WebSocket upgrade.
+func coalescable(req *http.Request) bool {
+	return (req.Method == http.MethodGet || req.Method == http.MethodHead) &&
+		req.ContentLength == 0 && !isWebSocket(req)
+}
+
+// requestKey returns a key identifying requests with the same method, URL and
+// values of the given headers, which may share a response.
+func requestKey(req *http.Request, headers []string) string {
+	var key strings.Builder
+	key.WriteString(req.Method)
+	key.WriteString(" ")
+	key.WriteString(req.Host)
+	key.WriteString(req.URL.RequestURI())
+	for _, name := range headers {
+		key.WriteString("\x00")
+		key.WriteString(name)
+		key.WriteString(":")
+		key.WriteString(strings.Join(req.Header.Values(name), ","))
+	}
+	return key.String()
+}
+
+// writeCopy writes a copy of the response to another request, with the
+// request's own ID.
+func writeCopy(rw http.ResponseWriter, req *http.Request, status int, header http.Header, body []byte) {
+	for name, values := range header {
+		if rw.Header().Get(name) == "" {
+			rw.Header()[name] = append([]string(nil), values...)
+		}
+	}
+	if id := requestID(req); id != "" {
+		rw.Header().Set(requestIDHeader, id)
+	}
+	rw.WriteHeader(status)
+	rw.Write(body)
+}
+
+// coalesce wraps next so that a request identical to one being served waits
+// for that request's response and is sent a copy of it, rather than taking up
+// a worker of its own. Responses which fail or are larger than
+// -single-flight-max-bytes are not copied, and the waiting requests are then
+// served as usual.
+func (s *Stabilizer) coalesce(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		if !coalescable(req) {
+			next.ServeHTTP(rw, req)
+			return
+		}
+		key := requestKey(req, s.cfg.SingleFlightHeaders)
+		s.flightsMu.Lock()
+		if f, ok := s.flights[key]; ok {
+			f.followers++
+			s.flightsMu.Unlock()
+			select {
+			case <-f.done:
+			case <-req.Context().Done():
+				return
+			}
+			if !f.ok {
+				next.ServeHTTP(rw, req)
+				return
+			}
+			s.metrics.coalescedCounter.Inc()
+			rw.Header().Set(coalescedHeader, strconv.Itoa(f.requests))
+			writeCopy(rw, req, f.status, f.header, f.body)
+			return
+		}
+		f := &flight{done: make(chan struct{})}
+		s.flights[key] = f
+		s.flightsMu.Unlock()
+
+		entry, tracked := trackOutcome(req)
+		recorder := &copyRecorder{ResponseWriter: rw, max: s.cfg.SingleFlightMaxBytes}
+		next.ServeHTTP(recorder, tracked)
+
+		s.flightsMu.Lock()
+		delete(s.flights, key)
+		f.requests = f.followers + 1
+		s.flightsMu.Unlock()
+		if entry.succeeded() && recorder.status != 0 && !recorder.overflow && req.Context().Err() == nil {
+			f.ok = true
+			f.status = recorder.status
+			f.header = recorder.header
+			f.body = recorder.body.Bytes()
+		}
+		close(f.done)
+	})
+}
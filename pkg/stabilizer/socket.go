@@ -0,0 +1,65 @@
+package stabilizer
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"os"
+	"path/filepath"
+	"strconv"
+	"sync/atomic"
+)
+
+// host returns the host that requests to the worker are sent to. In
+// -worker-socket-dir mode, this is the name of the worker's socket, which
+// dialWorker resolves.
+func (w *worker) host() string {
+	if w.upstream != "" {
+		return w.upstream
+	}
+	if w.socket != "" {
+		return filepath.Base(w.socket)
+	}
+	return net.JoinHostPort(w.listenHost, strconv.Itoa(w.port))
+}
+
+// dialWorker connects to the worker with the given host, as returned by
+// worker.host. It is used as the DialContext of transports that talk to
+// workers.
+func (s *Stabilizer) dialWorker(ctx context.Context, network, addr string) (net.Conn, error) {
+	if s.cfg.WorkerSocketDir == "" {
+		return s.dialer.DialContext(ctx, network, addr)
+	}
+	host, _, err := net.SplitHostPort(addr)
+	if err != nil {
+		host = addr
+	}
+	return s.dialer.DialContext(ctx, "unix", filepath.Join(s.cfg.WorkerSocketDir, host))
+}
+
+// nextSocket returns a new, unique socket path for a worker.
+func (s *Stabilizer) nextSocket() string {
+	seq := atomic.AddUint32(&s.socketSeq, 1)
+	return filepath.Join(s.cfg.WorkerSocketDir, fmt.Sprintf("worker-%d.sock", seq))
+}
+
+// cleanSockets creates -worker-socket-dir if needed, and removes any sockets
+// left behind in it by a previous run.
+func (s *Stabilizer) cleanSockets() error {
+	if err := os.MkdirAll(s.cfg.WorkerSocketDir, 0700); err != nil {
+		return err
+	}
+	if err := s.chownForWorkers(s.cfg.WorkerSocketDir); err != nil {
+		return err
+	}
+	stale, err := filepath.Glob(filepath.Join(s.cfg.WorkerSocketDir, "worker-*.sock"))
+	if err != nil {
+		return err
+	}
+	for _, path := range stale {
+		if err := os.Remove(path); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+	}
+	return nil
+}
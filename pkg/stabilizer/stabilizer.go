@@ -0,0 +1,1221 @@
+// Package stabilizer runs a pool of HTTP server worker processes and proxies
+// requests to them, killing and restarting workers that get stuck. It is the
+// library behind the http-server-stabilizer command.
+package stabilizer
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"html/template"
+	"math/rand"
+	"net"
+	"net/http"
+	"net/http/httputil"
+	"os"
+	"os/exec"
+	"reflect"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/sourcegraph/log"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/trace"
+	"golang.org/x/net/http2"
+	"golang.org/x/net/http2/h2c"
+)
+
+// Stabilizer runs a pool of worker processes and proxies HTTP requests to
+// them, killing and restarting workers which get stuck.
+type Stabilizer struct {
+	// inflight is the number of requests being served. It is accessed
+	// atomically, and is first to keep it 64-bit aligned on 32-bit
+	// platforms.
+	inflight int64
+
+	// draining is 1 in drain mode, and accessed atomically.
+	draining int32
+
+	log log.Logger
+	// workerLog is the logger workers log with.
+	workerLog log.Logger
+	command   string
+	args      []string
+	// argTemplates and envTemplates are the templates in args and
+	// -worker-env, and hostname the hostname they may use. envRedact is the
+	// compiled -worker-env-redact.
+	argTemplates argTemplates
+	envTemplates argTemplates
+	dirTemplate  argTemplates
+	hostname     string
+	envRedact    *regexp.Regexp
+
+	// umask is the parsed -worker-umask, or -1 if unset.
+	umask int
+	// credential is who workers run as, or nil to run them as the
+	// stabilizer's user.
+	credential *workerCredential
+
+	// cgroupLimits are the parsed -worker-cgroup limits, and cgroups
+	// creates the cgroups of workers with them once started, or is nil if
+	// there are none or -worker-cgroup-parent could not be prepared.
+	cgroupLimits []cgroupLimit
+	cgroups      *cgroups
+
+	// cpus are the CPUs workers are pinned to with -worker-cpus, or nil if
+	// they are not pinned.
+	cpus []int
+
+	// cfg is the configuration. The fields which Update may change are
+	// guarded by configMu, which is held while reading them when serving
+	// requests: Timeout, TimeoutMin, TimeoutMax, QueueTimeout and Routes
+	// (as routes).
+	cfg      Config
+	configMu sync.RWMutex
+	routes   routes
+
+	// err is the error found in the configuration by New, which Start
+	// returns.
+	err error
+
+	// ctx is the parent of all worker contexts, it is cancelled upon shutdown.
+	ctx    context.Context
+	cancel func()
+	// slots tracks the ensureWorkers goroutines, which exit upon shutdown once
+	// their worker has died.
+	slots sync.WaitGroup
+
+	// childMu guards children, the pids of the workers and other commands
+	// which have not been waited for yet, so that -reap leaves them to
+	// whatever waits for them.
+	childMu  sync.Mutex
+	children map[int]bool
+
+	// targetMu guards target, the number of workers that should be running,
+	// runningSlots, the indices of slots that have a goroutine running, and
+	// crashLooping, the reason the last worker failed in slots whose workers
+	// keep failing.
+	targetMu     sync.Mutex
+	target       int
+	runningSlots map[int]bool
+	crashLooping map[int]string
+
+	pool           pool
+	workerByAddrMu sync.RWMutex
+	workerByAddr   map[string]*worker
+	// workerDirs counts the workers using each templated -worker-dir,
+	// including those which are still starting, so that a directory is only
+	// removed once none does. It is guarded by workerByAddrMu.
+	workerDirs map[string]int
+
+	// ports allocates worker ports, and socketSeq numbers worker sockets in
+	// -worker-socket-dir mode.
+	ports     portAllocator
+	socketSeq uint32
+
+	// portPattern is the compiled -worker-port-from-output, and dialer is
+	// used to connect to workers.
+	portPattern *regexp.Regexp
+	dialer      *net.Dialer
+
+	// routeLabel is the compiled -metrics-route-label, or nil.
+	routeLabel *regexp.Regexp
+
+	// buildInfo is the build info given with WithBuildInfo, or nil.
+	buildInfo *BuildInfo
+
+	// workerVersion is the version of the worker command found with
+	// -worker-version-arg, if known.
+	workerVersionMu sync.Mutex
+	workerVersion   string
+
+	// tracer traces requests, or is nil if tracing is disabled.
+	// tracerProvider is the provider exporting to -otel-endpoint, if this
+	// Stabilizer created it, to be shut down with it.
+	tracer         trace.Tracer
+	tracerProvider *sdktrace.TracerProvider
+
+	// dumpSignal is the parsed -stuck-dump-signal, and errorTemplate the
+	// HTML error page template.
+	dumpSignal    syscall.Signal
+	errorTemplate *template.Template
+
+	// warmup are the parsed -warmup requests.
+	warmup []warmupRequest
+
+	// upstreamErrors are the -upstream-5xx-as-error statuses.
+	upstreamErrors map[int]bool
+
+	// rateLimiter enforces -rate-limit, if set.
+	rateLimiter *rateLimiter
+
+	// flights are the requests being served whose response identical
+	// requests may share with -single-flight, by flightKey.
+	flightsMu sync.Mutex
+	flights   map[string]*flight
+
+	// cache is the -cache-ttl cache, if enabled.
+	cache *responseCache
+
+	// probeTransport is used to probe workers for readiness.
+	probeTransport *http.Transport
+
+	proxy   *httputil.ReverseProxy
+	handler http.Handler
+
+	// metrics are the stabilizer's metrics, and registered those of them and
+	// the state metrics which were registered with registerer.
+	metrics    *metrics
+	registerer prometheus.Registerer
+	registered []prometheus.Collector
+
+	// poisonMu serializes writing to -poison-request-dir.
+	poisonMu sync.Mutex
+
+	// restartAllMu prevents rolling restarts from running concurrently.
+	restartAllMu sync.Mutex
+
+	restarts restartLimiter
+
+	// restartCount counts worker restarts by reason, for Stats.
+	restartCountMu sync.Mutex
+	restartCount   map[string]int
+
+	// canary and mirror run the -canary-command and -mirror-command
+	// workers, if set. variant is the variant of the workers a Stabilizer
+	// runs for another, and empty otherwise.
+	canary  *Stabilizer
+	mirror  *Stabilizer
+	variant string
+
+	// upstreams are the hosts of the -upstreams servers, if any.
+	upstreams []string
+
+	// pools are the -pool pools. poolName is the name of the pool a
+	// Stabilizer runs the workers of for another, and empty otherwise.
+	pools    []workerPool
+	poolName string
+}
+
+// New returns a Stabilizer configured by the given options, which are applied
+// to DefaultConfig in order. Its metrics are registered right away. Errors in
+// the configuration are returned by Start.
+func New(opts ...Option) *Stabilizer {
+	o := options{cfg: DefaultConfig(), registerer: prometheus.DefaultRegisterer}
+	for _, opt := range opts {
+		opt(&o)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	s := &Stabilizer{
+		log:          log.Scoped("stabilizer", "worker stabilizer"),
+		workerLog:    log.Scoped("worker", "worker instance"),
+		command:      o.cfg.Command,
+		args:         o.cfg.Args,
+		cfg:          o.cfg,
+		routes:       newRoutes(o.cfg.Routes),
+		ctx:          ctx,
+		cancel:       cancel,
+		workerByAddr: make(map[string]*worker),
+		workerDirs:   make(map[string]int),
+		runningSlots: make(map[int]bool),
+		children:     make(map[int]bool),
+		crashLooping: make(map[int]string),
+		restartCount: make(map[string]int),
+		dialer: &net.Dialer{
+			Timeout:   o.cfg.WorkerDialTimeout,
+			KeepAlive: 30 * time.Second,
+		},
+		restarts: restartLimiter{
+			max:      o.cfg.MaxRestarts,
+			window:   o.cfg.MaxRestartsWindow,
+			exceeded: make(chan struct{}),
+		},
+	}
+	s.probeTransport = &http.Transport{
+		DialContext:       s.dialWorker,
+		DisableKeepAlives: true,
+	}
+	if o.logger != nil {
+		s.log = o.logger
+		s.workerLog = o.logger.Scoped("worker", "worker instance")
+	}
+	s.buildInfo = o.buildInfo
+	if o.tracerProvider == nil && o.cfg.OTelEndpoint != "" && checkTracing(o.cfg) == nil {
+		tp, err := newTracerProvider(o.cfg)
+		if err != nil {
+			s.log.Error("failed to set up tracing, requests will not be traced", log.Error(err))
+		} else {
+			s.tracerProvider = tp
+			o.tracerProvider = tp
+		}
+	}
+	if o.tracerProvider != nil {
+		s.tracer = o.tracerProvider.Tracer(tracerName)
+	}
+	s.pool.concurrency = o.cfg.Concurrency
+	s.pool.drainTimeout = o.cfg.DrainTimeout
+	s.pool.balance = o.cfg.Balance
+	s.pool.slowStart = o.cfg.SlowStart
+	s.pool.slowStartCurve = o.cfg.SlowStartCurve
+	s.pool.reserved = o.cfg.PriorityReserved
+	s.pool.promoteAfter = o.cfg.PriorityPromoteAfter
+	s.pool.pack = o.cfg.MaxWorkers > 0
+	namespace := metricsNamespace(o.cfg.PrometheusAppName)
+	s.metrics = newMetrics(namespace, o.cfg.PrometheusBuckets, o.cfg.MetricsRouteLabel != "")
+	if o.cfg.CanaryCommand != "" {
+		s.canary = newChild(variantCanary, canaryConfig(o.cfg), o.logger, o.registerer, o.tracerProvider, metricLabels(o.cfg, variantCanary, poolDefault))
+		s.canary.variant = variantCanary
+	}
+	if o.cfg.MirrorCommand != "" {
+		s.mirror = newChild(variantShadow, mirrorConfig(o.cfg), o.logger, o.registerer, o.tracerProvider, metricLabels(o.cfg, variantShadow, poolDefault))
+		s.mirror.variant = variantShadow
+	}
+	if checkPools(o.cfg.Pools) == nil {
+		for _, p := range o.cfg.Pools {
+			child := newChild("pool-"+p.Name, poolConfig(o.cfg, p), o.logger, o.registerer, o.tracerProvider, metricLabels(o.cfg, variantStable, p.Name))
+			child.poolName = p.Name
+			s.pools = append(s.pools, workerPool{Pool: p, s: child})
+		}
+	}
+	registerer := o.registerer
+	if labels := metricLabels(o.cfg, variantStable, poolDefault); registerer != nil && len(labels) > 0 {
+		// Label the metrics of each variant and pool, so that they can be
+		// told apart.
+		registerer = prometheus.WrapRegistererWith(labels, registerer)
+	}
+	if err := s.registerMetrics(registerer, namespace); err != nil {
+		s.log.Error("failed to register metrics, they will not be published", log.Error(err))
+	}
+	s.err = s.init()
+	if s.err == nil {
+		// Allocate ports for all variants and pools from
+		// -worker-port-range.
+		for _, child := range s.childStabilizers() {
+			child.ports = s.ports
+		}
+	}
+	return s
+}
+
+// init validates the configuration and sets up what depends on it.
+func (s *Stabilizer) init() error {
+	if err := checkPools(s.cfg.Pools); err != nil {
+		return err
+	}
+	if len(s.cfg.Upstreams) > 0 {
+		if err := checkUpstreams(s.cfg); err != nil {
+			return err
+		}
+		var err error
+		s.upstreams, err = parseUpstreams(s.cfg.Upstreams)
+		if err != nil {
+			return fmt.Errorf("invalid upstream: %v", err)
+		}
+	}
+	if s.command == "" {
+		if len(s.pools) == 0 && len(s.upstreams) == 0 {
+			return errors.New("no worker command given")
+		}
+		// Only the pools run workers, or each upstream is one.
+		s.cfg.Workers = len(s.upstreams)
+	}
+	if s.cfg.Concurrency <= 0 {
+		return errors.New("invalid concurrency: must be positive")
+	}
+	if s.cfg.WorkerMaxIdleConnsPerHost < 0 || s.cfg.WorkerIdleConnTimeout < 0 {
+		return errors.New("invalid worker idle connections: must not be negative")
+	}
+	switch s.cfg.WorkerLogFormat {
+	case "", LogFormatText, LogFormatJSON:
+	default:
+		return fmt.Errorf("invalid worker log format %q, expected %q or %q", s.cfg.WorkerLogFormat, LogFormatText, LogFormatJSON)
+	}
+	switch s.cfg.Balance {
+	case "", BalancePool, BalanceLeastLoaded:
+	default:
+		return fmt.Errorf("invalid balance %q, expected %q or %q", s.cfg.Balance, BalancePool, BalanceLeastLoaded)
+	}
+	if s.cfg.SlowStart < 0 {
+		return errors.New("invalid slow start: must not be negative")
+	}
+	switch s.cfg.SlowStartCurve {
+	case "", SlowStartLinear, SlowStartExponential:
+	default:
+		return fmt.Errorf("invalid slow start curve %q, expected %q or %q", s.cfg.SlowStartCurve, SlowStartLinear, SlowStartExponential)
+	}
+	if s.cfg.RateLimit < 0 {
+		return errors.New("invalid rate limit: must not be negative")
+	}
+	if s.cfg.CanaryWeight < 0 || s.cfg.CanaryWeight > 1 {
+		return fmt.Errorf("invalid canary weight %v: must be from 0 to 1", s.cfg.CanaryWeight)
+	}
+	if s.canary != nil && s.cfg.CanaryWorkers <= 0 {
+		return errors.New("invalid number of canary workers: must be positive")
+	}
+	if s.cfg.MirrorSample < 0 || s.cfg.MirrorSample > 1 {
+		return fmt.Errorf("invalid mirror sample %v: must be from 0 to 1", s.cfg.MirrorSample)
+	}
+	if s.mirror != nil && s.cfg.MirrorWorkers <= 0 {
+		return errors.New("invalid number of mirror workers: must be positive")
+	}
+	if s.mirror != nil && s.cfg.MirrorTimeout <= 0 {
+		return errors.New("invalid mirror timeout: must be positive")
+	}
+	for _, v := range s.variants() {
+		if v.err != nil {
+			return fmt.Errorf("invalid %s: %v", v.variant, v.err)
+		}
+	}
+	for _, p := range s.pools {
+		if p.s.err != nil {
+			return fmt.Errorf("invalid pool %q: %v", p.Name, p.s.err)
+		}
+	}
+	if s.cfg.PriorityReserved < 0 || s.cfg.PriorityReserved >= 1 {
+		return fmt.Errorf("invalid priority reserved %v: must be at least 0 and less than 1", s.cfg.PriorityReserved)
+	}
+	switch s.cfg.WorkerStderrLevel {
+	case "":
+		s.cfg.WorkerStderrLevel = LevelWarn
+	case LevelDebug, LevelInfo, LevelWarn, LevelError:
+	default:
+		return fmt.Errorf("invalid worker stderr level %q, expected debug, info, warn or error", s.cfg.WorkerStderrLevel)
+	}
+	// Zero statuses, from a Config not based on DefaultConfig, get the
+	// defaults.
+	statuses := []struct {
+		name     string
+		code     *int
+		fallback int
+	}{
+		{"queue timeout status", &s.cfg.QueueTimeoutStatus, http.StatusServiceUnavailable},
+		{"timeout status", &s.cfg.TimeoutStatus, http.StatusGatewayTimeout},
+		{"error status", &s.cfg.ErrorStatus, http.StatusServiceUnavailable},
+	}
+	for _, status := range statuses {
+		if *status.code == 0 {
+			*status.code = status.fallback
+		} else if *status.code < 400 || *status.code > 599 {
+			return fmt.Errorf("invalid %s %d: must be an HTTP error status code", status.name, *status.code)
+		}
+	}
+	var err error
+	s.dumpSignal, err = parseSignal(s.cfg.StuckDumpSignal)
+	if err != nil {
+		return fmt.Errorf("invalid stuck dump signal: %v", err)
+	}
+	s.upstreamErrors = make(map[int]bool)
+	for _, code := range s.cfg.Upstream5xxAsError {
+		if code < 500 || code > 599 {
+			return fmt.Errorf("invalid upstream 5xx as error status %d: must be a 5xx status code", code)
+		}
+		s.upstreamErrors[code] = true
+	}
+	s.errorTemplate, err = loadErrorTemplate(s.cfg.ErrorTemplate)
+	if err != nil {
+		return fmt.Errorf("invalid error template: %v", err)
+	}
+	if s.cfg.WorkerHost == "" {
+		s.cfg.WorkerHost = defaultWorkerHost
+	} else if err := checkWorkerHost(s.cfg.WorkerHost); err != nil {
+		return fmt.Errorf("invalid worker host: %v", err)
+	}
+	s.ports, err = newPortAllocator(s.cfg.WorkerPortRange, s.cfg.WorkerHost)
+	if err != nil {
+		return fmt.Errorf("invalid worker port range: %v", err)
+	}
+	s.argTemplates, err = parseArgs(s.args)
+	if err != nil {
+		return fmt.Errorf("invalid worker args: %v", err)
+	}
+	if err := checkEnv(s.cfg.WorkerEnv); err != nil {
+		return fmt.Errorf("invalid worker env: %v", err)
+	}
+	s.envTemplates, err = parseArgs(s.cfg.WorkerEnv)
+	if err != nil {
+		return fmt.Errorf("invalid worker env: %v", err)
+	}
+	s.dirTemplate, err = parseArgs([]string{s.cfg.WorkerDir})
+	if err != nil {
+		return fmt.Errorf("invalid worker dir: %v", err)
+	}
+	s.umask = -1
+	if s.cfg.WorkerUmask != "" {
+		umask, err := strconv.ParseUint(s.cfg.WorkerUmask, 8, 32)
+		if err != nil || umask > 0777 {
+			return fmt.Errorf("invalid worker umask %q: must be octal, e.g. 027", s.cfg.WorkerUmask)
+		}
+		s.umask = int(umask)
+	}
+	if (s.cfg.WorkerUser != "" || s.cfg.WorkerGroup != "") && credentialSupported {
+		s.credential, err = lookupCredential(s.cfg.WorkerUser, s.cfg.WorkerGroup)
+		if err == nil {
+			err = s.credential.check()
+		}
+		if err != nil {
+			return fmt.Errorf("invalid worker user or group: %v", err)
+		}
+	}
+	if err := checkCPUs(s.cfg); err != nil {
+		return err
+	}
+	if s.cfg.WorkerCPUs > 0 && cpusSupported {
+		s.cpus, err = availableCPUs()
+		if err != nil {
+			return fmt.Errorf("failed to get the available CPUs: %v", err)
+		}
+		if s.cfg.WorkerCPUs > len(s.cpus) {
+			return fmt.Errorf("invalid number of worker CPUs: only %d are available", len(s.cpus))
+		}
+	}
+	s.cgroupLimits, err = parseCgroupLimits(s.cfg.WorkerCgroup)
+	if err != nil {
+		return fmt.Errorf("invalid worker cgroup limit: %v", err)
+	}
+	if s.cfg.WorkerCgroupParent == "" {
+		s.cfg.WorkerCgroupParent = DefaultWorkerCgroupParent
+	}
+	if s.cfg.WorkerEnvRedact != "" {
+		s.envRedact, err = regexp.Compile(s.cfg.WorkerEnvRedact)
+		if err != nil {
+			return fmt.Errorf("invalid worker env redact pattern: %v", err)
+		}
+	}
+	s.hostname = hostname()
+	if s.cfg.WorkerPortFromOutput != "" {
+		s.portPattern, err = regexp.Compile(s.cfg.WorkerPortFromOutput)
+		if err == nil && s.portPattern.NumSubexp() < 1 {
+			err = errors.New("must contain a group matching the port")
+		}
+		if err != nil {
+			return fmt.Errorf("invalid worker port pattern: %v", err)
+		}
+	}
+	s.warmup, err = parseWarmup(s.cfg.Warmup)
+	if err != nil {
+		return fmt.Errorf("invalid warmup request: %v", err)
+	}
+	if len(s.warmup) > 0 && s.cfg.WarmupTimeout <= 0 {
+		return errors.New("invalid warmup timeout: must be positive")
+	}
+	if s.cfg.ProcMetricsInterval < 0 {
+		return errors.New("invalid proc metrics interval: must not be negative")
+	}
+	if err := checkTracing(s.cfg); err != nil {
+		return fmt.Errorf("invalid tracing configuration: %v", err)
+	}
+	if s.cfg.MetricsRouteLabel != "" {
+		s.routeLabel, err = regexp.Compile(s.cfg.MetricsRouteLabel)
+		if err != nil {
+			return fmt.Errorf("invalid metrics route label pattern: %v", err)
+		}
+	}
+	maxWorkers := s.cfg.Workers
+	if s.autoscaling() {
+		if s.command == "" {
+			return errors.New("invalid autoscaling: only the workers of a worker command can be autoscaled")
+		}
+		if err := checkAutoscaling(s.cfg); err != nil {
+			return fmt.Errorf("invalid autoscaling: %v", err)
+		}
+		// Start with the fewest workers, which the autoscaler adds to.
+		s.cfg.Workers, maxWorkers = s.cfg.MinWorkers, s.cfg.MaxWorkers
+	}
+	if err := s.checkWorkers(maxWorkers); err != nil {
+		return fmt.Errorf("invalid number of workers: %v", err)
+	}
+	transport, err := s.workerTransport()
+	if err != nil {
+		return fmt.Errorf("invalid worker protocol: %v", err)
+	}
+	s.proxy = &httputil.ReverseProxy{
+		Director:       s.director,
+		Transport:      retryingTransport{s, hedgingTransport{s, instrumentedTransport{transport, s.metrics}}},
+		FlushInterval:  s.cfg.FlushInterval,
+		ModifyResponse: s.modifyResponse,
+		ErrorHandler:   s.errorHandler,
+	}
+	s.handler = s
+	if s.cfg.SingleFlight {
+		s.flights = make(map[string]*flight)
+		s.handler = s.coalesce(s.handler)
+	}
+	if s.cfg.CacheTTL > 0 {
+		s.cache = newResponseCache(s.cfg.CacheTTL, s.cfg.CacheMaxBytes)
+		s.handler = s.cacheResponses(s.handler)
+	}
+	s.handler = s.limitInflight(s.handler)
+	if s.cfg.DrainReject {
+		s.handler = s.rejectDraining(s.handler)
+	}
+	if s.cfg.RateLimit > 0 {
+		s.rateLimiter = newRateLimiter(s.cfg.RateLimit, s.cfg.RateLimitBurst)
+		s.handler = s.limitRate(s.handler)
+	}
+	if s.cfg.AccessLog {
+		s.handler = s.accessLog(s.handler)
+	}
+	s.handler = s.instrumentRequests(s.handler)
+	if s.tracer != nil {
+		s.handler = s.traceRequests(s.handler)
+	}
+	if s.cfg.WorkerProtocol == ProtocolH2C {
+		// Let clients such as gRPC clients speak HTTP/2 without TLS too.
+		s.handler = h2c.NewHandler(s.handler, &http2.Server{})
+	}
+	return nil
+}
+
+// Start starts the workers, and waits for them to start up or for ctx to be
+// done. If they fail to start, they are stopped and an error is returned.
+func (s *Stabilizer) Start(ctx context.Context) error {
+	if s.err != nil {
+		return s.err
+	}
+	if s.command != "" {
+		if _, err := exec.LookPath(s.command); err != nil {
+			return fmt.Errorf("worker command %q not found: %v", s.command, err)
+		}
+	}
+	if s.cfg.WorkerMaxRSS > 0 && !procStatsSupported {
+		s.log.Warn("worker max RSS is not supported on this platform and will be ignored")
+	}
+	if (s.cfg.WorkerUser != "" || s.cfg.WorkerGroup != "") && !credentialSupported {
+		s.log.Warn("worker user and group are not supported on this platform and will be ignored")
+	}
+	if (s.cfg.WorkerCPUs > 0 || s.cfg.WorkerNice != 0) && !cpusSupported {
+		s.log.Warn("worker CPU affinity and niceness are not supported on this platform and will be ignored")
+	}
+	if s.cfg.WorkerUmask != "" && !umaskSupported {
+		s.log.Warn("worker umask is not supported on this platform and will be ignored")
+	}
+	if s.cfg.Reap {
+		if err := s.startReaper(); err != nil {
+			return fmt.Errorf("failed to start reaping orphaned processes: %v", err)
+		}
+	}
+	if s.cfg.WorkerSocketDir != "" {
+		if err := s.cleanSockets(); err != nil {
+			return fmt.Errorf("failed to prepare worker socket dir: %v", err)
+		}
+	}
+	if s.cfg.PoisonRequestDir != "" {
+		if err := os.MkdirAll(s.cfg.PoisonRequestDir, 0700); err != nil {
+			return fmt.Errorf("failed to create poison request dir: %v", err)
+		}
+	}
+	s.prepareCgroups()
+	if s.command != "" && s.cfg.WorkerVersionArg != "" {
+		s.updateWorkerVersion()
+	}
+	if s.runsWorkers() {
+		s.ensureWorkers(s.cfg.Workers)
+	}
+	if s.autoscaling() {
+		go s.autoscale()
+	}
+	if s.command != "" && s.cfg.WatchWorkerBinary {
+		go s.watchWorkerBinary()
+	}
+	for _, v := range s.variants() {
+		if err := v.startChild(); err != nil {
+			s.shutdown()
+			return fmt.Errorf("%s workers failed to start: %v", v.variant, err)
+		}
+	}
+	for _, p := range s.pools {
+		if err := p.s.startChild(); err != nil {
+			s.shutdown()
+			return fmt.Errorf("pool %q workers failed to start: %v", p.Name, err)
+		}
+	}
+
+	// Fail fast if the workers can't run at all, rather than serving errors
+	// forever.
+	if err := s.waitStartup(ctx, s.cfg.StartupRequireReady); err != nil {
+		s.shutdown()
+		return fmt.Errorf("workers failed to start: %v", err)
+	}
+	for _, p := range s.pools {
+		if err := p.s.waitStartup(ctx, s.cfg.StartupRequireReady); err != nil {
+			s.shutdown()
+			return fmt.Errorf("pool %q workers failed to start: %v", p.Name, err)
+		}
+	}
+	return nil
+}
+
+// Handler returns the handler that proxies requests to the workers. It must
+// only be used once Start has succeeded.
+func (s *Stabilizer) Handler() http.Handler {
+	return s.handler
+}
+
+// AdminHandler returns a handler for the admin endpoints: /healthz, /readyz,
+// /drain, /undrain, /workers, /workers/{pid}/restart, /workers/restart,
+// /config/workers, /cache/flush and /buildinfo.
+func (s *Stabilizer) AdminHandler() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/healthz", s.serveHealthz)
+	mux.HandleFunc("/readyz", s.serveReadyz)
+	mux.HandleFunc("/drain", s.serveDrain)
+	mux.HandleFunc("/undrain", s.serveDrain)
+	mux.HandleFunc("/workers", s.serveWorkers)
+	mux.HandleFunc("/workers/", s.serveWorkerAction)
+	mux.HandleFunc("/config/workers", s.serveConfigWorkers)
+	mux.HandleFunc("/cache/flush", s.serveCacheFlush)
+	mux.HandleFunc("/buildinfo", s.serveBuildInfo)
+	return mux
+}
+
+// Shutdown kills all workers and waits for them to exit, or for ctx to be
+// done. Workers are not restarted after shutdown. In-flight requests are not
+// waited for, so callers serving Handler should shut down their server
+// first.
+func (s *Stabilizer) Shutdown(ctx context.Context) error {
+	done := make(chan struct{})
+	go func() {
+		s.shutdown()
+		s.unregisterMetrics()
+		if s.tracerProvider != nil {
+			// Export the spans of the last requests.
+			if err := s.tracerProvider.Shutdown(ctx); err != nil {
+				s.log.Warn("failed to export traces", log.Error(err))
+			}
+		}
+		close(done)
+	}()
+	select {
+	case <-done:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// Config returns the current configuration.
+func (s *Stabilizer) Config() Config {
+	s.configMu.RLock()
+	defer s.configMu.RUnlock()
+	return s.cfg
+}
+
+// Update applies options to a running Stabilizer. Only the timeouts
+// (Timeout, TimeoutMin, TimeoutMax and QueueTimeout), Concurrency, Workers
+// and Routes may be changed; an error is returned, and nothing is changed, if
+// the options change anything else.
+func (s *Stabilizer) Update(opts ...Option) error {
+	s.configMu.RLock()
+	o := options{cfg: s.cfg}
+	s.configMu.RUnlock()
+	for _, opt := range opts {
+		opt(&o)
+	}
+	if o.logger != nil || o.registerer != nil || o.tracerProvider != nil || o.buildInfo != nil {
+		return errors.New("the logger, registerer, tracer provider and build info cannot be updated")
+	}
+	current, next := s.Config(), o.cfg
+	for _, c := range []*Config{&current, &next} {
+		c.Timeout, c.TimeoutMin, c.TimeoutMax, c.QueueTimeout = 0, 0, 0, 0
+		c.Concurrency, c.Workers, c.Routes = 0, 0, nil
+	}
+	if !reflect.DeepEqual(current, next) {
+		return errors.New("only timeouts, concurrency, workers and routes can be updated")
+	}
+	if o.cfg.Concurrency <= 0 {
+		return errors.New("invalid concurrency: must be positive")
+	}
+	switch {
+	case s.command == "":
+		o.cfg.Workers = len(s.upstreams)
+	case s.autoscaling():
+		// The autoscaler decides the number of workers.
+		o.cfg.Workers = s.cfg.Workers
+	}
+	if err := s.checkWorkers(o.cfg.Workers); err != nil {
+		return fmt.Errorf("invalid number of workers: %v", err)
+	}
+	if s.canary != nil {
+		// The canary is configured like the stabilizer, other than its
+		// number of workers.
+		next := o.cfg
+		err := s.canary.Update(func(c *options) {
+			c.cfg.Timeout, c.cfg.TimeoutMin, c.cfg.TimeoutMax = next.Timeout, next.TimeoutMin, next.TimeoutMax
+			c.cfg.QueueTimeout = next.QueueTimeout
+			c.cfg.Concurrency = next.Concurrency
+			c.cfg.Routes = next.Routes
+		})
+		if err != nil {
+			return fmt.Errorf("failed to update canary: %v", err)
+		}
+	}
+
+	// Only the fields which may change are written, as the others are read
+	// without holding configMu.
+	s.configMu.Lock()
+	previous := s.cfg
+	s.cfg.Timeout = o.cfg.Timeout
+	s.cfg.TimeoutMin = o.cfg.TimeoutMin
+	s.cfg.TimeoutMax = o.cfg.TimeoutMax
+	s.cfg.QueueTimeout = o.cfg.QueueTimeout
+	s.cfg.Concurrency = o.cfg.Concurrency
+	s.cfg.Workers = o.cfg.Workers
+	s.cfg.Routes = o.cfg.Routes
+	s.routes = newRoutes(o.cfg.Routes)
+	s.configMu.Unlock()
+
+	if o.cfg.Workers != previous.Workers {
+		s.ensureWorkers(o.cfg.Workers)
+	}
+	if o.cfg.Concurrency != previous.Concurrency {
+		s.pool.setConcurrency(o.cfg.Concurrency)
+	}
+	return nil
+}
+
+// Exceeded returns a channel which is closed once workers have failed more
+// than MaxRestarts times within MaxRestartsWindow.
+func (s *Stabilizer) Exceeded() <-chan struct{} {
+	return s.restarts.exceeded
+}
+
+// RecentFailures describes the most recent worker failures, up to max.
+func (s *Stabilizer) RecentFailures(max int) []string {
+	return s.restarts.recent(max)
+}
+
+// ensureWorkers ensures that n workers are always alive. If they die, they
+// will be started again. It may be called again to change the number of
+// workers, in which case excess workers are drained and not replaced.
+func (s *Stabilizer) ensureWorkers(n int) {
+	s.log.Info("ensuring workers",
+		log.String("command", strings.Join(append([]string{s.command}, s.args...), " ")),
+		log.Int("count", n))
+
+	s.targetMu.Lock()
+	defer s.targetMu.Unlock()
+	rebalance := s.target != n
+	s.target = n
+	for i := 0; i < n; i++ {
+		if s.runningSlots[i] {
+			continue
+		}
+		s.runningSlots[i] = true
+		s.slots.Add(1)
+		go s.runSlot(i)
+	}
+
+	s.workerByAddrMu.RLock()
+	defer s.workerByAddrMu.RUnlock()
+	for _, w := range s.workerByAddr {
+		if w.index >= n {
+			s.pool.drain(w, reasonScaleDown)
+		} else if rebalance {
+			// Spread the workers across the CPUs again.
+			s.pinWorker(w, n)
+		}
+	}
+}
+
+// checkWorkers returns an error if n workers can't be run.
+func (s *Stabilizer) checkWorkers(n int) error {
+	if n < 0 {
+		return errors.New("the number of workers must not be negative")
+	}
+	allocatesPorts := s.cfg.WorkerSocketDir == "" && s.portPattern == nil
+	if c := s.ports.capacity(); allocatesPorts && c > 0 && n > c {
+		return fmt.Errorf("-worker-port-range only has %v ports, fewer than %v workers", c, n)
+	}
+	return nil
+}
+
+// targetWorkers returns the number of workers that should be running.
+func (s *Stabilizer) targetWorkers() int {
+	s.targetMu.Lock()
+	defer s.targetMu.Unlock()
+	return s.target
+}
+
+// runsWorkers reports whether the stabilizer runs workers of its own, rather
+// than only those of its pools.
+func (s *Stabilizer) runsWorkers() bool {
+	return s.command != "" || len(s.upstreams) > 0
+}
+
+// keepSlot reports whether the slot with the given index should keep running
+// workers. If not, the slot is marked as no longer running.
+func (s *Stabilizer) keepSlot(i int) bool {
+	s.targetMu.Lock()
+	defer s.targetMu.Unlock()
+	if i < s.target {
+		return true
+	}
+	delete(s.runningSlots, i)
+	return false
+}
+
+// runSlot keeps a worker running in the slot with the given index until
+// shutdown, or until the number of workers is reduced below index.
+func (s *Stabilizer) runSlot(i int) {
+	defer s.slots.Done()
+	defer s.setCrashLooping(i, "")
+	var (
+		last      restart
+		recycling *worker
+		backoff   time.Duration
+	)
+	for s.ctx.Err() == nil && s.keepSlot(i) {
+		if len(s.upstreams) > 0 {
+			last = s.runUpstream(i, last)
+			continue
+		}
+		if backoff > 0 {
+			select {
+			case <-s.ctx.Done():
+				continue
+			case <-time.After(backoff):
+			}
+		}
+
+		var (
+			workerPort   int
+			workerSocket string
+		)
+		if s.cfg.WorkerSocketDir != "" {
+			workerSocket = s.nextSocket()
+		} else if s.portPattern == nil {
+			var err error
+			workerPort, err = s.ports.allocate()
+			if err != nil {
+				s.log.Warn("failed to find free port", log.Error(err))
+				time.Sleep(1 * time.Second)
+				continue
+			}
+		}
+
+		wc, err := s.workerCommand(i, workerPort, workerSocket)
+		if err != nil {
+			s.log.Warn("failed to prepare worker command", log.Error(err))
+			if workerPort != 0 {
+				s.ports.release(workerPort)
+			}
+			time.Sleep(1 * time.Second)
+			continue
+		}
+
+		last, recycling = s.runWorker(i, workerPort, workerSocket, wc, last, recycling)
+		backoff = s.restartBackoff(i, backoff, last)
+	}
+	if recycling != nil {
+		// The slot is going away before a replacement became ready.
+		s.pool.drain(recycling, recycling.recycleReason)
+	}
+	s.metrics.forgetProcStats(i)
+	s.metrics.workerLastRestart.DeleteLabelValues(strconv.Itoa(i))
+	s.metrics.workerConcurrency.DeleteLabelValues(strconv.Itoa(i))
+}
+
+// Bounds on how long a slot waits before starting a new worker when its
+// workers keep failing, and how long a worker must have been ready for the
+// slot to no longer be considered to be crash looping.
+const (
+	restartBackoffMin   = 250 * time.Millisecond
+	restartBackoffMax   = 30 * time.Second
+	restartBackoffReset = 10 * time.Second
+)
+
+// restartBackoff returns how long the given slot should wait before starting
+// its next worker, given the previous backoff and why the last worker died.
+// The backoff doubles each time a worker fails without having been ready for
+// restartBackoffReset.
+func (s *Stabilizer) restartBackoff(index int, backoff time.Duration, last restart) time.Duration {
+	switch last.reason {
+	case reasonCrash, reasonOOM, reasonStartupFailure:
+	default:
+		s.setCrashLooping(index, "")
+		return 0
+	}
+	if last.ready >= restartBackoffReset {
+		s.setCrashLooping(index, "")
+		return 0
+	}
+
+	next := backoff * 2
+	if next < restartBackoffMin {
+		next = restartBackoffMin
+	}
+	if next > restartBackoffMax {
+		next = restartBackoffMax
+	}
+	if next != backoff {
+		s.log.Error("worker is crash looping",
+			log.Int("index", index),
+			log.String("reason", last.reason),
+			log.Duration("backoff", next))
+	}
+	s.setCrashLooping(index, last.reason)
+	return next
+}
+
+// setCrashLooping records the reason the last worker in the given slot
+// failed, or that the slot is not crash looping if reason is empty.
+func (s *Stabilizer) setCrashLooping(index int, reason string) {
+	s.targetMu.Lock()
+	defer s.targetMu.Unlock()
+	if reason != "" {
+		s.crashLooping[index] = reason
+	} else {
+		delete(s.crashLooping, index)
+	}
+}
+
+// crashLoopingSlots returns the number of slots whose workers keep failing,
+// and the reason the last worker in one of them failed.
+func (s *Stabilizer) crashLoopingSlots() (int, string) {
+	s.targetMu.Lock()
+	defer s.targetMu.Unlock()
+	var reason string
+	for _, r := range s.crashLooping {
+		reason = r
+	}
+	return len(s.crashLooping), reason
+}
+
+// restart describes why and when the previous worker in a slot was restarted,
+// and how long it had been ready for.
+type restart struct {
+	reason string
+	time   time.Time
+	ready  time.Duration
+}
+
+// runWorker spawns a worker for the given slot on the given port or Unix
+// socket, run with wc, and hands it out to requests until it dies, returning
+// why it died.
+//
+// If the worker is recycled instead, runWorker returns as soon as that is
+// requested along with the worker, which keeps serving requests. It should
+// be passed back in as recycling on the next call, so that it is drained
+// once its replacement is ready.
+func (s *Stabilizer) runWorker(index, workerPort int, workerSocket string, wc workerCommand, last restart, recycling *worker) (restart, *worker) {
+	w, err := s.spawnWorker(s.ctx,
+		s.workerLog,
+		index, workerPort, workerSocket, s.command, wc)
+	w.restartReason = last.reason
+	w.restartTime = last.time
+
+	// Don't hand out the worker until it is ready to serve requests, and
+	// never one which failed to spawn.
+	if err != nil {
+		err = fmt.Errorf("worker failed to spawn: %v", err)
+	} else {
+		err = s.waitPort(w)
+	}
+	if err == nil {
+		s.workerByAddrMu.Lock()
+		s.workerByAddr[w.host()] = w
+		s.workerByAddrMu.Unlock()
+		err = s.waitReady(w)
+	}
+	if err == nil && len(s.warmup) > 0 {
+		// Warm up the worker before it takes requests, so that they are not
+		// the ones to find it slow.
+		err = s.warmUp(w)
+		if err != nil && !s.cfg.WarmupRequired && w.ctx.Err() == nil {
+			w.log.Warn("handing out worker despite failed warmup", log.Error(err))
+			err = nil
+		}
+	}
+	if err != nil {
+		reason := reasonStartupFailure
+		if err == errPortConflict {
+			// Try again right away with a new port.
+			reason = reasonPortConflict
+			s.metrics.portConflictsCounter.Inc()
+		}
+		if s.ctx.Err() == nil {
+			w.log.Warn("restarting due to startup failure", log.String("reason", reason), log.Error(err))
+		}
+		w.kill(reason)
+		<-w.done
+		s.forgetWorker(w)
+		return s.recordRestart(w), recycling
+	}
+
+	// Hand out the worker until it is killed or dies. If the number of
+	// workers was reduced while it was starting, get rid of it instead.
+	w.mu.Lock()
+	w.ready = true
+	w.readyTime = time.Now()
+	w.mu.Unlock()
+	s.metrics.workerStartup.Observe(w.readyTime.Sub(w.started).Seconds())
+	crashLoopingReset := time.AfterFunc(restartBackoffReset, func() {
+		s.setCrashLooping(index, "")
+	})
+	defer crashLoopingReset.Stop()
+	if index >= s.targetWorkers() {
+		s.pool.drain(w, reasonScaleDown)
+	}
+	s.pool.add(w)
+	if s.cfg.WorkerMaxAge > 0 {
+		t := time.AfterFunc(time.Until(w.started.Add(jitter(s.cfg.WorkerMaxAge))), func() {
+			if w.recycle(reasonMaxAge) {
+				w.log.Info("recycling", log.String("reason", reasonMaxAge), log.Duration("age", time.Since(w.started)))
+			}
+		})
+		defer t.Stop()
+	}
+	if recycling != nil {
+		s.pool.drain(recycling, recycling.recycleReason)
+	}
+	if procStatsSupported && (s.cfg.ProcMetricsInterval > 0 || s.cfg.WorkerMaxRSS > 0) {
+		go s.monitorProc(w)
+	}
+	if s.cfg.HealthCheckPath != "" {
+		go s.healthCheck(w)
+	}
+	select {
+	case <-w.ctx.Done():
+	case <-w.done:
+	case <-w.recycling:
+		// Start the replacement right away, and clean up after the worker
+		// once it has been drained.
+		s.slots.Add(1)
+		go func() {
+			defer s.slots.Done()
+			s.waitWorker(w)
+		}()
+		return restart{reason: w.recycleReason, time: time.Now()}, w
+	}
+	return s.waitWorker(w), nil
+}
+
+// jitter returns d randomly adjusted by up to 10% either way, so that workers
+// started together are not all recycled at the same time.
+func jitter(d time.Duration) time.Duration {
+	return d + time.Duration((rand.Float64()*0.2-0.1)*float64(d))
+}
+
+// waitWorker waits for a worker that has been handed out to die, and returns
+// why it died.
+func (s *Stabilizer) waitWorker(w *worker) restart {
+	select {
+	case <-w.ctx.Done():
+	case <-w.done:
+	}
+	s.pool.remove(w)
+	<-w.done
+	s.forgetWorker(w)
+	return s.recordRestart(w)
+}
+
+// recordRestart records and returns the reason a worker died, so long as it
+// was not killed because the stabilizer is shutting down. It must only be
+// called once the worker is done.
+func (s *Stabilizer) recordRestart(w *worker) restart {
+	if s.ctx.Err() != nil {
+		return restart{}
+	}
+	reason := w.exitReason()
+	s.metrics.workerLifetime.WithLabelValues(reason).Observe(w.exitTime.Sub(w.started).Seconds())
+	if reason == reasonScaleDown {
+		return restart{}
+	}
+	if reason == reasonCrash || reason == reasonOOM {
+		code, sig := w.exitStatus()
+		fields := []log.Field{
+			log.String("reason", reason),
+			log.String("process.state", w.state.String()),
+			log.Int("process.exit_code", code),
+		}
+		if sig != 0 {
+			fields = append(fields, log.String("process.signal", sig.String()))
+		}
+		w.log.Warn("restarting due to unexpected exit", fields...)
+	}
+	s.metrics.workerRestartsCounter.WithLabelValues(reason).Inc()
+	s.restartCountMu.Lock()
+	s.restartCount[reason]++
+	s.restartCountMu.Unlock()
+	if isFailure(reason) {
+		if tail := w.tail.get(); len(tail) > 0 {
+			w.log.Warn("last worker output before failure",
+				log.String("reason", reason),
+				log.Strings("output", tail))
+		}
+		s.restarts.record(failure{time: time.Now(), reason: reason, state: w.state.String()})
+	}
+	r := restart{reason: reason, time: time.Now()}
+	s.metrics.workerLastRestart.WithLabelValues(strconv.Itoa(w.index)).Set(float64(r.time.UnixNano()) / 1e9)
+	w.mu.Lock()
+	if w.ready {
+		r.ready = r.time.Sub(w.readyTime)
+	}
+	w.mu.Unlock()
+	return r
+}
+
+// forgetWorker stops tracking a worker once it has died, so that workerByAddr
+// only holds roughly as many entries as there are workers.
+func (s *Stabilizer) forgetWorker(w *worker) {
+	s.workerByAddrMu.Lock()
+	defer s.workerByAddrMu.Unlock()
+	if s.workerByAddr[w.host()] == w {
+		delete(s.workerByAddr, w.host())
+	}
+	if w.socket != "" {
+		os.Remove(w.socket)
+	} else if w.port != 0 {
+		s.ports.release(w.port)
+	}
+	for _, port := range w.extraPorts {
+		s.ports.release(port)
+	}
+	if w.cgroup != "" {
+		if err := removeCgroup(w.cgroup); err != nil {
+			w.log.Warn("failed to remove worker cgroup", log.Error(err))
+		}
+	}
+	if w.dir != "" {
+		if err := s.releaseWorkerDir(w.dir); err != nil {
+			w.log.Warn("failed to remove worker dir", log.Error(err))
+		}
+	}
+}
+
+// useWorkerDir records that a worker is about to use the templated
+// -worker-dir dir, so that it is not removed until the worker is done with
+// it.
+func (s *Stabilizer) useWorkerDir(dir string) {
+	s.workerByAddrMu.Lock()
+	defer s.workerByAddrMu.Unlock()
+	s.workerDirs[dir]++
+}
+
+// releaseWorkerDir records that a worker no longer uses the templated
+// -worker-dir dir, and removes it unless another worker uses it too, e.g. the
+// replacement of a worker which was recycled, or another worker altogether if
+// the template is not unique to each worker. s.workerByAddrMu must be held.
+func (s *Stabilizer) releaseWorkerDir(dir string) error {
+	s.workerDirs[dir]--
+	if s.workerDirs[dir] > 0 {
+		return nil
+	}
+	delete(s.workerDirs, dir)
+	return os.RemoveAll(dir)
+}
+
+// shutdown kills all workers and waits for them to exit. Workers are not
+// restarted after shutdown.
+func (s *Stabilizer) shutdown() {
+	s.cancel()
+	for _, child := range s.childStabilizers() {
+		child.shutdown()
+	}
+	s.slots.Wait()
+}
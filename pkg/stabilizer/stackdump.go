@@ -0,0 +1,57 @@
+package stabilizer
+
+import (
+	"strings"
+	"syscall"
+
+	"github.com/sourcegraph/log"
+)
+
+// stackDumpMaxBytes bounds the output kept for a stack dump. Dumps of
+// processes with many goroutines or threads can be large.
+const stackDumpMaxBytes = 1 << 20
+
+// stackDump is the output of a worker after it was sent -stuck-dump-signal.
+type stackDump struct {
+	requestID string
+	signal    syscall.Signal
+	lines     []string
+	bytes     int
+	dropped   int
+}
+
+// addDump adds a line of output to the stack dump, if one is being captured.
+func (w *worker) addDump(line string) {
+	w.dumpMu.Lock()
+	defer w.dumpMu.Unlock()
+	d := w.dump
+	if d == nil {
+		return
+	}
+	if d.bytes+len(line) > stackDumpMaxBytes {
+		d.dropped += len(line)
+		return
+	}
+	d.lines = append(d.lines, strings.TrimSuffix(line, "\n"))
+	d.bytes += len(line)
+}
+
+// logDump logs the captured stack dump, if any, as a single entry.
+func (w *worker) logDump() {
+	w.dumpMu.Lock()
+	d := w.dump
+	w.dump = nil
+	w.dumpMu.Unlock()
+	if d == nil {
+		return
+	}
+	fields := []log.Field{
+		log.String("requestID", d.requestID),
+		log.String("signal", d.signal.String()),
+		log.String("dump", strings.Join(d.lines, "\n")),
+	}
+	if d.dropped > 0 {
+		fields = append(fields, log.Int("droppedBytes", d.dropped))
+	}
+	w.log.Warn("stack dump of stuck worker", fields...)
+}
@@ -0,0 +1,151 @@
+package stabilizer
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/sourcegraph/log"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracehttp"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/sdk/resource"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// tracerName is the name of the tracer proxied requests are traced with.
+const tracerName = "github.com/slimsag/http-server-stabilizer/pkg/stabilizer"
+
+// traceContext propagates W3C traceparent and tracestate headers.
+var traceContext = propagation.TraceContext{}
+
+// checkTracing returns an error if the -otel-endpoint is set but is not a URL
+// such as http://localhost:4318, or the -otel-sample-ratio is not between 0
+// and 1.
+func checkTracing(cfg Config) error {
+	if cfg.OTelSampleRatio < 0 || cfg.OTelSampleRatio > 1 {
+		return errors.New("the sample ratio must be between 0 and 1")
+	}
+	if cfg.OTelEndpoint == "" {
+		return nil
+	}
+	u, err := url.Parse(cfg.OTelEndpoint)
+	if err != nil {
+		return err
+	}
+	if (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return fmt.Errorf("%q must be a URL such as http://localhost:4318", cfg.OTelEndpoint)
+	}
+	return nil
+}
+
+// newTracerProvider returns a tracer provider which exports spans over
+// OTLP/HTTP to the -otel-endpoint, sampling -otel-sample-ratio of the traces
+// which do not continue a caller's trace. Traces which do are sampled if the
+// caller's was. The configuration must have passed checkTracing.
+func newTracerProvider(cfg Config) (*sdktrace.TracerProvider, error) {
+	u, err := url.Parse(cfg.OTelEndpoint)
+	if err != nil {
+		return nil, err
+	}
+	opts := []otlptracehttp.Option{otlptracehttp.WithEndpoint(u.Host)}
+	if u.Scheme == "http" {
+		opts = append(opts, otlptracehttp.WithInsecure())
+	}
+	if path := strings.TrimSuffix(u.Path, "/"); path != "" {
+		opts = append(opts, otlptracehttp.WithURLPath(path))
+	}
+	exporter, err := otlptracehttp.New(context.Background(), opts...)
+	if err != nil {
+		return nil, err
+	}
+	return sdktrace.NewTracerProvider(
+		sdktrace.WithBatcher(exporter),
+		sdktrace.WithSampler(sdktrace.ParentBased(sdktrace.TraceIDRatioBased(cfg.OTelSampleRatio))),
+		sdktrace.WithResource(resource.NewSchemaless(attribute.String("service.name", "http-server-stabilizer"))),
+	), nil
+}
+
+// traceRequests wraps next to create a span for each request, which continues
+// the caller's trace if the request has a traceparent header. ServeHTTP
+// passes the span on to the worker in the same way.
+func (s *Stabilizer) traceRequests(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		ctx := traceContext.Extract(req.Context(), propagation.HeaderCarrier(req.Header))
+		ctx, span := s.tracer.Start(ctx, "HTTP "+req.Method,
+			trace.WithSpanKind(trace.SpanKindServer),
+			trace.WithAttributes(
+				attribute.String("http.method", req.Method),
+				attribute.String("http.target", req.URL.RequestURI()),
+			))
+		defer span.End()
+
+		entry, tracked := trackOutcome(req.WithContext(ctx))
+		recorder := &statusRecorder{ResponseWriter: rw}
+		next.ServeHTTP(recorder, tracked)
+
+		status := recorder.status
+		if status == 0 {
+			status = http.StatusOK
+		}
+		outcome := outcomeOK
+		if pr := entry.pr; pr != nil {
+			outcome = pr.outcome
+			span.SetAttributes(
+				attribute.String("hss.request_id", pr.id),
+				attribute.Float64("hss.queue_wait_ms", float64(pr.queueWait)/float64(time.Millisecond)),
+				attribute.Int64("hss.timeout_ms", pr.timeout.Milliseconds()),
+				attribute.Int("hss.retries", pr.retries),
+				attribute.Bool("hss.hedged", pr.hedged),
+			)
+			if w := pr.worker; w != nil {
+				span.SetAttributes(workerAttributes(w)...)
+			}
+		}
+		span.SetAttributes(
+			attribute.Int("http.status_code", status),
+			attribute.String("hss.outcome", outcome),
+		)
+		if status >= 500 {
+			span.SetStatus(codes.Error, outcome)
+		}
+	})
+}
+
+// workerAttributes returns the span attributes identifying a worker.
+func workerAttributes(w *worker) []attribute.KeyValue {
+	switch {
+	case w.upstream != "":
+		return []attribute.KeyValue{attribute.String("hss.worker.upstream", w.upstream)}
+	case w.socket != "":
+		return []attribute.KeyValue{attribute.Int("hss.worker.pid", w.pid), attribute.String("hss.worker.socket", w.socket)}
+	}
+	return []attribute.KeyValue{attribute.Int("hss.worker.pid", w.pid), attribute.Int("hss.worker.port", w.port)}
+}
+
+// traceWorkerKilled adds an event to the span of the request in ctx, if it is
+// being traced, telling that its worker was killed for the given reason.
+func traceWorkerKilled(ctx context.Context, w *worker, reason string) {
+	span := trace.SpanFromContext(ctx)
+	if !span.IsRecording() {
+		return
+	}
+	attrs := append(workerAttributes(w), attribute.String("hss.reason", reason))
+	span.AddEvent("worker killed", trace.WithAttributes(attrs...))
+}
+
+// withTrace returns logger with the trace and span IDs of the request in ctx,
+// if it is being traced, so that its log entries can be found from the trace.
+func withTrace(ctx context.Context, logger log.Logger) log.Logger {
+	sc := trace.SpanContextFromContext(ctx)
+	if !sc.IsValid() {
+		return logger
+	}
+	return logger.WithTrace(log.TraceContext{TraceID: sc.TraceID().String(), SpanID: sc.SpanID().String()})
+}
@@ -0,0 +1,163 @@
+package stabilizer
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/url"
+	"time"
+
+	"github.com/sourcegraph/log"
+)
+
+// upstreamProbeInterval is how often an -upstreams server which is not being
+// sent requests is checked until it passes.
+const upstreamProbeInterval = time.Second
+
+// errUpstreams is returned when asked to replace workers in -upstreams mode,
+// in which there are no worker processes.
+var errUpstreams = errors.New("upstreams are not run by the stabilizer and cannot be replaced")
+
+// parseUpstreams returns the hosts of the given -upstreams URLs.
+func parseUpstreams(upstreams []string) ([]string, error) {
+	var hosts []string
+	seen := make(map[string]bool)
+	for _, upstream := range upstreams {
+		u, err := url.Parse(upstream)
+		if err != nil {
+			return nil, err
+		}
+		if u.Scheme != "http" || u.Host == "" {
+			return nil, fmt.Errorf("%q must be a URL such as http://10.0.0.1:4443", upstream)
+		}
+		if (u.Path != "" && u.Path != "/") || u.RawQuery != "" {
+			return nil, fmt.Errorf("%q must not have a path", upstream)
+		}
+		if u.Port() == "" {
+			u.Host += ":80"
+		}
+		if seen[u.Host] {
+			return nil, fmt.Errorf("duplicate upstream %q", upstream)
+		}
+		seen[u.Host] = true
+		hosts = append(hosts, u.Host)
+	}
+	return hosts, nil
+}
+
+// checkUpstreams returns an error if the configuration does not allow
+// -upstreams, which only replace the worker command.
+func checkUpstreams(cfg Config) error {
+	switch {
+	case cfg.Command != "":
+		return errors.New("upstreams cannot be used with a worker command")
+	case cfg.CanaryCommand != "", cfg.MirrorCommand != "", len(cfg.Pools) > 0:
+		return errors.New("upstreams cannot be used with a canary, mirror or pools")
+	case cfg.WorkerSocketDir != "":
+		return errors.New("upstreams cannot be used with a worker socket dir")
+	case cfg.WorkerMaxRequests > 0, cfg.WorkerMaxAge > 0:
+		return errors.New("upstreams cannot be recycled after a maximum number of requests or age")
+	case len(cfg.Warmup) > 0:
+		return errors.New("upstreams cannot be warmed up")
+	case cfg.MaxWorkers > 0:
+		return errors.New("upstreams cannot be autoscaled")
+	case cfg.EjectDuration < 0:
+		return errors.New("the eject duration must not be negative")
+	}
+	return nil
+}
+
+// newUpstreamWorker returns a worker for the given slot which stands for the
+// upstream with the given host. It is done once it is killed.
+func (s *Stabilizer) newUpstreamWorker(index int, host string) *worker {
+	ctx, cancel := context.WithCancel(s.ctx)
+	w := &worker{
+		log:       s.workerLog.With(log.String("upstream", host)),
+		ctx:       ctx,
+		index:     index,
+		upstream:  host,
+		cancel:    cancel,
+		done:      make(chan struct{}),
+		exited:    make(chan struct{}),
+		started:   time.Now(),
+		recycling: make(chan struct{}),
+		metrics:   s.metrics,
+	}
+	go func() {
+		<-ctx.Done()
+		w.exitTime = time.Now()
+		close(w.exited)
+		close(w.done)
+	}()
+	return w
+}
+
+// runUpstream hands out the upstream for the given slot to requests until it
+// is ejected, returning why. An upstream which was ejected is only handed out
+// again after -eject-duration, once it passes a health check.
+func (s *Stabilizer) runUpstream(index int, last restart) restart {
+	w := s.newUpstreamWorker(index, s.upstreams[index])
+	w.restartReason = last.reason
+	w.restartTime = last.time
+	s.workerByAddrMu.Lock()
+	s.workerByAddr[w.host()] = w
+	s.workerByAddrMu.Unlock()
+
+	if last.reason != "" {
+		select {
+		case <-w.ctx.Done():
+		case <-time.After(s.cfg.EjectDuration):
+		}
+	}
+	if err := s.waitUpstream(w); err != nil {
+		<-w.done
+		s.forgetWorker(w)
+		return s.recordRestart(w)
+	}
+
+	w.mu.Lock()
+	w.ready = true
+	w.readyTime = time.Now()
+	w.mu.Unlock()
+	s.pool.add(w)
+	if s.cfg.HealthCheckPath != "" {
+		go s.healthCheck(w)
+	}
+	r := s.waitWorker(w)
+	if r.reason != "" {
+		w.log.Warn("ejected", log.String("reason", r.reason), log.Duration("duration", s.cfg.EjectDuration))
+	}
+	return r
+}
+
+// waitUpstream blocks until the upstream passes a health check, or the
+// readiness probe if there is no -healthcheck-path. Unlike a worker process,
+// an upstream is waited for indefinitely, as it may be down for longer than a
+// worker takes to start. An error is only returned once the worker is killed.
+func (s *Stabilizer) waitUpstream(w *worker) error {
+	path := s.cfg.WorkerReadyPath
+	if s.cfg.HealthCheckPath != "" {
+		path = s.cfg.HealthCheckPath
+	}
+	ticker := time.NewTicker(upstreamProbeInterval)
+	defer ticker.Stop()
+	failing := false
+	for {
+		ctx, cancel := context.WithTimeout(w.ctx, s.cfg.HealthCheckTimeout)
+		err := s.probeWorker(ctx, w.host(), path)
+		cancel()
+		if err == nil && w.ctx.Err() == nil {
+			w.log.Info("ready")
+			return nil
+		}
+		if !failing && w.ctx.Err() == nil {
+			w.log.Warn("upstream is not ready", log.Error(err))
+			failing = true
+		}
+		select {
+		case <-w.ctx.Done():
+			return w.ctx.Err()
+		case <-ticker.C:
+		}
+	}
+}
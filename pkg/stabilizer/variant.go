@@ -0,0 +1,21 @@
+package stabilizer
+
+// Variants of workers. When a canary or mirror is configured, metrics and
+// /workers are labelled with the variant of the workers involved.
+const (
+	variantStable = "stable"
+	variantCanary = "canary"
+	variantShadow = "shadow"
+)
+
+// variants returns the Stabilizers running the other variants of the
+// workers, if any: the canary, and then the mirror.
+func (s *Stabilizer) variants() []*Stabilizer {
+	var variants []*Stabilizer
+	for _, v := range []*Stabilizer{s.canary, s.mirror} {
+		if v != nil {
+			variants = append(variants, v)
+		}
+	}
+	return variants
+}
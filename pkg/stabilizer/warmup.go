@@ -0,0 +1,98 @@
+package stabilizer
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/sourcegraph/log"
+)
+
+// warmupRequest is a -warmup request, which is sent to each new worker before
+// it is handed out.
+type warmupRequest struct {
+	method string
+	path   string
+}
+
+func (r warmupRequest) String() string {
+	return r.method + " " + r.path
+}
+
+// parseWarmup parses -warmup requests such as "GET /health/full", or just
+// "/health/full" for a GET request.
+func parseWarmup(specs []string) ([]warmupRequest, error) {
+	var requests []warmupRequest
+	for _, spec := range specs {
+		fields := strings.Fields(spec)
+		r := warmupRequest{method: http.MethodGet}
+		switch len(fields) {
+		case 1:
+			r.path = fields[0]
+		case 2:
+			r.method, r.path = fields[0], fields[1]
+		default:
+			return nil, fmt.Errorf("%q must be a method and path such as \"GET /health/full\"", spec)
+		}
+		if !strings.HasPrefix(r.path, "/") {
+			return nil, fmt.Errorf("the path of %q must start with /", spec)
+		}
+		requests = append(requests, r)
+	}
+	return requests, nil
+}
+
+// warmUp sends the -warmup requests to a worker which just became ready, one
+// at a time, each within -warmup-timeout. An error is returned if any of
+// them fails or gets a 5xx response, once all of them have been sent.
+func (s *Stabilizer) warmUp(w *worker) error {
+	start := time.Now()
+	var firstErr error
+	failed := 0
+	for _, r := range s.warmup {
+		if err := s.sendWarmup(w, r); err != nil {
+			if w.ctx.Err() != nil {
+				return fmt.Errorf("worker died during warmup: %v", err)
+			}
+			s.metrics.warmupFailuresCounter.Inc()
+			w.log.Debug("warmup request failed", log.String("request", r.String()), log.Error(err))
+			if firstErr == nil {
+				firstErr = fmt.Errorf("%v: %v", r, err)
+			}
+			failed++
+		}
+	}
+	if firstErr != nil {
+		return fmt.Errorf("%d of %d warmup requests failed, the first with %v", failed, len(s.warmup), firstErr)
+	}
+	w.log.Info("warmed up", log.Int("requests", len(s.warmup)), log.Duration("duration", time.Since(start)))
+	return nil
+}
+
+// sendWarmup sends a warmup request to a worker, and reads its response.
+func (s *Stabilizer) sendWarmup(w *worker, r warmupRequest) error {
+	ctx, cancel := context.WithTimeout(w.ctx, s.cfg.WarmupTimeout)
+	defer cancel()
+	req, err := http.NewRequestWithContext(ctx, r.method, "http://"+w.host()+r.path, nil)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("User-Agent", "http-server-stabilizer warmup")
+	resp, err := s.probeTransport.RoundTrip(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	// The worker may only be warmed up once it has sent the whole response.
+	if _, err := io.Copy(ioutil.Discard, resp.Body); err != nil {
+		return err
+	}
+	if resp.StatusCode >= 500 {
+		return fmt.Errorf("unexpected status %v", resp.StatusCode)
+	}
+	return nil
+}
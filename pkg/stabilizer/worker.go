@@ -0,0 +1,610 @@
+package stabilizer
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"regexp"
+	"strconv"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/sourcegraph/log"
+)
+
+type worker struct {
+	// log is a logger that carries the worker's pid and address as fields
+	log log.Logger
+
+	ctx    context.Context
+	cancel func()
+	pid    int
+	cmd    *exec.Cmd
+	done   chan struct{}
+
+	// group is how the worker and its subprocesses are signaled together,
+	// or nil if only the worker process can be.
+	group *processGroup
+
+	// port is the TCP port the worker listens on at listenHost
+	// (-worker-host), or socket the Unix socket it listens on in
+	// -worker-socket-dir mode.
+	port       int
+	listenHost string
+	socket     string
+	// extraPorts are the other ports allocated for the worker, e.g. for
+	// {{.Port2}} in its arguments.
+	extraPorts []int
+	// dir is the worker's own -worker-dir, which is removed once it is
+	// done, if its -worker-dir is a template.
+	dir string
+	// cgroup is the path of the worker's -worker-cgroup cgroup, if any,
+	// which is removed once it is done.
+	cgroup string
+	// upstream is the host of the -upstreams server the worker stands for,
+	// in which case there is no process and pid is 0.
+	upstream string
+
+	// stdout and stderr are the read ends of the worker's output pipes, and
+	// stderrLevel is -worker-stderr-level.
+	stdout      *os.File
+	stderr      *os.File
+	stderrLevel string
+
+	// portFound is closed once the worker has reported the port it listens
+	// on in -worker-port-from-output mode, and is nil otherwise. port must
+	// not be read before then. portMu serializes looking for it in stdout
+	// and stderr.
+	portFound   chan struct{}
+	portPattern *regexp.Regexp
+	portMu      sync.Mutex
+
+	// logFormat is -worker-log-format, logMaxLine -worker-log-max-line-bytes
+	// and logLimiter limits the rate at which output is logged.
+	logFormat  string
+	logMaxLine int64
+	logLimiter *lineLimiter
+
+	// tail holds the last -worker-log-tail lines of output.
+	tail *outputTail
+
+	killGrace time.Duration
+	metrics   *metrics
+
+	// dumpSignal is -stuck-dump-signal, or 0 if unset, and dumpGrace
+	// -stuck-dump-grace. dump captures the worker's output once it has been
+	// sent dumpSignal, and is guarded by dumpMu.
+	dumpSignal syscall.Signal
+	dumpGrace  time.Duration
+	dumpMu     sync.Mutex
+	dump       *stackDump
+
+	// exited is closed once the process has exited, at which point state
+	// holds its exit status and exitTime when it was found to have exited.
+	exited   chan struct{}
+	state    *os.ProcessState
+	exitTime time.Time
+	// oomKilled reports whether the OOM killer killed a process in the
+	// worker's cgroup, which is known once it is done.
+	oomKilled bool
+
+	// index is the ensureWorkers slot the worker runs in, which is stable
+	// across restarts.
+	index int
+	// restartReason and restartTime are the reason and time the previous
+	// worker in the same slot died or was recycled, if any.
+	restartReason string
+	restartTime   time.Time
+	// started is when the worker was started, or the upstream first handed
+	// out. version is the version of the worker command then, if known.
+	started time.Time
+	version string
+
+	// recycling is closed once the worker should be replaced for
+	// recycleReason, which is guarded by mu.
+	recycling     chan struct{}
+	recycleReason string
+
+	// mu guards the fields below.
+	mu         sync.Mutex
+	killed     bool
+	killReason string
+	ready      bool
+	readyTime  time.Time
+	requests   int
+
+	// stuckRequestID is the ID of the request that found the worker to be
+	// stuck, if that is why it was killed.
+	stuckRequestID string
+
+	// responses5xx is the number of 5xx responses from the worker, and
+	// consecutive5xx the number since its last non-5xx response.
+	responses5xx   int
+	consecutive5xx int
+
+	// inflight is the number of requests the worker is serving, and draining
+	// whether it should be killed for drainReason once that reaches zero.
+	// drainTimer kills it after -drain-timeout. slowStartTime is when it
+	// began -slow-start, if it did, and lastUsed when it last finished
+	// serving a request. These are guarded by pool.mu.
+	inflight      int
+	draining      bool
+	drainReason   string
+	drainTimer    *time.Timer
+	slowStartTime time.Time
+	lastUsed      time.Time
+}
+
+// Reasons for which workers are restarted.
+const (
+	reasonTimeout        = "timeout"
+	reasonCrash          = "crash"
+	reasonStartupFailure = "startup_failure"
+	reasonOOM            = "oom"
+	reasonAdmin          = "admin"
+
+	// reasonHeaderTimeout is used when a worker did not send response
+	// headers within -worker-response-header-timeout.
+	reasonHeaderTimeout = "header_timeout"
+
+	// reasonScaleDown is used when the worker count is reduced. Such workers
+	// are not replaced, so they do not count as restarts.
+	reasonScaleDown = "scale_down"
+
+	// reasonMaxRequests and reasonMaxAge are used when a worker is recycled
+	// after serving -worker-max-requests requests or running for
+	// -worker-max-age.
+	reasonMaxRequests = "max_requests"
+	reasonMaxAge      = "max_age"
+
+	// reasonMemory is used when a worker is drained because its memory
+	// usage exceeded -worker-max-rss.
+	reasonMemory = "memory"
+
+	// reasonUnhealthy is used when a worker returned -unhealthy-after-5xx
+	// consecutive 5xx responses.
+	reasonUnhealthy = "unhealthy"
+
+	// reasonHealthCheck is used when a worker failed -healthcheck-failures
+	// health checks in a row.
+	reasonHealthCheck = "healthcheck"
+
+	// reasonPortConflict is used when a worker could not listen on its port
+	// because another process already was.
+	reasonPortConflict = "port_conflict"
+
+	// reasonRollout is used when workers are recycled one at a time, e.g. to
+	// pick up a new version of the worker binary.
+	reasonRollout = "rollout"
+)
+
+// kill cancels the worker for the given reason, causing it to be killed. It
+// reports whether this call was the one that killed the worker; subsequent
+// calls do nothing.
+func (w *worker) kill(reason string) bool {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if w.killed {
+		return false
+	}
+	w.killed = true
+	w.killReason = reason
+	w.cancel()
+	return true
+}
+
+// isKilled reports whether the worker has been killed.
+func (w *worker) isKilled() bool {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	return w.killed
+}
+
+// killStuck kills the worker because the request with the given ID found it
+// to be stuck, for the given reason. With -stuck-dump-signal, it is first
+// asked to dump its stacks. Like kill, it reports whether this call was the
+// one that killed the worker.
+func (w *worker) killStuck(reason, requestID string) bool {
+	w.mu.Lock()
+	if !w.killed {
+		w.stuckRequestID = requestID
+	}
+	w.mu.Unlock()
+	return w.kill(reason)
+}
+
+// recycle asks for the worker to be replaced for the given reason. Unlike
+// kill, the worker keeps serving requests until its replacement is ready, and
+// is then drained. It reports whether this was the first request to recycle
+// the worker.
+func (w *worker) recycle(reason string) bool {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if w.killed || w.recycleReason != "" {
+		return false
+	}
+	w.recycleReason = reason
+	close(w.recycling)
+	return true
+}
+
+// exitReason returns the reason the worker died. It must only be called once
+// the worker is done.
+func (w *worker) exitReason() string {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if w.killed {
+		return w.killReason
+	}
+
+	// The worker exited on its own. Nothing but the kernel's OOM killer is
+	// expected to send it SIGKILL, but it may also have killed one of the
+	// worker's subprocesses.
+	if w.oomKilled {
+		return reasonOOM
+	}
+	if w.state != nil {
+		if status, ok := w.state.Sys().(syscall.WaitStatus); ok && status.Signaled() && status.Signal() == syscall.SIGKILL {
+			return reasonOOM
+		}
+	}
+	return reasonCrash
+}
+
+// exitStatus returns how the worker exited, as a shell reports it: its exit
+// code, or 128 plus the number of the signal which killed it, along with that
+// signal. It returns -1 if the worker could not be waited for. It must only be
+// called once the worker has exited.
+func (w *worker) exitStatus() (int, syscall.Signal) {
+	if w.state == nil {
+		return -1, 0
+	}
+	if status, ok := w.state.Sys().(syscall.WaitStatus); ok && status.Signaled() {
+		return 128 + int(status.Signal()), status.Signal()
+	}
+	return w.state.ExitCode(), 0
+}
+
+// describe returns how the worker is referred to in error responses, by its
+// pid or upstream.
+func (w *worker) describe() string {
+	if w.upstream != "" {
+		return "upstream: " + w.upstream
+	}
+	return fmt.Sprintf("pid: %v", w.pid)
+}
+
+// alive reports whether the worker process is still running.
+func (w *worker) alive() bool {
+	select {
+	case <-w.done:
+		return false
+	default:
+		return true
+	}
+}
+
+// outputDrainTimeout is how long to wait for the rest of a worker's output
+// once it has exited. Its output pipes may be held open by subprocesses that
+// left its process group.
+const outputDrainTimeout = 2 * time.Second
+
+// watch monitors the worker until it dies. The worker is only done once all
+// of its output has been logged, so that e.g. a panic it printed as it
+// crashed is not lost.
+func (w *worker) watch() {
+	// The loggers are derived here rather than by the readers, as With is
+	// not safe to call concurrently on the same logger.
+	stdoutLog := w.log.With(log.String("stream", "stdout"))
+	stderrLog := w.log.With(log.String("stream", "stderr"))
+	var readers sync.WaitGroup
+	readers.Add(2)
+	go func() {
+		defer readers.Done()
+		w.readOutput(stdoutLog, w.stdout, LevelInfo)
+	}()
+	go func() {
+		defer readers.Done()
+		w.readOutput(stderrLog, w.stderr, w.stderrLevel)
+	}()
+	drained := make(chan struct{})
+	go func() {
+		readers.Wait()
+		close(drained)
+	}()
+
+	go func() {
+		// This is the only place the worker is waited for.
+		_ = w.cmd.Wait()
+		w.state = w.cmd.ProcessState
+		w.exitTime = time.Now()
+		close(w.exited)
+	}()
+	select {
+	case <-w.ctx.Done():
+		w.terminate()
+	case <-w.exited:
+		w.cancel()
+	}
+	if w.group != nil {
+		w.group.close()
+	}
+	code, _ := w.exitStatus()
+	w.metrics.workerExitsCounter.WithLabelValues(strconv.Itoa(code)).Inc()
+	if w.cgroup != "" {
+		w.oomKilled = cgroupOOMKilled(w.cgroup)
+	}
+	select {
+	case <-drained:
+	case <-time.After(outputDrainTimeout):
+		w.log.Warn("output not closed after exit, giving up on the rest of it")
+	}
+	w.stdout.Close()
+	w.stderr.Close()
+	<-drained
+	w.reportSuppressed(w.logLimiter.flush())
+	w.logDump()
+	close(w.done)
+}
+
+// readOutput logs each line of one of the worker's output streams with logger
+// at the given level until it is closed.
+func (w *worker) readOutput(logger log.Logger, r io.Reader, level string) {
+	output := bufio.NewReader(r)
+	for {
+		line, err := w.readLine(output)
+		if line != "" {
+			w.tail.add(line)
+			w.addDump(line)
+			w.logLine(logger, level, line)
+			w.findPort(line)
+		}
+		if err != nil {
+			if err != io.EOF && !errors.Is(err, os.ErrClosed) {
+				fields := []log.Field{log.Error(err)}
+				// The exit status is only known once the process has
+				// been waited for.
+				select {
+				case <-w.exited:
+					fields = append(fields, log.String("process.state", w.state.String()))
+				default:
+				}
+				logger.Error("read error", fields...)
+			}
+			return
+		}
+	}
+}
+
+// terminate kills the worker process and its subprocesses, and waits for it to
+// exit. If -kill-grace is set, the process group is first sent SIGTERM and is
+// only killed if it is still running once the grace period has passed.
+func (w *worker) terminate() {
+	w.dumpStacks()
+	if w.killGrace == 0 {
+		// Kill the process.
+		if err := w.cmd.Process.Kill(); err != nil {
+			if err != nil {
+				w.log.Error("killing process", log.Error(err))
+			}
+		}
+
+		// Also kill subprocesses.
+		if w.group != nil {
+			w.group.signal(syscall.SIGTERM)
+		}
+
+		<-w.exited
+		w.log.Info("killed", log.String("mode", "forced"))
+		w.metrics.workerKillsCounter.WithLabelValues("forced").Inc()
+		return
+	}
+
+	signalGroup := func(sig syscall.Signal) {
+		if w.group != nil {
+			w.group.signal(sig)
+			return
+		}
+		w.cmd.Process.Signal(sig)
+	}
+
+	signalGroup(syscall.SIGTERM)
+	mode := "graceful"
+	select {
+	case <-w.exited:
+	case <-time.After(w.killGrace):
+		mode = "forced"
+		signalGroup(syscall.SIGKILL)
+		<-w.exited
+	}
+	w.log.Info("killed", log.String("mode", mode))
+	w.metrics.workerKillsCounter.WithLabelValues(mode).Inc()
+}
+
+// dumpStacks sends -stuck-dump-signal to a worker that was killed for being
+// stuck, and gives it -stuck-dump-grace to print its stacks or exit. The
+// output from then on is logged together by logDump once the worker is done.
+func (w *worker) dumpStacks() {
+	w.mu.Lock()
+	requestID := w.stuckRequestID
+	w.mu.Unlock()
+	if w.dumpSignal == 0 || requestID == "" {
+		return
+	}
+	w.dumpMu.Lock()
+	w.dump = &stackDump{requestID: requestID, signal: w.dumpSignal}
+	w.dumpMu.Unlock()
+	if err := w.cmd.Process.Signal(w.dumpSignal); err != nil {
+		w.log.Error("sending stack dump signal", log.Error(err))
+		return
+	}
+	select {
+	case <-w.exited:
+	case <-time.After(w.dumpGrace):
+	}
+}
+
+// spawnWorker spawns a new worker process, run with wc. stderr and stdout will
+// be logged, the done channel signals when the worker has died, and
+// w.cancel() can be used to kill the worker. If the process fails to start,
+// the error is returned along with a worker which is already done, so that
+// the failure is recorded like that of any other worker.
+func (s *Stabilizer) spawnWorker(ctx context.Context, logger log.Logger, index, port int, socket string, command string, wc workerCommand) (*worker, error) {
+	ctx, cancel := context.WithCancel(ctx)
+
+	// The worker is killed by watch once ctx is cancelled, so that it may be
+	// given a chance to exit gracefully first.
+	cmd := exec.Command(command, wc.args...)
+	cmd.SysProcAttr = processGroupAttr()
+	if s.credential != nil {
+		setCredential(cmd.SysProcAttr, s.credential)
+	}
+	cmd.Env = wc.env
+	cmd.Dir = wc.dir
+	if socket != "" {
+		logger = logger.With(log.String("socket", socket))
+	} else if port != 0 {
+		logger = logger.With(log.Int("port", port))
+	}
+	w := &worker{
+		log: logger,
+
+		ctx:    ctx,
+		index:  index,
+		port:   port,
+		socket: socket,
+		cancel: cancel,
+		cmd:    cmd,
+		done:   make(chan struct{}),
+		exited: make(chan struct{}),
+
+		listenHost: s.cfg.WorkerHost,
+		extraPorts: wc.extraPorts,
+
+		stderrLevel: s.cfg.WorkerStderrLevel,
+
+		started:   time.Now(),
+		version:   s.currentWorkerVersion(),
+		recycling: make(chan struct{}),
+
+		portPattern: s.portPattern,
+		logFormat:   s.cfg.WorkerLogFormat,
+		logMaxLine:  s.cfg.WorkerLogMaxLineBytes,
+		logLimiter:  newLineLimiter(s.cfg.WorkerLogRate),
+		tail:        newOutputTail(s.cfg.WorkerLogTail),
+		killGrace:   s.cfg.KillGrace,
+		dumpSignal:  s.dumpSignal,
+		dumpGrace:   s.cfg.StuckDumpGrace,
+		metrics:     s.metrics,
+	}
+	if w.portPattern != nil {
+		w.portFound = make(chan struct{})
+	}
+	if wc.ownDir {
+		w.dir = wc.dir
+	}
+
+	// Hold childMu until the worker is a known child, so that -reap does not
+	// wait for it should it exit right away.
+	s.childMu.Lock()
+	var err error
+	w.stdout, w.stderr, err = s.startCommand(cmd)
+	if err == nil {
+		s.children[cmd.Process.Pid] = true
+	}
+	s.childMu.Unlock()
+	if err != nil {
+		logger.Error("spawn error", log.Error(err))
+		cancel()
+		w.exitTime = time.Now()
+		close(w.exited)
+		close(w.done)
+		return w, err
+	}
+
+	// Track the process ID associated with this worker
+	w.pid = w.cmd.Process.Pid
+	w.log = w.log.With(log.Int("pid", w.pid))
+	w.group, err = newProcessGroup(w.pid)
+	if err != nil {
+		w.log.Warn("failed to track worker subprocesses, they will not be killed with it", log.Error(err))
+	}
+	if wc.env != nil {
+		w.log.Debug("environment", log.Strings("env", redactEnv(wc.env, s.envRedact)))
+	}
+	if s.cgroups != nil {
+		w.cgroup, err = s.cgroups.enter(w.pid)
+		if err != nil {
+			w.log.Warn("failed to move worker into its cgroup, it will run without resource limits", log.Error(err))
+		}
+	}
+	s.tuneWorker(w, s.targetWorkers())
+
+	go w.watch()
+	go func() {
+		<-w.exited
+		s.childMu.Lock()
+		delete(s.children, w.pid)
+		s.childMu.Unlock()
+	}()
+
+	w.log.Info("started")
+	return w, nil
+}
+
+// umaskMu serializes setting the process-wide umask to start workers with
+// -worker-umask.
+var umaskMu sync.Mutex
+
+// startCommand starts the command of a worker, reading from
+// -worker-stdin-file if set and otherwise the null device, and with
+// -worker-umask if set. It returns the read ends of the pipes the worker's
+// stdout and stderr go to, which must be closed once read.
+//
+// The worker writes to the pipes directly, rather than through pipes created
+// by cmd, so that cmd.Wait does not wait for them to be read: a subprocess of
+// the worker may hold them open after it exits.
+func (s *Stabilizer) startCommand(cmd *exec.Cmd) (stdout, stderr *os.File, err error) {
+	// The worker has its own copies of the files once started.
+	if s.cfg.WorkerStdinFile != "" {
+		stdin, err := os.Open(s.cfg.WorkerStdinFile)
+		if err != nil {
+			return nil, nil, err
+		}
+		defer stdin.Close()
+		cmd.Stdin = stdin
+	}
+	stdout, stdoutWriter, err := os.Pipe()
+	if err != nil {
+		return nil, nil, err
+	}
+	defer stdoutWriter.Close()
+	stderr, stderrWriter, err := os.Pipe()
+	if err != nil {
+		stdout.Close()
+		return nil, nil, err
+	}
+	defer stderrWriter.Close()
+	cmd.Stdout, cmd.Stderr = stdoutWriter, stderrWriter
+
+	if s.umask >= 0 && umaskSupported {
+		umaskMu.Lock()
+		previous := setUmask(s.umask)
+		err = cmd.Start()
+		setUmask(previous)
+		umaskMu.Unlock()
+	} else {
+		err = cmd.Start()
+	}
+	if err != nil {
+		stdout.Close()
+		stderr.Close()
+		return nil, nil, err
+	}
+	return stdout, stderr, nil
+}
@@ -0,0 +1,134 @@
+package stabilizer
+
+import (
+	"context"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/sourcegraph/log/logtest"
+)
+
+// TestSpawnFailure checks that a worker which could not be started is never
+// registered or handed out to requests.
+func TestSpawnFailure(t *testing.T) {
+	dir, err := ioutil.TempDir("", "hss-worker")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	command := filepath.Join(dir, "worker")
+	// It can be found, but is not a program.
+	if err := ioutil.WriteFile(command, []byte("not a program\n"), 0755); err != nil {
+		t.Fatal(err)
+	}
+
+	cfg := testConfig()
+	cfg.Command = command
+	logger, exportLogs := logtest.Captured(t)
+	s := New(WithConfig(cfg), WithLogger(logger), WithRegisterer(nil))
+	defer s.cancel()
+	port := freePort(t)
+	wc, err := s.workerCommand(0, port, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	last, _ := s.runWorker(0, port, "", wc, restart{}, nil)
+	spawnFailed := false
+	for _, entry := range exportLogs() {
+		spawnFailed = spawnFailed || entry.Message == "spawn error"
+	}
+	if !spawnFailed {
+		t.Fatal("worker did not fail to spawn")
+	}
+	if last.reason != reasonStartupFailure {
+		t.Errorf("got restart reason %q, want %q", last.reason, reasonStartupFailure)
+	}
+	s.workerByAddrMu.RLock()
+	registered := len(s.workerByAddr)
+	s.workerByAddrMu.RUnlock()
+	if registered != 0 {
+		t.Errorf("got %v registered workers, want 0", registered)
+	}
+	if n := s.pool.size(); n != 0 {
+		t.Errorf("got %v workers in the pool, want 0", n)
+	}
+}
+
+// TestWorkerExit checks that the exit status of a worker which exits while
+// its output is being read is known once it is done. Run with -race, it also
+// checks that the process state is only read once it has been waited for.
+func TestWorkerExit(t *testing.T) {
+	cfg := testConfig()
+	cfg.WorkerEnv = []string{testWorkerEnv + "=crash"}
+	s := New(WithConfig(cfg), WithLogger(logtest.NoOp(t)), WithRegisterer(nil))
+	defer s.cancel()
+	wc, err := s.workerCommand(0, 0, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	w, err := s.spawnWorker(context.Background(), s.workerLog, 0, 0, "", s.command, wc)
+	if err != nil {
+		t.Fatal(err)
+	}
+	<-w.done
+	if code, _ := w.exitStatus(); code != 3 {
+		t.Errorf("got exit status %v, want 3", code)
+	}
+	if reason := w.exitReason(); reason != reasonCrash {
+		t.Errorf("got exit reason %q, want %q", reason, reasonCrash)
+	}
+	if w.ctx.Err() == nil {
+		t.Error("worker context not cancelled once it exited")
+	}
+}
+
+// TestConfigWorkers checks that changing the number of workers with PUT
+// /config/workers changes the configuration, so that updating it back to the
+// previous number, e.g. by reloading -config, takes effect.
+func TestConfigWorkers(t *testing.T) {
+	s, _, stop := startStabilizer(t, testConfig())
+	defer stop()
+
+	put := func(body string) *httptest.ResponseRecorder {
+		rec := httptest.NewRecorder()
+		s.serveConfigWorkers(rec, httptest.NewRequest("PUT", "/config/workers", strings.NewReader(body)))
+		return rec
+	}
+	if rec := put(`{"count": 2}`); rec.Code != http.StatusOK {
+		t.Fatalf("got status %v, want %v: %s", rec.Code, http.StatusOK, rec.Body)
+	}
+	if n := s.Config().Workers; n != 2 {
+		t.Fatalf("configuration has %v workers, want 2", n)
+	}
+	waitFor(t, 10*time.Second, "the second worker", func() bool { return len(s.workerPIDs()) == 2 })
+
+	if err := s.Update(WithWorkers(1)); err != nil {
+		t.Fatal(err)
+	}
+	waitFor(t, 10*time.Second, "the second worker to be stopped", func() bool { return len(s.workerPIDs()) == 1 })
+
+	if rec := put(`{"count": -1}`); rec.Code != http.StatusBadRequest {
+		t.Errorf("got status %v for a negative count, want %v", rec.Code, http.StatusBadRequest)
+	}
+}
+
+// TestRestartInvalidPID checks that restarting a worker by a pid which is not
+// valid fails, rather than restarting a worker without a pid.
+func TestRestartInvalidPID(t *testing.T) {
+	s, _, stop := startStabilizer(t, testConfig())
+	defer stop()
+
+	for _, pid := range []string{"foo", "0", "-1", ""} {
+		rec := httptest.NewRecorder()
+		s.serveWorkerAction(rec, httptest.NewRequest("POST", "/workers/"+pid+"/restart", nil))
+		if rec.Code != http.StatusBadRequest {
+			t.Errorf("got status %v restarting worker %q, want %v", rec.Code, pid, http.StatusBadRequest)
+		}
+	}
+}
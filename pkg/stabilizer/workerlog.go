@@ -0,0 +1,323 @@
+package stabilizer
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/sourcegraph/log"
+)
+
+// Formats of worker output, see Config.WorkerLogFormat.
+const (
+	LogFormatText = "text"
+	LogFormatJSON = "json"
+)
+
+// Levels at which lines of worker output may be logged, see
+// Config.WorkerStderrLevel.
+const (
+	LevelDebug = "debug"
+	LevelInfo  = "info"
+	LevelWarn  = "warn"
+	LevelError = "error"
+)
+
+// suppressedReportInterval is how often the number of lines of output that
+// were not logged due to -worker-log-rate is logged while a worker is being
+// throttled.
+const suppressedReportInterval = 10 * time.Second
+
+// readLine reads a line of the worker's output, however long it is. Only the
+// first -worker-log-max-line-bytes of it are kept, if set, followed by a
+// marker saying how much was cut off.
+func (w *worker) readLine(r *bufio.Reader) (string, error) {
+	var (
+		line    []byte
+		dropped int
+	)
+	for {
+		chunk, err := r.ReadSlice('\n')
+		keep := chunk
+		if w.logMaxLine > 0 {
+			if room := int(w.logMaxLine) - len(line); room < len(keep) {
+				if room < 0 {
+					room = 0
+				}
+				dropped += len(keep) - room
+				keep = keep[:room]
+			}
+		}
+		line = append(line, keep...)
+		if err == bufio.ErrBufferFull {
+			continue
+		}
+		if dropped > 0 {
+			newline := ""
+			if strings.HasSuffix(string(chunk), "\n") {
+				// The newline was cut off too, but is not part of the line.
+				dropped--
+				newline = "\n"
+			}
+			w.metrics.workerLogTruncated.WithLabelValues(strconv.Itoa(w.index)).Inc()
+			line = append(line, fmt.Sprintf("… [%d bytes truncated]%s", dropped, newline)...)
+		}
+		return string(line), err
+	}
+}
+
+// logLine logs a line of the worker's output with the given logger, unless it
+// is being throttled by -worker-log-rate. In -worker-log-format json mode,
+// lines that are JSON objects are logged at their level with their fields;
+// other lines are logged as they are at the given level.
+func (w *worker) logLine(logger log.Logger, level, line string) {
+	allowed, suppressed := w.logLimiter.allow(time.Now())
+	w.reportSuppressed(suppressed)
+	if !allowed {
+		w.metrics.workerLogSuppressed.WithLabelValues(strconv.Itoa(w.index)).Inc()
+		return
+	}
+	if w.logFormat != LogFormatJSON || !logJSON(logger, line) {
+		logAt(logger, level, line)
+	}
+}
+
+// logAt logs a message at the given level, one of the Level constants.
+func logAt(logger log.Logger, level, message string, fields ...log.Field) {
+	switch level {
+	case LevelDebug:
+		logger.Debug(message, fields...)
+	case LevelWarn:
+		logger.Warn(message, fields...)
+	case LevelError:
+		logger.Error(message, fields...)
+	default:
+		logger.Info(message, fields...)
+	}
+}
+
+// logJSON logs a line of output that is a JSON object, reporting whether it
+// was one.
+func logJSON(logger log.Logger, line string) bool {
+	var entry map[string]interface{}
+	if err := json.Unmarshal([]byte(line), &entry); err != nil || entry == nil {
+		return false
+	}
+
+	var level, message string
+	keys := make([]string, 0, len(entry))
+	for key, value := range entry {
+		switch strings.ToLower(key) {
+		case "level", "severity":
+			if s, ok := value.(string); ok && level == "" {
+				level = s
+				continue
+			}
+		case "msg", "message":
+			if s, ok := value.(string); ok && message == "" {
+				message = s
+				continue
+			}
+		}
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	fields := make([]log.Field, 0, len(keys))
+	for _, key := range keys {
+		fields = append(fields, jsonField(key, entry[key]))
+	}
+
+	switch strings.ToLower(level) {
+	case "debug", "trace":
+		logger.Debug(message, fields...)
+	case "warn", "warning":
+		logger.Warn(message, fields...)
+	case "error", "err", "fatal", "critical", "panic", "dpanic", "alert", "emergency":
+		// The stabilizer must not exit or panic because a worker did.
+		logger.Error(message, fields...)
+	default:
+		logger.Info(message, fields...)
+	}
+	return true
+}
+
+// jsonField returns a log field for a value decoded from JSON. Objects and
+// arrays are kept as JSON.
+func jsonField(key string, value interface{}) log.Field {
+	switch v := value.(type) {
+	case string:
+		return log.String(key, v)
+	case float64:
+		return log.Float64(key, v)
+	case bool:
+		return log.Bool(key, v)
+	case nil:
+		return log.String(key, "null")
+	}
+	encoded, err := json.Marshal(value)
+	if err != nil {
+		return log.String(key, fmt.Sprint(value))
+	}
+	return log.String(key, string(encoded))
+}
+
+// reportSuppressed logs the number of lines of output that were not logged
+// due to -worker-log-rate since this was last reported, if any. This is done
+// every suppressedReportInterval by logLine, and once the worker's output
+// ends.
+func (w *worker) reportSuppressed(lines int) {
+	if lines > 0 {
+		w.log.Warn("suppressed worker output", log.Int("lines", lines), log.Float64("rate", w.logLimiter.rate))
+	}
+}
+
+// lineLimiter limits the rate at which lines of a worker's output are logged,
+// allowing bursts of up to a second's worth. A nil lineLimiter allows every
+// line. It is shared by the readers of the worker's stdout and stderr.
+type lineLimiter struct {
+	rate float64
+
+	mu     sync.Mutex
+	tokens float64
+	last   time.Time
+
+	// suppressed is the number of lines not allowed since reported, the time
+	// that was last logged.
+	suppressed int
+	reported   time.Time
+}
+
+// newLineLimiter returns a lineLimiter allowing rate lines per second, or nil
+// if rate is not positive.
+func newLineLimiter(rate float64) *lineLimiter {
+	if rate <= 0 {
+		return nil
+	}
+	return &lineLimiter{rate: rate, tokens: rate}
+}
+
+// allow reports whether a line may be logged at the given time. Every
+// suppressedReportInterval while lines are being suppressed, it also returns
+// the number suppressed since this was last done, which should be reported.
+func (l *lineLimiter) allow(now time.Time) (allowed bool, suppressed int) {
+	if l == nil {
+		return true, 0
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.suppressed > 0 && now.Sub(l.reported) >= suppressedReportInterval {
+		suppressed = l.suppressed
+		l.suppressed = 0
+		l.reported = now
+	}
+	burst := l.rate
+	if burst < 1 {
+		burst = 1
+	}
+	if !l.last.IsZero() {
+		l.tokens += now.Sub(l.last).Seconds() * l.rate
+		if l.tokens > burst {
+			l.tokens = burst
+		}
+	}
+	l.last = now
+	if l.tokens >= 1 {
+		l.tokens--
+		return true, suppressed
+	}
+	if l.suppressed == 0 && suppressed == 0 {
+		l.reported = now
+	}
+	l.suppressed++
+	return false, suppressed
+}
+
+// flush returns the number of lines suppressed since this was last reported,
+// and resets it.
+func (l *lineLimiter) flush() int {
+	if l == nil {
+		return 0
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	suppressed := l.suppressed
+	l.suppressed = 0
+	l.reported = time.Now()
+	return suppressed
+}
+
+// outputTailMaxBytes bounds the size of a worker's output tail, however many
+// lines -worker-log-tail keeps.
+const outputTailMaxBytes = 64 << 10
+
+// outputTail is a ring buffer of the most recent lines of a worker's output,
+// so that they can be reported when it fails. A nil outputTail keeps nothing.
+// It is safe for concurrent use.
+type outputTail struct {
+	maxBytes int
+
+	mu sync.Mutex
+	// lines holds count lines starting at start, which take up bytes bytes.
+	lines []string
+	start int
+	count int
+	bytes int
+}
+
+// newOutputTail returns an outputTail keeping up to maxLines lines, or nil if
+// maxLines is not positive.
+func newOutputTail(maxLines int) *outputTail {
+	if maxLines <= 0 {
+		return nil
+	}
+	return &outputTail{lines: make([]string, maxLines), maxBytes: outputTailMaxBytes}
+}
+
+// add adds a line to the tail, dropping the oldest lines to keep within its
+// bounds.
+func (t *outputTail) add(line string) {
+	if t == nil {
+		return
+	}
+	line = strings.TrimSuffix(line, "\n")
+	if len(line) > t.maxBytes {
+		line = line[:t.maxBytes]
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.count == len(t.lines) {
+		t.dropOldest()
+	}
+	t.lines[(t.start+t.count)%len(t.lines)] = line
+	t.count++
+	t.bytes += len(line)
+	for t.bytes > t.maxBytes {
+		t.dropOldest()
+	}
+}
+
+func (t *outputTail) dropOldest() {
+	t.bytes -= len(t.lines[t.start])
+	t.lines[t.start] = ""
+	t.start = (t.start + 1) % len(t.lines)
+	t.count--
+}
+
+// get returns the lines in the tail, oldest first.
+func (t *outputTail) get() []string {
+	if t == nil {
+		return nil
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	lines := make([]string, 0, t.count)
+	for i := 0; i < t.count; i++ {
+		lines = append(lines, t.lines[(t.start+i)%len(t.lines)])
+	}
+	return lines
+}
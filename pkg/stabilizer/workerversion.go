@@ -0,0 +1,96 @@
+package stabilizer
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"os/exec"
+	"strings"
+	"time"
+
+	"github.com/sourcegraph/log"
+)
+
+// workerVersionTimeout is how long the worker command is given to print its
+// version with -worker-version-arg.
+const workerVersionTimeout = 10 * time.Second
+
+// maxWorkerVersionLen is how much of the version printed by the worker
+// command is kept, so that a command which ignores -worker-version-arg and
+// prints something else does not make for a huge metric label.
+const maxWorkerVersionLen = 200
+
+// runWorkerVersion runs the worker command with -worker-version-arg, and
+// returns the first line it prints, on stdout or stderr.
+func (s *Stabilizer) runWorkerVersion() (string, error) {
+	ctx, cancel := context.WithTimeout(s.ctx, workerVersionTimeout)
+	defer cancel()
+	var out bytes.Buffer
+	cmd := exec.CommandContext(ctx, s.command, s.cfg.WorkerVersionArg)
+	cmd.Stdout = &out
+	cmd.Stderr = &out
+	// Like workers, the command is a known child until it is waited for, so
+	// that -reap does not wait for it instead.
+	s.childMu.Lock()
+	err := cmd.Start()
+	if err == nil {
+		s.children[cmd.Process.Pid] = true
+	}
+	s.childMu.Unlock()
+	if err != nil {
+		return "", err
+	}
+	err = cmd.Wait()
+	s.childMu.Lock()
+	delete(s.children, cmd.Process.Pid)
+	s.childMu.Unlock()
+	if ctx.Err() == context.DeadlineExceeded {
+		return "", fmt.Errorf("timed out after %v", workerVersionTimeout)
+	}
+	if err != nil {
+		return "", err
+	}
+	scanner := bufio.NewScanner(&out)
+	for scanner.Scan() {
+		if line := strings.TrimSpace(scanner.Text()); line != "" {
+			if len(line) > maxWorkerVersionLen {
+				line = line[:maxWorkerVersionLen]
+			}
+			return line, nil
+		}
+	}
+	return "", errors.New("no output")
+}
+
+// updateWorkerVersion finds out the version of the worker command with
+// -worker-version-arg, logs it and records it for /buildinfo, /workers and
+// the hss_worker_build_info metric. If that fails, the version is unknown
+// until it is next updated.
+func (s *Stabilizer) updateWorkerVersion() {
+	version, err := s.runWorkerVersion()
+	if err != nil {
+		s.log.Warn("failed to get worker version",
+			log.String("command", s.command),
+			log.String("arg", s.cfg.WorkerVersionArg),
+			log.Error(err))
+	} else {
+		s.log.Info("worker version", log.String("version", version))
+	}
+	s.workerVersionMu.Lock()
+	s.workerVersion = version
+	s.workerVersionMu.Unlock()
+	s.metrics.workerBuildInfo.Reset()
+	if version != "" {
+		s.metrics.workerBuildInfo.WithLabelValues(version).Set(1)
+	}
+}
+
+// currentWorkerVersion returns the version of the worker command, or an
+// empty string if it is not known.
+func (s *Stabilizer) currentWorkerVersion() string {
+	s.workerVersionMu.Lock()
+	defer s.workerVersionMu.Unlock()
+	return s.workerVersion
+}
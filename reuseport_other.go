@@ -0,0 +1,14 @@
+//go:build !(linux || darwin || dragonfly || freebsd || netbsd || openbsd)
+// +build !linux,!darwin,!dragonfly,!freebsd,!netbsd,!openbsd
+
+package main
+
+import (
+	"errors"
+	"syscall"
+)
+
+// reuseport fails, as SO_REUSEPORT is not supported on this platform.
+func reuseport(network, address string, c syscall.RawConn) error {
+	return errors.New("-reuseport is not supported on this platform")
+}
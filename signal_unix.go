@@ -0,0 +1,63 @@
+//go:build !windows
+// +build !windows
+
+package main
+
+import (
+	"fmt"
+	"os"
+	"strings"
+	"syscall"
+)
+
+// parseDrainSignal parses a -drain-on-signal value, such as SIGUSR1. An empty
+// value returns nil.
+func parseDrainSignal(name string) (os.Signal, error) {
+	switch strings.TrimPrefix(strings.ToUpper(strings.TrimSpace(name)), "SIG") {
+	case "":
+		return nil, nil
+	case "USR1":
+		return syscall.SIGUSR1, nil
+	case "USR2":
+		return syscall.SIGUSR2, nil
+	}
+	return nil, fmt.Errorf("unsupported signal %q, expected SIGUSR1 or SIGUSR2", name)
+}
+
+// parseRolloutSignal parses -rollout-signal, which may be "none".
+func parseRolloutSignal(name string) (os.Signal, error) {
+	switch strings.TrimPrefix(strings.ToUpper(strings.TrimSpace(name)), "SIG") {
+	case "", "NONE":
+		return nil, nil
+	case "HUP":
+		return syscall.SIGHUP, nil
+	case "USR1":
+		return syscall.SIGUSR1, nil
+	case "USR2":
+		return syscall.SIGUSR2, nil
+	}
+	return nil, fmt.Errorf("unsupported signal %q, expected SIGHUP, SIGUSR1, SIGUSR2 or none", name)
+}
+
+// forwardableSignals are the signals -forward-signals may relay to workers.
+// SIGTERM and SIGINT are left out, as they shut the stabilizer down.
+var forwardableSignals = map[string]syscall.Signal{
+	"HUP":   syscall.SIGHUP,
+	"USR1":  syscall.SIGUSR1,
+	"USR2":  syscall.SIGUSR2,
+	"WINCH": syscall.SIGWINCH,
+}
+
+// parseForwardSignals parses a comma-separated -forward-signals list, such as
+// USR1,USR2.
+func parseForwardSignals(v string) ([]syscall.Signal, error) {
+	var signals []syscall.Signal
+	for _, name := range parseList(v) {
+		sig, ok := forwardableSignals[strings.TrimPrefix(strings.ToUpper(name), "SIG")]
+		if !ok {
+			return nil, fmt.Errorf("unsupported signal %q, expected SIGHUP, SIGUSR1, SIGUSR2 or SIGWINCH", name)
+		}
+		signals = append(signals, sig)
+	}
+	return signals, nil
+}
@@ -0,0 +1,38 @@
+package main
+
+import (
+	"errors"
+	"os"
+	"strings"
+	"syscall"
+)
+
+// parseDrainSignal parses a -drain-on-signal value, which on Windows, where
+// there are no SIGUSR1 and SIGUSR2, may only be empty, returning nil.
+func parseDrainSignal(name string) (os.Signal, error) {
+	if strings.TrimSpace(name) != "" {
+		return nil, errors.New("draining on a signal is not supported on Windows, use POST /drain on the admin server instead")
+	}
+	return nil, nil
+}
+
+// parseRolloutSignal parses -rollout-signal, which on Windows may only be
+// "none" or SIGHUP, the default, which is never received.
+func parseRolloutSignal(name string) (os.Signal, error) {
+	switch strings.TrimPrefix(strings.ToUpper(strings.TrimSpace(name)), "SIG") {
+	case "", "NONE":
+		return nil, nil
+	case "HUP":
+		return syscall.SIGHUP, nil
+	}
+	return nil, errors.New("rolling out on a signal is not supported on Windows, use POST /workers/restart-all on the admin server instead")
+}
+
+// parseForwardSignals parses -forward-signals, which on Windows may only be
+// empty, as workers cannot be sent signals.
+func parseForwardSignals(v string) ([]syscall.Signal, error) {
+	if len(parseList(v)) > 0 {
+		return nil, errors.New("forwarding signals to workers is not supported on Windows")
+	}
+	return nil, nil
+}
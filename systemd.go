@@ -0,0 +1,95 @@
+package main
+
+import (
+	"net"
+	"os"
+	"strconv"
+	"time"
+
+	"github.com/slimsag/http-server-stabilizer/pkg/stabilizer"
+	"github.com/sourcegraph/log"
+)
+
+// listenFDsStart is the first file descriptor passed by systemd socket
+// activation.
+const listenFDsStart = 3
+
+// systemdListener returns the socket passed by systemd socket activation
+// (LISTEN_FDS and LISTEN_PID), which is used instead of binding -listen, or
+// nil if there is none. Only the first socket is used.
+func systemdListener() (net.Listener, error) {
+	defer os.Unsetenv("LISTEN_PID")
+	defer os.Unsetenv("LISTEN_FDS")
+	defer os.Unsetenv("LISTEN_FDNAMES")
+	if pid, err := strconv.Atoi(os.Getenv("LISTEN_PID")); err != nil || pid != os.Getpid() {
+		return nil, nil
+	}
+	n, err := strconv.Atoi(os.Getenv("LISTEN_FDS"))
+	if err != nil || n < 1 {
+		return nil, nil
+	}
+	var ln net.Listener
+	for fd := listenFDsStart; fd < listenFDsStart+n; fd++ {
+		f := os.NewFile(uintptr(fd), "LISTEN_FD_"+strconv.Itoa(fd))
+		// FileListener duplicates the descriptor, so close the original
+		// whether it is used or not so that workers do not inherit it.
+		if fd == listenFDsStart {
+			ln, err = net.FileListener(f)
+		}
+		f.Close()
+	}
+	return ln, err
+}
+
+// sdNotify sends a state change such as "READY=1" to systemd, if it asked
+// for notifications with NOTIFY_SOCKET.
+func sdNotify(state string) error {
+	addr := os.Getenv("NOTIFY_SOCKET")
+	if addr == "" {
+		return nil
+	}
+	if addr[0] == '@' {
+		// An abstract socket.
+		addr = "\x00" + addr[1:]
+	}
+	conn, err := net.DialUnix("unixgram", nil, &net.UnixAddr{Name: addr, Net: "unixgram"})
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	_, err = conn.Write([]byte(state))
+	return err
+}
+
+// notifyReady tells systemd that the stabilizer is ready once
+// -healthy-min-workers workers are.
+func notifyReady(s *stabilizer.Stabilizer, logger log.Logger) {
+	if os.Getenv("NOTIFY_SOCKET") == "" {
+		return
+	}
+	for !s.Ready() {
+		time.Sleep(100 * time.Millisecond)
+	}
+	if err := sdNotify("READY=1"); err != nil {
+		logger.Warn("failed to notify systemd of readiness", log.Error(err))
+	}
+}
+
+// watchdog pings the systemd watchdog at half the interval it asked for with
+// WATCHDOG_USEC, if any.
+func watchdog(logger log.Logger) {
+	if pid, err := strconv.Atoi(os.Getenv("WATCHDOG_PID")); err == nil && pid != os.Getpid() {
+		return
+	}
+	usec, err := strconv.ParseInt(os.Getenv("WATCHDOG_USEC"), 10, 64)
+	if err != nil || usec <= 0 {
+		return
+	}
+	ticker := time.NewTicker(time.Duration(usec) * time.Microsecond / 2)
+	defer ticker.Stop()
+	for range ticker.C {
+		if err := sdNotify("WATCHDOG=1"); err != nil {
+			logger.Warn("failed to ping systemd watchdog", log.Error(err))
+		}
+	}
+}
@@ -0,0 +1,153 @@
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"fmt"
+	"net"
+	"net/http"
+	"os"
+	"os/signal"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/sourcegraph/log"
+)
+
+// certPollInterval is how often certificate files are checked for changes.
+const certPollInterval = 10 * time.Second
+
+// certReloader serves a TLS certificate loaded from files, and reloads it
+// when the files change or on SIGHUP so that certificates can be rotated
+// without a restart.
+type certReloader struct {
+	log               log.Logger
+	certFile, keyFile string
+
+	mu      sync.RWMutex
+	cert    *tls.Certificate
+	modTime time.Time
+}
+
+// newCertReloader loads the certificate in the given files, and keeps it up
+// to date in the background.
+func newCertReloader(logger log.Logger, certFile, keyFile string) (*certReloader, error) {
+	if certFile == "" || keyFile == "" {
+		return nil, fmt.Errorf("both a certificate and a key must be given")
+	}
+	c := &certReloader{log: logger, certFile: certFile, keyFile: keyFile}
+	if err := c.reload(); err != nil {
+		return nil, err
+	}
+	go c.watch()
+	return c, nil
+}
+
+// reload loads the certificate from its files.
+func (c *certReloader) reload() error {
+	modTime, err := c.filesModTime()
+	if err != nil {
+		return err
+	}
+	cert, err := tls.LoadX509KeyPair(c.certFile, c.keyFile)
+	if err != nil {
+		return err
+	}
+	c.mu.Lock()
+	c.cert = &cert
+	c.modTime = modTime
+	c.mu.Unlock()
+	return nil
+}
+
+// filesModTime returns the latest modification time of the certificate and
+// key files.
+func (c *certReloader) filesModTime() (time.Time, error) {
+	var latest time.Time
+	for _, name := range []string{c.certFile, c.keyFile} {
+		info, err := os.Stat(name)
+		if err != nil {
+			return time.Time{}, err
+		}
+		if info.ModTime().After(latest) {
+			latest = info.ModTime()
+		}
+	}
+	return latest, nil
+}
+
+// watch reloads the certificate on SIGHUP, or when its files change. If the
+// new files are invalid the previous certificate is kept.
+func (c *certReloader) watch() {
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
+	ticker := time.NewTicker(certPollInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-hup:
+		case <-ticker.C:
+			modTime, err := c.filesModTime()
+			c.mu.RLock()
+			changed := err == nil && !modTime.Equal(c.modTime)
+			c.mu.RUnlock()
+			if !changed {
+				continue
+			}
+		}
+		if err := c.reload(); err != nil {
+			c.log.Error("failed to reload certificate, keeping the previous one", log.String("cert", c.certFile), log.Error(err))
+			continue
+		}
+		c.log.Info("reloaded certificate", log.String("cert", c.certFile))
+	}
+}
+
+func (c *certReloader) getCertificate(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	return c.cert, nil
+}
+
+// listenAndServe serves HTTP on the server's address, or HTTPS (including
+// HTTP/2) if certs is not nil.
+func listenAndServe(server *http.Server, certs *certReloader) error {
+	ln, err := listen(server.Addr)
+	if err != nil {
+		return err
+	}
+	return serve(server, ln, certs)
+}
+
+// listen listens on the given TCP address. With -reuseport, the address may
+// also be bound by other processes, and new connections are handed off to the
+// one which bound it last.
+func listen(addr string) (net.Listener, error) {
+	listenConfig := net.ListenConfig{}
+	if *flagReuseport {
+		listenConfig.Control = reuseport
+	}
+	if addr == "" {
+		addr = ":http"
+	}
+	ln, err := listenConfig.Listen(context.Background(), "tcp", addr)
+	if err != nil || !*flagReuseport {
+		return ln, err
+	}
+	if err := handOff(ln); err != nil {
+		ln.Close()
+		return nil, fmt.Errorf("failed to hand off connections to new listeners: %v", err)
+	}
+	return ln, nil
+}
+
+// serve serves HTTP on the listener, or HTTPS (including HTTP/2) if certs is
+// not nil.
+func serve(server *http.Server, ln net.Listener, certs *certReloader) error {
+	if certs == nil {
+		return server.Serve(ln)
+	}
+	server.TLSConfig = &tls.Config{GetCertificate: certs.getCertificate}
+	return server.ServeTLS(ln, "", "")
+}